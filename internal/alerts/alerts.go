@@ -0,0 +1,79 @@
+package alerts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Alerter tells a human that something needs attention. Implementations must
+// not block the caller for long and must not fail the caller's work.
+type Alerter interface {
+	Alert(ctx context.Context, message string)
+}
+
+// LogAlerter only writes alerts to the log, for when no channel is set up.
+type LogAlerter struct {
+	Logger *log.Logger
+}
+
+func NewLogAlerter(logger *log.Logger) *LogAlerter {
+	return &LogAlerter{Logger: logger}
+}
+
+func (la *LogAlerter) Alert(ctx context.Context, message string) {
+	la.Logger.Printf("ALERT: %s", message)
+}
+
+// HTTPAlerter posts alerts as {"text": message}, the format Slack and most
+// chat incoming webhooks accept. Every alert is also logged.
+type HTTPAlerter struct {
+	URL string
+	Logger *log.Logger
+	httpClient *http.Client
+}
+
+func NewHTTPAlerter(url string, timeout time.Duration, logger *log.Logger) *HTTPAlerter {
+	return &HTTPAlerter{
+		URL: url,
+		Logger: logger,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+func (ha *HTTPAlerter) Alert(ctx context.Context, message string) {
+	ha.Logger.Printf("ALERT: %s", message)
+
+	err := ha.post(context.WithoutCancel(ctx), message)
+	if err != nil {
+		ha.Logger.Printf("failed to send alert: %v", err)
+	}
+}
+
+func (ha *HTTPAlerter) post(ctx context.Context, message string) error {
+	body, err := json.Marshal(map[string]string{"text": message})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ha.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := ha.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook returned status %d", res.StatusCode)
+	}
+	return nil
+}
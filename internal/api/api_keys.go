@@ -0,0 +1,177 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+)
+
+const defaultRotationGracePeriod = 24 * time.Hour
+
+type APIKeyRequest struct {
+	Name string `json:"name"`
+	Scopes []string `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type RotateAPIKeyRequest struct {
+	// GracePeriod is how long the old key keeps working, e.g. "1h". It
+	// defaults to 24h; "0s" retires the old key at once.
+	GracePeriod string `json:"grace_period"`
+}
+
+// APIKeyHandler issues, rotates and revokes API keys.
+type APIKeyHandler struct {
+	Store stores.APIKeyStore
+	Logger *log.Logger
+}
+
+func NewAPIKeyHandler(store stores.APIKeyStore, logger *log.Logger) *APIKeyHandler {
+	return &APIKeyHandler{
+		Store: store,
+		Logger: logger,
+	}
+}
+
+func (kh *APIKeyHandler) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+
+	if req.Name == "" || len(req.Name) > 100 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "name is required and must be at most 100 characters"})
+		return
+	}
+	if len(req.Scopes) == 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "scopes are required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !stores.ValidScope(scope) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid scope " + strconv.Quote(scope), "scopes": stores.Scopes})
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "expires_at must be in the future"})
+		return
+	}
+
+	newKey, key, err := middleware.NewAPIKey(req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create API key"})
+		kh.Logger.Printf("failed to generate API key: %v", err)
+		return
+	}
+
+	apiKey, err := kh.Store.CreateAPIKey(newKey)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create API key"})
+		kh.Logger.Printf("failed to create API key: %v", err)
+		return
+	}
+
+	kh.Logger.Printf("API key %s (%s) created by API key %s", apiKey.ID, apiKey.Name, middleware.APIKeyID(r.Context()))
+	// the key is never shown again
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"api_key": apiKey, "key": key})
+}
+
+func (kh *APIKeyHandler) HandleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	apiKeys, err := kh.Store.ListAPIKeys()
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to list API keys"})
+		kh.Logger.Printf("failed to list API keys: %v", err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_keys": apiKeys})
+}
+
+// HandleRotateAPIKey issues a replacement with the same name, scopes and
+// expiry, and lets the old key keep working for the grace period.
+func (kh *APIKeyHandler) HandleRotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "API key not found")
+	if !ok {
+		return
+	}
+
+	var req RotateAPIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+	gracePeriod := defaultRotationGracePeriod
+	if req.GracePeriod != "" {
+		gracePeriod, err = time.ParseDuration(req.GracePeriod)
+		if err != nil || gracePeriod < 0 {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "grace_period must be a non-negative duration such as 1h"})
+			return
+		}
+	}
+
+	oldKey, err := kh.Store.GetAPIKeyByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to rotate API key"})
+		kh.Logger.Printf("failed to get API key %s: %v", id, err)
+		return
+	}
+
+	newKey, key, err := middleware.NewAPIKey(oldKey.Name, oldKey.Scopes, oldKey.ExpiresAt)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to rotate API key"})
+		kh.Logger.Printf("failed to generate API key: %v", err)
+		return
+	}
+
+	apiKey, err := kh.Store.RotateAPIKey(id, newKey, time.Now().Add(gracePeriod))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "API key is revoked or expired"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to rotate API key"})
+		kh.Logger.Printf("failed to rotate API key %s: %v", id, err)
+		return
+	}
+
+	kh.Logger.Printf("API key %s rotated to %s by API key %s", id, apiKey.ID, middleware.APIKeyID(r.Context()))
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"api_key": apiKey, "key": key})
+}
+
+func (kh *APIKeyHandler) HandleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "API key not found")
+	if !ok {
+		return
+	}
+
+	apiKey, err := kh.Store.RevokeAPIKey(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "API key not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to revoke API key"})
+		kh.Logger.Printf("failed to revoke API key %s: %v", id, err)
+		return
+	}
+
+	kh.Logger.Printf("API key %s revoked by API key %s", id, middleware.APIKeyID(r.Context()))
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_key": apiKey})
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+// apiKeyServer serves the key management routes to an admin key, and a
+// /probe route that needs transactions:read.
+type apiKeyServer struct {
+	router chi.Router
+	admin string
+}
+
+func newAPIKeyServer(t *testing.T) *apiKeyServer {
+	logger := log.New(io.Discard, "", 0)
+	store := &memAPIKeyStore{}
+	admin, secret, err := middleware.NewAPIKey("admin", []string{stores.ScopeKeysManage}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.CreateAPIKey(admin)
+
+	auth := middleware.NewAPIKeyAuth(store, logger)
+	kh := NewAPIKeyHandler(store, logger)
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(auth.Require(stores.ScopeKeysManage))
+		r.Post("/api-keys", kh.HandleCreateAPIKey)
+		r.Post("/api-keys/{id}/rotate", kh.HandleRotateAPIKey)
+		r.Delete("/api-keys/{id}", kh.HandleRevokeAPIKey)
+	})
+	r.With(auth.Require(stores.ScopeTransactionsRead)).Get("/probe", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	return &apiKeyServer{router: r, admin: secret}
+}
+
+func (ks *apiKeyServer) do(method string, path string, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	rec := httptest.NewRecorder()
+	ks.router.ServeHTTP(rec, req)
+	return rec
+}
+
+// issue decodes a created or rotated key.
+func issue(t *testing.T, rec *httptest.ResponseRecorder) (stores.APIKey, string) {
+	t.Helper()
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("status %d, want %d: %s", rec.Code, http.StatusCreated, rec.Body)
+	}
+	var res struct {
+		APIKey stores.APIKey `json:"api_key"`
+		Key string `json:"key"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.APIKey, res.Key
+}
+
+func (ks *apiKeyServer) probe(key string) int {
+	return ks.do(http.MethodGet, "/probe", key, "").Code
+}
+
+func TestCreateAPIKeyValidation(t *testing.T) {
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	tests := map[string]string{
+		"not json": `{"name": `,
+		"no name": `{"scopes": ["transactions:read"]}`,
+		"long name": `{"name": "` + strings.Repeat("a", 101) + `", "scopes": ["transactions:read"]}`,
+		"no scopes": `{"name": "partner-a", "scopes": []}`,
+		"unknown scope": `{"name": "partner-a", "scopes": ["transactions:read", "everything"]}`,
+		"expired": `{"name": "partner-a", "scopes": ["transactions:read"], "expires_at": "` + past + `"}`,
+	}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			ks := newAPIKeyServer(t)
+			if rec := ks.do(http.MethodPost, "/api-keys", ks.admin, body); rec.Code != http.StatusBadRequest {
+				t.Errorf("status %d, want %d: %s", rec.Code, http.StatusBadRequest, rec.Body)
+			}
+		})
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	ks := newAPIKeyServer(t)
+
+	original, originalSecret := issue(t, ks.do(http.MethodPost, "/api-keys", ks.admin, `{"name": "partner-a", "scopes": ["transactions:read"]}`))
+	if code := ks.probe(originalSecret); code != http.StatusOK {
+		t.Fatalf("new key: status %d", code)
+	}
+	if code := ks.do(http.MethodPost, "/api-keys", originalSecret, `{"name": "escalated", "scopes": ["keys:manage"]}`).Code; code != http.StatusForbidden {
+		t.Errorf("key without keys:manage created a key: status %d", code)
+	}
+
+	// the old key keeps working for the grace period
+	rotated, rotatedSecret := issue(t, ks.do(http.MethodPost, "/api-keys/"+original.ID+"/rotate", ks.admin, `{"grace_period": "1h"}`))
+	if rotated.RotatedFrom != original.ID || rotated.Name != "partner-a" || len(rotated.Scopes) != 1 || rotated.Scopes[0] != stores.ScopeTransactionsRead {
+		t.Errorf("rotated to %+v, want the same name and scopes", rotated)
+	}
+	if code := ks.probe(rotatedSecret); code != http.StatusOK {
+		t.Errorf("rotated key: status %d", code)
+	}
+	if code := ks.probe(originalSecret); code != http.StatusOK {
+		t.Errorf("old key within its grace period: status %d", code)
+	}
+
+	// with no grace period the old key stops at once
+	latest, latestSecret := issue(t, ks.do(http.MethodPost, "/api-keys/"+rotated.ID+"/rotate", ks.admin, `{"grace_period": "0s"}`))
+	if code := ks.probe(rotatedSecret); code != http.StatusUnauthorized {
+		t.Errorf("old key rotated without grace: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := ks.do(http.MethodPost, "/api-keys/"+rotated.ID+"/rotate", ks.admin, "").Code; code != http.StatusConflict {
+		t.Errorf("rotating a retired key: status %d, want %d", code, http.StatusConflict)
+	}
+
+	if rec := ks.do(http.MethodDelete, "/api-keys/"+latest.ID, ks.admin, ""); rec.Code != http.StatusOK {
+		t.Fatalf("revoke: status %d: %s", rec.Code, rec.Body)
+	}
+	if code := ks.probe(latestSecret); code != http.StatusUnauthorized {
+		t.Errorf("revoked key: status %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := ks.probe(originalSecret); code != http.StatusOK {
+		t.Errorf("revoking one key stopped another: status %d", code)
+	}
+}
+
+func TestAPIKeyManagementErrors(t *testing.T) {
+	ks := newAPIKeyServer(t)
+	const unknown = "00000000-0000-4000-8000-000000000099"
+
+	tests := []struct {
+		name string
+		method string
+		path string
+		body string
+		wantCode int
+	}{
+		{"rotate unknown key", http.MethodPost, "/api-keys/" + unknown + "/rotate", "", http.StatusNotFound},
+		{"rotate with a bad path", http.MethodPost, "/api-keys/not-a-uuid/rotate", "", http.StatusNotFound},
+		{"rotate with a negative grace period", http.MethodPost, "/api-keys/" + unknown + "/rotate", `{"grace_period": "-1h"}`, http.StatusBadRequest},
+		{"rotate with a malformed grace period", http.MethodPost, "/api-keys/" + unknown + "/rotate", `{"grace_period": "a day"}`, http.StatusBadRequest},
+		{"revoke unknown key", http.MethodDelete, "/api-keys/" + unknown, "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := ks.do(tt.method, tt.path, ks.admin, tt.body); rec.Code != tt.wantCode {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+		})
+	}
+}
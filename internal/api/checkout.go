@@ -0,0 +1,424 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/nhx-finance/wallet/internal/alerts"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/money"
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/prices"
+	"github.com/nhx-finance/wallet/internal/rates"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/validate"
+	"github.com/nhx-finance/wallet/internal/workers"
+	"github.com/shopspring/decimal"
+	"github.com/stripe/stripe-go/v83"
+	"github.com/stripe/stripe-go/v83/webhook"
+)
+
+// maxStripeEventSize matches the limit Stripe documents for event payloads.
+const maxStripeEventSize = 1 << 16
+
+type CheckoutRequest struct {
+	Email string `json:"email"`
+	Asset string `json:"asset"`
+	Quantity int64 `json:"quantity"`
+	ImageURL string `json:"image_url"`
+	HederaAccountID string `json:"hedera_account_id"`
+}
+
+type CheckoutHandler struct {
+	Stripe *payments.StripeHandler
+	HieroClient *hiero.Client
+	Mirror *mirror.Client
+	Assets *assets.Registry
+	TransactionStore stores.TransactionStore
+	WebhookStore stores.WebhookStore
+	// APIKeys tells which keys may read a session: the rotation family of
+	// the key that created it.
+	APIKeys stores.APIKeyStore
+	WebhookSecret string
+	Settler *workers.Settler
+	Alerter alerts.Alerter
+	Logger *log.Logger
+}
+
+func NewCheckoutHandler(stripeHandler *payments.StripeHandler, hieroClient *hiero.Client, mirrorClient *mirror.Client, assetRegistry *assets.Registry, transactionStore stores.TransactionStore, webhookStore stores.WebhookStore, apiKeyStore stores.APIKeyStore, webhookSecret string, settler *workers.Settler, alerter alerts.Alerter, logger *log.Logger) *CheckoutHandler {
+	return &CheckoutHandler{
+		Stripe: stripeHandler,
+		HieroClient: hieroClient,
+		Mirror: mirrorClient,
+		Assets: assetRegistry,
+		TransactionStore: transactionStore,
+		WebhookStore: webhookStore,
+		APIKeys: apiKeyStore,
+		WebhookSecret: webhookSecret,
+		Settler: settler,
+		Alerter: alerter,
+		Logger: logger,
+	}
+}
+
+func (ch *CheckoutHandler) HandleCreateCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	var req CheckoutRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+
+	errs := validate.Errors{}
+	req.HederaAccountID = accountIDField(errs, "hedera_account_id", req.HederaAccountID, ch.HieroClient)
+	if req.Quantity <= 0 {
+		errs.Add("quantity", "must be a positive whole number")
+	}
+	asset, err := ch.Assets.Get(req.Asset)
+	if req.Asset == "" {
+		errs.Add("asset", "is required")
+	} else if err != nil {
+		errs.Add("asset", "is not a listed asset")
+	}
+	if !errs.Empty() {
+		writeValidationErrors(w, errs)
+		return
+	}
+	if !checkRecipient(w, r, ch.Mirror, ch.Assets, req.HederaAccountID, asset.Symbol, ch.Logger) {
+		return
+	}
+
+	session, err := ch.Stripe.CreateCheckoutSession(r.Context(), req.Email, asset.Symbol, req.Quantity, req.ImageURL, req.HederaAccountID, middleware.APIKeyID(r.Context()))
+	if errors.Is(err, assets.ErrUnknownAsset) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown asset"})
+		return
+	}
+	if errors.Is(err, rates.ErrRateStale) {
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "exchange rate is temporarily unavailable"})
+		ch.Logger.Printf("refusing to create checkout session: %v", err)
+		return
+	}
+	if errors.Is(err, prices.ErrPriceStale) {
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "asset price is temporarily unavailable"})
+		ch.Logger.Printf("refusing to create checkout session: %v", err)
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create checkout session"})
+		ch.Logger.Printf("failed to create checkout session: %v", err)
+		return
+	}
+	middleware.MarkSideEffect(r.Context())
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"checkout_session": checkoutSessionView(session)})
+}
+
+func (ch *CheckoutHandler) HandleGetCheckoutSession(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := utils.ReadParamID(r, "id")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	session, err := ch.Stripe.RetrieveCheckoutSession(r.Context(), sessionID)
+	var stripeErr *stripe.Error
+	if errors.As(err, &stripeErr) && stripeErr.HTTPStatusCode == http.StatusNotFound {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "checkout session not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get checkout session"})
+		ch.Logger.Printf("failed to get checkout session %s: %v", sessionID, err)
+		return
+	}
+
+	// another client's session, and the transaction it paid for, are not
+	// found rather than forbidden
+	owned, err := ch.ownsSession(r, session)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get checkout session"})
+		ch.Logger.Printf("failed to check the API key of checkout session %s: %v", sessionID, err)
+		return
+	}
+	if !owned {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "checkout session not found"})
+		return
+	}
+
+	response := utils.Envelope{"checkout_session": checkoutSessionView(session)}
+
+	txn, err := ch.TransactionStore.GetTransactionByStripeSessionID(sessionID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+		ch.Logger.Printf("failed to get transaction for checkout session %s: %v", sessionID, err)
+		return
+	}
+	if txn != nil {
+		response["transaction"] = txn
+	}
+
+	utils.WriteJSON(w, http.StatusOK, response)
+}
+
+// ownsSession reports whether the request's API key belongs to the rotation
+// family of the key that created session.
+func (ch *CheckoutHandler) ownsSession(r *http.Request, session *stripe.CheckoutSession) (bool, error) {
+	owner := session.Metadata[payments.CheckoutMetadataAPIKeyID]
+	caller := middleware.APIKeyID(r.Context())
+	if owner == "" || caller == "" {
+		return false, nil
+	}
+	if owner == caller {
+		return true, nil
+	}
+	return ch.APIKeys.InAPIKeyFamily(caller, owner)
+}
+
+// HandleStripeWebhook receives Stripe events. Each is stored like an M-Pesa
+// callback, keyed by event ID so that Stripe's retries are not applied twice.
+func (ch *CheckoutHandler) HandleStripeWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStripeEventSize))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+
+	stored := stores.Webhook{
+		Source: "stripe",
+		RawBody: body,
+		ReceivedAt: time.Now(),
+	}
+	if json.Valid(body) {
+		stored.Payload = json.RawMessage(body)
+	}
+
+	event, err := webhook.ConstructEvent(body, r.Header.Get("Stripe-Signature"), ch.WebhookSecret)
+	if err != nil {
+		stored.EventType = "unverified"
+		stored.StatusCode = http.StatusBadRequest
+		stored.VerificationError = err.Error()
+		rejected, storeErr := ch.WebhookStore.CreateWebhook(stored)
+		if storeErr != nil {
+			ch.Logger.Printf("failed to store rejected stripe webhook: %v", storeErr)
+		}
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid signature"})
+
+		webhookID := "unsaved"
+		if rejected != nil {
+			webhookID = rejected.ID
+		}
+		ch.Alerter.Alert(r.Context(), fmt.Sprintf("Rejected Stripe webhook from %s (webhook %s): %v", r.RemoteAddr, webhookID, err))
+		return
+	}
+
+	stored.EventType = string(event.Type)
+	stored.EventKey = event.ID
+	created, err := ch.WebhookStore.CreateWebhook(stored)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to store webhook"})
+		ch.Logger.Printf("failed to store stripe event %s: %v", event.ID, err)
+		return
+	}
+
+	original, err := ch.WebhookStore.GetProcessedWebhookByEventKey(created.EventType, created.EventKey)
+	if err == nil {
+		created.TransactionID = original.TransactionID
+		created.DuplicateOf = original.ID
+		ch.respond(w, created, true, http.StatusOK, utils.Envelope{"message": "duplicate event ignored"})
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		ch.Logger.Printf("failed to check for duplicate stripe event %s: %v", event.ID, err)
+	}
+
+	switch event.Type {
+	case stripe.EventTypeCheckoutSessionCompleted, stripe.EventTypeCheckoutSessionExpired,
+		stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded, stripe.EventTypeCheckoutSessionAsyncPaymentFailed:
+		ch.handleCheckoutSessionEvent(w, created, event)
+	default:
+		ch.respond(w, created, true, http.StatusOK, utils.Envelope{"message": "event ignored"})
+	}
+}
+
+func (ch *CheckoutHandler) handleCheckoutSessionEvent(w http.ResponseWriter, stored *stores.Webhook, event stripe.Event) {
+	var session stripe.CheckoutSession
+	err := json.Unmarshal(event.Data.Raw, &session)
+	if err != nil {
+		ch.Logger.Printf("failed to decode checkout session in stripe event %s: %v", event.ID, err)
+		ch.respond(w, stored, false, http.StatusBadRequest, utils.Envelope{"error": "invalid checkout session"})
+		return
+	}
+
+	existing, err := ch.TransactionStore.GetTransactionByStripeSessionID(session.ID)
+	if err == nil {
+		ch.updateCardTransaction(w, stored, existing, &session, event.Type)
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		ch.Logger.Printf("failed to get transaction for checkout session %s: %v", session.ID, err)
+		ch.respond(w, stored, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+		return
+	}
+
+	tx, err := cardTransaction(&session, event.Type)
+	if err != nil {
+		ch.Logger.Printf("cannot record checkout session %s: %v", session.ID, err)
+		ch.respond(w, stored, false, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	created, err := ch.TransactionStore.CreateTransaction(tx)
+	if err != nil {
+		ch.Logger.Printf("failed to create transaction for checkout session %s: %v", session.ID, err)
+		ch.respond(w, stored, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to create transaction"})
+		return
+	}
+
+	stored.TransactionID = created.ID
+	ch.respond(w, stored, true, http.StatusOK, utils.Envelope{"transaction": created})
+
+	if created.Status == stores.StatusConfirmed {
+		ch.Settler.Trigger()
+	}
+}
+
+// updateCardTransaction applies an event for a checkout session that is
+// already recorded. Only an initiated transaction, one whose asynchronous
+// payment (e.g. a bank debit) was still pending, can move on.
+func (ch *CheckoutHandler) updateCardTransaction(w http.ResponseWriter, stored *stores.Webhook, existing *stores.Transaction, session *stripe.CheckoutSession, eventType stripe.EventType) {
+	stored.TransactionID = existing.ID
+
+	status := cardTransactionStatus(session, eventType)
+	if existing.Status != stores.StatusInitiated || status == stores.StatusInitiated || status == stores.StatusExpired {
+		ch.Logger.Printf("checkout session %s already recorded as transaction %s", session.ID, existing.ID)
+		ch.respond(w, stored, true, http.StatusOK, utils.Envelope{"transaction": existing})
+		return
+	}
+
+	updated, err := ch.TransactionStore.TransitionTransaction(existing.ID, stores.StatusInitiated, status, stores.StatusChange{Actor: stores.ActorStripeWebhook, Reason: string(eventType)})
+	if errors.Is(err, sql.ErrNoRows) {
+		// a concurrent event for the same session got there first
+		current, err := ch.TransactionStore.GetTransactionByID(existing.ID)
+		if err != nil {
+			ch.Logger.Printf("failed to get transaction %s: %v", existing.ID, err)
+			ch.respond(w, stored, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+			return
+		}
+		ch.respond(w, stored, true, http.StatusOK, utils.Envelope{"transaction": current})
+		return
+	}
+	if err != nil {
+		ch.Logger.Printf("failed to mark transaction %s %s: %v", existing.ID, status, err)
+		ch.respond(w, stored, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to update transaction"})
+		return
+	}
+
+	ch.Logger.Printf("transaction %s for checkout session %s is %s", updated.ID, session.ID, updated.Status)
+	ch.respond(w, stored, true, http.StatusOK, utils.Envelope{"transaction": updated})
+
+	if updated.Status == stores.StatusConfirmed {
+		ch.Settler.Trigger()
+	}
+}
+
+func (ch *CheckoutHandler) respond(w http.ResponseWriter, stored *stores.Webhook, processed bool, status int, data utils.Envelope) {
+	respondToWebhook(w, ch.WebhookStore, ch.Logger, stored, processed, status, data)
+}
+
+// cardTransaction builds the transaction for a finished checkout session from
+// the metadata we set when creating it. Card payments are taken in USD, which
+// is counted one to one as USDC.
+func cardTransaction(session *stripe.CheckoutSession, eventType stripe.EventType) (stores.Transaction, error) {
+	if session.Currency != stripe.CurrencyUSD {
+		return stores.Transaction{}, fmt.Errorf("unexpected currency %q", session.Currency)
+	}
+	accountID := session.Metadata[payments.CheckoutMetadataAccountID]
+	if accountID == "" {
+		return stores.Transaction{}, errors.New("checkout session has no account_id")
+	}
+	exchangeRate, err := decimal.NewFromString(session.Metadata[payments.CheckoutMetadataExchangeRate])
+	if err != nil || !exchangeRate.IsPositive() {
+		return stores.Transaction{}, errors.New("checkout session has no valid exchange_rate")
+	}
+	asset := session.Metadata[payments.CheckoutMetadataAsset]
+	if asset == "" {
+		return stores.Transaction{}, errors.New("checkout session has no asset")
+	}
+	quantity, err := decimal.NewFromString(session.Metadata[payments.CheckoutMetadataQuantity])
+	if err != nil || !quantity.IsPositive() {
+		return stores.Transaction{}, errors.New("checkout session has no valid quantity")
+	}
+
+	amountUSD := decimal.New(session.AmountTotal, -2)
+
+	var phone string
+	if session.CustomerDetails != nil {
+		phone = session.CustomerDetails.Phone
+	}
+
+	return stores.Transaction{
+		Phone: phone,
+		HederaAccountID: accountID,
+		Type: "card",
+		AmountKSH: money.USDCToKES(amountUSD, exchangeRate),
+		AmountUSDC: money.USDC(amountUSD),
+		Asset: asset,
+		AssetQuantity: quantity,
+		ExchangeRate: exchangeRate,
+		Status: cardTransactionStatus(session, eventType),
+		StripeSessionID: session.ID,
+		APIKeyID: session.Metadata[payments.CheckoutMetadataAPIKeyID],
+	}, nil
+}
+
+// cardTransactionStatus is the status a checkout session event puts a card
+// transaction in. A completed session whose asynchronous payment has not
+// cleared yet stays initiated until async_payment_succeeded or
+// async_payment_failed arrives.
+func cardTransactionStatus(session *stripe.CheckoutSession, eventType stripe.EventType) stores.TransactionStatus {
+	switch eventType {
+	case stripe.EventTypeCheckoutSessionCompleted:
+		if session.PaymentStatus == stripe.CheckoutSessionPaymentStatusPaid {
+			return stores.StatusConfirmed
+		}
+		return stores.StatusInitiated
+	case stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded:
+		return stores.StatusConfirmed
+	case stripe.EventTypeCheckoutSessionAsyncPaymentFailed:
+		return stores.StatusFailed
+	default:
+		return stores.StatusExpired
+	}
+}
+
+type checkoutSession struct {
+	ID string `json:"id"`
+	URL string `json:"url,omitempty"`
+	Status string `json:"status"`
+	PaymentStatus string `json:"payment_status"`
+	AmountTotal decimal.Decimal `json:"amount_total"`
+	Currency string `json:"currency"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func checkoutSessionView(session *stripe.CheckoutSession) checkoutSession {
+	return checkoutSession{
+		ID: session.ID,
+		URL: session.URL,
+		Status: string(session.Status),
+		PaymentStatus: string(session.PaymentStatus),
+		AmountTotal: decimal.New(session.AmountTotal, -2),
+		Currency: string(session.Currency),
+		ExpiresAt: time.Unix(session.ExpiresAt, 0).UTC(),
+	}
+}
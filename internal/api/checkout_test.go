@@ -0,0 +1,221 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nhx-finance/wallet/internal/alerts"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/workers"
+	"github.com/stripe/stripe-go/v83"
+	"github.com/stripe/stripe-go/v83/webhook"
+)
+
+const testStripeWebhookSecret = "whsec_test"
+
+func newTestCheckoutHandler(transactionStore stores.TransactionStore) *CheckoutHandler {
+	logger := log.New(io.Discard, "", 0)
+	settler := workers.NewSettler(transactionStore, nil, nil, assets.NewRegistry(), logger)
+	return NewCheckoutHandler(nil, nil, nil, assets.NewRegistry(), transactionStore, &memWebhookStore{}, &memAPIKeyStore{}, testStripeWebhookSecret, settler, alerts.NewLogAlerter(logger), logger)
+}
+
+// postStripeEvent sends a signed checkout session event to the handler.
+func postStripeEvent(t *testing.T, ch *CheckoutHandler, eventID string, eventType stripe.EventType, paymentStatus stripe.CheckoutSessionPaymentStatus) *httptest.ResponseRecorder {
+	t.Helper()
+	session := map[string]any{
+		"id": "cs_test_1",
+		"object": "checkout.session",
+		"currency": "usd",
+		"amount_total": 1000,
+		"payment_status": paymentStatus,
+		"metadata": map[string]string{
+			payments.CheckoutMetadataAccountID: "0.0.1234",
+			payments.CheckoutMetadataAsset: "USDC",
+			payments.CheckoutMetadataQuantity: "10",
+			payments.CheckoutMetadataExchangeRate: "129.5",
+		},
+	}
+	payload, err := json.Marshal(map[string]any{
+		"id": eventID,
+		"object": "event",
+		"api_version": stripe.APIVersion,
+		"type": eventType,
+		"data": map[string]any{"object": session},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{Payload: payload, Secret: testStripeWebhookSecret})
+
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/stripe", bytes.NewReader(signed.Payload))
+	req.Header.Set("Stripe-Signature", signed.Header)
+	rec := httptest.NewRecorder()
+	ch.HandleStripeWebhook(rec, req)
+	return rec
+}
+
+func TestStripeAsyncPayment(t *testing.T) {
+	tests := []struct {
+		name string
+		event stripe.EventType
+		want stores.TransactionStatus
+	}{
+		{"succeeded", stripe.EventTypeCheckoutSessionAsyncPaymentSucceeded, stores.StatusConfirmed},
+		{"failed", stripe.EventTypeCheckoutSessionAsyncPaymentFailed, stores.StatusFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memTransactionStore{}
+			ch := newTestCheckoutHandler(store)
+
+			rec := postStripeEvent(t, ch, "evt_completed", stripe.EventTypeCheckoutSessionCompleted, stripe.CheckoutSessionPaymentStatusUnpaid)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("completed: status %d: %s", rec.Code, rec.Body)
+			}
+			txn, err := store.GetTransactionByStripeSessionID("cs_test_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if txn.Status != stores.StatusInitiated {
+				t.Fatalf("after completed: status %s, want initiated", txn.Status)
+			}
+
+			rec = postStripeEvent(t, ch, "evt_async", tt.event, stripe.CheckoutSessionPaymentStatusPaid)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: status %d: %s", tt.event, rec.Code, rec.Body)
+			}
+			txn, err = store.GetTransactionByStripeSessionID("cs_test_1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if txn.Status != tt.want {
+				t.Errorf("after %s: status %s, want %s", tt.event, txn.Status, tt.want)
+			}
+			if len(store.txns) != 1 {
+				t.Errorf("%d transactions, want the existing one updated", len(store.txns))
+			}
+		})
+	}
+}
+
+// newFakeStripe serves the given checkout sessions by ID, answering 404 for
+// any other, and returns a handler that retrieves them from it.
+func newFakeStripe(t *testing.T, sessions map[string]map[string]any) *payments.StripeHandler {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session, ok := sessions[strings.TrimPrefix(r.URL.Path, "/v1/checkout/sessions/")]
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != http.MethodGet || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]any{"error": map[string]any{"type": "invalid_request_error", "message": "No such checkout.session"}})
+			return
+		}
+		json.NewEncoder(w).Encode(session)
+	}))
+	t.Cleanup(server.Close)
+
+	noRetries := int64(0)
+	backend := stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL: stripe.String(server.URL),
+		MaxNetworkRetries: &noRetries,
+		LeveledLogger: &stripe.LeveledLogger{Level: stripe.LevelNull},
+	})
+	client := stripe.NewClient("sk_test_fake", stripe.WithBackends(&stripe.Backends{API: backend, Connect: backend, Uploads: backend, MeterEvents: backend}))
+	return payments.NewStripeHandler(client, nil, nil)
+}
+
+func TestGetCheckoutSessionScopedToAPIKey(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+
+	// key-a2 replaced key-a by rotation; key-b is another client
+	keyStore := &memAPIKeyStore{}
+	secrets := map[string]string{}
+	for _, id := range []string{"key-a", "key-a2", "key-b"} {
+		apiKey, secret, err := middleware.NewAPIKey(id, []string{stores.ScopeCheckoutWrite}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiKey.ID = id
+		if id == "key-a2" {
+			apiKey.RotatedFrom = "key-a"
+		}
+		keyStore.keys = append(keyStore.keys, apiKey)
+		secrets[id] = secret
+	}
+
+	session := func(id string, apiKeyID string) map[string]any {
+		return map[string]any{
+			"id": id,
+			"object": "checkout.session",
+			"status": "complete",
+			"payment_status": "paid",
+			"amount_total": 1000,
+			"currency": "usd",
+			"metadata": map[string]string{payments.CheckoutMetadataAPIKeyID: apiKeyID},
+		}
+	}
+	sessions := map[string]map[string]any{
+		"cs_test_own": session("cs_test_own", "key-a"),
+		"cs_test_other": session("cs_test_other", "key-b"),
+		"cs_test_untracked": session("cs_test_untracked", ""),
+	}
+	transactions := &memTransactionStore{txns: []*stores.Transaction{
+		{ID: "txn-own", Type: "card", Status: stores.StatusSettled, StripeSessionID: "cs_test_own", APIKeyID: "key-a"},
+		{ID: "txn-other", Type: "card", Status: stores.StatusSettled, StripeSessionID: "cs_test_other", APIKeyID: "key-b"},
+	}}
+	ch := NewCheckoutHandler(newFakeStripe(t, sessions), nil, nil, assets.NewRegistry(), transactions, &memWebhookStore{}, keyStore, testStripeWebhookSecret, nil, alerts.NewLogAlerter(logger), logger)
+
+	r := chi.NewRouter()
+	r.Use(middleware.NewAPIKeyAuth(keyStore, logger).Require(stores.ScopeCheckoutWrite))
+	r.Get("/checkout/sessions/{id}", ch.HandleGetCheckoutSession)
+
+	tests := []struct {
+		key string
+		sessionID string
+		wantCode int
+		wantTransaction string
+	}{
+		{"key-a", "cs_test_own", http.StatusOK, "txn-own"},
+		{"key-a2", "cs_test_own", http.StatusOK, "txn-own"},
+		{"key-a2", "cs_test_other", http.StatusNotFound, ""},
+		{"key-b", "cs_test_own", http.StatusNotFound, ""},
+		{"key-a", "cs_test_untracked", http.StatusNotFound, ""},
+		{"key-a", "cs_test_missing", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key+" "+tt.sessionID, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/checkout/sessions/"+tt.sessionID, nil)
+			req.Header.Set("Authorization", "Bearer "+secrets[tt.key])
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+
+			var resp struct {
+				Transaction *stores.Transaction `json:"transaction"`
+			}
+			err := json.Unmarshal(rec.Body.Bytes(), &resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if resp.Transaction != nil {
+				got = resp.Transaction.ID
+			}
+			if got != tt.wantTransaction {
+				t.Errorf("transaction %q, want %q", got, tt.wantTransaction)
+			}
+		})
+	}
+}
@@ -0,0 +1,431 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/prices"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/shopspring/decimal"
+)
+
+// memTransactionStore keeps transactions in memory with the status rules of
+// the Postgres store. Methods a test does not need panic.
+type memTransactionStore struct {
+	stores.TransactionStore
+	mu sync.Mutex
+	txns []*stores.Transaction
+	events []stores.TransactionEvent
+}
+
+func (m *memTransactionStore) CreateTransaction(tx stores.Transaction) (*stores.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx.ID = "txn-" + strconv.Itoa(len(m.txns)+1)
+	m.txns = append(m.txns, &tx)
+	created := tx
+	return &created, nil
+}
+
+func (m *memTransactionStore) find(match func(*stores.Transaction) bool) (*stores.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, txn := range m.txns {
+		if match(txn) {
+			found := *txn
+			return &found, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memTransactionStore) GetTransactionByID(id string) (*stores.Transaction, error) {
+	return m.find(func(txn *stores.Transaction) bool { return txn.ID == id })
+}
+
+func (m *memTransactionStore) GetTransactionByStripeSessionID(sessionID string) (*stores.Transaction, error) {
+	return m.find(func(txn *stores.Transaction) bool { return txn.StripeSessionID == sessionID })
+}
+
+func (m *memTransactionStore) TransitionTransaction(id string, from stores.TransactionStatus, to stores.TransactionStatus, change stores.StatusChange) (*stores.Transaction, error) {
+	if !from.CanTransitionTo(to) {
+		return nil, stores.ErrInvalidTransition
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, txn := range m.txns {
+		if txn.ID == id && txn.Status == from {
+			txn.Status = to
+			updated := *txn
+			return &updated, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memTransactionStore) GetTransactionByMpesaCheckoutID(mpesaCheckoutID string) (*stores.Transaction, error) {
+	return m.find(func(txn *stores.Transaction) bool { return txn.MpesaCheckoutID == mpesaCheckoutID })
+}
+
+func (m *memTransactionStore) UpdateTransactionByMpesaCheckoutID(mpesaCheckoutID string, status stores.TransactionStatus, mpesaReceiptNumber string, change stores.StatusChange) (*stores.Transaction, error) {
+	if !stores.StatusInitiated.CanTransitionTo(status) {
+		return nil, stores.ErrInvalidTransition
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, txn := range m.txns {
+		if txn.MpesaCheckoutID == mpesaCheckoutID && txn.Status == stores.StatusInitiated {
+			txn.Status = status
+			txn.MpesaReceiptNumber = mpesaReceiptNumber
+			updated := *txn
+			return &updated, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// memWebhookStore records webhooks in memory and finds processed ones by
+// event key like the Postgres store.
+type memWebhookStore struct {
+	mu sync.Mutex
+	webhooks []stores.Webhook
+}
+
+func (m *memWebhookStore) CreateWebhook(webhook stores.Webhook) (*stores.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhook.ID = "webhook-" + strconv.Itoa(len(m.webhooks)+1)
+	m.webhooks = append(m.webhooks, webhook)
+	return &webhook, nil
+}
+
+func (m *memWebhookStore) CompleteWebhook(webhook stores.Webhook) (*stores.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := range m.webhooks {
+		if m.webhooks[i].ID == webhook.ID {
+			m.webhooks[i] = webhook
+		}
+	}
+	return &webhook, nil
+}
+
+func (m *memWebhookStore) GetProcessedWebhookByEventKey(eventType string, eventKey string) (*stores.Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, webhook := range m.webhooks {
+		if webhook.EventType == eventType && webhook.EventKey == eventKey && webhook.Processed && webhook.DuplicateOf == "" {
+			return &webhook, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// memQuoteStore keeps created quotes in memory. Methods a test does not need
+// panic.
+type memQuoteStore struct {
+	stores.QuoteStore
+	quotes []stores.Quote
+}
+
+func (m *memQuoteStore) CreateQuote(quote stores.Quote) (*stores.Quote, error) {
+	quote.ID = "quote-" + strconv.Itoa(len(m.quotes)+1)
+	m.quotes = append(m.quotes, quote)
+	return &quote, nil
+}
+
+func (m *memQuoteStore) ReserveQuote(id string) (*stores.Quote, error) {
+	for i := range m.quotes {
+		quote := &m.quotes[i]
+		if quote.ID == id && quote.UsedAt == nil && quote.ExpiresAt.After(time.Now()) {
+			now := time.Now()
+			quote.UsedAt = &now
+			reserved := *quote
+			return &reserved, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memQuoteStore) GetQuoteByID(id string) (*stores.Quote, error) {
+	for _, quote := range m.quotes {
+		if quote.ID == id {
+			return &quote, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memQuoteStore) ReleaseQuote(id string) error {
+	for i := range m.quotes {
+		if m.quotes[i].ID == id {
+			m.quotes[i].UsedAt = nil
+		}
+	}
+	return nil
+}
+
+// fixedPrices prices assets in shillings. Symbols it has no price for are
+// stale.
+type fixedPrices map[string]decimal.Decimal
+
+func (fp fixedPrices) AssetPrice(ctx context.Context, symbol string) (prices.AssetPrice, error) {
+	price, ok := fp[symbol]
+	if !ok {
+		return prices.AssetPrice{}, prices.ErrPriceStale
+	}
+	return prices.AssetPrice{Symbol: symbol, PriceKSH: price, Source: "test", AsOf: time.Now()}, nil
+}
+
+// fakeDaraja answers Daraja's OAuth, STK push and STK query endpoints,
+// accepting every push, and points the STK environment at itself for the
+// test.
+type fakeDaraja struct {
+	*httptest.Server
+	mu sync.Mutex
+	pushes []map[string]any
+	// query is the answer to every STK query.
+	query payments.STKQueryResponse
+	// pushCode, if set, is the ResponseCode every STK push gets instead of 0.
+	pushCode string
+}
+
+func newFakeDaraja(t *testing.T) *fakeDaraja {
+	fd := &fakeDaraja{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /oauth", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(payments.AuthorizationResponse{AccessToken: "token", ExpiresIn: "3599"})
+	})
+	mux.HandleFunc("POST /stkpush", func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		json.NewDecoder(r.Body).Decode(&payload)
+		fd.mu.Lock()
+		fd.pushes = append(fd.pushes, payload)
+		checkoutID := "ws_CO_" + strconv.Itoa(len(fd.pushes))
+		code := fd.pushCode
+		fd.mu.Unlock()
+		if code == "" {
+			code = "0"
+		}
+		json.NewEncoder(w).Encode(payments.STKPushResponse{CheckoutRequestID: checkoutID, ResponseCode: code})
+	})
+	mux.HandleFunc("POST /stkquery", func(w http.ResponseWriter, r *http.Request) {
+		fd.mu.Lock()
+		query := fd.query
+		fd.mu.Unlock()
+		json.NewEncoder(w).Encode(query)
+	})
+	fd.Server = httptest.NewServer(mux)
+	t.Cleanup(fd.Close)
+
+	t.Setenv("STK_PUSH_URL", fd.URL+"/stkpush")
+	t.Setenv("STK_QUERY_URL", fd.URL+"/stkquery")
+	t.Setenv("BUSINESS_SHORT_CODE", "174379")
+	t.Setenv("PASS_KEY", "passkey")
+	t.Setenv("CALLBACK_URL", "https://example.com/webhooks/mpesa")
+	return fd
+}
+
+func (fd *fakeDaraja) Client() *payments.DarajaClient {
+	return payments.NewDarajaClient(fd.URL+"/oauth", "key", "secret", 5*time.Second)
+}
+
+func (m *memTransactionStore) UpdateTransactionPayout(conversationID string, originatorConversationID string, status stores.TransactionStatus, mpesaReceiptNumber string, change stores.StatusChange) (*stores.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, txn := range m.txns {
+		matched := txn.MpesaConversationID == conversationID || (originatorConversationID != "" && txn.ID == originatorConversationID)
+		if txn.Type == "offramp" && txn.Status == stores.StatusSettling && matched {
+			txn.Status = status
+			txn.MpesaReceiptNumber = mpesaReceiptNumber
+			if txn.MpesaConversationID == "" {
+				txn.MpesaConversationID = conversationID
+			}
+			updated := *txn
+			return &updated, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// GetTransactionByIDForAPIKey treats each key as its own rotation family.
+func (m *memTransactionStore) GetTransactionByIDForAPIKey(id string, apiKeyID string) (*stores.Transaction, error) {
+	return m.find(func(txn *stores.Transaction) bool { return txn.ID == id && txn.APIKeyID == apiKeyID })
+}
+
+// GetTransactionEvents returns the events a test recorded in events.
+func (m *memTransactionStore) GetTransactionEvents(transactionID string) ([]stores.TransactionEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	events := []stores.TransactionEvent{}
+	for _, event := range m.events {
+		if event.TransactionID == transactionID {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func (m *memTransactionStore) recordEvent(event stores.TransactionEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, event)
+}
+
+// ListTransactions filters on the API key and phone only.
+func (m *memTransactionStore) ListTransactions(filter stores.TransactionFilter) ([]stores.Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	txns := []stores.Transaction{}
+	for _, txn := range m.txns {
+		if txn.APIKeyID == filter.APIKeyID && txn.Phone == filter.Phone {
+			txns = append(txns, *txn)
+		}
+	}
+	return txns, nil
+}
+
+// memAPIKeyStore holds API keys in memory. Methods a test does not need
+// panic.
+type memAPIKeyStore struct {
+	stores.APIKeyStore
+	keys []stores.APIKey
+}
+
+func (m *memAPIKeyStore) GetAPIKeyByPrefix(prefix string) (*stores.APIKey, error) {
+	for _, key := range m.keys {
+		if key.Prefix == prefix {
+			return &key, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memAPIKeyStore) TouchAPIKey(id string) error {
+	return nil
+}
+
+// CreateAPIKey gives keys UUIDs, since handlers take them from the path.
+func (m *memAPIKeyStore) CreateAPIKey(key stores.APIKey) (*stores.APIKey, error) {
+	key.ID = fmt.Sprintf("00000000-0000-4000-8000-%012d", len(m.keys)+1)
+	key.CreatedAt = time.Now()
+	m.keys = append(m.keys, key)
+	return &key, nil
+}
+
+func (m *memAPIKeyStore) GetAPIKeyByID(id string) (*stores.APIKey, error) {
+	for _, key := range m.keys {
+		if key.ID == id {
+			return &key, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// RotateAPIKey shortens the old key's expiry like the Postgres store.
+func (m *memAPIKeyStore) RotateAPIKey(oldID string, newKey stores.APIKey, oldExpiresAt time.Time) (*stores.APIKey, error) {
+	for i := range m.keys {
+		old := &m.keys[i]
+		if old.ID != oldID || !old.Active(time.Now()) {
+			continue
+		}
+		if old.ExpiresAt == nil || oldExpiresAt.Before(*old.ExpiresAt) {
+			old.ExpiresAt = &oldExpiresAt
+		}
+		newKey.RotatedFrom = oldID
+		return m.CreateAPIKey(newKey)
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memAPIKeyStore) RevokeAPIKey(id string) (*stores.APIKey, error) {
+	for i := range m.keys {
+		if m.keys[i].ID == id {
+			if m.keys[i].RevokedAt == nil {
+				now := time.Now()
+				m.keys[i].RevokedAt = &now
+			}
+			revoked := m.keys[i]
+			return &revoked, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// InAPIKeyFamily follows rotated_from links both ways, like apiKeyFamily.
+func (m *memAPIKeyStore) InAPIKeyFamily(keyID string, otherID string) (bool, error) {
+	family := map[string]bool{keyID: true}
+	for grown := true; grown; {
+		grown = false
+		for _, key := range m.keys {
+			if family[key.ID] != family[key.RotatedFrom] && key.RotatedFrom != "" {
+				family[key.ID] = true
+				family[key.RotatedFrom] = true
+				grown = true
+			}
+		}
+	}
+	return family[otherID], nil
+}
+
+// memMerchantWebhookStore keeps subscriptions in memory. Methods a test does
+// not need panic.
+type memMerchantWebhookStore struct {
+	stores.MerchantWebhookStore
+	subscriptions []stores.WebhookSubscription
+}
+
+func (m *memMerchantWebhookStore) CreateWebhookSubscription(subscription stores.WebhookSubscription) (*stores.WebhookSubscription, error) {
+	subscription.ID = "subscription-" + strconv.Itoa(len(m.subscriptions)+1)
+	m.subscriptions = append(m.subscriptions, subscription)
+	return &subscription, nil
+}
+
+// memRefundStore keeps one refund per deposit, like the Postgres store.
+type memRefundStore struct {
+	refunds []stores.Refund
+}
+
+func (m *memRefundStore) CreateRefund(refund stores.Refund) (*stores.Refund, bool, error) {
+	for _, existing := range m.refunds {
+		if existing.DepositTxID == refund.DepositTxID {
+			return &existing, false, nil
+		}
+	}
+	refund.ID = "refund-" + strconv.Itoa(len(m.refunds)+1)
+	refund.Status = "pending"
+	m.refunds = append(m.refunds, refund)
+	return &refund, true, nil
+}
+
+type alertRecorder struct {
+	alerts []string
+}
+
+func (ar *alertRecorder) Alert(ctx context.Context, message string) {
+	ar.alerts = append(ar.alerts, message)
+}
+
+// fakeBroker hands every subscriber the same wakeups channel, which the test
+// sends on or closes.
+type fakeBroker struct {
+	wakeups chan struct{}
+	unsubscribed chan struct{}
+}
+
+func newFakeBroker() *fakeBroker {
+	return &fakeBroker{wakeups: make(chan struct{}), unsubscribed: make(chan struct{})}
+}
+
+func (fb *fakeBroker) Subscribe(transactionID string) (<-chan struct{}, func()) {
+	return fb.wakeups, func() { close(fb.unsubscribed) }
+}
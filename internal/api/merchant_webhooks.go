@@ -0,0 +1,273 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/validate"
+)
+
+type WebhookSubscriptionRequest struct {
+	URL string `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// MerchantWebhookHandler manages partners' webhook subscriptions and lets
+// them inspect and replay deliveries. A partner only sees the subscriptions
+// of its own API key; anyone else's are not found.
+type MerchantWebhookHandler struct {
+	Store stores.MerchantWebhookStore
+	// Resolver looks up subscription hosts, which must all be public.
+	Resolver HostResolver
+	Logger *log.Logger
+}
+
+// HostResolver is satisfied by *net.Resolver.
+type HostResolver interface {
+	LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error)
+}
+
+func NewMerchantWebhookHandler(store stores.MerchantWebhookStore, logger *log.Logger) *MerchantWebhookHandler {
+	return &MerchantWebhookHandler{
+		Store: store,
+		Resolver: net.DefaultResolver,
+		Logger: logger,
+	}
+}
+
+func (mh *MerchantWebhookHandler) HandleCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	var req WebhookSubscriptionRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+
+	endpoint, err := url.Parse(req.URL)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Hostname() == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "url must be an absolute https URL"})
+		return
+	}
+	problem := mh.checkHost(r.Context(), endpoint.Hostname())
+	if problem != "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": problem})
+		return
+	}
+	if len(req.EventTypes) == 0 {
+		req.EventTypes = []string{"*"}
+	}
+	for _, eventType := range req.EventTypes {
+		if !validEventType(eventType) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid event type " + strconv.Quote(eventType)})
+			return
+		}
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create secret"})
+		mh.Logger.Printf("failed to create webhook secret: %v", err)
+		return
+	}
+
+	subscription, err := mh.Store.CreateWebhookSubscription(stores.WebhookSubscription{
+		URL: req.URL,
+		APIKeyID: middleware.APIKeyID(r.Context()),
+		Secret: secret,
+		EventTypes: req.EventTypes,
+	})
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create subscription"})
+		mh.Logger.Printf("failed to create webhook subscription: %v", err)
+		return
+	}
+
+	// the secret is never shown again
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"subscription": subscription, "secret": secret})
+}
+
+func (mh *MerchantWebhookHandler) HandleListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	subscriptions, err := mh.Store.ListWebhookSubscriptions(middleware.APIKeyID(r.Context()))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to list subscriptions"})
+		mh.Logger.Printf("failed to list webhook subscriptions: %v", err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"subscriptions": subscriptions})
+}
+
+func (mh *MerchantWebhookHandler) HandleDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "subscription not found")
+	if !ok {
+		return
+	}
+
+	subscription, err := mh.Store.DeactivateWebhookSubscription(id, middleware.APIKeyID(r.Context()))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "subscription not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to deactivate subscription"})
+		mh.Logger.Printf("failed to deactivate webhook subscription %s: %v", id, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"subscription": subscription})
+}
+
+func (mh *MerchantWebhookHandler) HandleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "subscription not found")
+	if !ok {
+		return
+	}
+
+	limit := 50
+	if r.URL.Query().Get("limit") != "" {
+		var err error
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit < 1 || limit > 100 {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and 100"})
+			return
+		}
+	}
+
+	_, err := mh.Store.GetWebhookSubscriptionForAPIKey(id, middleware.APIKeyID(r.Context()))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "subscription not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get subscription"})
+		mh.Logger.Printf("failed to get webhook subscription %s: %v", id, err)
+		return
+	}
+
+	deliveries, err := mh.Store.ListWebhookDeliveries(id, limit)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to list deliveries"})
+		mh.Logger.Printf("failed to list deliveries of webhook subscription %s: %v", id, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"deliveries": deliveries})
+}
+
+func (mh *MerchantWebhookHandler) HandleGetDelivery(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "delivery not found")
+	if !ok {
+		return
+	}
+
+	delivery, err := mh.Store.GetWebhookDelivery(id, middleware.APIKeyID(r.Context()))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "delivery not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get delivery"})
+		mh.Logger.Printf("failed to get webhook delivery %s: %v", id, err)
+		return
+	}
+
+	attempts, err := mh.Store.GetWebhookDeliveryAttempts(id)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get delivery attempts"})
+		mh.Logger.Printf("failed to get attempts of webhook delivery %s: %v", id, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"delivery": delivery, "attempts": attempts})
+}
+
+// HandleReplayDelivery queues a delivery to be sent again, e.g. after the
+// partner fixed their endpoint.
+func (mh *MerchantWebhookHandler) HandleReplayDelivery(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "delivery not found")
+	if !ok {
+		return
+	}
+
+	delivery, err := mh.Store.ReplayWebhookDelivery(id, middleware.APIKeyID(r.Context()))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "delivery not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to replay delivery"})
+		mh.Logger.Printf("failed to replay webhook delivery %s: %v", id, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"delivery": delivery})
+}
+
+// checkHost returns what is wrong with a subscription host, or "" if every
+// address it resolves to is public. The dispatcher checks again when it
+// connects, in case the host later resolves elsewhere.
+func (mh *MerchantWebhookHandler) checkHost(ctx context.Context, host string) string {
+	addrs := []netip.Addr{}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = append(addrs, addr)
+	} else {
+		addrs, err = mh.Resolver.LookupNetIP(ctx, "ip", host)
+		if err != nil || len(addrs) == 0 {
+			mh.Logger.Printf("failed to resolve webhook host %s: %v", host, err)
+			return "url host could not be resolved"
+		}
+	}
+
+	for _, addr := range addrs {
+		if !validate.PublicAddr(addr) {
+			return "url must not point at a private, loopback or reserved address"
+		}
+	}
+	return ""
+}
+
+// readUUIDParam reads the "id" URL parameter, writing notFound as a 404 if it
+// cannot be an ID.
+func readUUIDParam(w http.ResponseWriter, r *http.Request, notFound string) (string, bool) {
+	id, err := utils.ReadParamID(r, "id")
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return "", false
+	}
+	if !utils.IsUUID(id) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": notFound})
+		return "", false
+	}
+	return id, true
+}
+
+func validEventType(eventType string) bool {
+	if eventType == "*" {
+		return true
+	}
+	status, ok := strings.CutPrefix(eventType, "transaction.")
+	return ok && stores.TransactionStatus(status).IsValid()
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// staticResolver resolves the hosts it knows and fails for any other.
+type staticResolver map[string][]netip.Addr
+
+func (sr staticResolver) LookupNetIP(ctx context.Context, network string, host string) ([]netip.Addr, error) {
+	addrs, ok := sr[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+	return addrs, nil
+}
+
+func TestCreateSubscriptionRefusesNonPublicURLs(t *testing.T) {
+	resolver := staticResolver{
+		"partner.example.com": {netip.MustParseAddr("93.184.216.34")},
+		"internal.example.com": {netip.MustParseAddr("93.184.216.34"), netip.MustParseAddr("10.0.0.5")},
+		"metadata.example.com": {netip.MustParseAddr("169.254.169.254")},
+	}
+
+	tests := []struct {
+		url string
+		want int
+	}{
+		{"https://partner.example.com/nhx", http.StatusCreated},
+		{"http://partner.example.com/nhx", http.StatusBadRequest},
+		{"https://127.0.0.1/nhx", http.StatusBadRequest},
+		{"https://[::1]:8443/nhx", http.StatusBadRequest},
+		{"https://169.254.169.254/latest/meta-data", http.StatusBadRequest},
+		{"https://192.168.1.10/nhx", http.StatusBadRequest},
+		{"https://internal.example.com/nhx", http.StatusBadRequest},
+		{"https://metadata.example.com/nhx", http.StatusBadRequest},
+		{"https://unknown.example.com/nhx", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			store := &memMerchantWebhookStore{}
+			mh := NewMerchantWebhookHandler(store, log.New(io.Discard, "", 0))
+			mh.Resolver = resolver
+
+			req := httptest.NewRequest(http.MethodPost, "/webhook-subscriptions", strings.NewReader(`{"url": "`+tt.url+`"}`))
+			rec := httptest.NewRecorder()
+			mh.HandleCreateSubscription(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if created := len(store.subscriptions) == 1; created != (tt.want == http.StatusCreated) {
+				t.Errorf("subscription created = %v", created)
+			}
+		})
+	}
+}
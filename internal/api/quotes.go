@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/money"
+	"github.com/nhx-finance/wallet/internal/prices"
+	"github.com/nhx-finance/wallet/internal/pricing"
+	"github.com/nhx-finance/wallet/internal/rates"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/validate"
+	"github.com/shopspring/decimal"
+)
+
+type QuoteRequest struct {
+	AmountKSH decimal.Decimal `json:"amount_ksh"`
+	// Asset is what the on-ramp will buy. It defaults to USDC.
+	Asset string `json:"asset"`
+}
+
+type QuoteHandler struct {
+	QuoteStore stores.QuoteStore
+	Rates rates.RateProvider
+	Pricing *pricing.Engine
+	Assets *assets.Registry
+	Prices prices.AssetPriceSource
+	TTL time.Duration
+	// STKAmounts bounds what the quoted on-ramp's STK push may charge.
+	STKAmounts validate.AmountRange
+	Logger *log.Logger
+}
+
+func NewQuoteHandler(quoteStore stores.QuoteStore, rateProvider rates.RateProvider, pricingEngine *pricing.Engine, assetRegistry *assets.Registry, priceSource prices.AssetPriceSource, ttl time.Duration, logger *log.Logger) *QuoteHandler {
+	return &QuoteHandler{
+		QuoteStore: quoteStore,
+		Rates: rateProvider,
+		Pricing: pricingEngine,
+		Assets: assetRegistry,
+		Prices: priceSource,
+		TTL: ttl,
+		STKAmounts: validate.NewAmountRange(1, 250000),
+		Logger: logger,
+	}
+}
+
+func (qh *QuoteHandler) HandleCreateQuote(w http.ResponseWriter, r *http.Request) {
+	var req QuoteRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+
+	if !req.AmountKSH.IsPositive() || !money.KES(req.AmountKSH).Equal(req.AmountKSH) {
+		writeValidationErrors(w, validate.Errors{"amount_ksh": "must be a positive whole number of shillings"})
+		return
+	}
+	err = qh.STKAmounts.Check(req.AmountKSH)
+	if err != nil {
+		writeValidationErrors(w, validate.Errors{"amount_ksh": err.Error()})
+		return
+	}
+	asset, err := qh.Assets.Get(assetOrUSDC(req.Asset))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown asset"})
+		return
+	}
+
+	rate, ok := currentRate(w, r, qh.Rates, qh.Logger)
+	if !ok {
+		return
+	}
+
+	price, err := qh.Pricing.PriceOnRamp(asset.Symbol, req.AmountKSH, rate)
+	if errors.Is(err, pricing.ErrAmountTooSmall) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to price quote"})
+		qh.Logger.Printf("failed to price quote: %v", err)
+		return
+	}
+	// the quantity is fixed now, so the on-ramp does not depend on the asset
+	// price or rate still being fresh when it is initiated
+	quantity, ok := assetQuantity(w, r, qh.Prices, asset, price.AmountUSDC, rate, qh.Logger)
+	if !ok {
+		return
+	}
+
+	quote := stores.Quote{
+		Direction: "onramp",
+		Asset: asset.Symbol,
+		AssetQuantity: quantity,
+		AmountKSH: price.AmountKSH,
+		AmountUSDC: price.AmountUSDC,
+		ExchangeRate: price.ExchangeRate,
+		FeeKSH: price.FeeKSH,
+		SpreadKSH: price.SpreadKSH,
+		ExpiresAt: time.Now().Add(qh.TTL),
+	}
+	createdQuote, err := qh.QuoteStore.CreateQuote(quote)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create quote"})
+		qh.Logger.Printf("failed to create quote: %v", err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"quote": createdQuote})
+}
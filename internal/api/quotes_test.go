@@ -0,0 +1,134 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/pricing"
+	"github.com/nhx-finance/wallet/internal/rates"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/shopspring/decimal"
+)
+
+const testFeeSchedule = `{"rules": [
+	{"direction": "onramp", "asset": "USDC", "fixed_ksh": "0", "percent": "1", "min_ksh": "0", "max_ksh": "0", "spread_percent": "0"},
+	{"direction": "onramp", "asset": "SCOM", "fixed_ksh": "50", "percent": "0", "min_ksh": "0", "max_ksh": "0", "spread_percent": "2"}
+]}`
+
+func TestCreateQuoteUsesAssetFeeRule(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	path := filepath.Join(t.TempDir(), "fees.json")
+	err := os.WriteFile(path, []byte(testFeeSchedule), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine, err := pricing.NewEngine(path, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := assets.NewRegistry()
+	for _, symbol := range []string{"USDC", "SCOM"} {
+		err = registry.Register(assets.Asset{Symbol: symbol, Decimals: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		body string
+		asset string
+		fee string
+		// quantity is how much of the asset the quote fixes, or empty to
+		// expect the quote's USDC amount
+		quantity string
+	}{
+		{`{"amount_ksh": "1000"}`, "USDC", "10", ""},
+		// 950 KSH after the fee buys 7.164404 USDC at 132.6, and SCOM at
+		// 26 KSH is 0.2 USDC
+		{`{"amount_ksh": "1000", "asset": "scom"}`, "SCOM", "50", "35.82"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.asset, func(t *testing.T) {
+			store := &memQuoteStore{}
+			qh := NewQuoteHandler(store, rates.NewFixedRateProvider(decimal.NewFromInt(130)), engine, registry, fixedPrices{"SCOM": decimal.NewFromInt(26)}, time.Minute, logger)
+
+			rec := httptest.NewRecorder()
+			qh.HandleCreateQuote(rec, httptest.NewRequest(http.MethodPost, "/quotes", strings.NewReader(tt.body)))
+			if rec.Code != http.StatusCreated {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+
+			var resp struct {
+				Quote stores.Quote `json:"quote"`
+			}
+			err := json.NewDecoder(rec.Body).Decode(&resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.Quote.Asset != tt.asset {
+				t.Errorf("asset = %s, want %s", resp.Quote.Asset, tt.asset)
+			}
+			if !resp.Quote.FeeKSH.Equal(decimal.RequireFromString(tt.fee)) {
+				t.Errorf("fee_ksh = %s, want %s", resp.Quote.FeeKSH, tt.fee)
+			}
+			quantity := resp.Quote.AmountUSDC
+			if tt.quantity != "" {
+				quantity = decimal.RequireFromString(tt.quantity)
+			}
+			if !resp.Quote.AssetQuantity.Equal(quantity) {
+				t.Errorf("asset_quantity = %s, want %s", resp.Quote.AssetQuantity, quantity)
+			}
+			if !store.quotes[0].AssetQuantity.Equal(quantity) {
+				t.Errorf("stored asset_quantity = %s, want %s", store.quotes[0].AssetQuantity, quantity)
+			}
+		})
+	}
+}
+
+func TestCreateQuoteRejectsUnknownAsset(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	engine, err := pricing.NewEngine("", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qh := NewQuoteHandler(&memQuoteStore{}, rates.NewFixedRateProvider(decimal.NewFromInt(130)), engine, assets.NewRegistry(), fixedPrices{}, time.Minute, logger)
+
+	rec := httptest.NewRecorder()
+	qh.HandleCreateQuote(rec, httptest.NewRequest(http.MethodPost, "/quotes", strings.NewReader(`{"amount_ksh": "1000", "asset": "NOPE"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+}
+
+func TestCreateQuoteRefusesStaleAssetPrice(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	engine, err := pricing.NewEngine("", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := assets.NewRegistry()
+	err = registry.Register(assets.Asset{Symbol: "SCOM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &memQuoteStore{}
+	qh := NewQuoteHandler(store, rates.NewFixedRateProvider(decimal.NewFromInt(130)), engine, registry, fixedPrices{}, time.Minute, logger)
+
+	rec := httptest.NewRecorder()
+	qh.HandleCreateQuote(rec, httptest.NewRequest(http.MethodPost, "/quotes", strings.NewReader(`{"amount_ksh": "1000", "asset": "SCOM"}`)))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 503", rec.Code)
+	}
+	if len(store.quotes) != 0 {
+		t.Errorf("%d quotes created, want none", len(store.quotes))
+	}
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/workers"
+)
+
+const maxReviewListing = 100
+
+// Decisions an operator can make about a transaction in review.
+const (
+	DecisionConfirm = "confirm"
+	DecisionFail = "fail"
+	// DecisionRequery asks Daraja again and applies its answer. It is only
+	// offered for STK pushes Daraja gave no result for; a payment that was
+	// received but did not match needs a person to decide.
+	DecisionRequery = "requery"
+)
+
+type ResolveReviewRequest struct {
+	Decision string `json:"decision"`
+	Reason string `json:"reason"`
+}
+
+// ReviewHandler lets operators work off on-ramps that were moved to review,
+// either because the payment did not match or because Daraja never said
+// what happened to the STK push.
+type ReviewHandler struct {
+	TransactionStore stores.TransactionStore
+	Daraja *payments.DarajaClient
+	Settler *workers.Settler
+	Logger *log.Logger
+}
+
+func NewReviewHandler(transactionStore stores.TransactionStore, daraja *payments.DarajaClient, settler *workers.Settler, logger *log.Logger) *ReviewHandler {
+	return &ReviewHandler{
+		TransactionStore: transactionStore,
+		Daraja: daraja,
+		Settler: settler,
+		Logger: logger,
+	}
+}
+
+// HandleListReviews lists on-ramps waiting in review, oldest first.
+func (rh *ReviewHandler) HandleListReviews(w http.ResponseWriter, r *http.Request) {
+	txns, err := rh.TransactionStore.GetTransactionsByTypeAndStatus("onramp", stores.StatusReview, maxReviewListing)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to list transactions in review"})
+		rh.Logger.Printf("failed to list transactions in review: %v", err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"transactions": txns})
+}
+
+// HandleResolveReview moves a transaction out of review. A confirmed
+// transaction is settled like any other.
+func (rh *ReviewHandler) HandleResolveReview(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "transaction not found")
+	if !ok {
+		return
+	}
+
+	var req ResolveReviewRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+	if req.Decision != DecisionConfirm && req.Decision != DecisionFail && req.Decision != DecisionRequery {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "decision must be confirm, fail or requery"})
+		return
+	}
+	if req.Decision != DecisionRequery && (req.Reason == "" || len(req.Reason) > 500) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "reason is required and must be at most 500 characters"})
+		return
+	}
+
+	txn, err := rh.TransactionStore.GetTransactionByID(id)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "transaction not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+		rh.Logger.Printf("failed to get transaction %s: %v", id, err)
+		return
+	}
+	if txn.Status != stores.StatusReview {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "transaction is not in review", "transaction": txn})
+		return
+	}
+
+	status := stores.StatusConfirmed
+	reason := req.Reason
+	switch req.Decision {
+	case DecisionFail:
+		status = stores.StatusFailed
+	case DecisionRequery:
+		if txn.MpesaReceiptNumber != "" {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "the payment was received but did not match; confirm or fail it"})
+			return
+		}
+		queryResp, err := rh.Daraja.QuerySTKPush(r.Context(), txn.MpesaCheckoutID)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "failed to query M-Pesa"})
+			rh.Logger.Printf("failed to query STK push %s: %v", txn.MpesaCheckoutID, err)
+			return
+		}
+		if queryResp.InProgress() {
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "M-Pesa has no result for this payment yet"})
+			return
+		}
+		if queryResp.ResultCode != "0" {
+			status = stores.StatusFailed
+		}
+		reason = "STK query: " + queryResp.ResultDesc
+	}
+
+	operator := "operator"
+	if apiKey := middleware.APIKeyFromContext(r.Context()); apiKey != nil {
+		operator = apiKey.Name
+	}
+	resolved, err := rh.TransactionStore.TransitionTransaction(id, stores.StatusReview, status, stores.StatusChange{Actor: stores.ActorOperator, Reason: operator + ": " + reason})
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "transaction is not in review"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to resolve transaction"})
+		rh.Logger.Printf("failed to resolve transaction %s: %v", id, err)
+		return
+	}
+	rh.Logger.Printf("transaction %s resolved as %s by %s", id, status, operator)
+	if status == stores.StatusConfirmed {
+		rh.Settler.Trigger()
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"transaction": resolved})
+}
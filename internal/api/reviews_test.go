@@ -0,0 +1,88 @@
+package api
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/workers"
+)
+
+const reviewID = "3b9e1c7a-5d2f-4a8e-b6c0-9f1d2e3a4b5c"
+
+func newReviewRouter(t *testing.T, txn stores.Transaction) (*memTransactionStore, *fakeDaraja, http.Handler) {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	store := &memTransactionStore{txns: []*stores.Transaction{&txn}}
+	daraja := newFakeDaraja(t)
+	settler := workers.NewSettler(store, nil, nil, assets.NewRegistry(), logger)
+
+	rh := NewReviewHandler(store, daraja.Client(), settler, logger)
+	r := chi.NewRouter()
+	r.Post("/reviews/{id}/resolve", rh.HandleResolveReview)
+	return store, daraja, r
+}
+
+func resolveReview(router http.Handler, body string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/reviews/"+reviewID+"/resolve", strings.NewReader(body)))
+	return rec
+}
+
+func TestResolveReview(t *testing.T) {
+	// a payment that arrived but did not match
+	mismatched := stores.Transaction{ID: reviewID, Type: "onramp", Status: stores.StatusReview, MpesaCheckoutID: "ws_CO_1", MpesaReceiptNumber: "NLJ7RT61SV"}
+	// an STK push Daraja never gave a result for
+	unanswered := stores.Transaction{ID: reviewID, Type: "onramp", Status: stores.StatusReview, MpesaCheckoutID: "ws_CO_1"}
+	settled := stores.Transaction{ID: reviewID, Type: "onramp", Status: stores.StatusSettled, MpesaCheckoutID: "ws_CO_1"}
+
+	tests := []struct {
+		name string
+		txn stores.Transaction
+		query payments.STKQueryResponse
+		body string
+		wantCode int
+		wantStatus stores.TransactionStatus
+	}{
+		{"confirm", mismatched, payments.STKQueryResponse{}, `{"decision": "confirm", "reason": "balance paid by till"}`, http.StatusOK, stores.StatusConfirmed},
+		{"fail", mismatched, payments.STKQueryResponse{}, `{"decision": "fail", "reason": "refunded on M-Pesa"}`, http.StatusOK, stores.StatusFailed},
+		{"no reason", mismatched, payments.STKQueryResponse{}, `{"decision": "confirm"}`, http.StatusBadRequest, stores.StatusReview},
+		{"unknown decision", mismatched, payments.STKQueryResponse{}, `{"decision": "settle", "reason": "x"}`, http.StatusBadRequest, stores.StatusReview},
+		{"not in review", settled, payments.STKQueryResponse{}, `{"decision": "fail", "reason": "x"}`, http.StatusConflict, stores.StatusSettled},
+		{"requery paid", unanswered, payments.STKQueryResponse{ResultCode: "0", ResultDesc: "The service request is processed successfully."}, `{"decision": "requery"}`, http.StatusOK, stores.StatusConfirmed},
+		{"requery cancelled", unanswered, payments.STKQueryResponse{ResultCode: "1032", ResultDesc: "Request cancelled by user"}, `{"decision": "requery"}`, http.StatusOK, stores.StatusFailed},
+		{"requery in progress", unanswered, payments.STKQueryResponse{ErrorCode: "500.001.1001"}, `{"decision": "requery"}`, http.StatusConflict, stores.StatusReview},
+		// Daraja would report the mismatched payment as paid
+		{"requery mismatched", mismatched, payments.STKQueryResponse{ResultCode: "0"}, `{"decision": "requery"}`, http.StatusConflict, stores.StatusReview},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, daraja, router := newReviewRouter(t, tt.txn)
+			daraja.query = tt.query
+
+			rec := resolveReview(router, tt.body)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if got := store.txns[0].Status; got != tt.wantStatus {
+				t.Errorf("transaction is %s, want %s", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestResolveReviewUnknownTransaction(t *testing.T) {
+	_, _, router := newReviewRouter(t, stores.Transaction{ID: "0e7d9a3c-2b1f-4c6d-8e5a-7f9b0c1d2e3f", Status: stores.StatusReview})
+
+	rec := resolveReview(router, `{"decision": "fail", "reason": "x"}`)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body)
+	}
+}
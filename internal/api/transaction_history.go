@@ -0,0 +1,282 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/validate"
+)
+
+const (
+	defaultTransactionPageSize = 20
+	maxTransactionPageSize = 100
+)
+
+// HandleGetTransaction returns a transaction created by the caller's API key
+// with its status history. Anyone else's transaction is not found.
+func (th *TransactionHandler) HandleGetTransaction(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "transaction not found")
+	if !ok {
+		return
+	}
+
+	txn, err := th.TransactionStore.GetTransactionByIDForAPIKey(id, middleware.APIKeyID(r.Context()))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "transaction not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+		th.Logger.Printf("failed to get transaction %s: %v", id, err)
+		return
+	}
+
+	events, err := th.TransactionStore.GetTransactionEvents(id)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction events"})
+		th.Logger.Printf("failed to get events of transaction %s: %v", id, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"transaction": txn, "events": events})
+}
+
+// HandleListTransactions lists one account's or phone number's transactions
+// that were created by the caller's API key, newest first, a page at a time.
+// next_cursor is empty on the last page.
+func (th *TransactionHandler) HandleListTransactions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := stores.TransactionFilter{
+		APIKeyID: middleware.APIKeyID(r.Context()),
+		HederaAccountID: query.Get("hedera_account_id"),
+		Phone: query.Get("phone"),
+		Status: stores.TransactionStatus(query.Get("status")),
+		Type: query.Get("type"),
+		Limit: defaultTransactionPageSize,
+	}
+
+	if filter.HederaAccountID == "" && filter.Phone == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "hedera_account_id or phone is required"})
+		return
+	}
+	// normalised the same way as when the transactions were created
+	errs := validate.Errors{}
+	if filter.HederaAccountID != "" {
+		filter.HederaAccountID = accountIDField(errs, "hedera_account_id", filter.HederaAccountID, th.HieroClient)
+	}
+	if filter.Phone != "" {
+		filter.Phone = phoneField(errs, "phone", filter.Phone)
+	}
+	if !errs.Empty() {
+		writeValidationErrors(w, errs)
+		return
+	}
+	if filter.Status != "" && !filter.Status.IsValid() {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid status"})
+		return
+	}
+	if filter.Type != "" && filter.Type != "onramp" && filter.Type != "offramp" && filter.Type != "card" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid type"})
+		return
+	}
+
+	var err error
+	if query.Get("from") != "" {
+		filter.From, err = time.Parse(time.RFC3339, query.Get("from"))
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "from must be an RFC 3339 time"})
+			return
+		}
+	}
+	if query.Get("to") != "" {
+		filter.To, err = time.Parse(time.RFC3339, query.Get("to"))
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "to must be an RFC 3339 time"})
+			return
+		}
+	}
+	if query.Get("limit") != "" {
+		filter.Limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || filter.Limit < 1 || filter.Limit > maxTransactionPageSize {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "limit must be between 1 and " + strconv.Itoa(maxTransactionPageSize)})
+			return
+		}
+	}
+	if query.Get("cursor") != "" {
+		filter.After, err = decodeTransactionCursor(query.Get("cursor"))
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid cursor"})
+			return
+		}
+	}
+
+	// one extra row tells us whether there is another page
+	pageSize := filter.Limit
+	filter.Limit++
+	txns, err := th.TransactionStore.ListTransactions(filter)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to list transactions"})
+		th.Logger.Printf("failed to list transactions: %v", err)
+		return
+	}
+
+	nextCursor := ""
+	if len(txns) > pageSize {
+		txns = txns[:pageSize]
+		last := txns[len(txns)-1]
+		nextCursor = encodeTransactionCursor(stores.TransactionCursor{CreatedAt: last.CreatedAt, ID: last.ID})
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"transactions": txns, "next_cursor": nextCursor})
+}
+
+// Cursors are opaque to clients: the created_at and ID of the last
+// transaction on the page, base64 encoded.
+func encodeTransactionCursor(cursor stores.TransactionCursor) string {
+	raw := cursor.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + cursor.ID
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeTransactionCursor(encoded string) (*stores.TransactionCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	createdAt, id, ok := strings.Cut(string(raw), "|")
+	if !ok || !utils.IsUUID(id) {
+		return nil, errors.New("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return nil, err
+	}
+	return &stores.TransactionCursor{CreatedAt: t, ID: id}, nil
+}
+
+// HandleTransactionEvents streams a transaction's status history as
+// Server-Sent Events: everything so far, then each change as it commits, and
+// ends once the transaction reaches a final status. Clients reconnecting with
+// Last-Event-ID only get the events after that one. Only transactions created
+// by the caller's API key can be followed.
+func (th *TransactionHandler) HandleTransactionEvents(w http.ResponseWriter, r *http.Request) {
+	id, ok := readUUIDParam(w, r, "transaction not found")
+	if !ok {
+		return
+	}
+
+	_, err := th.TransactionStore.GetTransactionByIDForAPIKey(id, middleware.APIKeyID(r.Context()))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "transaction not found"})
+		return
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+		th.Logger.Printf("failed to get transaction %s: %v", id, err)
+		return
+	}
+
+	// subscribe before the first read so no change falls between the two
+	wakeups, unsubscribe := th.Broker.Subscribe(id)
+	defer unsubscribe()
+
+	events, err := th.TransactionStore.GetTransactionEvents(id)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction events"})
+		th.Logger.Printf("failed to get events of transaction %s: %v", id, err)
+		return
+	}
+	if len(events) == 0 {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "transaction not found"})
+		return
+	}
+
+	// the server's write timeout would cut the stream off
+	rc := http.NewResponseController(w)
+	err = rc.SetWriteDeadline(time.Time{})
+	if err != nil {
+		th.Logger.Printf("failed to clear write deadline for event stream: %v", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sent := map[string]bool{}
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		for _, event := range events {
+			sent[event.ID] = true
+			if event.ID == lastEventID {
+				break
+			}
+		}
+		// an unknown ID means the whole history is replayed
+		if !sent[lastEventID] {
+			sent = map[string]bool{}
+		}
+	}
+
+	keepAlive := time.NewTicker(th.KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		final := false
+		for _, event := range events {
+			final = event.ToStatus.IsFinal()
+			if sent[event.ID] {
+				continue
+			}
+			err := writeServerSentEvent(w, event)
+			if err != nil {
+				return
+			}
+			sent[event.ID] = true
+		}
+		err := rc.Flush()
+		if err != nil || final {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case _, ok := <-wakeups:
+			if !ok {
+				// shutting down
+				return
+			}
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		events, err = th.TransactionStore.GetTransactionEvents(id)
+		if err != nil {
+			th.Logger.Printf("failed to get events of transaction %s: %v", id, err)
+			return
+		}
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event stores.TransactionEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: status\ndata: %s\n\n", event.ID, data)
+	return err
+}
@@ -0,0 +1,277 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+func TestTransactionsScopedToAPIKey(t *testing.T) {
+	const (
+		ownID = "6f1c2a4e-8d3b-4f5a-9c7e-1b2d3e4f5a6b"
+		otherID = "0e7d9a3c-2b1f-4c6d-8e5a-7f9b0c1d2e3f"
+	)
+	logger := log.New(io.Discard, "", 0)
+
+	keyStore := &memAPIKeyStore{}
+	var secrets []string
+	for i, name := range []string{"partner-a", "partner-b"} {
+		apiKey, secret, err := middleware.NewAPIKey(name, []string{stores.ScopeTransactionsRead}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiKey.ID = []string{"key-a", "key-b"}[i]
+		keyStore.keys = append(keyStore.keys, apiKey)
+		secrets = append(secrets, secret)
+	}
+
+	store := &memTransactionStore{txns: []*stores.Transaction{
+		{ID: ownID, Type: "onramp", Phone: "254712345678", Status: stores.StatusSettled, APIKeyID: "key-a"},
+		{ID: otherID, Type: "onramp", Phone: "254712345678", Status: stores.StatusSettled, APIKeyID: "key-b"},
+	}}
+	th := &TransactionHandler{TransactionStore: store, Logger: logger}
+
+	r := chi.NewRouter()
+	r.Use(middleware.NewAPIKeyAuth(keyStore, logger).Require(stores.ScopeTransactionsRead))
+	r.Get("/transactions", th.HandleListTransactions)
+	r.Get("/transactions/{id}", th.HandleGetTransaction)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+secrets[0])
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := get("/transactions/" + ownID); rec.Code != http.StatusOK {
+		t.Errorf("own transaction: status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+	if rec := get("/transactions/" + otherID); rec.Code != http.StatusNotFound {
+		t.Errorf("another key's transaction: status %d, want %d: %s", rec.Code, http.StatusNotFound, rec.Body)
+	}
+
+	rec := get("/transactions?phone=0712345678")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("list: status %d: %s", rec.Code, rec.Body)
+	}
+	var list struct {
+		Transactions []stores.Transaction `json:"transactions"`
+	}
+	err := json.Unmarshal(rec.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Transactions) != 1 || list.Transactions[0].ID != ownID {
+		t.Errorf("listed %+v, want only %s", list.Transactions, ownID)
+	}
+}
+
+// eventStream serves HandleTransactionEvents to a key that owns ownID.
+type eventStream struct {
+	*httptest.Server
+	store *memTransactionStore
+	broker *fakeBroker
+	secret string
+}
+
+const (
+	streamOwnID = "6f1c2a4e-8d3b-4f5a-9c7e-1b2d3e4f5a6b"
+	streamOtherID = "0e7d9a3c-2b1f-4c6d-8e5a-7f9b0c1d2e3f"
+)
+
+func newEventStream(t *testing.T, keepAlive time.Duration, events ...stores.TransactionEvent) *eventStream {
+	logger := log.New(io.Discard, "", 0)
+	apiKey, secret, err := middleware.NewAPIKey("partner-a", []string{stores.ScopeTransactionsRead}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey.ID = "key-a"
+
+	es := &eventStream{
+		store: &memTransactionStore{txns: []*stores.Transaction{
+			{ID: streamOwnID, Type: "onramp", Status: stores.StatusInitiated, APIKeyID: "key-a"},
+			{ID: streamOtherID, Type: "onramp", Status: stores.StatusInitiated, APIKeyID: "key-b"},
+		}, events: events},
+		broker: newFakeBroker(),
+		secret: secret,
+	}
+	th := &TransactionHandler{TransactionStore: es.store, Broker: es.broker, KeepAlive: keepAlive, Logger: logger}
+
+	r := chi.NewRouter()
+	r.With(middleware.NewAPIKeyAuth(&memAPIKeyStore{keys: []stores.APIKey{apiKey}}, logger).RequireForStream(stores.ScopeTransactionsRead)).Get("/transactions/{id}/events", th.HandleTransactionEvents)
+	es.Server = httptest.NewServer(r)
+	t.Cleanup(es.Close)
+	return es
+}
+
+func (es *eventStream) open(t *testing.T, id string, lastEventID string) *http.Response {
+	req, err := http.NewRequest(http.MethodGet, es.URL+"/transactions/"+id+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+es.secret)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res
+}
+
+func statusEvent(id string, from stores.TransactionStatus, to stores.TransactionStatus) stores.TransactionEvent {
+	return stores.TransactionEvent{ID: id, TransactionID: streamOwnID, FromStatus: from, ToStatus: to, Actor: stores.ActorAPI}
+}
+
+// readFrame reads up to the next blank line and returns the lines before it,
+// or nil at the end of the stream.
+func readFrame(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && line == "" && len(lines) == 0 {
+			return nil
+		}
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// readEvents reads n status events and returns their IDs, checking that each
+// is framed as the handler writes it.
+func readEvents(t *testing.T, r *bufio.Reader, n int) []string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		frame := readFrame(t, r)
+		if len(frame) != 3 || !strings.HasPrefix(frame[0], "id: ") || frame[1] != "event: status" || !strings.HasPrefix(frame[2], "data: ") {
+			t.Fatalf("got frame %q, want a status event", frame)
+		}
+		var event stores.TransactionEvent
+		err := json.Unmarshal([]byte(strings.TrimPrefix(frame[2], "data: ")), &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if "id: "+event.ID != frame[0] {
+			t.Errorf("frame %q carries event %s", frame[0], event.ID)
+		}
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestTransactionEventsFollowsChanges(t *testing.T) {
+	es := newEventStream(t, time.Minute, statusEvent("event-1", "", stores.StatusInitiated))
+	res := es.open(t, streamOwnID, "")
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(res.Body)
+
+	if got := readEvents(t, stream, 1); got[0] != "event-1" {
+		t.Fatalf("history %v, want event-1", got)
+	}
+
+	es.store.recordEvent(statusEvent("event-2", stores.StatusInitiated, stores.StatusConfirmed))
+	es.broker.wakeups <- struct{}{}
+	if got := readEvents(t, stream, 1); got[0] != "event-2" {
+		t.Fatalf("got %v, want event-2", got)
+	}
+
+	es.store.recordEvent(statusEvent("event-3", stores.StatusConfirmed, stores.StatusSettled))
+	es.broker.wakeups <- struct{}{}
+	if got := readEvents(t, stream, 1); got[0] != "event-3" {
+		t.Fatalf("got %v, want event-3", got)
+	}
+
+	if frame := readFrame(t, stream); frame != nil {
+		t.Errorf("stream went on after a final status: %q", frame)
+	}
+	select {
+	case <-es.broker.unsubscribed:
+	case <-time.After(time.Second):
+		t.Error("stream did not unsubscribe")
+	}
+}
+
+func TestTransactionEventsResumes(t *testing.T) {
+	history := []stores.TransactionEvent{
+		statusEvent("event-1", "", stores.StatusInitiated),
+		statusEvent("event-2", stores.StatusInitiated, stores.StatusConfirmed),
+		statusEvent("event-3", stores.StatusConfirmed, stores.StatusSettled),
+	}
+
+	tests := []struct {
+		lastEventID string
+		want []string
+	}{
+		{"", []string{"event-1", "event-2", "event-3"}},
+		{"event-1", []string{"event-2", "event-3"}},
+		{"event-3", nil},
+		{"unknown", []string{"event-1", "event-2", "event-3"}},
+	}
+	for _, tt := range tests {
+		t.Run("last event "+tt.lastEventID, func(t *testing.T) {
+			es := newEventStream(t, time.Minute, history...)
+			stream := bufio.NewReader(es.open(t, streamOwnID, tt.lastEventID).Body)
+
+			got := readEvents(t, stream, len(tt.want))
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if frame := readFrame(t, stream); frame != nil {
+				t.Errorf("stream went on after a final status: %q", frame)
+			}
+		})
+	}
+}
+
+func TestTransactionEventsKeepAliveAndShutdown(t *testing.T) {
+	es := newEventStream(t, 10*time.Millisecond, statusEvent("event-1", "", stores.StatusInitiated))
+	stream := bufio.NewReader(es.open(t, streamOwnID, "").Body)
+	readEvents(t, stream, 1)
+
+	if frame := readFrame(t, stream); len(frame) != 1 || frame[0] != ": keep-alive" {
+		t.Fatalf("idle stream sent %q, want a keep-alive comment", frame)
+	}
+
+	close(es.broker.wakeups)
+	for {
+		frame := readFrame(t, stream)
+		if frame == nil {
+			break
+		}
+		if frame[0] != ": keep-alive" {
+			t.Fatalf("got %q after shutdown", frame)
+		}
+	}
+}
+
+func TestTransactionEventsScopedToAPIKey(t *testing.T) {
+	es := newEventStream(t, time.Minute, statusEvent("event-1", "", stores.StatusInitiated))
+
+	for _, id := range []string{streamOtherID, "3c4d5e6f-7a8b-4c9d-8e0f-1a2b3c4d5e6f", "not-a-uuid"} {
+		res := es.open(t, id, "")
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status %d, want %d", id, res.StatusCode, http.StatusNotFound)
+		}
+	}
+}
@@ -1,34 +1,101 @@
 package api
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/money"
 	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/prices"
+	"github.com/nhx-finance/wallet/internal/pricing"
+	"github.com/nhx-finance/wallet/internal/pubsub"
+	"github.com/nhx-finance/wallet/internal/rates"
 	"github.com/nhx-finance/wallet/internal/stores"
 	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/validate"
+	"github.com/shopspring/decimal"
 )
 
 type OnRampRequest struct {
-	AmountKSH float64 `json:"amount_ksh"`
+	AmountKSH decimal.Decimal `json:"amount_ksh"`
 	Phone string `json:"phone"`
 	HederaAccountID string `json:"hedera_account_id"`
+	QuoteID string `json:"quote_id"`
+	// Asset is what the USDC bought is spent on, e.g. "SCOM". It defaults
+	// to USDC itself.
+	Asset string `json:"asset"`
 }
 
+type OffRampRequest struct {
+	AmountUSDC decimal.Decimal `json:"amount_usdc"`
+	Phone string `json:"phone"`
+	HederaAccountID string `json:"hedera_account_id"`
+}
+
+type DepositInstruction struct {
+	AccountID string `json:"account_id"`
+	TokenID string `json:"token_id"`
+	Memo string `json:"memo"`
+	AmountUSDC decimal.Decimal `json:"amount_usdc"`
+	// ExpiresAt is when the off-ramp expires if no deposit has arrived.
+	ExpiresAt time.Time `json:"expires_at"`
+}
 
 
 type TransactionHandler struct {
 	TransactionStore stores.TransactionStore
+	QuoteStore stores.QuoteStore
 	HieroClient *hiero.Client
+	Mirror *mirror.Client
+	Daraja *payments.DarajaClient
+	Rates rates.RateProvider
+	Pricing *pricing.Engine
+	Assets *assets.Registry
+	Prices prices.AssetPriceSource
+	Broker pubsub.TransactionSubscriber
+	TreasuryAccountID hiero.AccountID
+	USDCTokenID hiero.TokenID
+	// KeepAlive is how often an idle event stream is sent a comment so
+	// that proxies don't close it.
+	KeepAlive time.Duration
+	// STKAmounts bounds what an STK push may charge and B2CAmounts what a
+	// payout may send.
+	STKAmounts validate.AmountRange
+	B2CAmounts validate.AmountRange
+	// DepositWindow is how long an off-ramp waits for its deposit.
+	DepositWindow time.Duration
 	Logger *log.Logger
 }
 
-func NewTransactionHandler (transactionStore stores.TransactionStore, hieroClient *hiero.Client, logger *log.Logger) *TransactionHandler {
+func NewTransactionHandler (transactionStore stores.TransactionStore, quoteStore stores.QuoteStore, hieroClient *hiero.Client, mirrorClient *mirror.Client, daraja *payments.DarajaClient, rateProvider rates.RateProvider, pricingEngine *pricing.Engine, assetRegistry *assets.Registry, priceSource prices.AssetPriceSource, broker pubsub.TransactionSubscriber, treasuryAccountID hiero.AccountID, usdcTokenID hiero.TokenID, logger *log.Logger) *TransactionHandler {
 	return &TransactionHandler{
 		TransactionStore: transactionStore,
+		QuoteStore: quoteStore,
 		HieroClient: hieroClient,
+		Mirror: mirrorClient,
+		Daraja: daraja,
+		Rates: rateProvider,
+		Pricing: pricingEngine,
+		Assets: assetRegistry,
+		Prices: priceSource,
+		Broker: broker,
+		TreasuryAccountID: treasuryAccountID,
+		USDCTokenID: usdcTokenID,
+		KeepAlive: 15 * time.Second,
+		STKAmounts: validate.NewAmountRange(1, 250000),
+		B2CAmounts: validate.NewAmountRange(10, 250000),
+		DepositWindow: 30 * time.Minute,
 		Logger: logger,
 	}
 }
@@ -41,26 +108,165 @@ func (th *TransactionHandler) HandleInitiatePayment(w http.ResponseWriter, r *ht
 		return
 	}
 
-	stkPushResp, err := payments.InitiateSTKPush(req.Phone, req.AmountKSH, req.HederaAccountID)
+	errs := validate.Errors{}
+	req.Phone = phoneField(errs, "phone", req.Phone)
+	req.HederaAccountID = accountIDField(errs, "hedera_account_id", req.HederaAccountID, th.HieroClient)
+	if req.QuoteID == "" {
+		if !req.AmountKSH.IsPositive() || !money.KES(req.AmountKSH).Equal(req.AmountKSH) {
+			errs.Add("amount_ksh", "must be a positive whole number of shillings")
+		} else if err := th.STKAmounts.Check(req.AmountKSH); err != nil {
+			errs.Add("amount_ksh", err.Error())
+		}
+	}
+	if !errs.Empty() {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	tx := stores.Transaction{
+		Phone: req.Phone,
+		HederaAccountID: req.HederaAccountID,
+		Type: "onramp",
+		Status: stores.StatusInitiated,
+		APIKeyID: middleware.APIKeyID(r.Context()),
+	}
+
+	var asset assets.Asset
+	if req.QuoteID != "" {
+		quote, ok := th.reserveQuote(w, req)
+		if !ok {
+			return
+		}
+		asset, err = th.Assets.Get(quote.Asset)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown asset"})
+			th.releaseQuote(quote.ID)
+			return
+		}
+		tx.QuoteID = quote.ID
+		tx.Asset = asset.Symbol
+		tx.AssetQuantity = quote.AssetQuantity
+		tx.AmountKSH = quote.AmountKSH
+		tx.AmountUSDC = quote.AmountUSDC
+		tx.ExchangeRate = quote.ExchangeRate
+		tx.FeeKSH = quote.FeeKSH
+		tx.SpreadKSH = quote.SpreadKSH
+	} else {
+		asset, err = th.Assets.Get(assetOrUSDC(req.Asset))
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unknown asset"})
+			return
+		}
+		exchangeRate, ok := th.currentRate(w, r)
+		if !ok {
+			return
+		}
+		price, err := th.Pricing.PriceOnRamp(asset.Symbol, req.AmountKSH, exchangeRate)
+		if !th.checkPrice(w, err) {
+			return
+		}
+		tx.AmountKSH = price.AmountKSH
+		tx.AmountUSDC = price.AmountUSDC
+		tx.ExchangeRate = price.ExchangeRate
+		tx.FeeKSH = price.FeeKSH
+		tx.SpreadKSH = price.SpreadKSH
+
+		tx.Asset = asset.Symbol
+		tx.AssetQuantity, ok = assetQuantity(w, r, th.Prices, asset, tx.AmountUSDC, exchangeRate, th.Logger)
+		if !ok {
+			return
+		}
+	}
+
+	if !checkRecipient(w, r, th.Mirror, th.Assets, tx.HederaAccountID, tx.Asset, th.Logger) {
+		th.releaseQuote(tx.QuoteID)
+		return
+	}
+
+	callbackToken, err := payments.NewCallbackToken()
 	if err != nil {
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to initiate STK push"})
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create callback token"})
+		th.Logger.Printf("failed to create callback token: %v", err)
+		th.releaseQuote(tx.QuoteID)
 		return
 	}
+	tx.CallbackTokenHash = utils.HashToken(callbackToken)
 
-	if stkPushResp.ResponseCode != "0" {
+	stkPushResp, err := th.Daraja.InitiateSTKPush(r.Context(), req.Phone, tx.AmountKSH, req.HederaAccountID, callbackToken)
+	if err != nil || stkPushResp.ResponseCode != "0" {
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to initiate STK push"})
+		th.releaseQuote(tx.QuoteID)
+		return
+	}
+	// the customer has been prompted; a retry must not prompt them again
+	middleware.MarkSideEffect(r.Context())
+	tx.MpesaCheckoutID = stkPushResp.CheckoutRequestID
+
+	createdTx, err := th.TransactionStore.CreateTransaction(tx)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create transaction"})
+		th.Logger.Printf("failed to create transaction: %v", err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"stk_push_response": stkPushResp, "transaction": createdTx})
+}
+
+
+func (th *TransactionHandler) HandleInitiateOffRamp(w http.ResponseWriter, r *http.Request) {
+	var req OffRampRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+
+	errs := validate.Errors{}
+	req.Phone = phoneField(errs, "phone", req.Phone)
+	req.HederaAccountID = accountIDField(errs, "hedera_account_id", req.HederaAccountID, th.HieroClient)
+	if !req.AmountUSDC.IsPositive() || !money.USDC(req.AmountUSDC).Equal(req.AmountUSDC) {
+		errs.Add("amount_usdc", "must be positive with at most 6 decimal places")
+	}
+	if !errs.Empty() {
+		writeValidationErrors(w, errs)
+		return
+	}
+
+	exchangeRate, ok := th.currentRate(w, r)
+	if !ok {
+		return
+	}
+	price, err := th.Pricing.PriceOffRamp("USDC", req.AmountUSDC, exchangeRate)
+	if !th.checkPrice(w, err) {
+		return
+	}
+	err = th.B2CAmounts.Check(price.AmountKSH)
+	if err != nil {
+		writeValidationErrors(w, validate.Errors{"amount_usdc": "pays out KES " + price.AmountKSH.String() + ", which " + err.Error()})
+		return
+	}
+
+	memo, err := newDepositMemo()
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to create deposit memo"})
+		th.Logger.Printf("failed to create deposit memo: %v", err)
 		return
 	}
 
 	tx := stores.Transaction{
 		Phone: req.Phone,
 		HederaAccountID: req.HederaAccountID,
-		Type: "onramp",
-		AmountKSH: req.AmountKSH,
-		AmountUSDC: req.AmountKSH / utils.DefaultExchangeRate,
-		ExchangeRate: utils.DefaultExchangeRate,
-		Status: "initiated",
-		MpesaCheckoutID: stkPushResp.CheckoutRequestID,
+		Type: "offramp",
+		AmountKSH: price.AmountKSH,
+		AmountUSDC: price.AmountUSDC,
+		Asset: "USDC",
+		AssetQuantity: price.AmountUSDC,
+		ExchangeRate: price.ExchangeRate,
+		FeeKSH: price.FeeKSH,
+		SpreadKSH: price.SpreadKSH,
+		Status: stores.StatusPending,
+		DepositMemo: memo,
+		APIKeyID: middleware.APIKeyID(r.Context()),
 	}
 	createdTx, err := th.TransactionStore.CreateTransaction(tx)
 	if err != nil {
@@ -68,7 +274,159 @@ func (th *TransactionHandler) HandleInitiatePayment(w http.ResponseWriter, r *ht
 		th.Logger.Printf("failed to create transaction: %v", err)
 		return
 	}
+	middleware.MarkSideEffect(r.Context())
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"stk_push_response": stkPushResp, "transaction": createdTx})
+	deposit := DepositInstruction{
+		AccountID: th.TreasuryAccountID.String(),
+		TokenID: th.USDCTokenID.String(),
+		Memo: memo,
+		AmountUSDC: createdTx.AmountUSDC,
+		ExpiresAt: createdTx.CreatedAt.Add(th.DepositWindow),
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"deposit": deposit, "transaction": createdTx})
+}
+
+// reserveQuote claims the quote named in req for this on-ramp, writing an
+// error response and returning false if it cannot be used.
+func (th *TransactionHandler) reserveQuote(w http.ResponseWriter, req OnRampRequest) (*stores.Quote, bool) {
+	if !utils.IsUUID(req.QuoteID) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "quote not found"})
+		return nil, false
+	}
+
+	quote, err := th.QuoteStore.ReserveQuote(req.QuoteID)
+	if errors.Is(err, sql.ErrNoRows) {
+		existing, err := th.QuoteStore.GetQuoteByID(req.QuoteID)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "quote not found"})
+		case err != nil:
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get quote"})
+			th.Logger.Printf("failed to get quote %s: %v", req.QuoteID, err)
+		case existing.UsedAt != nil:
+			utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "quote has already been used"})
+		default:
+			utils.WriteJSON(w, http.StatusGone, utils.Envelope{"error": "quote has expired"})
+		}
+		return nil, false
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to reserve quote"})
+		th.Logger.Printf("failed to reserve quote %s: %v", req.QuoteID, err)
+		return nil, false
+	}
+
+	if quote.Direction != "onramp" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "quote is not for an on-ramp"})
+		th.releaseQuote(quote.ID)
+		return nil, false
+	}
+	if !req.AmountKSH.IsZero() && !req.AmountKSH.Equal(quote.AmountKSH) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "amount_ksh does not match the quote"})
+		th.releaseQuote(quote.ID)
+		return nil, false
+	}
+	if req.Asset != "" && !strings.EqualFold(req.Asset, quote.Asset) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "asset does not match the quote"})
+		th.releaseQuote(quote.ID)
+		return nil, false
+	}
+
+	return quote, true
+}
+
+func (th *TransactionHandler) releaseQuote(quoteID string) {
+	if quoteID == "" {
+		return
+	}
+	err := th.QuoteStore.ReleaseQuote(quoteID)
+	if err != nil {
+		th.Logger.Printf("failed to release quote %s: %v", quoteID, err)
+	}
+}
+
+// currentRate fetches the rate to price a new transaction at, writing an error
+// response and returning false if there is none we are willing to quote.
+func (th *TransactionHandler) currentRate(w http.ResponseWriter, r *http.Request) (decimal.Decimal, bool) {
+	return currentRate(w, r, th.Rates, th.Logger)
 }
 
+func currentRate(w http.ResponseWriter, r *http.Request, rateProvider rates.RateProvider, logger *log.Logger) (decimal.Decimal, bool) {
+	rate, err := rateProvider.KESPerUSDC(r.Context())
+	if errors.Is(err, rates.ErrRateStale) {
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "exchange rate is temporarily unavailable"})
+		logger.Printf("refusing to price transaction: %v", err)
+		return decimal.Zero, false
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get exchange rate"})
+		logger.Printf("failed to get exchange rate: %v", err)
+		return decimal.Zero, false
+	}
+	return money.Rate(rate.Value), true
+}
+
+// assetOrUSDC is the asset a request buys, USDC when it names none.
+func assetOrUSDC(symbol string) string {
+	if symbol == "" {
+		return "USDC"
+	}
+	return symbol
+}
+
+// assetQuantity is how much of asset amountUSDC buys, valuing the asset at its
+// current price and midRate and rounding down to the token's decimals. It
+// writes an error response and returns false if the asset cannot be bought.
+func assetQuantity(w http.ResponseWriter, r *http.Request, priceSource prices.AssetPriceSource, asset assets.Asset, amountUSDC decimal.Decimal, midRate decimal.Decimal, logger *log.Logger) (decimal.Decimal, bool) {
+	if asset.Symbol == "USDC" {
+		return amountUSDC, true
+	}
+
+	price, err := priceSource.AssetPrice(r.Context(), asset.Symbol)
+	if errors.Is(err, assets.ErrUnknownAsset) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "no price for " + asset.Symbol})
+		return decimal.Zero, false
+	}
+	if errors.Is(err, prices.ErrPriceStale) {
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "asset price is temporarily unavailable"})
+		logger.Printf("refusing to price transaction: %v", err)
+		return decimal.Zero, false
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get asset price"})
+		logger.Printf("failed to get %s price: %v", asset.Symbol, err)
+		return decimal.Zero, false
+	}
+
+	quantity := amountUSDC.Div(price.InUSDC(midRate)).RoundFloor(int32(asset.Decimals))
+	if !quantity.IsPositive() {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "amount is too small to buy any " + asset.Symbol})
+		return decimal.Zero, false
+	}
+	return quantity, true
+}
+
+// checkPrice writes an error response for a failed pricing and returns false,
+// or returns true if err is nil.
+func (th *TransactionHandler) checkPrice(w http.ResponseWriter, err error) bool {
+	if errors.Is(err, pricing.ErrAmountTooSmall) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return false
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to price transaction"})
+		th.Logger.Printf("failed to price transaction: %v", err)
+		return false
+	}
+	return true
+}
+
+func newDepositMemo() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return "NHX-" + strings.ToUpper(hex.EncodeToString(b)), nil
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/mirror/mirrortest"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/validate"
+	"github.com/shopspring/decimal"
+)
+
+func TestInitiatePaymentDeliversQuotedQuantity(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	daraja := newFakeDaraja(t)
+
+	registry := assets.NewRegistry()
+	err := registry.Register(assets.Asset{Symbol: "SCOM", TokenID: hiero.TokenID{Token: 3000}, Decimals: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := mirrortest.NewServer()
+	defer server.Close()
+	server.AddAccount(mirror.Account{Account: "0.0.1234"})
+	server.Associate("0.0.1234", mirror.TokenRelationship{TokenID: "0.0.3000", KYCStatus: mirror.StatusNotApplicable, FreezeStatus: mirror.StatusNotApplicable})
+
+	const quoteID = "6f1c2a4e-8b0d-4c3e-9a7f-2d5b6e8f1a3c"
+	quotes := &memQuoteStore{quotes: []stores.Quote{{
+		ID: quoteID,
+		Direction: "onramp",
+		Asset: "SCOM",
+		AssetQuantity: decimal.RequireFromString("35.82"),
+		AmountKSH: decimal.NewFromInt(1000),
+		AmountUSDC: decimal.RequireFromString("7.164404"),
+		ExchangeRate: decimal.RequireFromString("132.6"),
+		FeeKSH: decimal.NewFromInt(50),
+		ExpiresAt: time.Now().Add(time.Minute),
+	}}}
+	txns := &memTransactionStore{}
+	// every price is stale and there is no rate, so the quantity can only come
+	// from the quote
+	th := &TransactionHandler{
+		TransactionStore: txns,
+		QuoteStore: quotes,
+		Mirror: server.Client(),
+		Daraja: daraja.Client(),
+		Assets: registry,
+		Prices: fixedPrices{},
+		STKAmounts: validate.NewAmountRange(1, 250000),
+		Logger: logger,
+	}
+
+	body := `{"phone": "0712345678", "hedera_account_id": "0.0.1234", "quote_id": "` + quoteID + `"}`
+	rec := httptest.NewRecorder()
+	th.HandleInitiatePayment(rec, httptest.NewRequest(http.MethodPost, "/onramp/initiate", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp struct {
+		Transaction stores.Transaction `json:"transaction"`
+	}
+	err = json.NewDecoder(rec.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Transaction.Asset != "SCOM" || !resp.Transaction.AssetQuantity.Equal(decimal.RequireFromString("35.82")) {
+		t.Errorf("transaction delivers %s %s, want 35.82 SCOM", resp.Transaction.AssetQuantity, resp.Transaction.Asset)
+	}
+	if resp.Transaction.QuoteID != quoteID {
+		t.Errorf("quote_id = %q, want %q", resp.Transaction.QuoteID, quoteID)
+	}
+	if len(daraja.pushes) != 1 || daraja.pushes[0]["Amount"] != float64(1000) {
+		t.Errorf("STK pushes = %v, want one for 1000", daraja.pushes)
+	}
+}
+
+func TestInitiatePaymentChecksRecipient(t *testing.T) {
+	usable := mirror.TokenRelationship{TokenID: "0.0.3000", KYCStatus: mirror.StatusNotApplicable, FreezeStatus: mirror.StatusNotApplicable}
+
+	tests := []struct {
+		name string
+		account *mirror.Account
+		relationship *mirror.TokenRelationship
+		unavailable bool
+		wantCode int
+	}{
+		{"unknown account", nil, nil, false, http.StatusBadRequest},
+		{"unassociated token", &mirror.Account{Account: "0.0.1234"}, nil, false, http.StatusBadRequest},
+		{"frozen account", &mirror.Account{Account: "0.0.1234"}, &mirror.TokenRelationship{TokenID: "0.0.3000", KYCStatus: mirror.StatusNotApplicable, FreezeStatus: mirror.FreezeFrozen}, false, http.StatusBadRequest},
+		{"revoked KYC", &mirror.Account{Account: "0.0.1234"}, &mirror.TokenRelationship{TokenID: "0.0.3000", KYCStatus: mirror.KYCRevoked, FreezeStatus: mirror.StatusNotApplicable}, false, http.StatusBadRequest},
+		{"free auto-association slots", &mirror.Account{Account: "0.0.1234", MaxAutomaticTokenAssociations: 10}, nil, false, http.StatusOK},
+		{"associated", &mirror.Account{Account: "0.0.1234"}, &usable, false, http.StatusOK},
+		{"mirror unavailable", &mirror.Account{Account: "0.0.1234"}, &usable, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daraja := newFakeDaraja(t)
+			registry := assets.NewRegistry()
+			err := registry.Register(assets.Asset{Symbol: "SCOM", TokenID: hiero.TokenID{Token: 3000}, Decimals: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := mirrortest.NewServer()
+			defer server.Close()
+			if tt.account != nil {
+				server.AddAccount(*tt.account)
+			}
+			if tt.relationship != nil {
+				server.Associate("0.0.1234", *tt.relationship)
+			}
+			server.SetUnavailable(tt.unavailable)
+
+			const quoteID = "6f1c2a4e-8b0d-4c3e-9a7f-2d5b6e8f1a3c"
+			quotes := &memQuoteStore{quotes: []stores.Quote{{
+				ID: quoteID,
+				Direction: "onramp",
+				Asset: "SCOM",
+				AssetQuantity: decimal.RequireFromString("35.82"),
+				AmountKSH: decimal.NewFromInt(1000),
+				AmountUSDC: decimal.RequireFromString("7.164404"),
+				ExchangeRate: decimal.RequireFromString("132.6"),
+				FeeKSH: decimal.NewFromInt(50),
+				ExpiresAt: time.Now().Add(time.Minute),
+			}}}
+			th := &TransactionHandler{
+				TransactionStore: &memTransactionStore{},
+				QuoteStore: quotes,
+				Mirror: server.Client(),
+				Daraja: daraja.Client(),
+				Assets: registry,
+				STKAmounts: validate.NewAmountRange(1, 250000),
+				Logger: log.New(io.Discard, "", 0),
+			}
+
+			body := `{"phone": "0712345678", "hedera_account_id": "0.0.1234", "quote_id": "` + quoteID + `"}`
+			rec := httptest.NewRecorder()
+			th.HandleInitiatePayment(rec, httptest.NewRequest(http.MethodPost, "/onramp/initiate", strings.NewReader(body)))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if rec.Code == http.StatusOK {
+				return
+			}
+			// the customer must not be asked to pay, and the quote stays usable
+			if len(daraja.pushes) != 0 {
+				t.Errorf("sent %d STK pushes, want none", len(daraja.pushes))
+			}
+			if quotes.quotes[0].UsedAt != nil {
+				t.Error("quote was not released")
+			}
+			if tt.wantCode == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "hedera_account_id") {
+				t.Errorf("body %s does not name hedera_account_id", rec.Body)
+			}
+		})
+	}
+}
+
+func usdcRegistry(t *testing.T) *assets.Registry {
+	t.Helper()
+	registry := assets.NewRegistry()
+	err := registry.Register(assets.Asset{Symbol: "USDC", TokenID: hiero.TokenID{Token: 429274}, Decimals: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return registry
+}
+
+func TestInitiatePaymentQuoteRules(t *testing.T) {
+	const quoteID = "6f1c2a4e-8b0d-4c3e-9a7f-2d5b6e8f1a3c"
+	usedAt := time.Now().Add(-time.Minute)
+	quote := func(change func(*stores.Quote)) stores.Quote {
+		q := stores.Quote{
+			ID: quoteID,
+			Direction: "onramp",
+			Asset: "USDC",
+			AssetQuantity: decimal.RequireFromString("7.164404"),
+			AmountKSH: decimal.NewFromInt(1000),
+			AmountUSDC: decimal.RequireFromString("7.164404"),
+			ExchangeRate: decimal.RequireFromString("132.6"),
+			FeeKSH: decimal.NewFromInt(50),
+			ExpiresAt: time.Now().Add(time.Minute),
+		}
+		if change != nil {
+			change(&q)
+		}
+		return q
+	}
+
+	tests := []struct {
+		name string
+		quote stores.Quote
+		body string
+		pushCode string
+		wantCode int
+		// wantUsed says whether the quote is spent afterwards
+		wantUsed bool
+	}{
+		{"valid", quote(nil), `{"quote_id": "` + quoteID + `"}`, "", http.StatusOK, true},
+		{"matching amount and asset", quote(nil), `{"quote_id": "` + quoteID + `", "amount_ksh": 1000, "asset": "usdc"}`, "", http.StatusOK, true},
+		{"expired", quote(func(q *stores.Quote) { q.ExpiresAt = time.Now().Add(-time.Second) }), `{"quote_id": "` + quoteID + `"}`, "", http.StatusGone, false},
+		{"already used", quote(func(q *stores.Quote) { q.UsedAt = &usedAt }), `{"quote_id": "` + quoteID + `"}`, "", http.StatusConflict, true},
+		{"unknown", quote(nil), `{"quote_id": "0e7d9a3c-2b1f-4c6d-8e5a-7f9b0c1d2e3f"}`, "", http.StatusNotFound, false},
+		{"not a UUID", quote(nil), `{"quote_id": "quote-1"}`, "", http.StatusNotFound, false},
+		{"off-ramp quote", quote(func(q *stores.Quote) { q.Direction = "offramp" }), `{"quote_id": "` + quoteID + `"}`, "", http.StatusBadRequest, false},
+		{"different amount", quote(nil), `{"quote_id": "` + quoteID + `", "amount_ksh": 2000}`, "", http.StatusBadRequest, false},
+		{"different asset", quote(nil), `{"quote_id": "` + quoteID + `", "asset": "SCOM"}`, "", http.StatusBadRequest, false},
+		// the customer was never prompted, so the quote can be tried again
+		{"STK push rejected", quote(nil), `{"quote_id": "` + quoteID + `"}`, "1", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daraja := newFakeDaraja(t)
+			daraja.pushCode = tt.pushCode
+			server := mirrortest.NewServer()
+			defer server.Close()
+			server.AddAccount(mirror.Account{Account: "0.0.1234", MaxAutomaticTokenAssociations: -1})
+
+			quotes := &memQuoteStore{quotes: []stores.Quote{tt.quote}}
+			th := &TransactionHandler{
+				TransactionStore: &memTransactionStore{},
+				QuoteStore: quotes,
+				Mirror: server.Client(),
+				Daraja: daraja.Client(),
+				Assets: usdcRegistry(t),
+				STKAmounts: validate.NewAmountRange(1, 250000),
+				Logger: log.New(io.Discard, "", 0),
+			}
+
+			body := `{"phone": "0712345678", "hedera_account_id": "0.0.1234", ` + strings.TrimPrefix(tt.body, "{")
+			rec := httptest.NewRecorder()
+			th.HandleInitiatePayment(rec, httptest.NewRequest(http.MethodPost, "/onramp/initiate", strings.NewReader(body)))
+			if rec.Code != tt.wantCode {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if used := quotes.quotes[0].UsedAt != nil; used != tt.wantUsed {
+				t.Errorf("quote used = %t, want %t", used, tt.wantUsed)
+			}
+		})
+	}
+}
+
+func TestInitiatePaymentQuoteSingleUse(t *testing.T) {
+	const quoteID = "6f1c2a4e-8b0d-4c3e-9a7f-2d5b6e8f1a3c"
+	daraja := newFakeDaraja(t)
+	server := mirrortest.NewServer()
+	defer server.Close()
+	server.AddAccount(mirror.Account{Account: "0.0.1234", MaxAutomaticTokenAssociations: -1})
+	th := &TransactionHandler{
+		TransactionStore: &memTransactionStore{},
+		QuoteStore: &memQuoteStore{quotes: []stores.Quote{{ID: quoteID, Direction: "onramp", Asset: "USDC", AssetQuantity: decimal.NewFromInt(7), AmountKSH: decimal.NewFromInt(1000), AmountUSDC: decimal.NewFromInt(7), ExpiresAt: time.Now().Add(time.Minute)}}},
+		Mirror: server.Client(),
+		Daraja: daraja.Client(),
+		Assets: usdcRegistry(t),
+		STKAmounts: validate.NewAmountRange(1, 250000),
+		Logger: log.New(io.Discard, "", 0),
+	}
+
+	body := `{"phone": "0712345678", "hedera_account_id": "0.0.1234", "quote_id": "` + quoteID + `"}`
+	var codes []int
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		th.HandleInitiatePayment(rec, httptest.NewRequest(http.MethodPost, "/onramp/initiate", strings.NewReader(body)))
+		codes = append(codes, rec.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusConflict {
+		t.Errorf("statuses %v, want [200 409]", codes)
+	}
+	if len(daraja.pushes) != 1 {
+		t.Errorf("sent %d STK pushes, want 1", len(daraja.pushes))
+	}
+}
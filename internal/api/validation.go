@@ -0,0 +1,73 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/validate"
+)
+
+// writeValidationErrors answers a request whose fields failed validation with
+// every problem at once, keyed by field.
+func writeValidationErrors(w http.ResponseWriter, errs validate.Errors) {
+	utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request", "fields": errs})
+}
+
+// phoneField normalises a required phone number, recording an error for
+// field if it is missing or invalid.
+func phoneField(errs validate.Errors, field string, phone string) string {
+	if phone == "" {
+		errs.Add(field, "is required")
+		return ""
+	}
+	msisdn, err := validate.MSISDN(phone)
+	if err != nil {
+		errs.Add(field, err.Error())
+		return ""
+	}
+	return msisdn
+}
+
+// accountIDField normalises a required Hedera account ID, recording an error
+// for field if it is missing or invalid.
+func accountIDField(errs validate.Errors, field string, accountID string, client *hiero.Client) string {
+	if accountID == "" {
+		errs.Add(field, "is required")
+		return ""
+	}
+	id, err := validate.AccountID(accountID, client)
+	if err != nil {
+		errs.Add(field, err.Error())
+		return ""
+	}
+	return id.String()
+}
+
+// checkRecipient makes sure the asset can be delivered to accountID before
+// the buyer pays for it, writing an error response and returning false if it
+// cannot. An account that does not exist or is not associated with the token
+// would otherwise leave a paid transaction that can never settle.
+func checkRecipient(w http.ResponseWriter, r *http.Request, client *mirror.Client, registry *assets.Registry, accountID string, symbol string, logger *log.Logger) bool {
+	asset, err := registry.Get(symbol)
+	if err != nil {
+		writeValidationErrors(w, validate.Errors{"asset": "is not a listed asset"})
+		return false
+	}
+
+	err = client.CheckRecipient(r.Context(), accountID, asset.TokenID.String())
+	if mirror.IsRecipientError(err) {
+		writeValidationErrors(w, validate.Errors{"hedera_account_id": fmt.Sprintf("cannot receive %s (%s): %v", asset.Symbol, asset.TokenID, err)})
+		return false
+	}
+	if err != nil {
+		utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "cannot check hedera_account_id right now, try again shortly"})
+		logger.Printf("failed to check Hedera account %s for %s: %v", accountID, asset.Symbol, err)
+		return false
+	}
+	return true
+}
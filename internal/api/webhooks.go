@@ -1,85 +1,355 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/nhx-finance/wallet/internal/alerts"
+	"github.com/nhx-finance/wallet/internal/payments"
 	"github.com/nhx-finance/wallet/internal/stores"
 	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/workers"
 )
 
 type WebhookHandler struct {
 	WebhookStore stores.WebhookStore
 	TransactionStore stores.TransactionStore
+	Settler *workers.Settler
+	// Refunder records the deposits of off-ramps whose payout failed.
+	Refunder *workers.Refunder
+	// Alerter is told about payments moved to review.
+	Alerter alerts.Alerter
 	Logger *log.Logger
 }
 
-func NewWebhookHandler(webhookStore stores.WebhookStore, transactionStore stores.TransactionStore, logger *log.Logger) *WebhookHandler {
+func NewWebhookHandler(webhookStore stores.WebhookStore, transactionStore stores.TransactionStore, settler *workers.Settler, refunder *workers.Refunder, alerter alerts.Alerter, logger *log.Logger) *WebhookHandler {
 	return &WebhookHandler{
 		WebhookStore: webhookStore,
 		TransactionStore: transactionStore,
+		Settler: settler,
+		Refunder: refunder,
+		Alerter: alerter,
 		Logger: logger,
 	}
 }
 
-type SuccessfulRequest struct {
-	Body struct {
-		StkCallback struct {
-			MerchantRequestID string `json:"MerchantRequestID"`
-			CheckoutRequestID string `json:"CheckoutRequestID"`
-			ResultCode        int    `json:"ResultCode"`
-			ResultDesc        string `json:"ResultDesc"`
-			CallbackMetadata  struct {
-				Item []struct {
-					Name  string      `json:"Name"`
-					Value any `json:"Value"`
-				} `json:"Item"`
-			} `json:"CallbackMetadata"`
-		} `json:"stkCallback"`
-	} `json:"Body"`
-}
-
-type FailedRequest struct {
-	Body struct {
-		StkCallback struct {
-			MerchantRequestID string `json:"MerchantRequestID"`
-			CheckoutRequestID string `json:"CheckoutRequestID"`
-			ResultCode        int    `json:"ResultCode"`
-			ResultDesc        string `json:"ResultDesc"`
-		} `json:"stkCallback"`
-	} `json:"Body"`
-}
+// maxCallbackBodySize bounds what we are willing to store per callback.
+const maxCallbackBodySize = 1 << 20
 
 func (wh *WebhookHandler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	var callback SuccessfulRequest
-	err := json.NewDecoder(r.Body).Decode(&callback)
+	webhook, body, ok := wh.receive(w, r, stores.WebhookSTKCallback)
+	if !ok {
+		return
+	}
+
+	callback, err := payments.ParseSTKCallback(body)
 	if err != nil {
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
-		wh.Logger.Printf("failed to decode successful request: %v", err)
+		wh.Logger.Printf("failed to parse STK callback %s: %v", webhook.ID, err)
+		wh.respond(w, webhook, false, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
 		return
 	}
+	webhook.EventKey = callback.CheckoutRequestID
 
-	if callback.Body.StkCallback.ResultCode != 0 {
-		wh.Logger.Printf("failed to process successful request: %v", callback.Body)
-		txn, err := wh.TransactionStore.UpdateTransactionByMpesaCheckoutID(callback.Body.StkCallback.CheckoutRequestID, "failed", callback.Body.StkCallback.ResultDesc)
+	if wh.acknowledgeDuplicate(w, webhook) {
+		return
+	}
+
+	if !callback.Succeeded() {
+		wh.Logger.Printf("STK push %s failed: %s", callback.CheckoutRequestID, callback.ResultDesc)
+		txn, err := wh.TransactionStore.UpdateTransactionByMpesaCheckoutID(callback.CheckoutRequestID, stores.StatusFailed, "", stores.StatusChange{Actor: stores.ActorMpesaCallback, Reason: callback.ResultDesc})
+		if errors.Is(err, sql.ErrNoRows) {
+			wh.writeAlreadyResolved(w, webhook)
+			return
+		}
 		if err != nil {
 			wh.Logger.Printf("failed to update transaction: %v", err)
-			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to update transaction"})
+			wh.respond(w, webhook, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to update transaction"})
 			return
 		}
-		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": callback.Body.StkCallback.ResultDesc, "transaction": txn})
+		webhook.TransactionID = txn.ID
+		wh.respond(w, webhook, true, http.StatusBadRequest, utils.Envelope{"error": callback.ResultDesc, "transaction": txn})
+		return
+	}
+
+	existing, err := wh.TransactionStore.GetTransactionByMpesaCheckoutID(callback.CheckoutRequestID)
+	if errors.Is(err, sql.ErrNoRows) {
+		wh.writeAlreadyResolved(w, webhook)
 		return
 	}
+	if err != nil {
+		wh.Logger.Printf("failed to get transaction: %v", err)
+		wh.respond(w, webhook, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+		return
+	}
+
+	status := stores.StatusConfirmed
+	reason := callback.ResultDesc
+	if mismatch := paymentMismatch(existing, callback); mismatch != "" {
+		status = stores.StatusReview
+		reason = mismatch
+		wh.Logger.Printf("STK payment %s for transaction %s needs review: %s", callback.MpesaReceiptNumber, existing.ID, mismatch)
+	}
 
-	receiptNumber := callback.Body.StkCallback.CallbackMetadata.Item[1].Value.(string)
-	txn, err := wh.TransactionStore.UpdateTransactionByMpesaCheckoutID(callback.Body.StkCallback.CheckoutRequestID, "confirmed", receiptNumber)
+	txn, err := wh.TransactionStore.UpdateTransactionByMpesaCheckoutID(callback.CheckoutRequestID, status, callback.MpesaReceiptNumber, stores.StatusChange{Actor: stores.ActorMpesaCallback, Reason: reason})
+	if errors.Is(err, sql.ErrNoRows) {
+		wh.writeAlreadyResolved(w, webhook)
+		return
+	}
 	if err != nil {
 		wh.Logger.Printf("failed to update transaction: %v", err)
-		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to update transaction"})
+		wh.respond(w, webhook, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to update transaction"})
+		return
+	}
+	if status == stores.StatusConfirmed {
+		wh.Settler.Trigger()
+	} else {
+		wh.Alerter.Alert(r.Context(), fmt.Sprintf("On-ramp %s (M-Pesa receipt %s) needs review: %s", txn.ID, callback.MpesaReceiptNumber, reason))
+	}
+
+	webhook.TransactionID = txn.ID
+	wh.respond(w, webhook, true, http.StatusOK, utils.Envelope{"transaction": txn})
+}
+
+// paymentMismatch describes how a successful STK payment differs from the
+// transaction it pays for, or returns "" if it matches.
+func paymentMismatch(txn *stores.Transaction, callback *payments.STKCallback) string {
+	if !callback.Amount.Equal(txn.AmountKSH) {
+		return fmt.Sprintf("paid %s KES, expected %s KES", callback.Amount, txn.AmountKSH)
+	}
+	if !samePhone(callback.PhoneNumber, txn.Phone) {
+		return fmt.Sprintf("paid from %s, expected %s", callback.PhoneNumber, txn.Phone)
+	}
+	return ""
+}
+
+// samePhone compares two Kenyan numbers by their last nine digits, so that
+// 0712345678, +254712345678 and 254712345678 are all the same subscriber.
+func samePhone(a string, b string) bool {
+	a, b = digitsOnly(a), digitsOnly(b)
+	if len(a) < 9 || len(b) < 9 {
+		return a == b
+	}
+	return a[len(a)-9:] == b[len(b)-9:]
+}
+
+func digitsOnly(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// receive stores the raw callback before anything else looks at it, so that
+// we keep the evidence even if processing fails. It writes an error response
+// and returns false if the body cannot be read or stored.
+func (wh *WebhookHandler) receive(w http.ResponseWriter, r *http.Request, eventType string) (*stores.Webhook, []byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBodySize))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		wh.Logger.Printf("failed to read %s callback: %v", eventType, err)
+		return nil, nil, false
+	}
+
+	webhook := stores.Webhook{
+		Source: "mpesa",
+		EventType: eventType,
+		RawBody: body,
+		ReceivedAt: time.Now(),
+	}
+	if json.Valid(body) {
+		webhook.Payload = json.RawMessage(body)
+	}
+
+	stored, err := wh.WebhookStore.CreateWebhook(webhook)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to store callback"})
+		wh.Logger.Printf("failed to store %s callback: %v", eventType, err)
+		return nil, nil, false
+	}
+
+	return stored, body, true
+}
+
+// acknowledgeDuplicate answers a redelivery of an event that was already
+// processed without applying it again, and returns true if it did so.
+func (wh *WebhookHandler) acknowledgeDuplicate(w http.ResponseWriter, webhook *stores.Webhook) bool {
+	if webhook.EventKey == "" {
+		return false
+	}
+
+	original, err := wh.WebhookStore.GetProcessedWebhookByEventKey(webhook.EventType, webhook.EventKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		// Carry on; the status guards in the store stop a double update.
+		wh.Logger.Printf("failed to check for duplicate %s %s: %v", webhook.EventType, webhook.EventKey, err)
+		return false
+	}
+
+	wh.Logger.Printf("duplicate %s %s ignored, first delivered as %s", webhook.EventType, webhook.EventKey, original.ID)
+	webhook.TransactionID = original.TransactionID
+	webhook.DuplicateOf = original.ID
+	wh.respond(w, webhook, true, http.StatusOK, utils.Envelope{"message": "duplicate callback ignored"})
+	return true
+}
+
+func (wh *WebhookHandler) respond(w http.ResponseWriter, webhook *stores.Webhook, processed bool, status int, data utils.Envelope) {
+	respondToWebhook(w, wh.WebhookStore, wh.Logger, webhook, processed, status, data)
+}
+
+// respondToWebhook writes the response and records it against the stored
+// webhook.
+func respondToWebhook(w http.ResponseWriter, webhookStore stores.WebhookStore, logger *log.Logger, webhook *stores.Webhook, processed bool, status int, data utils.Envelope) {
+	utils.WriteJSON(w, status, data)
+
+	webhook.StatusCode = status
+	webhook.Processed = processed
+	_, err := webhookStore.CompleteWebhook(*webhook)
+	if err != nil {
+		logger.Printf("failed to record outcome of webhook %s: %v", webhook.ID, err)
+	}
+}
+
+// writeAlreadyResolved answers a callback for a transaction that is no longer
+// initiated, e.g. because the STK query resolver got to it first.
+func (wh *WebhookHandler) writeAlreadyResolved(w http.ResponseWriter, webhook *stores.Webhook) {
+	txn, err := wh.TransactionStore.GetTransactionByMpesaCheckoutID(webhook.EventKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		wh.Logger.Printf("callback for unknown checkout request %s", webhook.EventKey)
+		wh.respond(w, webhook, false, http.StatusNotFound, utils.Envelope{"error": "transaction not found"})
+		return
+	}
+	if err != nil {
+		wh.Logger.Printf("failed to get transaction: %v", err)
+		wh.respond(w, webhook, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+		return
+	}
+
+	wh.Logger.Printf("callback for checkout request %s ignored, transaction %s is already %s", webhook.EventKey, txn.ID, txn.Status)
+	webhook.TransactionID = txn.ID
+	wh.respond(w, webhook, true, http.StatusOK, utils.Envelope{"transaction": txn})
+}
+
+func (wh *WebhookHandler) HandleB2CResult(w http.ResponseWriter, r *http.Request) {
+	webhook, body, ok := wh.receive(w, r, stores.WebhookB2CResult)
+	if !ok {
+		return
+	}
+
+	var callback payments.B2CResult
+	err := json.Unmarshal(body, &callback)
+	if err != nil {
+		wh.Logger.Printf("failed to decode B2C result %s: %v", webhook.ID, err)
+		wh.respond(w, webhook, false, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+	webhook.EventKey = callback.Result.ConversationID
+
+	if wh.acknowledgeDuplicate(w, webhook) {
+		return
+	}
+
+	status := stores.StatusSettled
+	if callback.Result.ResultCode != 0 {
+		status = stores.StatusFailed
+		wh.Logger.Printf("B2C payout %s failed: %s", callback.Result.ConversationID, callback.Result.ResultDesc)
+	}
+
+	// payouts are requested with the transaction ID as originator ID
+	transactionID := callback.Result.OriginatorConversationID
+	if !utils.IsUUID(transactionID) {
+		transactionID = ""
+	}
+
+	txn, err := wh.TransactionStore.UpdateTransactionPayout(callback.Result.ConversationID, transactionID, status, callback.Result.TransactionID, stores.StatusChange{Actor: stores.ActorB2CCallback, Reason: callback.Result.ResultDesc})
+	if errors.Is(err, sql.ErrNoRows) {
+		wh.writePayoutNotSettling(w, webhook, transactionID)
+		return
+	}
+	if err != nil {
+		wh.Logger.Printf("failed to update transaction for conversation %s: %v", callback.Result.ConversationID, err)
+		wh.respond(w, webhook, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to update transaction"})
+		return
+	}
+	if status == stores.StatusFailed {
+		// the payout is already failed, so a retried callback would not get
+		// here again; a refund that cannot be recorded is only logged
+		err = wh.Refunder.Refund(r.Context(), stores.Refund{TransactionID: txn.ID, DepositTxID: txn.HederaTxID, AmountUSDC: txn.AmountUSDC, Reason: stores.RefundPayoutFailed})
+		if err != nil {
+			wh.Logger.Printf("off-ramp %s was not paid out, deposit %s needs a refund: %v", txn.ID, txn.HederaTxID, err)
+		}
+	}
+
+	webhook.TransactionID = txn.ID
+	wh.respond(w, webhook, true, http.StatusOK, utils.Envelope{"transaction": txn})
+}
+
+// writePayoutNotSettling answers a B2C result that matched no settling
+// off-ramp: either it was already resolved, or the result is for a payout we
+// do not know. Neither is worth Daraja retrying, so neither gets a 5xx.
+func (wh *WebhookHandler) writePayoutNotSettling(w http.ResponseWriter, webhook *stores.Webhook, transactionID string) {
+	if transactionID == "" {
+		wh.Logger.Printf("B2C result for unknown conversation %s needs manual reconciliation", webhook.EventKey)
+		wh.respond(w, webhook, false, http.StatusNotFound, utils.Envelope{"error": "transaction not found"})
+		return
+	}
+
+	txn, err := wh.TransactionStore.GetTransactionByID(transactionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		wh.Logger.Printf("B2C result for conversation %s names unknown transaction %s, needs manual reconciliation", webhook.EventKey, transactionID)
+		wh.respond(w, webhook, false, http.StatusNotFound, utils.Envelope{"error": "transaction not found"})
+		return
+	}
+	if err != nil {
+		wh.Logger.Printf("failed to get transaction %s: %v", transactionID, err)
+		wh.respond(w, webhook, false, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
 		return
 	}
-	// TODO: Initiate Hedera transaction on another goroutine
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"transaction": txn})
-}
\ No newline at end of file
+	wh.Logger.Printf("B2C result for conversation %s ignored, off-ramp %s is already %s", webhook.EventKey, txn.ID, txn.Status)
+	webhook.TransactionID = txn.ID
+	wh.respond(w, webhook, true, http.StatusOK, utils.Envelope{"transaction": txn})
+}
+
+// HandleB2CTimeout is called when a payout request expired in Daraja's queue.
+// Whether the payout eventually happened is unknown, so the transaction is
+// left in settling for manual reconciliation rather than being retried.
+func (wh *WebhookHandler) HandleB2CTimeout(w http.ResponseWriter, r *http.Request) {
+	webhook, body, ok := wh.receive(w, r, stores.WebhookB2CTimeout)
+	if !ok {
+		return
+	}
+
+	var callback payments.B2CResult
+	err := json.Unmarshal(body, &callback)
+	if err != nil {
+		wh.Logger.Printf("failed to decode B2C timeout %s: %v", webhook.ID, err)
+		wh.respond(w, webhook, false, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return
+	}
+	webhook.EventKey = callback.Result.ConversationID
+
+	if wh.acknowledgeDuplicate(w, webhook) {
+		return
+	}
+
+	wh.Logger.Printf("B2C payout %s (originator %s) timed out in queue, needs manual reconciliation: %s", callback.Result.ConversationID, callback.Result.OriginatorConversationID, callback.Result.ResultDesc)
+
+	// payouts are requested with the transaction ID as originator ID
+	webhook.TransactionID = callback.Result.OriginatorConversationID
+	if !utils.IsUUID(webhook.TransactionID) {
+		webhook.TransactionID = ""
+	}
+	wh.respond(w, webhook, true, http.StatusOK, utils.Envelope{"message": "timeout acknowledged"})
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/workers"
+	"github.com/shopspring/decimal"
+)
+
+func postB2CResult(t *testing.T, wh *WebhookHandler, originatorConversationID string, conversationID string) *httptest.ResponseRecorder {
+	t.Helper()
+	return postB2CResultCode(t, wh, originatorConversationID, conversationID, 0)
+}
+
+func postB2CResultCode(t *testing.T, wh *WebhookHandler, originatorConversationID string, conversationID string, resultCode int) *httptest.ResponseRecorder {
+	t.Helper()
+	body := `{"Result": {"ResultType": 0, "ResultCode": ` + strconv.Itoa(resultCode) + `, "ResultDesc": "The service request is processed successfully.", "OriginatorConversationID": "` + originatorConversationID + `", "ConversationID": "` + conversationID + `", "TransactionID": "NLJ41HAY6Q"}}`
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/mpesa/b2c/result", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	wh.HandleB2CResult(rec, req)
+	return rec
+}
+
+func TestB2CResult(t *testing.T) {
+	const offRampID = "6f1c2a4e-8d3b-4f5a-9c7e-1b2d3e4f5a6b"
+
+	tests := []struct {
+		name string
+		conversationID string
+		originator string
+		wantCode int
+		wantStatus stores.TransactionStatus
+	}{
+		// the result beat SetTransactionMpesaConversationID
+		{"before conversation ID recorded", "AG_20260101_0000", offRampID, http.StatusOK, stores.StatusSettled},
+		{"unknown payout", "AG_20260101_9999", "not-a-transaction", http.StatusNotFound, stores.StatusSettling},
+		{"unknown transaction", "AG_20260101_9999", "0e7d9a3c-2b1f-4c6d-8e5a-7f9b0c1d2e3f", http.StatusNotFound, stores.StatusSettling},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memTransactionStore{txns: []*stores.Transaction{
+				{ID: offRampID, Type: "offramp", Status: stores.StatusSettling},
+			}}
+			wh := NewWebhookHandler(&memWebhookStore{}, store, nil, nil, nil, log.New(io.Discard, "", 0))
+
+			rec := postB2CResult(t, wh, tt.originator, tt.conversationID)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if got := store.txns[0].Status; got != tt.wantStatus {
+				t.Errorf("off-ramp is %s, want %s", got, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestB2CResultAlreadyResolved(t *testing.T) {
+	const offRampID = "6f1c2a4e-8d3b-4f5a-9c7e-1b2d3e4f5a6b"
+	store := &memTransactionStore{txns: []*stores.Transaction{
+		{ID: offRampID, Type: "offramp", Status: stores.StatusSettled, MpesaConversationID: "AG_20260101_0000"},
+	}}
+	wh := NewWebhookHandler(&memWebhookStore{}, store, nil, nil, nil, log.New(io.Discard, "", 0))
+
+	rec := postB2CResult(t, wh, offRampID, "AG_20260101_0000")
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+}
+
+func TestB2CResultFailureRecordsRefund(t *testing.T) {
+	const offRampID = "6f1c2a4e-8d3b-4f5a-9c7e-1b2d3e4f5a6b"
+	logger := log.New(io.Discard, "", 0)
+	store := &memTransactionStore{txns: []*stores.Transaction{
+		{ID: offRampID, Type: "offramp", Status: stores.StatusSettling, MpesaConversationID: "AG_20260101_0000", HederaTxID: "0.0.7@1700000000.000000001", AmountUSDC: decimal.NewFromInt(10)},
+	}}
+	refunds := &memRefundStore{}
+	alerter := &alertRecorder{}
+	wh := NewWebhookHandler(&memWebhookStore{}, store, nil, workers.NewRefunder(refunds, alerter, logger), alerter, logger)
+
+	rec := postB2CResultCode(t, wh, offRampID, "AG_20260101_0000", 2001)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := store.txns[0].Status; got != stores.StatusFailed {
+		t.Errorf("off-ramp is %s, want failed", got)
+	}
+	if len(refunds.refunds) != 1 {
+		t.Fatalf("recorded %d refunds, want 1", len(refunds.refunds))
+	}
+	if got := refunds.refunds[0]; got.TransactionID != offRampID || got.DepositTxID != "0.0.7@1700000000.000000001" || !got.AmountUSDC.Equal(decimal.NewFromInt(10)) || got.Reason != stores.RefundPayoutFailed {
+		t.Errorf("refund = %+v, want the off-ramp's 10 USDC deposit for a failed payout", got)
+	}
+	if len(alerter.alerts) != 1 {
+		t.Errorf("sent %d alerts, want 1", len(alerter.alerts))
+	}
+}
+
+// postSTKCallback delivers an STK callback for checkoutID. A resultCode of 0
+// pays amount from 254712345678.
+func postSTKCallback(wh *WebhookHandler, checkoutID string, resultCode int, amount int) *httptest.ResponseRecorder {
+	body := `{"Body": {"stkCallback": {"MerchantRequestID": "29115-34620561-1", "CheckoutRequestID": "` + checkoutID + `", "ResultCode": ` + strconv.Itoa(resultCode) + `, "ResultDesc": "result ` + strconv.Itoa(resultCode) + `"`
+	if resultCode == 0 {
+		body += `, "CallbackMetadata": {"Item": [
+			{"Name": "Amount", "Value": ` + strconv.Itoa(amount) + `},
+			{"Name": "MpesaReceiptNumber", "Value": "NLJ7RT61SV"},
+			{"Name": "PhoneNumber", "Value": 254712345678}
+		]}`
+	}
+	body += `}}}`
+	rec := httptest.NewRecorder()
+	wh.HandleWebhook(rec, httptest.NewRequest(http.MethodPost, "/webhooks/mpesa", strings.NewReader(body)))
+	return rec
+}
+
+func TestSTKCallbackMismatchAlerts(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	store := &memTransactionStore{txns: []*stores.Transaction{
+		{ID: "txn-1", Type: "onramp", Status: stores.StatusInitiated, MpesaCheckoutID: "ws_CO_1", Phone: "254712345678", AmountKSH: decimal.NewFromInt(1000)},
+	}}
+	alerter := &alertRecorder{}
+	wh := NewWebhookHandler(&memWebhookStore{}, store, nil, nil, alerter, logger)
+
+	rec := postSTKCallback(wh, "ws_CO_1", 0, 400)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got := store.txns[0].Status; got != stores.StatusReview {
+		t.Errorf("on-ramp is %s, want review", got)
+	}
+	if len(alerter.alerts) != 1 || !strings.Contains(alerter.alerts[0], "txn-1") {
+		t.Errorf("alerts = %q, want one about txn-1", alerter.alerts)
+	}
+}
+
+func TestSTKCallbackDoesNotReopenResolvedTransaction(t *testing.T) {
+	tests := []struct {
+		name string
+		status stores.TransactionStatus
+		resultCode int
+	}{
+		{"late failure after settlement", stores.StatusSettled, 1032},
+		{"late failure while settling", stores.StatusSettling, 1032},
+		{"late success after failure", stores.StatusFailed, 0},
+		{"late success after expiry", stores.StatusExpired, 0},
+		{"late success in review", stores.StatusReview, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memTransactionStore{txns: []*stores.Transaction{
+				{ID: "txn-1", Type: "onramp", Status: tt.status, MpesaCheckoutID: "ws_CO_1", Phone: "254712345678", AmountKSH: decimal.NewFromInt(1000)},
+			}}
+			webhooks := &memWebhookStore{}
+			wh := NewWebhookHandler(webhooks, store, nil, nil, &alertRecorder{}, log.New(io.Discard, "", 0))
+
+			rec := postSTKCallback(wh, "ws_CO_1", tt.resultCode, 1000)
+			if rec.Code != http.StatusOK {
+				t.Errorf("status %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+			}
+			if got := store.txns[0].Status; got != tt.status {
+				t.Errorf("transaction is %s, want it left %s", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestSTKCallbackIsStoredAndDeduplicated(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	store := &memTransactionStore{txns: []*stores.Transaction{
+		{ID: "txn-1", Type: "onramp", Status: stores.StatusInitiated, MpesaCheckoutID: "ws_CO_1", Phone: "254712345678", AmountKSH: decimal.NewFromInt(1000)},
+	}}
+	webhooks := &memWebhookStore{}
+	settler := workers.NewSettler(store, nil, nil, assets.NewRegistry(), logger)
+	wh := NewWebhookHandler(webhooks, store, settler, nil, &alertRecorder{}, logger)
+
+	first := postSTKCallback(wh, "ws_CO_1", 0, 1000)
+	if first.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", first.Code, first.Body)
+	}
+	if got := store.txns[0].Status; got != stores.StatusConfirmed {
+		t.Fatalf("on-ramp is %s, want confirmed", got)
+	}
+	// the settler moves it on before Safaricom redelivers
+	store.txns[0].Status = stores.StatusSettled
+
+	second := postSTKCallback(wh, "ws_CO_1", 0, 1000)
+	if second.Code != http.StatusOK || !strings.Contains(second.Body.String(), "duplicate callback ignored") {
+		t.Errorf("redelivery got %d: %s, want 200 duplicate callback ignored", second.Code, second.Body)
+	}
+	if got := store.txns[0].Status; got != stores.StatusSettled {
+		t.Errorf("on-ramp is %s after the redelivery, want settled", got)
+	}
+
+	if len(webhooks.webhooks) != 2 {
+		t.Fatalf("stored %d webhooks, want 2", len(webhooks.webhooks))
+	}
+	original, duplicate := webhooks.webhooks[0], webhooks.webhooks[1]
+	if original.EventKey != "ws_CO_1" || original.TransactionID != "txn-1" || !original.Processed || original.StatusCode != http.StatusOK {
+		t.Errorf("first delivery stored as %+v, want processed for txn-1 with a 200", original)
+	}
+	if duplicate.DuplicateOf != original.ID || duplicate.TransactionID != "txn-1" {
+		t.Errorf("redelivery stored as duplicate of %q for %q, want %q for txn-1", duplicate.DuplicateOf, duplicate.TransactionID, original.ID)
+	}
+	if len(original.RawBody) == 0 || original.Payload == nil {
+		t.Error("raw body was not kept")
+	}
+}
+
+func TestUnparseableCallbackIsStored(t *testing.T) {
+	webhooks := &memWebhookStore{}
+	wh := NewWebhookHandler(webhooks, &memTransactionStore{}, nil, nil, &alertRecorder{}, log.New(io.Discard, "", 0))
+
+	body := `{"Body": {"stkCallback": {"ResultCode": 0`
+	rec := httptest.NewRecorder()
+	wh.HandleWebhook(rec, httptest.NewRequest(http.MethodPost, "/webhooks/mpesa", strings.NewReader(body)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if len(webhooks.webhooks) != 1 {
+		t.Fatalf("stored %d webhooks, want 1", len(webhooks.webhooks))
+	}
+	stored := webhooks.webhooks[0]
+	if string(stored.RawBody) != body || stored.Payload != nil || stored.Processed || stored.StatusCode != http.StatusBadRequest {
+		t.Errorf("stored %+v, want the raw body, unprocessed, with a 400", stored)
+	}
+}
@@ -2,16 +2,34 @@ package app
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
 	"github.com/joho/godotenv"
+	"github.com/nhx-finance/wallet/internal/alerts"
 	"github.com/nhx-finance/wallet/internal/api"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/middleware"
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/prices"
+	"github.com/nhx-finance/wallet/internal/pricing"
+	"github.com/nhx-finance/wallet/internal/pubsub"
+	"github.com/nhx-finance/wallet/internal/ratelimit"
+	"github.com/nhx-finance/wallet/internal/rates"
 	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/validate"
+	"github.com/nhx-finance/wallet/internal/workers"
 	"github.com/nhx-finance/wallet/migrations"
+	"github.com/shopspring/decimal"
+	"github.com/stripe/stripe-go/v83"
 )
 
 type Application struct {
@@ -20,6 +38,23 @@ type Application struct {
 	HieroClient *hiero.Client
 	TransactionHandler *api.TransactionHandler
 	WebhookHandler *api.WebhookHandler
+	QuoteHandler *api.QuoteHandler
+	MerchantWebhookHandler *api.MerchantWebhookHandler
+	APIKeyHandler *api.APIKeyHandler
+	ReviewHandler *api.ReviewHandler
+	// CheckoutHandler is nil when STRIPE_SECRET is not set.
+	CheckoutHandler *api.CheckoutHandler
+	Pricing *pricing.Engine
+	Idempotency *middleware.Idempotency
+	APIKeys *middleware.APIKeyAuth
+	RateLimit *middleware.RateLimit
+	RateLimiter *ratelimit.PostgresLimiter
+	Broker *pubsub.TransactionBroker
+	MpesaVerifier *middleware.MpesaVerifier
+	Settler *workers.Settler
+	OffRampWorker *workers.OffRampWorker
+	STKResolver *workers.STKResolver
+	WebhookDispatcher *workers.WebhookDispatcher
 }
 
 func loadEnvironmentVariables() {
@@ -36,20 +71,13 @@ func loadEnvironmentVariables() {
 
 func NewApplication() (*Application, error) {
 	loadEnvironmentVariables()
-	accountID, err := hiero.AccountIDFromString(os.Getenv("OPERATOR_ACCOUNT_ID"))
-	if err != nil {
-		panic(err)
-	}
+	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
 
-	privateKey, err := hiero.PrivateKeyFromStringEd25519(os.Getenv("OPERATOR_KEY"))
+	client, network, err := newHieroClientFromEnv()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-
-	client := hiero.ClientForTestnet()
-
-	client.SetOperator(accountID, privateKey)
-	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+	logger.Printf("Using Hedera %s as operator %s", network, client.GetOperatorAccountID())
 
 	pgDB, err := stores.Open()
 	if err != nil {
@@ -57,16 +85,204 @@ func NewApplication() (*Application, error) {
 	}
 	err = stores.MigrateFS(pgDB, migrations.FS, ".")
 	if err != nil {
-		panic(err)
+		pgDB.Close()
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
 	// stores
 	transactionStore := stores.NewPostgresTransactionStore(pgDB)
 	webhookStore := stores.NewPostgresWebhookStore(pgDB)
+	quoteStore := stores.NewPostgresQuoteStore(pgDB)
+	idempotencyStore := stores.NewPostgresIdempotencyStore(pgDB)
+	assetPriceStore := stores.NewPostgresAssetPriceStore(pgDB)
+	merchantWebhookStore := stores.NewPostgresMerchantWebhookStore(pgDB)
+	apiKeyStore := stores.NewPostgresAPIKeyStore(pgDB)
+	rateLimitStore := stores.NewPostgresRateLimitStore(pgDB)
+	cursorStore := stores.NewPostgresCursorStore(pgDB)
+	refundStore := stores.NewPostgresRefundStore(pgDB)
+
+	// clients
+	var alerter alerts.Alerter = alerts.NewLogAlerter(logger)
+	if os.Getenv("ALERT_WEBHOOK_URL") != "" {
+		alerter = alerts.NewHTTPAlerter(os.Getenv("ALERT_WEBHOOK_URL"), 10*time.Second, logger)
+	}
+
+	daraja, err := payments.NewDarajaClientFromEnv(utils.GetEnvDuration("DARAJA_HTTP_TIMEOUT", 30*time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	mirrorNodeURL := os.Getenv("MIRROR_NODE_URL")
+	if mirrorNodeURL == "" {
+		mirrorNodeURL = mirrorNodeURLs[network]
+	}
+	mirrorClient := mirror.NewClient(mirrorNodeURL, utils.GetEnvDuration("MIRROR_NODE_TIMEOUT", 10*time.Second))
+
+	var rateProvider rates.RateProvider
+	if os.Getenv("EXCHANGE_RATE_FIXED") != "" {
+		fixedRate, err := decimal.NewFromString(os.Getenv("EXCHANGE_RATE_FIXED"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid EXCHANGE_RATE_FIXED: %w", err)
+		}
+		rateProvider = rates.NewFixedRateProvider(fixedRate)
+	} else {
+		if os.Getenv("EXCHANGE_RATE_URL") == "" {
+			return nil, errors.New("EXCHANGE_RATE_URL is not set")
+		}
+		rateProvider = rates.NewCachedRateProvider(
+			rates.NewHTTPRateProvider(os.Getenv("EXCHANGE_RATE_URL"), 10*time.Second),
+			utils.GetEnvDuration("EXCHANGE_RATE_TTL", time.Minute),
+			utils.GetEnvDuration("EXCHANGE_RATE_MAX_AGE", 15*time.Minute),
+			logger,
+		)
+	}
+
+	pricingEngine, err := pricing.NewEngine(os.Getenv("FEE_SCHEDULE_PATH"), logger)
+	if err != nil {
+		return nil, fmt.Errorf("invalid FEE_SCHEDULE_PATH: %w", err)
+	}
+	if pricingEngine.Path == "" {
+		logger.Println("FEE_SCHEDULE_PATH is not set, charging no fees")
+	}
+	pricingEngine.Interval = utils.GetEnvDuration("FEE_SCHEDULE_RELOAD_INTERVAL", pricingEngine.Interval)
+
+	usdcTokenID, err := hiero.TokenIDFromString(os.Getenv("USDC_TOKEN_ID"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid USDC_TOKEN_ID: %w", err)
+	}
+	usdcDecimals := uint32(utils.GetEnvInt("USDC_TOKEN_DECIMALS", 6))
+
+	assetRegistry := assets.NewRegistry()
+	if os.Getenv("ASSET_REGISTRY_PATH") != "" {
+		assetRegistry, err = assets.LoadRegistry(os.Getenv("ASSET_REGISTRY_PATH"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ASSET_REGISTRY_PATH: %w", err)
+		}
+	} else {
+		logger.Println("ASSET_REGISTRY_PATH is not set, only USDC can be bought")
+	}
+	err = assetRegistry.Register(assets.Asset{Symbol: "USDC", TokenID: usdcTokenID, Decimals: usdcDecimals})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ASSET_REGISTRY_PATH: %w", err)
+	}
+
+	var priceSource prices.AssetPriceSource
+	if os.Getenv("ASSET_PRICES_URL") != "" {
+		market := prices.NSE()
+		for _, holiday := range strings.Split(os.Getenv("NSE_HOLIDAYS"), ",") {
+			holiday = strings.TrimSpace(holiday)
+			if holiday == "" {
+				continue
+			}
+			_, err := time.Parse(time.DateOnly, holiday)
+			if err != nil {
+				return nil, fmt.Errorf("invalid NSE_HOLIDAYS: %w", err)
+			}
+			market.Holidays[holiday] = true
+		}
+		priceSource = prices.NewCheckedPriceSource(
+			prices.NewPriceSource(os.Getenv("ASSET_PRICES_URL"), 10*time.Second),
+			market,
+			utils.GetEnvDuration("ASSET_PRICE_MAX_AGE", 30*time.Minute),
+			assetPriceStore,
+			logger,
+		)
+	} else if len(assetRegistry.Symbols()) > 1 {
+		return nil, errors.New("ASSET_PRICES_URL is not set but ASSET_REGISTRY_PATH lists assets")
+	}
+
+	// workers
+	settler := workers.NewSettler(transactionStore, client, mirrorClient, assetRegistry, logger)
+	settler.Interval = utils.GetEnvDuration("SETTLEMENT_INTERVAL", settler.Interval)
+	settler.MintBatch = utils.GetEnvInt("ASSET_MINT_BATCH", settler.MintBatch)
+
+	treasuryAccountID := client.GetOperatorAccountID()
+	if os.Getenv("TREASURY_ACCOUNT_ID") != "" {
+		treasuryAccountID, err = hiero.AccountIDFromString(os.Getenv("TREASURY_ACCOUNT_ID"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid TREASURY_ACCOUNT_ID: %w", err)
+		}
+	}
+	refunder := workers.NewRefunder(refundStore, alerter, logger)
+	offRampWorker := workers.NewOffRampWorker(transactionStore, cursorStore, daraja, mirrorClient, refunder, treasuryAccountID, usdcTokenID, usdcDecimals, logger)
+	offRampWorker.Interval = utils.GetEnvDuration("OFFRAMP_POLL_INTERVAL", offRampWorker.Interval)
+	offRampWorker.DepositWindow = utils.GetEnvDuration("OFFRAMP_DEPOSIT_WINDOW", offRampWorker.DepositWindow)
+	offRampWorker.MirrorLag = utils.GetEnvDuration("OFFRAMP_MIRROR_LAG", offRampWorker.MirrorLag)
+
+	stkResolver := workers.NewSTKResolver(transactionStore, daraja, settler, alerter, logger)
+	stkResolver.Interval = utils.GetEnvDuration("STK_RESOLVER_INTERVAL", stkResolver.Interval)
+	stkResolver.MinAge = utils.GetEnvDuration("STK_RESOLVER_MIN_AGE", stkResolver.MinAge)
+	stkResolver.Deadline = utils.GetEnvDuration("STK_RESOLVER_DEADLINE", stkResolver.Deadline)
+
+	webhookDispatcher := workers.NewWebhookDispatcher(merchantWebhookStore, utils.GetEnvDuration("WEBHOOK_DELIVERY_TIMEOUT", 10*time.Second), logger)
+	webhookDispatcher.Interval = utils.GetEnvDuration("WEBHOOK_DISPATCH_INTERVAL", webhookDispatcher.Interval)
+	webhookDispatcher.MaxAttempts = utils.GetEnvInt("WEBHOOK_MAX_ATTEMPTS", webhookDispatcher.MaxAttempts)
+
+	broker := pubsub.NewTransactionBroker(pgDB, logger)
 
 	// handlers
-	transactionHandler := api.NewTransactionHandler(transactionStore, client, logger)
-	webhookHandler := api.NewWebhookHandler(webhookStore, transactionStore, logger)
+	transactionHandler := api.NewTransactionHandler(transactionStore, quoteStore, client, mirrorClient, daraja, rateProvider, pricingEngine, assetRegistry, priceSource, broker, treasuryAccountID, usdcTokenID, logger)
+	quoteHandler := api.NewQuoteHandler(quoteStore, rateProvider, pricingEngine, assetRegistry, priceSource, utils.GetEnvDuration("QUOTE_TTL", 2*time.Minute), logger)
+	stkAmounts := validate.NewAmountRange(utils.GetEnvInt("MPESA_STK_MIN_AMOUNT", 1), utils.GetEnvInt("MPESA_STK_MAX_AMOUNT", 250000))
+	transactionHandler.STKAmounts = stkAmounts
+	transactionHandler.B2CAmounts = validate.NewAmountRange(utils.GetEnvInt("MPESA_B2C_MIN_AMOUNT", 10), utils.GetEnvInt("MPESA_B2C_MAX_AMOUNT", 250000))
+	quoteHandler.STKAmounts = stkAmounts
+	transactionHandler.DepositWindow = offRampWorker.DepositWindow
+	webhookHandler := api.NewWebhookHandler(webhookStore, transactionStore, settler, refunder, alerter, logger)
+	merchantWebhookHandler := api.NewMerchantWebhookHandler(merchantWebhookStore, logger)
+	apiKeyHandler := api.NewAPIKeyHandler(apiKeyStore, logger)
+	reviewHandler := api.NewReviewHandler(transactionStore, daraja, settler, logger)
+
+	var checkoutHandler *api.CheckoutHandler
+	if os.Getenv("STRIPE_SECRET") != "" {
+		if os.Getenv("STRIPE_WEBHOOK_SECRET") == "" {
+			return nil, errors.New("STRIPE_WEBHOOK_SECRET is not set")
+		}
+		stripeHandler := payments.NewStripeHandler(stripe.NewClient(os.Getenv("STRIPE_SECRET")), rateProvider, priceSource)
+		checkoutHandler = api.NewCheckoutHandler(stripeHandler, client, mirrorClient, assetRegistry, transactionStore, webhookStore, apiKeyStore, os.Getenv("STRIPE_WEBHOOK_SECRET"), settler, alerter, logger)
+	} else {
+		logger.Println("STRIPE_SECRET is not set, card checkout is disabled")
+	}
+
+	// middleware
+	idempotency := middleware.NewIdempotency(idempotencyStore, logger)
+	idempotency.Wait = utils.GetEnvDuration("IDEMPOTENCY_WAIT", idempotency.Wait)
+	idempotency.Retention = utils.GetEnvDuration("IDEMPOTENCY_RETENTION", idempotency.Retention)
+
+	apiKeys := middleware.NewAPIKeyAuth(apiKeyStore, logger)
+
+	mpesaVerifier := middleware.NewMpesaVerifier(transactionStore, webhookStore, daraja, alerter, logger)
+	mpesaVerifier.AllowedNetworks, err = middleware.ParseNetworks(os.Getenv("MPESA_ALLOWED_IPS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid MPESA_ALLOWED_IPS: %w", err)
+	}
+	if len(mpesaVerifier.AllowedNetworks) == 0 {
+		logger.Println("MPESA_ALLOWED_IPS is not set, accepting M-Pesa callbacks from any address")
+	}
+	mpesaVerifier.TrustedProxies, err = middleware.ParseNetworks(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %w", err)
+	}
+	mpesaVerifier.CrossCheck = os.Getenv("MPESA_CROSS_CHECK") != "false"
+
+	rateLimiter := ratelimit.NewPostgresLimiter(rateLimitStore, logger)
+	rateLimit := middleware.NewRateLimit(rateLimiter, logger)
+	rateLimit.TrustedProxies = mpesaVerifier.TrustedProxies
+	rateLimit.IdempotencyStore = idempotencyStore
+	for env, limit := range map[string]*ratelimit.Limit{
+		"RATE_LIMIT_IP": &rateLimit.PerIP,
+		"RATE_LIMIT_PHONE": &rateLimit.PerPhone,
+		"RATE_LIMIT_ACCOUNT": &rateLimit.PerAccount,
+	} {
+		if os.Getenv(env) == "" {
+			continue
+		}
+		*limit, err = ratelimit.ParseLimit(os.Getenv(env))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", env, err)
+		}
+		rateLimiter.Retention = max(rateLimiter.Retention, limit.Per)
+	}
 
 	app := &Application{
 		Logger: logger,
@@ -74,11 +290,49 @@ func NewApplication() (*Application, error) {
 		DB: pgDB,
 		TransactionHandler: transactionHandler,
 		WebhookHandler: webhookHandler,
+		QuoteHandler: quoteHandler,
+		MerchantWebhookHandler: merchantWebhookHandler,
+		APIKeyHandler: apiKeyHandler,
+		ReviewHandler: reviewHandler,
+		CheckoutHandler: checkoutHandler,
+		Pricing: pricingEngine,
+		Idempotency: idempotency,
+		APIKeys: apiKeys,
+		RateLimit: rateLimit,
+		RateLimiter: rateLimiter,
+		Broker: broker,
+		MpesaVerifier: mpesaVerifier,
+		Settler: settler,
+		OffRampWorker: offRampWorker,
+		STKResolver: stkResolver,
+		WebhookDispatcher: webhookDispatcher,
 	}
 
 	return app, nil
 }
 
+// CreateAPIKey issues a key from the command line, which is how the first
+// keys:manage key is made.
+func (app *Application) CreateAPIKey(name string, scopes []string) (*stores.APIKey, string, error) {
+	if name == "" {
+		return nil, "", errors.New("API key name is required")
+	}
+	for _, scope := range scopes {
+		if !stores.ValidScope(scope) {
+			return nil, "", fmt.Errorf("invalid scope %q, expected one of %s", scope, strings.Join(stores.Scopes, ", "))
+		}
+	}
+	newKey, key, err := middleware.NewAPIKey(name, scopes, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	apiKey, err := app.APIKeys.Store.CreateAPIKey(newKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return apiKey, key, nil
+}
+
 func (app *Application) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("OK"))
@@ -0,0 +1,122 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+)
+
+const (
+	NetworkTestnet = "testnet"
+	NetworkPreviewnet = "previewnet"
+	NetworkMainnet = "mainnet"
+	// NetworkLocal is a local node, e.g. a Hiero Solo network, whose address
+	// book comes from HEDERA_NODES.
+	NetworkLocal = "local"
+)
+
+// mirrorNodeURLs are the default mirror node REST base URLs per network.
+var mirrorNodeURLs = map[string]string{
+	NetworkTestnet: "https://testnet.mirrornode.hedera.com",
+	NetworkPreviewnet: "https://previewnet.mirrornode.hedera.com",
+	NetworkMainnet: "https://mainnet-public.mirrornode.hedera.com",
+	NetworkLocal: "http://localhost:5551",
+}
+
+// newHieroClientFromEnv builds the Hedera client for HEDERA_NETWORK with the
+// operator and limits from the environment, and returns it with the network
+// name.
+func newHieroClientFromEnv() (*hiero.Client, string, error) {
+	network := os.Getenv("HEDERA_NETWORK")
+	if network == "" {
+		network = NetworkTestnet
+	}
+
+	var client *hiero.Client
+	switch network {
+	case NetworkTestnet:
+		client = hiero.ClientForTestnet()
+	case NetworkPreviewnet:
+		client = hiero.ClientForPreviewnet()
+	case NetworkMainnet:
+		client = hiero.ClientForMainnet()
+	case NetworkLocal:
+		nodes, err := parseNodes(os.Getenv("HEDERA_NODES"))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid HEDERA_NODES: %w", err)
+		}
+		client, err = hiero.ClientForNetworkV2(nodes)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid HEDERA_NODES: %w", err)
+		}
+	default:
+		return nil, "", fmt.Errorf("invalid HEDERA_NETWORK %q, expected testnet, previewnet, mainnet or local", network)
+	}
+
+	accountID, err := hiero.AccountIDFromString(os.Getenv("OPERATOR_ACCOUNT_ID"))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid OPERATOR_ACCOUNT_ID: %w", err)
+	}
+	privateKey, err := hiero.PrivateKeyFromStringEd25519(os.Getenv("OPERATOR_KEY"))
+	if err != nil {
+		// the key itself must never end up in the logs
+		return nil, "", errors.New("invalid OPERATOR_KEY: not an Ed25519 private key")
+	}
+	client.SetOperator(accountID, privateKey)
+
+	for env, set := range map[string]func(hiero.Hbar) error{
+		"HEDERA_MAX_TRANSACTION_FEE": client.SetDefaultMaxTransactionFee,
+		"HEDERA_MAX_QUERY_PAYMENT": client.SetDefaultMaxQueryPayment,
+	} {
+		if os.Getenv(env) == "" {
+			continue
+		}
+		amount, err := hiero.HbarFromString(os.Getenv(env))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid %s: %w", env, err)
+		}
+		err = set(amount)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid %s: %w", env, err)
+		}
+	}
+
+	if os.Getenv("HEDERA_REQUEST_TIMEOUT") != "" {
+		timeout, err := time.ParseDuration(os.Getenv("HEDERA_REQUEST_TIMEOUT"))
+		if err != nil || timeout <= 0 {
+			return nil, "", fmt.Errorf("invalid HEDERA_REQUEST_TIMEOUT %q", os.Getenv("HEDERA_REQUEST_TIMEOUT"))
+		}
+		client.SetRequestTimeout(&timeout)
+	}
+
+	return client, network, nil
+}
+
+// parseNodes parses an address book such as
+// "127.0.0.1:50211=0.0.3,127.0.0.1:51211=0.0.4".
+func parseNodes(s string) (map[string]hiero.AccountID, error) {
+	nodes := make(map[string]hiero.AccountID)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		address, id, ok := strings.Cut(entry, "=")
+		if !ok || address == "" {
+			return nil, fmt.Errorf("%q is not address=account", entry)
+		}
+		accountID, err := hiero.AccountIDFromString(strings.TrimSpace(id))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", entry, err)
+		}
+		nodes[strings.TrimSpace(address)] = accountID
+	}
+	if len(nodes) == 0 {
+		return nil, errors.New("no nodes listed")
+	}
+	return nodes, nil
+}
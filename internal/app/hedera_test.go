@@ -0,0 +1,154 @@
+package app
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+)
+
+// setOperator sets a valid operator and returns its key.
+func setOperator(t *testing.T) string {
+	privateKey, err := hiero.PrivateKeyGenerateEd25519()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OPERATOR_ACCOUNT_ID", "0.0.1234")
+	t.Setenv("OPERATOR_KEY", privateKey.String())
+	for _, env := range []string{"HEDERA_NETWORK", "HEDERA_NODES", "HEDERA_MAX_TRANSACTION_FEE", "HEDERA_MAX_QUERY_PAYMENT", "HEDERA_REQUEST_TIMEOUT"} {
+		t.Setenv(env, "")
+	}
+	return privateKey.String()
+}
+
+func newTestHieroClient(t *testing.T) (*hiero.Client, string, error) {
+	client, network, err := newHieroClientFromEnv()
+	if client != nil {
+		t.Cleanup(func() { client.Close() })
+	}
+	return client, network, err
+}
+
+func TestHieroClientNetworks(t *testing.T) {
+	tests := []struct {
+		env string
+		want string
+		ledger string
+	}{
+		{"", NetworkTestnet, "testnet"},
+		{NetworkTestnet, NetworkTestnet, "testnet"},
+		{NetworkPreviewnet, NetworkPreviewnet, "previewnet"},
+		{NetworkMainnet, NetworkMainnet, "mainnet"},
+	}
+	for _, tt := range tests {
+		t.Run("network "+tt.env, func(t *testing.T) {
+			setOperator(t)
+			t.Setenv("HEDERA_NETWORK", tt.env)
+
+			client, network, err := newTestHieroClient(t)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if network != tt.want {
+				t.Errorf("network %q, want %q", network, tt.want)
+			}
+			if ledger := client.GetLedgerID(); ledger == nil || ledger.String() != tt.ledger {
+				t.Errorf("ledger %v, want %s", ledger, tt.ledger)
+			}
+			if client.GetOperatorAccountID().String() != "0.0.1234" {
+				t.Errorf("operator %s, want 0.0.1234", client.GetOperatorAccountID())
+			}
+			if mirrorNodeURLs[network] == "" {
+				t.Errorf("no default mirror node for %s", network)
+			}
+		})
+	}
+}
+
+func TestHieroClientLocalNetwork(t *testing.T) {
+	setOperator(t)
+	t.Setenv("HEDERA_NETWORK", NetworkLocal)
+	t.Setenv("HEDERA_NODES", "127.0.0.1:50211=0.0.3, 127.0.0.1:51211=0.0.4")
+
+	client, network, err := newTestHieroClient(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if network != NetworkLocal {
+		t.Errorf("network %q, want %q", network, NetworkLocal)
+	}
+	nodes := client.GetNetwork()
+	if len(nodes) != 2 || nodes["127.0.0.1:50211"].String() != "0.0.3" || nodes["127.0.0.1:51211"].String() != "0.0.4" {
+		t.Errorf("nodes %v", nodes)
+	}
+	if mirrorNodeURLs[NetworkLocal] != "http://localhost:5551" {
+		t.Errorf("local mirror node %q", mirrorNodeURLs[NetworkLocal])
+	}
+}
+
+func TestHieroClientLimits(t *testing.T) {
+	setOperator(t)
+	t.Setenv("HEDERA_MAX_TRANSACTION_FEE", "5")
+	t.Setenv("HEDERA_MAX_QUERY_PAYMENT", "0.5")
+	t.Setenv("HEDERA_REQUEST_TIMEOUT", "45s")
+
+	client, _, err := newTestHieroClient(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := client.GetDefaultMaxTransactionFee(); got.AsTinybar() != hiero.NewHbar(5).AsTinybar() {
+		t.Errorf("max transaction fee %s, want 5 ℏ", got)
+	}
+	if got := client.GetDefaultMaxQueryPayment(); got.AsTinybar() != hiero.NewHbar(0.5).AsTinybar() {
+		t.Errorf("max query payment %s, want 0.5 ℏ", got)
+	}
+	if got := client.GetRequestTimeout(); got == nil || *got != 45*time.Second {
+		t.Errorf("request timeout %v, want 45s", got)
+	}
+}
+
+func TestHieroClientInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		env map[string]string
+		want string
+	}{
+		{"unknown network", map[string]string{"HEDERA_NETWORK": "devnet"}, "HEDERA_NETWORK"},
+		{"local without nodes", map[string]string{"HEDERA_NETWORK": NetworkLocal}, "HEDERA_NODES"},
+		{"local node without account", map[string]string{"HEDERA_NETWORK": NetworkLocal, "HEDERA_NODES": "127.0.0.1:50211"}, "HEDERA_NODES"},
+		{"local node with a bad account", map[string]string{"HEDERA_NETWORK": NetworkLocal, "HEDERA_NODES": "127.0.0.1:50211=node3"}, "HEDERA_NODES"},
+		{"operator account", map[string]string{"OPERATOR_ACCOUNT_ID": "1234"}, "OPERATOR_ACCOUNT_ID"},
+		{"transaction fee", map[string]string{"HEDERA_MAX_TRANSACTION_FEE": "lots"}, "HEDERA_MAX_TRANSACTION_FEE"},
+		{"query payment", map[string]string{"HEDERA_MAX_QUERY_PAYMENT": "-1"}, "HEDERA_MAX_QUERY_PAYMENT"},
+		{"timeout", map[string]string{"HEDERA_REQUEST_TIMEOUT": "30"}, "HEDERA_REQUEST_TIMEOUT"},
+		{"negative timeout", map[string]string{"HEDERA_REQUEST_TIMEOUT": "-5s"}, "HEDERA_REQUEST_TIMEOUT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setOperator(t)
+			for env, value := range tt.env {
+				t.Setenv(env, value)
+			}
+
+			_, _, err := newTestHieroClient(t)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got %v, want an error about %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHieroClientDoesNotLogOperatorKey(t *testing.T) {
+	key := setOperator(t)
+	// an ECDSA key, or any other mistake, must not be echoed back
+	t.Setenv("OPERATOR_KEY", key+"ff")
+
+	_, _, err := newTestHieroClient(t)
+	if err == nil || !strings.Contains(err.Error(), "OPERATOR_KEY") {
+		t.Fatalf("got %v, want an error about OPERATOR_KEY", err)
+	}
+	if strings.Contains(err.Error(), key) {
+		t.Error("error includes the operator key")
+	}
+}
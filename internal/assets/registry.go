@@ -0,0 +1,107 @@
+package assets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+)
+
+// ErrUnknownAsset means the symbol is not in the registry.
+var ErrUnknownAsset = errors.New("unknown asset")
+
+// Asset is a token we can deliver. Deliveries are transfers from the operator
+// account, so the operator must hold the supply. If Mint is set the operator
+// also holds the token's supply key and is its treasury, and the settler mints
+// more whenever a delivery fails for lack of balance.
+type Asset struct {
+	Symbol string
+	TokenID hiero.TokenID
+	Decimals uint32
+	Mint bool
+}
+
+type assetConfig struct {
+	Symbol string `json:"symbol"`
+	TokenID string `json:"token_id"`
+	Decimals uint32 `json:"decimals"`
+	Mint bool `json:"mint"`
+}
+
+// Registry maps asset symbols, e.g. "SCOM", to their Hedera tokens.
+type Registry struct {
+	assets map[string]Asset
+}
+
+func NewRegistry() *Registry {
+	return &Registry{assets: map[string]Asset{}}
+}
+
+func (r *Registry) Register(asset Asset) error {
+	asset.Symbol = strings.ToUpper(asset.Symbol)
+	if asset.Symbol == "" {
+		return errors.New("asset is missing a symbol")
+	}
+	if _, ok := r.assets[asset.Symbol]; ok {
+		return fmt.Errorf("asset %s is registered twice", asset.Symbol)
+	}
+	r.assets[asset.Symbol] = asset
+	return nil
+}
+
+func (r *Registry) Get(symbol string) (Asset, error) {
+	asset, ok := r.assets[strings.ToUpper(symbol)]
+	if !ok {
+		return Asset{}, fmt.Errorf("%w: %s", ErrUnknownAsset, symbol)
+	}
+	return asset, nil
+}
+
+// Symbols lists the registered assets in alphabetical order.
+func (r *Registry) Symbols() []string {
+	symbols := make([]string, 0, len(r.assets))
+	for symbol := range r.assets {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// LoadRegistry reads a registry from a JSON file of the form
+// {"assets": [{"symbol": "SCOM", "token_id": "0.0.1234", "decimals": 0, "mint": true}]}.
+func LoadRegistry(path string) (*Registry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Assets []assetConfig `json:"assets"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse asset registry: %w", err)
+	}
+
+	registry := NewRegistry()
+	for _, config := range file.Assets {
+		tokenID, err := hiero.TokenIDFromString(config.TokenID)
+		if err != nil {
+			return nil, fmt.Errorf("asset %s has invalid token_id %q: %w", config.Symbol, config.TokenID, err)
+		}
+		err = registry.Register(Asset{
+			Symbol: config.Symbol,
+			TokenID: tokenID,
+			Decimals: config.Decimals,
+			Mint: config.Mint,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return registry, nil
+}
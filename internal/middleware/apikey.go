@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+)
+
+const (
+	APIKeyHeader = "X-API-Key"
+	// apiKeyQueryParam carries the key for EventSource clients, which cannot
+	// set headers.
+	apiKeyQueryParam = "api_key"
+	apiKeyPrefix = "nhx_"
+)
+
+type apiKeyContextKey struct{}
+
+// APIKeyAuth authenticates requests with an API key, sent as
+// "Authorization: Bearer <key>" or in the X-API-Key header. A key is
+// nhx_<prefix>_<secret>; the prefix finds the stored key and the whole key
+// must match its hash.
+type APIKeyAuth struct {
+	Store stores.APIKeyStore
+	Logger *log.Logger
+}
+
+func NewAPIKeyAuth(store stores.APIKeyStore, logger *log.Logger) *APIKeyAuth {
+	return &APIKeyAuth{
+		Store: store,
+		Logger: logger,
+	}
+}
+
+// NewAPIKey generates a key and returns it with the record to store for it,
+// which holds only the key's hash. The key cannot be recovered later.
+func NewAPIKey(name string, scopes []string, expiresAt *time.Time) (stores.APIKey, string, error) {
+	buf := make([]byte, 36)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return stores.APIKey{}, "", err
+	}
+	prefix := hex.EncodeToString(buf[:4])
+	key := apiKeyPrefix + prefix + "_" + hex.EncodeToString(buf[4:])
+	return stores.APIKey{
+		Name: name,
+		Prefix: prefix,
+		KeyHash: utils.HashToken(key),
+		Scopes: scopes,
+		ExpiresAt: expiresAt,
+	}, key, nil
+}
+
+// parseAPIKeyPrefix returns the prefix of a well-formed key.
+func parseAPIKeyPrefix(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	if !ok || prefix == "" || secret == "" {
+		return "", false
+	}
+	return prefix, true
+}
+
+// Require allows only requests whose key has scope.
+func (a *APIKeyAuth) Require(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return a.require(scope, false, next)
+	}
+}
+
+// RequireForStream is Require that also accepts the key in the api_key
+// query parameter, for server-sent event streams.
+func (a *APIKeyAuth) RequireForStream(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return a.require(scope, true, next)
+	}
+}
+
+func (a *APIKeyAuth) require(scope string, allowQuery bool, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := requestAPIKey(r, allowQuery)
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "API key required"})
+			return
+		}
+
+		apiKey, err := a.authenticate(key)
+		if errors.Is(err, errInvalidAPIKey) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid API key"})
+			return
+		}
+		if err != nil {
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to check API key"})
+			a.Logger.Printf("failed to check API key: %v", err)
+			return
+		}
+		if !apiKey.HasScope(scope) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "API key lacks scope " + scope})
+			return
+		}
+
+		err = a.Store.TouchAPIKey(apiKey.ID)
+		if err != nil {
+			a.Logger.Printf("failed to record use of API key %s: %v", apiKey.ID, err)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, apiKey)))
+	})
+}
+
+var errInvalidAPIKey = errors.New("invalid API key")
+
+// authenticate returns the active key matching key, or errInvalidAPIKey.
+func (a *APIKeyAuth) authenticate(key string) (*stores.APIKey, error) {
+	prefix, ok := parseAPIKeyPrefix(key)
+	if !ok {
+		return nil, errInvalidAPIKey
+	}
+	apiKey, err := a.Store.GetAPIKeyByPrefix(prefix)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(utils.HashToken(key)), []byte(apiKey.KeyHash)) != 1 {
+		return nil, errInvalidAPIKey
+	}
+	if !apiKey.Active(time.Now()) {
+		return nil, errInvalidAPIKey
+	}
+	return apiKey, nil
+}
+
+func requestAPIKey(r *http.Request, allowQuery bool) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		return key
+	}
+	if allowQuery {
+		return r.URL.Query().Get(apiKeyQueryParam)
+	}
+	return ""
+}
+
+// APIKeyFromContext returns the key that authenticated the request, or nil.
+func APIKeyFromContext(ctx context.Context) *stores.APIKey {
+	apiKey, _ := ctx.Value(apiKeyContextKey{}).(*stores.APIKey)
+	return apiKey
+}
+
+// APIKeyID returns the ID of the key that authenticated the request, or "".
+func APIKeyID(ctx context.Context) string {
+	apiKey := APIKeyFromContext(ctx)
+	if apiKey == nil {
+		return ""
+	}
+	return apiKey.ID
+}
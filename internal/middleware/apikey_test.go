@@ -0,0 +1,151 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	apiKey, key, err := NewAPIKey("partner-a", []string{stores.ScopeQuotesWrite}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, ok := parseAPIKeyPrefix(key)
+	if !ok || prefix != apiKey.Prefix {
+		t.Errorf("key %q has prefix %q, record has %q", key, prefix, apiKey.Prefix)
+	}
+	if apiKey.KeyHash != utils.HashToken(key) {
+		t.Error("record does not hold the key's hash")
+	}
+
+	_, other, err := NewAPIKey("partner-a", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == key {
+		t.Error("two keys are the same")
+	}
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+
+	newKey := func(id string, scopes []string, expiresAt *time.Time, revokedAt *time.Time) (stores.APIKey, string) {
+		apiKey, key, err := NewAPIKey(id, scopes, expiresAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		apiKey.ID = id
+		apiKey.RevokedAt = revokedAt
+		return apiKey, key
+	}
+	active, activeSecret := newKey("active", []string{stores.ScopeTransactionsRead}, nil, nil)
+	expiring, expiringSecret := newKey("expiring", []string{stores.ScopeTransactionsRead}, &future, nil)
+	expired, expiredSecret := newKey("expired", []string{stores.ScopeTransactionsRead}, &past, nil)
+	revoked, revokedSecret := newKey("revoked", []string{stores.ScopeTransactionsRead}, nil, &past)
+	unscoped, unscopedSecret := newKey("unscoped", []string{stores.ScopeQuotesWrite}, nil, nil)
+	// right prefix, wrong secret
+	forged := activeSecret[:len(activeSecret)-1] + "0"
+	if forged == activeSecret {
+		forged = activeSecret[:len(activeSecret)-1] + "1"
+	}
+
+	tests := []struct {
+		name string
+		stream bool
+		header string
+		value string
+		query string
+		wantCode int
+		wantKey string
+	}{
+		{"bearer", false, "Authorization", "Bearer " + activeSecret, "", http.StatusOK, "active"},
+		{"X-API-Key", false, APIKeyHeader, activeSecret, "", http.StatusOK, "active"},
+		{"not yet expired", false, APIKeyHeader, expiringSecret, "", http.StatusOK, "expiring"},
+		{"missing", false, "", "", "", http.StatusUnauthorized, ""},
+		{"other auth scheme", false, "Authorization", "Basic " + activeSecret, "", http.StatusUnauthorized, ""},
+		{"malformed", false, APIKeyHeader, "nhx_nounderscore", "", http.StatusUnauthorized, ""},
+		{"unknown prefix", false, APIKeyHeader, "nhx_00000000_abcdef", "", http.StatusUnauthorized, ""},
+		{"wrong secret", false, APIKeyHeader, forged, "", http.StatusUnauthorized, ""},
+		{"expired", false, APIKeyHeader, expiredSecret, "", http.StatusUnauthorized, ""},
+		{"revoked", false, APIKeyHeader, revokedSecret, "", http.StatusUnauthorized, ""},
+		{"lacks scope", false, APIKeyHeader, unscopedSecret, "", http.StatusForbidden, ""},
+		{"query parameter outside streams", false, "", "", activeSecret, http.StatusUnauthorized, ""},
+		{"query parameter on a stream", true, "", "", activeSecret, http.StatusOK, "active"},
+		{"header on a stream", true, APIKeyHeader, activeSecret, "", http.StatusOK, "active"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memAPIKeyStore{keys: []stores.APIKey{active, expiring, expired, revoked, unscoped}}
+			auth := NewAPIKeyAuth(store, log.New(io.Discard, "", 0))
+			require := auth.Require
+			if tt.stream {
+				require = auth.RequireForStream
+			}
+
+			var got string
+			handler := require(stores.ScopeTransactionsRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = APIKeyID(r.Context())
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			target := "/transactions"
+			if tt.query != "" {
+				target += "?api_key=" + tt.query
+			}
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if got != tt.wantKey {
+				t.Errorf("handler saw key %q, want %q", got, tt.wantKey)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Error("401 without WWW-Authenticate")
+			}
+			if tt.wantKey != "" && (len(store.touched) != 1 || store.touched[0] != tt.wantKey) {
+				t.Errorf("touched %v, want %s", store.touched, tt.wantKey)
+			}
+			if tt.wantKey == "" && len(store.touched) != 0 {
+				t.Errorf("touched %v on a rejected request", store.touched)
+			}
+		})
+	}
+}
+
+func TestAPIKeyAuthStoreFailure(t *testing.T) {
+	auth := NewAPIKeyAuth(&memAPIKeyStore{err: errors.New("connection refused")}, log.New(io.Discard, "", 0))
+	handler := auth.Require(stores.ScopeTransactionsRead)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler reached")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/transactions", nil)
+	req.Header.Set(APIKeyHeader, "nhx_0a1b2c3d_abcdef")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestAPIKeyFromContextWithoutKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	if APIKeyFromContext(req.Context()) != nil || APIKeyID(req.Context()) != "" {
+		t.Error("unauthenticated request has an API key")
+	}
+}
@@ -0,0 +1,176 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+// memIdempotencyStore is an IdempotencyStore backed by a map. Methods the
+// tests do not use panic.
+type memIdempotencyStore struct {
+	stores.IdempotencyStore
+	mu sync.Mutex
+	keys map[string]*stores.IdempotencyKey
+}
+
+func newMemIdempotencyStore() *memIdempotencyStore {
+	return &memIdempotencyStore{keys: make(map[string]*stores.IdempotencyKey)}
+}
+
+func (m *memIdempotencyStore) ClaimIdempotencyKey(scope string, key string, requestHash string) (*stores.IdempotencyKey, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.keys[scope+" "+key]; ok {
+		found := *existing
+		return &found, false, nil
+	}
+	m.keys[scope+" "+key] = &stores.IdempotencyKey{Scope: scope, Key: key, RequestHash: requestHash, Status: "processing"}
+	return nil, true, nil
+}
+
+func (m *memIdempotencyStore) GetIdempotencyKey(scope string, key string) (*stores.IdempotencyKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if existing, ok := m.keys[scope+" "+key]; ok {
+		found := *existing
+		return &found, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memIdempotencyStore) CompleteIdempotencyKey(scope string, key string, responseStatus int, responseBody []byte, contentType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ik := m.keys[scope+" "+key]
+	ik.Status = "completed"
+	ik.ResponseStatus = responseStatus
+	ik.ResponseBody = responseBody
+	ik.ContentType = contentType
+	return nil
+}
+
+func (m *memIdempotencyStore) DeleteIdempotencyKey(scope string, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.keys, scope+" "+key)
+	return nil
+}
+
+// memTransactionStore finds transactions by ID and checkout request. Methods
+// the tests do not use panic.
+type memTransactionStore struct {
+	stores.TransactionStore
+	txns []stores.Transaction
+}
+
+func (m *memTransactionStore) GetTransactionByID(id string) (*stores.Transaction, error) {
+	for _, txn := range m.txns {
+		if txn.ID == id {
+			return &txn, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memTransactionStore) GetTransactionByMpesaCheckoutID(checkoutID string) (*stores.Transaction, error) {
+	for _, txn := range m.txns {
+		if txn.MpesaCheckoutID == checkoutID {
+			return &txn, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+// memWebhookStore keeps the webhooks the verifier rejects.
+type memWebhookStore struct {
+	stores.WebhookStore
+	webhooks []stores.Webhook
+}
+
+func (m *memWebhookStore) CreateWebhook(webhook stores.Webhook) (*stores.Webhook, error) {
+	webhook.ID = "webhook-" + strconv.Itoa(len(m.webhooks)+1)
+	m.webhooks = append(m.webhooks, webhook)
+	return &webhook, nil
+}
+
+type alertRecorder struct {
+	mu sync.Mutex
+	alerts []string
+}
+
+func (ar *alertRecorder) Alert(ctx context.Context, message string) {
+	ar.mu.Lock()
+	defer ar.mu.Unlock()
+	ar.alerts = append(ar.alerts, message)
+}
+
+// fakeSTKQuery answers Daraja's OAuth and STK query endpoints with query and
+// points the STK environment at itself for the test. An empty query answers
+// the way Daraja does when the request fails.
+type fakeSTKQuery struct {
+	*httptest.Server
+	query payments.STKQueryResponse
+	calls int
+}
+
+func newFakeSTKQuery(t *testing.T, query payments.STKQueryResponse) *fakeSTKQuery {
+	fq := &fakeSTKQuery{query: query}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /oauth", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(payments.AuthorizationResponse{AccessToken: "token", ExpiresIn: "3599"})
+	})
+	mux.HandleFunc("POST /stkquery", func(w http.ResponseWriter, r *http.Request) {
+		fq.calls++
+		if fq.query == (payments.STKQueryResponse{}) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		json.NewEncoder(w).Encode(fq.query)
+	})
+	fq.Server = httptest.NewServer(mux)
+	t.Cleanup(fq.Close)
+
+	t.Setenv("STK_QUERY_URL", fq.URL+"/stkquery")
+	t.Setenv("BUSINESS_SHORT_CODE", "174379")
+	t.Setenv("PASS_KEY", "passkey")
+	return fq
+}
+
+func (fq *fakeSTKQuery) Client() *payments.DarajaClient {
+	return payments.NewDarajaClient(fq.URL+"/oauth", "key", "secret", 5*time.Second)
+}
+
+// memAPIKeyStore finds keys by prefix and records which were used. Methods
+// the tests do not use panic.
+type memAPIKeyStore struct {
+	stores.APIKeyStore
+	keys []stores.APIKey
+	err error
+	touched []string
+}
+
+func (m *memAPIKeyStore) GetAPIKeyByPrefix(prefix string) (*stores.APIKey, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	for _, key := range m.keys {
+		if key.Prefix == prefix {
+			return &key, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *memAPIKeyStore) TouchAPIKey(id string) error {
+	m.touched = append(m.touched, id)
+	return nil
+}
@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength = 255
+	maxIdempotentBodySize = 1 << 20
+)
+
+// Idempotency makes a POST safe to retry when the client sends an
+// Idempotency-Key header. The first response for a key is stored and replayed
+// for retries with the same body; a retry that arrives while the first request
+// is still running waits for it to finish. Requests without the header pass
+// straight through.
+//
+// Only the response of a request that called MarkSideEffect is stored. Any
+// other request, e.g. one refused with a 503 because the exchange rate was
+// stale, gives its key up again so that a retry runs afresh.
+type Idempotency struct {
+	Store stores.IdempotencyStore
+	// Wait is how long a concurrent duplicate blocks before giving up with 409.
+	// It should stay under the server's WriteTimeout.
+	Wait time.Duration
+	PollInterval time.Duration
+	// Retention is how long keys are kept before Run deletes them.
+	Retention time.Duration
+	Logger *log.Logger
+}
+
+func NewIdempotency(store stores.IdempotencyStore, logger *log.Logger) *Idempotency {
+	return &Idempotency{
+		Store: store,
+		Wait: 20 * time.Second,
+		PollInterval: 250 * time.Millisecond,
+		Retention: 24 * time.Hour,
+		Logger: logger,
+	}
+}
+
+func (id *Idempotency) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "Idempotency-Key must be at most 255 characters"})
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.Sum256(body)
+		requestHash := hex.EncodeToString(sum[:])
+		scope := idempotencyScope(r)
+
+		existing, claimed, err := id.Store.ClaimIdempotencyKey(scope, key, requestHash)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to check idempotency key"})
+			id.Logger.Printf("failed to claim idempotency key %q for %s: %v", key, scope, err)
+			return
+		}
+
+		if claimed {
+			id.serveAndStore(w, r, next, scope, key)
+			return
+		}
+
+		if existing.RequestHash != requestHash {
+			utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "Idempotency-Key was already used with a different request body"})
+			return
+		}
+
+		if existing.Status != "completed" {
+			existing, err = id.waitForCompletion(r.Context(), scope, key)
+			if errors.Is(err, sql.ErrNoRows) {
+				utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "the request with this Idempotency-Key did not complete, retry it"})
+				return
+			}
+			if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+				utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "a request with this Idempotency-Key is still in progress"})
+				return
+			}
+			if err != nil {
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to check idempotency key"})
+				id.Logger.Printf("failed to wait on idempotency key %q for %s: %v", key, scope, err)
+				return
+			}
+		}
+
+		replay(w, existing)
+	})
+}
+
+type sideEffectContextKey struct{}
+
+// MarkSideEffect records that the request has done something a retry must not
+// do again, such as sending an STK push or creating a transaction, so that its
+// response is kept for its Idempotency-Key whatever the status.
+func MarkSideEffect(ctx context.Context) {
+	if marked, ok := ctx.Value(sideEffectContextKey{}).(*atomic.Bool); ok {
+		marked.Store(true)
+	}
+}
+
+// idempotencyScope is what an Idempotency-Key is unique within. Keys are per
+// client: two API keys may use the same Idempotency-Key.
+func idempotencyScope(r *http.Request) string {
+	scope := r.Method + " " + r.URL.Path
+	if apiKeyID := APIKeyID(r.Context()); apiKeyID != "" {
+		scope = apiKeyID + " " + scope
+	}
+	return scope
+}
+
+// serveAndStore runs the handler and records its response against the key if
+// the handler marked a side effect. Otherwise, or if the handler panics, the
+// key is released so the client can retry.
+func (id *Idempotency) serveAndStore(w http.ResponseWriter, r *http.Request, next http.Handler, scope string, key string) {
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	marked := &atomic.Bool{}
+
+	defer func() {
+		if p := recover(); p != nil {
+			id.release(scope, key)
+			panic(p)
+		}
+	}()
+
+	next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), sideEffectContextKey{}, marked)))
+
+	if !marked.Load() {
+		id.release(scope, key)
+		return
+	}
+	err := id.Store.CompleteIdempotencyKey(scope, key, rec.status, rec.body.Bytes(), rec.Header().Get("Content-Type"))
+	if err != nil {
+		id.Logger.Printf("failed to store response for idempotency key %q for %s: %v", key, scope, err)
+	}
+}
+
+func (id *Idempotency) release(scope string, key string) {
+	err := id.Store.DeleteIdempotencyKey(scope, key)
+	if err != nil {
+		id.Logger.Printf("failed to release idempotency key %q for %s: %v", key, scope, err)
+	}
+}
+
+// waitForCompletion polls until the request holding the key has finished. It
+// returns sql.ErrNoRows if that request gave up the key, in which case the
+// client may retry, or a context error if the wait ran out.
+func (id *Idempotency) waitForCompletion(ctx context.Context, scope string, key string) (*stores.IdempotencyKey, error) {
+	ctx, cancel := context.WithTimeout(ctx, id.Wait)
+	defer cancel()
+
+	ticker := time.NewTicker(id.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+
+		existing, err := id.Store.GetIdempotencyKey(scope, key)
+		if err != nil {
+			return nil, err
+		}
+		if existing.Status == "completed" {
+			return existing, nil
+		}
+	}
+}
+
+// Run deletes keys older than Retention once an hour.
+func (id *Idempotency) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		deleted, err := id.Store.DeleteIdempotencyKeysBefore(time.Now().Add(-id.Retention))
+		if err != nil {
+			id.Logger.Printf("failed to delete old idempotency keys: %v", err)
+		} else if deleted > 0 {
+			id.Logger.Printf("deleted %d old idempotency keys", deleted)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func replay(w http.ResponseWriter, ik *stores.IdempotencyKey) {
+	if ik.ContentType != "" {
+		w.Header().Set("Content-Type", ik.ContentType)
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(ik.ResponseStatus)
+	w.Write(ik.ResponseBody)
+}
+
+// responseRecorder passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body bytes.Buffer
+	wroteHeader bool
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if !rr.wroteHeader {
+		rr.status = status
+		rr.wroteHeader = true
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.wroteHeader = true
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
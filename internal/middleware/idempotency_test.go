@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingHandler answers with status, marking a side effect first if asked
+// to, and counts how often it ran.
+type countingHandler struct {
+	status int
+	sideEffect bool
+	runs int
+}
+
+func (ch *countingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ch.runs++
+	if ch.sideEffect {
+		MarkSideEffect(r.Context())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ch.status)
+	w.Write([]byte(`{"run": ` + strconv.Itoa(ch.runs) + `}`))
+}
+
+func newTestIdempotency() *Idempotency {
+	id := NewIdempotency(newMemIdempotencyStore(), log.New(io.Discard, "", 0))
+	id.Wait = 200 * time.Millisecond
+	id.PollInterval = 10 * time.Millisecond
+	return id
+}
+
+func sendIdempotent(handler http.Handler, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/onramp/initiate", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotencyStoresOnlySideEffects(t *testing.T) {
+	tests := []struct {
+		name string
+		status int
+		sideEffect bool
+		wantRuns int
+	}{
+		{"stale rate before the STK push", http.StatusServiceUnavailable, false, 2},
+		{"invalid request", http.StatusBadRequest, false, 2},
+		{"internal error before the STK push", http.StatusInternalServerError, false, 2},
+		{"STK push sent", http.StatusOK, true, 1},
+		{"STK push sent but the transaction was not saved", http.StatusInternalServerError, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &countingHandler{status: tt.status, sideEffect: tt.sideEffect}
+			handler := newTestIdempotency().Handler(next)
+
+			first := sendIdempotent(handler, "key-1", `{"amount_ksh": "100"}`)
+			retry := sendIdempotent(handler, "key-1", `{"amount_ksh": "100"}`)
+
+			if next.runs != tt.wantRuns {
+				t.Errorf("handler ran %d times, want %d", next.runs, tt.wantRuns)
+			}
+			replayed := retry.Header().Get(idempotentReplayedHeader) == "true"
+			if replayed != (tt.wantRuns == 1) {
+				t.Errorf("retry replayed = %v", replayed)
+			}
+			if replayed && (retry.Code != first.Code || retry.Body.String() != first.Body.String()) {
+				t.Errorf("replay %d %s, want %d %s", retry.Code, retry.Body, first.Code, first.Body)
+			}
+		})
+	}
+}
+
+func TestIdempotencyRejectsKeyReuseWithDifferentBody(t *testing.T) {
+	next := &countingHandler{status: http.StatusOK, sideEffect: true}
+	handler := newTestIdempotency().Handler(next)
+
+	sendIdempotent(handler, "key-1", `{"amount_ksh": "100"}`)
+	rec := sendIdempotent(handler, "key-1", `{"amount_ksh": "200"}`)
+
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusUnprocessableEntity)
+	}
+	if next.runs != 1 {
+		t.Errorf("handler ran %d times, want 1", next.runs)
+	}
+}
+
+func TestIdempotencyWithoutKeyPassesThrough(t *testing.T) {
+	next := &countingHandler{status: http.StatusOK, sideEffect: true}
+	handler := newTestIdempotency().Handler(next)
+
+	sendIdempotent(handler, "", `{}`)
+	sendIdempotent(handler, "", `{}`)
+
+	if next.runs != 2 {
+		t.Errorf("handler ran %d times, want 2", next.runs)
+	}
+}
+
+func TestIdempotencyReleasesKeyOnPanic(t *testing.T) {
+	panicking := true
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		MarkSideEffect(r.Context())
+		if panicking {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := newTestIdempotency().Handler(next)
+
+	func() {
+		defer func() { recover() }()
+		sendIdempotent(handler, "key-1", `{}`)
+	}()
+	panicking = false
+
+	rec := sendIdempotent(handler, "key-1", `{}`)
+	if rec.Code != http.StatusOK || rec.Header().Get(idempotentReplayedHeader) != "" {
+		t.Errorf("retry after panic: status %d, replayed %q, want a fresh 200", rec.Code, rec.Header().Get(idempotentReplayedHeader))
+	}
+}
+
+func TestIdempotencyConcurrentDuplicateWaits(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		MarkSideEffect(r.Context())
+		w.WriteHeader(http.StatusCreated)
+	})
+	handler := newTestIdempotency().Handler(next)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- sendIdempotent(handler, "key-1", `{}`) }()
+	<-started
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		close(release)
+	}()
+	duplicate := sendIdempotent(handler, "key-1", `{}`)
+	first := <-done
+
+	if first.Code != http.StatusCreated {
+		t.Fatalf("first: status %d", first.Code)
+	}
+	if duplicate.Code != http.StatusCreated || duplicate.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("duplicate: status %d, replayed %q, want the first response replayed", duplicate.Code, duplicate.Header().Get(idempotentReplayedHeader))
+	}
+}
@@ -0,0 +1,345 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/alerts"
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+)
+
+const maxCallbackBodySize = 1 << 20
+
+// MpesaVerifier rejects M-Pesa callbacks that cannot be shown to come from
+// Safaricom. Checks are layered: the source IP must be in AllowedNetworks
+// (when set), a callback must carry the token issued with its STK push or
+// payout, and with CrossCheck an STK result must agree with Daraja's STK Push
+// Query.
+// Rejected callbacks are stored with the reason and alerted on, but never
+// reach the handler.
+type MpesaVerifier struct {
+	TransactionStore stores.TransactionStore
+	WebhookStore stores.WebhookStore
+	Daraja *payments.DarajaClient
+	// AllowedNetworks is the source allowlist; empty allows any source.
+	AllowedNetworks []*net.IPNet
+	// TrustedProxies are the load balancers whose X-Forwarded-For we believe.
+	TrustedProxies []*net.IPNet
+	CrossCheck bool
+	Alerter alerts.Alerter
+	Logger *log.Logger
+}
+
+func NewMpesaVerifier(transactionStore stores.TransactionStore, webhookStore stores.WebhookStore, daraja *payments.DarajaClient, alerter alerts.Alerter, logger *log.Logger) *MpesaVerifier {
+	return &MpesaVerifier{
+		TransactionStore: transactionStore,
+		WebhookStore: webhookStore,
+		Daraja: daraja,
+		CrossCheck: true,
+		Alerter: alerter,
+		Logger: logger,
+	}
+}
+
+// verificationFailure is a callback that did not pass a check.
+type verificationFailure struct {
+	status int
+	reason string
+	// suspicious failures look like forgery and are alerted on; the rest
+	// only mean we could not check right now.
+	suspicious bool
+}
+
+// VerifyB2CCallback applies the source check to B2C results and queue
+// timeouts, and makes sure they carry the token issued with the payout their
+// originator conversation ID, the off-ramp's ID, names.
+func (mv *MpesaVerifier) VerifyB2CCallback(eventType string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, ok := readBody(w, r)
+			if !ok {
+				return
+			}
+
+			if failure := mv.checkSource(r); failure != nil {
+				mv.reject(w, r, body, eventType, "", "", failure)
+				return
+			}
+
+			var callback payments.B2CResult
+			err := json.Unmarshal(body, &callback)
+			if err != nil {
+				// the handler stores it and answers 400
+				next.ServeHTTP(w, r)
+				return
+			}
+			result := callback.Result
+
+			unknown := &verificationFailure{
+				status: http.StatusNotFound,
+				reason: "unknown payout",
+				suspicious: true,
+			}
+			if !utils.IsUUID(result.OriginatorConversationID) {
+				mv.reject(w, r, body, eventType, result.ConversationID, "", unknown)
+				return
+			}
+			txn, err := mv.TransactionStore.GetTransactionByID(result.OriginatorConversationID)
+			if errors.Is(err, sql.ErrNoRows) || (err == nil && txn.Type != "offramp") {
+				mv.reject(w, r, body, eventType, result.ConversationID, "", unknown)
+				return
+			}
+			if err != nil {
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+				mv.Logger.Printf("failed to get transaction %s: %v", result.OriginatorConversationID, err)
+				return
+			}
+
+			failure := mv.checkToken(r, txn)
+			if failure == nil && txn.MpesaConversationID != "" && txn.MpesaConversationID != result.ConversationID {
+				failure = &verificationFailure{
+					status: http.StatusConflict,
+					reason: fmt.Sprintf("conversation %s is not the payout's %s", result.ConversationID, txn.MpesaConversationID),
+					suspicious: true,
+				}
+			}
+			if failure != nil {
+				mv.reject(w, r, body, eventType, result.ConversationID, txn.ID, failure)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// VerifySTKCallback applies every check to STK push callbacks.
+func (mv *MpesaVerifier) VerifySTKCallback(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+
+		if failure := mv.checkSource(r); failure != nil {
+			mv.reject(w, r, body, stores.WebhookSTKCallback, "", "", failure)
+			return
+		}
+
+		callback, err := payments.ParseSTKCallback(body)
+		if err != nil {
+			// Nothing can be applied from a callback we cannot parse; the
+			// handler stores it and answers 400.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		txn, err := mv.TransactionStore.GetTransactionByMpesaCheckoutID(callback.CheckoutRequestID)
+		if errors.Is(err, sql.ErrNoRows) {
+			mv.reject(w, r, body, stores.WebhookSTKCallback, callback.CheckoutRequestID, "", &verificationFailure{
+				status: http.StatusNotFound,
+				reason: "unknown checkout request",
+				suspicious: true,
+			})
+			return
+		}
+		if err != nil {
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to get transaction"})
+			mv.Logger.Printf("failed to get transaction for checkout request %s: %v", callback.CheckoutRequestID, err)
+			return
+		}
+
+		failure := mv.checkToken(r, txn)
+		if failure == nil {
+			failure = mv.crossCheck(r, txn, callback)
+		}
+		if failure != nil {
+			mv.reject(w, r, body, stores.WebhookSTKCallback, callback.CheckoutRequestID, txn.ID, failure)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (mv *MpesaVerifier) checkSource(r *http.Request) *verificationFailure {
+	if len(mv.AllowedNetworks) == 0 {
+		return nil
+	}
+
+	ip := ClientIP(r, mv.TrustedProxies)
+	if ip == nil || !containsIP(mv.AllowedNetworks, ip) {
+		return &verificationFailure{
+			status: http.StatusForbidden,
+			reason: fmt.Sprintf("source %s is not allowed", ip),
+			suspicious: true,
+		}
+	}
+	return nil
+}
+
+func (mv *MpesaVerifier) checkToken(r *http.Request, txn *stores.Transaction) *verificationFailure {
+	if txn.CallbackTokenHash == "" {
+		// created before callback tokens were issued
+		return nil
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(utils.HashToken(token)), []byte(txn.CallbackTokenHash)) != 1 {
+		return &verificationFailure{
+			status: http.StatusUnauthorized,
+			reason: "missing or wrong callback token",
+			suspicious: true,
+		}
+	}
+	return nil
+}
+
+// crossCheck asks Daraja for the STK push result and makes sure the callback
+// agrees with it. Only initiated transactions are checked, since a callback
+// for anything else will not be applied.
+func (mv *MpesaVerifier) crossCheck(r *http.Request, txn *stores.Transaction, callback *payments.STKCallback) *verificationFailure {
+	if !mv.CrossCheck || txn.Status != stores.StatusInitiated {
+		return nil
+	}
+
+	queryResp, err := mv.Daraja.QuerySTKPush(r.Context(), callback.CheckoutRequestID)
+	if err != nil {
+		// The STK resolver will settle the transaction later.
+		return &verificationFailure{
+			status: http.StatusServiceUnavailable,
+			reason: fmt.Sprintf("could not cross-check with STK query: %v", err),
+		}
+	}
+	if queryResp.InProgress() {
+		return &verificationFailure{
+			status: http.StatusServiceUnavailable,
+			reason: "STK query still reports the payment as in progress",
+		}
+	}
+
+	if (queryResp.ResultCode == "0") != callback.Succeeded() {
+		return &verificationFailure{
+			status: http.StatusForbidden,
+			reason: fmt.Sprintf("callback result %d disagrees with STK query result %s", callback.ResultCode, queryResp.ResultCode),
+			suspicious: true,
+		}
+	}
+	return nil
+}
+
+func (mv *MpesaVerifier) reject(w http.ResponseWriter, r *http.Request, body []byte, eventType string, eventKey string, transactionID string, failure *verificationFailure) {
+	utils.WriteJSON(w, failure.status, utils.Envelope{"error": "callback verification failed"})
+
+	webhook := stores.Webhook{
+		TransactionID: transactionID,
+		Source: "mpesa",
+		EventType: eventType,
+		EventKey: eventKey,
+		RawBody: body,
+		StatusCode: failure.status,
+		ReceivedAt: time.Now(),
+		VerificationError: failure.reason,
+	}
+	if json.Valid(body) {
+		webhook.Payload = json.RawMessage(body)
+	}
+	stored, err := mv.WebhookStore.CreateWebhook(webhook)
+	if err != nil {
+		mv.Logger.Printf("failed to store rejected %s callback: %v", eventType, err)
+	}
+
+	source := ClientIP(r, mv.TrustedProxies)
+	mv.Logger.Printf("rejected %s callback %q from %s: %s", eventType, eventKey, source, failure.reason)
+	if failure.suspicious {
+		webhookID := "unsaved"
+		if stored != nil {
+			webhookID = stored.ID
+		}
+		mv.Alerter.Alert(r.Context(), fmt.Sprintf("Rejected M-Pesa %s callback from %s (webhook %s, event %q): %s", eventType, source, webhookID, eventKey, failure.reason))
+	}
+}
+
+// ClientIP is the address of whoever sent the request. X-Forwarded-For is only
+// believed when the direct peer is a trusted proxy, and is then read from the
+// right, skipping further trusted proxies, since the left end is whatever the
+// client chose to send.
+func ClientIP(r *http.Request, trustedProxies []*net.IPNet) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if hop == nil {
+			return ip
+		}
+		ip = hop
+		if !containsIP(trustedProxies, hop) {
+			return hop
+		}
+	}
+	return ip
+}
+
+// ParseNetworks parses a comma-separated list of IPs and CIDR ranges.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", entry, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody reads the request body and puts it back for the next handler.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxCallbackBodySize))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+		return nil, false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, true
+}
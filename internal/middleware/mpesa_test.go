@@ -0,0 +1,234 @@
+package middleware
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+)
+
+func TestVerifyB2CCallback(t *testing.T) {
+	const offRampID = "6f1c2a4e-8d3b-4f5a-9c7e-1b2d3e4f5a6b"
+	const onRampID = "0b7e2c1d-3a4f-4e5d-8c9b-7a6f5e4d3c2b"
+	const token = "payout-token"
+
+	tests := []struct {
+		name string
+		// recorded is the conversation ID saved on the off-ramp, if any
+		recorded string
+		originator string
+		conversationID string
+		token string
+		wantCode int
+	}{
+		{"payout token", "AG_20260101_0000", offRampID, "AG_20260101_0000", token, http.StatusOK},
+		{"result before conversation ID recorded", "", offRampID, "AG_20260101_0000", token, http.StatusOK},
+		{"missing token", "AG_20260101_0000", offRampID, "AG_20260101_0000", "", http.StatusUnauthorized},
+		{"wrong token", "AG_20260101_0000", offRampID, "AG_20260101_0000", "guessed", http.StatusUnauthorized},
+		{"another payout's conversation", "AG_20260101_0000", offRampID, "AG_20260101_9999", token, http.StatusConflict},
+		{"unknown originator", "AG_20260101_0000", "0c1d2e3f-4a5b-4c6d-8e7f-9a0b1c2d3e4f", "AG_20260101_0000", token, http.StatusNotFound},
+		{"originator not a transaction ID", "AG_20260101_0000", "29115-34620561-1", "AG_20260101_0000", token, http.StatusNotFound},
+		{"originator an on-ramp", "AG_20260101_0000", onRampID, "AG_20260101_0000", token, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhooks := &memWebhookStore{}
+			alerter := &alertRecorder{}
+			mv := NewMpesaVerifier(&memTransactionStore{txns: []stores.Transaction{
+				{ID: offRampID, Type: "offramp", Status: stores.StatusSettling, MpesaConversationID: tt.recorded, CallbackTokenHash: utils.HashToken(token)},
+				{ID: onRampID, Type: "onramp", Status: stores.StatusInitiated, CallbackTokenHash: utils.HashToken(token)},
+			}}, webhooks, nil, alerter, log.New(io.Discard, "", 0))
+
+			reached := false
+			handler := mv.VerifyB2CCallback(stores.WebhookB2CResult)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			target := "/webhooks/mpesa/b2c/result"
+			if tt.token != "" {
+				target += "?token=" + tt.token
+			}
+			body := `{"Result": {"ResultType": 0, "ResultCode": 0, "ResultDesc": "ok", "OriginatorConversationID": "` + tt.originator + `", "ConversationID": "` + tt.conversationID + `", "TransactionID": "NLJ41HAY6Q"}}`
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if reached != (tt.wantCode == http.StatusOK) {
+				t.Errorf("handler reached = %v", reached)
+			}
+			if tt.wantCode != http.StatusOK {
+				if len(webhooks.webhooks) != 1 || webhooks.webhooks[0].VerificationError == "" {
+					t.Errorf("rejected callback stored as %+v, want one with a verification error", webhooks.webhooks)
+				}
+				if len(alerter.alerts) != 1 {
+					t.Errorf("sent %d alerts, want 1", len(alerter.alerts))
+				}
+			}
+		})
+	}
+}
+
+func TestVerifyB2CCallbackAllowsPayoutsWithoutToken(t *testing.T) {
+	const offRampID = "6f1c2a4e-8d3b-4f5a-9c7e-1b2d3e4f5a6b"
+	// claimed for payout before callback tokens were issued
+	mv := NewMpesaVerifier(&memTransactionStore{txns: []stores.Transaction{
+		{ID: offRampID, Type: "offramp", Status: stores.StatusSettling},
+	}}, &memWebhookStore{}, nil, &alertRecorder{}, log.New(io.Discard, "", 0))
+	handler := mv.VerifyB2CCallback(stores.WebhookB2CTimeout)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	body := `{"Result": {"ResultType": 0, "ResultCode": 1, "ResultDesc": "timed out", "OriginatorConversationID": "` + offRampID + `", "ConversationID": "AG_20260101_0000"}}`
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhooks/mpesa/b2c/timeout", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", rec.Code)
+	}
+}
+
+func TestVerifySTKCallback(t *testing.T) {
+	const token = "stk-token"
+	paid := payments.STKQueryResponse{ResponseCode: "0", ResultCode: "0", ResultDesc: "The service request is processed successfully."}
+	cancelled := payments.STKQueryResponse{ResponseCode: "0", ResultCode: "1032", ResultDesc: "Request cancelled by user"}
+	pending := payments.STKQueryResponse{ErrorCode: "500.001.1001", ErrorMessage: "The transaction is being processed"}
+
+	tests := []struct {
+		name string
+		status stores.TransactionStatus
+		// tokenHash is the hash saved on the on-ramp; empty for one created
+		// before callback tokens were issued
+		tokenHash string
+		checkoutID string
+		token string
+		resultCode int
+		query payments.STKQueryResponse
+		// allowed restricts the source to 196.201.214.0/24
+		allowed bool
+		wantCode int
+		wantQuery bool
+		wantAlert bool
+	}{
+		{"agrees with the STK query", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", token, 0, paid, false, http.StatusOK, true, false},
+		{"failure agrees with the STK query", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", token, 1032, cancelled, false, http.StatusOK, true, false},
+		{"success the STK query calls cancelled", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", token, 0, cancelled, false, http.StatusForbidden, true, true},
+		{"failure the STK query calls paid", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", token, 1032, paid, false, http.StatusForbidden, true, true},
+		{"STK query still in progress", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", token, 0, pending, false, http.StatusServiceUnavailable, true, false},
+		{"STK query fails", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", token, 0, payments.STKQueryResponse{}, false, http.StatusServiceUnavailable, true, false},
+		{"already resolved is not cross-checked", stores.StatusConfirmed, utils.HashToken(token), "ws_CO_1", token, 0, cancelled, false, http.StatusOK, false, false},
+		{"created before callback tokens", stores.StatusInitiated, "", "ws_CO_1", "", 0, paid, false, http.StatusOK, true, false},
+		{"missing token", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", "", 0, paid, false, http.StatusUnauthorized, false, true},
+		{"wrong token", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", "guessed", 0, paid, false, http.StatusUnauthorized, false, true},
+		{"unknown checkout request", stores.StatusInitiated, utils.HashToken(token), "ws_CO_9", token, 0, paid, false, http.StatusNotFound, false, true},
+		{"source not allowed", stores.StatusInitiated, utils.HashToken(token), "ws_CO_1", token, 0, paid, true, http.StatusForbidden, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			daraja := newFakeSTKQuery(t, tt.query)
+			webhooks := &memWebhookStore{}
+			alerter := &alertRecorder{}
+			mv := NewMpesaVerifier(&memTransactionStore{txns: []stores.Transaction{
+				{ID: "txn-1", Type: "onramp", Status: tt.status, MpesaCheckoutID: "ws_CO_1", CallbackTokenHash: tt.tokenHash},
+			}}, webhooks, daraja.Client(), alerter, log.New(io.Discard, "", 0))
+			if tt.allowed {
+				mv.AllowedNetworks, _ = ParseNetworks("196.201.214.0/24")
+			}
+
+			reached := false
+			handler := mv.VerifySTKCallback(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			target := "/webhooks/mpesa"
+			if tt.token != "" {
+				target += "?token=" + tt.token
+			}
+			body := `{"Body": {"stkCallback": {"MerchantRequestID": "29115-34620561-1", "CheckoutRequestID": "` + tt.checkoutID + `", "ResultCode": ` + strconv.Itoa(tt.resultCode) + `, "ResultDesc": "done"}}}`
+			if tt.resultCode == 0 {
+				body = `{"Body": {"stkCallback": {"MerchantRequestID": "29115-34620561-1", "CheckoutRequestID": "` + tt.checkoutID + `", "ResultCode": 0, "ResultDesc": "done", "CallbackMetadata": {"Item": [{"Name": "Amount", "Value": 1000}, {"Name": "MpesaReceiptNumber", "Value": "NLJ7RT61SV"}, {"Name": "PhoneNumber", "Value": 254712345678}]}}}}`
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantCode, rec.Body)
+			}
+			if reached != (tt.wantCode == http.StatusOK) {
+				t.Errorf("handler reached = %v", reached)
+			}
+			if (daraja.calls > 0) != tt.wantQuery {
+				t.Errorf("STK queries %d, want query = %v", daraja.calls, tt.wantQuery)
+			}
+			if (len(alerter.alerts) > 0) != tt.wantAlert {
+				t.Errorf("alerts %q, want alert = %v", alerter.alerts, tt.wantAlert)
+			}
+			if tt.wantCode != http.StatusOK {
+				if len(webhooks.webhooks) != 1 || webhooks.webhooks[0].VerificationError == "" || string(webhooks.webhooks[0].RawBody) != body {
+					t.Errorf("rejected callback stored as %+v, want its body with a verification error", webhooks.webhooks)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifySTKCallbackPassesUnparseableOn(t *testing.T) {
+	mv := NewMpesaVerifier(&memTransactionStore{}, &memWebhookStore{}, nil, &alertRecorder{}, log.New(io.Discard, "", 0))
+	reached := false
+	handler := mv.VerifySTKCallback(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != `{"Body": ` {
+			t.Errorf("handler read %q", body)
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/webhooks/mpesa", strings.NewReader(`{"Body": `)))
+	if !reached {
+		t.Error("an unparseable callback did not reach the handler, which stores it")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseNetworks("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		remoteAddr string
+		forwarded string
+		want string
+	}{
+		{"direct", "196.201.214.200:443", "", "196.201.214.200"},
+		{"forwarded header from an untrusted peer is ignored", "203.0.113.7:443", "196.201.214.200", "203.0.113.7"},
+		{"through a trusted proxy", "10.1.2.3:443", "196.201.214.200", "196.201.214.200"},
+		{"spoofed left end is skipped", "10.1.2.3:443", "196.201.214.200, 203.0.113.7", "203.0.113.7"},
+		{"through two trusted proxies", "10.1.2.3:443", "196.201.214.200, 192.168.1.1", "196.201.214.200"},
+		{"garbage hop stops at the last good address", "10.1.2.3:443", "not-an-ip", "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/webhooks/mpesa", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if got := ClientIP(r, proxies); got.String() != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
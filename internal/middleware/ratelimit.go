@@ -0,0 +1,146 @@
+package middleware
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/ratelimit"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/nhx-finance/wallet/internal/validate"
+)
+
+const maxRateLimitedBodySize = 1 << 20
+
+// RateLimit limits requests that reach a phone or a Hedera account, such as
+// STK pushes and payouts, with a token bucket per client IP, per target phone
+// and per Hedera account. The phone and account are read from the JSON body.
+// A request over any limit gets 429 with Retry-After.
+//
+// A retry whose Idempotency-Key has already been claimed is replayed rather
+// than sent to the phone or account again, so it only counts against the IP.
+type RateLimit struct {
+	Limiter ratelimit.Limiter
+	PerIP ratelimit.Limit
+	PerPhone ratelimit.Limit
+	PerAccount ratelimit.Limit
+	// IdempotencyStore is where Idempotency keeps its keys. If nil every
+	// request takes from every bucket.
+	IdempotencyStore stores.IdempotencyStore
+	// TrustedProxies are the load balancers whose X-Forwarded-For we believe.
+	TrustedProxies []*net.IPNet
+	Logger *log.Logger
+}
+
+func NewRateLimit(limiter ratelimit.Limiter, logger *log.Logger) *RateLimit {
+	return &RateLimit{
+		Limiter: limiter,
+		PerIP: ratelimit.Limit{Requests: 30, Per: time.Minute},
+		PerPhone: ratelimit.Limit{Requests: 3, Per: 5 * time.Minute},
+		PerAccount: ratelimit.Limit{Requests: 10, Per: 5 * time.Minute},
+		Logger: logger,
+	}
+}
+
+type rateLimitedRequest struct {
+	Phone string `json:"phone"`
+	HederaAccountID string `json:"hedera_account_id"`
+}
+
+func (rl *RateLimit) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRateLimitedBodySize))
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request body"})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// a body that does not parse is left for the handler to reject; it
+		// still counts against the IP
+		var req rateLimitedRequest
+		json.Unmarshal(body, &req)
+		if rl.isRetry(r) {
+			req = rateLimitedRequest{}
+		}
+
+		checks := []struct {
+			name string
+			key string
+			limit ratelimit.Limit
+		}{
+			{"ip", ClientIP(r, rl.TrustedProxies).String(), rl.PerIP},
+			{"phone", phoneKey(req.Phone), rl.PerPhone},
+			{"account", accountKey(req.HederaAccountID), rl.PerAccount},
+		}
+		for _, check := range checks {
+			if check.key == "" || !check.limit.Enabled() {
+				continue
+			}
+			res, err := rl.Limiter.Take(r.Context(), check.name+":"+check.key, check.limit)
+			if err != nil {
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "failed to check rate limit"})
+				rl.Logger.Printf("failed to check %s rate limit for %s: %v", check.name, check.key, err)
+				return
+			}
+			if !res.Allowed {
+				retryAfter := int(math.Ceil(res.RetryAfter.Seconds()))
+				w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+				utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "too many requests", "limit": check.name, "retry_after": retryAfter})
+				rl.Logger.Printf("rate limited %s %s on %s %s", check.name, check.key, r.Method, r.URL.Path)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isRetry reports whether the request's Idempotency-Key was already claimed,
+// so Idempotency will answer it without running the handler.
+func (rl *RateLimit) isRetry(r *http.Request) bool {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if rl.IdempotencyStore == nil || key == "" {
+		return false
+	}
+
+	_, err := rl.IdempotencyStore.GetIdempotencyKey(idempotencyScope(r), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	}
+	if err != nil {
+		// charge every bucket rather than risk letting a new request through
+		rl.Logger.Printf("failed to look up idempotency key %q: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// phoneKey keys a phone the way the handler will normalise it, so that
+// 0712... and +254 712... share a bucket.
+func phoneKey(phone string) string {
+	msisdn, err := validate.MSISDN(phone)
+	if err != nil {
+		return strings.TrimSpace(phone)
+	}
+	return msisdn
+}
+
+// accountKey keys an account without its checksum.
+func accountKey(accountID string) string {
+	id, err := validate.AccountID(accountID, nil)
+	if err != nil {
+		return strings.TrimSpace(accountID)
+	}
+	return id.String()
+}
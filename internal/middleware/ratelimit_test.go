@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/ratelimit"
+)
+
+func TestRateLimitReplaysOnlyTakeFromIP(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	idempotencyStore := newMemIdempotencyStore()
+
+	rl := NewRateLimit(ratelimit.NewMemoryLimiter(), logger)
+	rl.PerPhone = ratelimit.Limit{Requests: 1, Per: time.Hour}
+	rl.IdempotencyStore = idempotencyStore
+
+	var pushes int
+	handler := rl.Handler(NewIdempotency(idempotencyStore, logger).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pushes++
+		MarkSideEffect(r.Context())
+		w.WriteHeader(http.StatusCreated)
+	})))
+
+	send := func(idempotencyKey string) int {
+		req := httptest.NewRequest(http.MethodPost, "/onramp/initiate", strings.NewReader(`{"phone": "0712345678"}`))
+		req.Header.Set(IdempotencyKeyHeader, idempotencyKey)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	for i := range 3 {
+		if code := send("retry-me"); code != http.StatusCreated {
+			t.Fatalf("attempt %d: status %d, want the stored %d", i+1, code, http.StatusCreated)
+		}
+	}
+	if pushes != 1 {
+		t.Errorf("handler ran %d times, want 1", pushes)
+	}
+	if code := send("new-request"); code != http.StatusTooManyRequests {
+		t.Errorf("new request for the same phone: status %d, want %d", code, http.StatusTooManyRequests)
+	}
+}
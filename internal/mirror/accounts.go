@@ -0,0 +1,129 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"net/url"
+)
+
+type Account struct {
+	Account string `json:"account"`
+	Deleted bool `json:"deleted"`
+	ReceiverSigRequired bool `json:"receiver_sig_required"`
+	// MaxAutomaticTokenAssociations is how many tokens the account accepts
+	// without associating first; -1 is unlimited.
+	MaxAutomaticTokenAssociations int `json:"max_automatic_token_associations"`
+	Memo string `json:"memo"`
+}
+
+// Token KYC and freeze statuses. NOT_APPLICABLE means the token has no KYC
+// or freeze key.
+const (
+	StatusNotApplicable = "NOT_APPLICABLE"
+	KYCGranted = "GRANTED"
+	KYCRevoked = "REVOKED"
+	FreezeFrozen = "FROZEN"
+	FreezeUnfrozen = "UNFROZEN"
+)
+
+// TokenRelationship is an account's association with a token.
+type TokenRelationship struct {
+	TokenID string `json:"token_id"`
+	// Balance is in the token's smallest unit.
+	Balance int64 `json:"balance"`
+	Decimals uint32 `json:"decimals"`
+	KYCStatus string `json:"kyc_status"`
+	FreezeStatus string `json:"freeze_status"`
+	AutomaticAssociation bool `json:"automatic_association"`
+}
+
+// GetAccount returns an account, or ErrNotFound if it does not exist.
+func (c *Client) GetAccount(ctx context.Context, accountID string) (*Account, error) {
+	var account Account
+	err := c.get(ctx, "/api/v1/accounts/"+url.PathEscape(accountID)+"?transactions=false", &account)
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+type tokenRelationshipsResponse struct {
+	Tokens []TokenRelationship `json:"tokens"`
+	Links links `json:"links"`
+}
+
+// GetTokenRelationship returns the account's association with tokenID, or
+// ErrNotFound if the account is not associated with it.
+func (c *Client) GetTokenRelationship(ctx context.Context, accountID string, tokenID string) (*TokenRelationship, error) {
+	var resp tokenRelationshipsResponse
+	err := c.get(ctx, "/api/v1/accounts/"+url.PathEscape(accountID)+"/tokens?token.id="+url.QueryEscape(tokenID), &resp)
+	if err != nil {
+		return nil, err
+	}
+	for _, relationship := range resp.Tokens {
+		if relationship.TokenID == tokenID {
+			return &relationship, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Reasons an account cannot receive a token.
+var (
+	ErrAccountNotFound = errors.New("account does not exist")
+	ErrAccountDeleted = errors.New("account has been deleted")
+	ErrReceiverSigRequired = errors.New("account requires its signature to receive transfers")
+	ErrTokenNotAssociated = errors.New("account is not associated with the token")
+	ErrKYCNotGranted = errors.New("account has not been granted KYC for the token")
+	ErrAccountFrozen = errors.New("account is frozen for the token")
+)
+
+// CheckRecipient returns nil if accountID can be sent tokenID by the
+// treasury, or one of the errors above saying why not. Any other error means
+// the mirror node could not be asked.
+func (c *Client) CheckRecipient(ctx context.Context, accountID string, tokenID string) error {
+	account, err := c.GetAccount(ctx, accountID)
+	if errors.Is(err, ErrNotFound) {
+		return ErrAccountNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if account.Deleted {
+		return ErrAccountDeleted
+	}
+	if account.ReceiverSigRequired {
+		return ErrReceiverSigRequired
+	}
+
+	relationship, err := c.GetTokenRelationship(ctx, accountID, tokenID)
+	if errors.Is(err, ErrNotFound) {
+		// an open automatic association slot takes the token on transfer;
+		// we cannot see whether the slots are used up, so trust it
+		if account.MaxAutomaticTokenAssociations != 0 {
+			return nil
+		}
+		return ErrTokenNotAssociated
+	}
+	if err != nil {
+		return err
+	}
+	if relationship.KYCStatus == KYCRevoked {
+		return ErrKYCNotGranted
+	}
+	if relationship.FreezeStatus == FreezeFrozen {
+		return ErrAccountFrozen
+	}
+	return nil
+}
+
+// IsRecipientError reports whether err is one of the reasons CheckRecipient
+// gives for refusing an account.
+func IsRecipientError(err error) bool {
+	for _, reason := range []error{ErrAccountNotFound, ErrAccountDeleted, ErrReceiverSigRequired, ErrTokenNotAssociated, ErrKYCNotGranted, ErrAccountFrozen} {
+		if errors.Is(err, reason) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package mirror_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/mirror/mirrortest"
+)
+
+const (
+	recipient = "0.0.1234"
+	usdc = "0.0.429274"
+)
+
+func TestCheckRecipient(t *testing.T) {
+	associated := mirror.TokenRelationship{TokenID: usdc, KYCStatus: mirror.StatusNotApplicable, FreezeStatus: mirror.StatusNotApplicable}
+
+	tests := []struct {
+		name string
+		account *mirror.Account
+		relationship *mirror.TokenRelationship
+		want error
+	}{
+		{"unknown account", nil, nil, mirror.ErrAccountNotFound},
+		{"deleted", &mirror.Account{Account: recipient, Deleted: true}, &associated, mirror.ErrAccountDeleted},
+		{"receiver signature required", &mirror.Account{Account: recipient, ReceiverSigRequired: true}, &associated, mirror.ErrReceiverSigRequired},
+		{"unassociated", &mirror.Account{Account: recipient}, nil, mirror.ErrTokenNotAssociated},
+		{"free auto-association slots", &mirror.Account{Account: recipient, MaxAutomaticTokenAssociations: 10}, nil, nil},
+		{"unlimited auto-association", &mirror.Account{Account: recipient, MaxAutomaticTokenAssociations: -1}, nil, nil},
+		{"associated", &mirror.Account{Account: recipient}, &associated, nil},
+		{"KYC granted", &mirror.Account{Account: recipient}, &mirror.TokenRelationship{TokenID: usdc, KYCStatus: mirror.KYCGranted, FreezeStatus: mirror.FreezeUnfrozen}, nil},
+		{"KYC revoked", &mirror.Account{Account: recipient}, &mirror.TokenRelationship{TokenID: usdc, KYCStatus: mirror.KYCRevoked, FreezeStatus: mirror.FreezeUnfrozen}, mirror.ErrKYCNotGranted},
+		{"frozen", &mirror.Account{Account: recipient}, &mirror.TokenRelationship{TokenID: usdc, KYCStatus: mirror.KYCGranted, FreezeStatus: mirror.FreezeFrozen}, mirror.ErrAccountFrozen},
+		// a relationship with another token says nothing about this one
+		{"associated with another token", &mirror.Account{Account: recipient}, &mirror.TokenRelationship{TokenID: "0.0.5555", KYCStatus: mirror.StatusNotApplicable, FreezeStatus: mirror.StatusNotApplicable}, mirror.ErrTokenNotAssociated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := mirrortest.NewServer()
+			defer server.Close()
+			if tt.account != nil {
+				server.AddAccount(*tt.account)
+			}
+			if tt.relationship != nil {
+				server.Associate(recipient, *tt.relationship)
+			}
+
+			err := server.Client().CheckRecipient(context.Background(), recipient, usdc)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("CheckRecipient() = %v, want %v", err, tt.want)
+			}
+			if tt.want != nil && !mirror.IsRecipientError(err) {
+				t.Errorf("IsRecipientError(%v) = false, want true", err)
+			}
+		})
+	}
+}
+
+func TestCheckRecipientMirrorUnavailable(t *testing.T) {
+	server := mirrortest.NewServer()
+	defer server.Close()
+	server.AddAccount(mirror.Account{Account: recipient})
+	server.SetUnavailable(true)
+
+	err := server.Client().CheckRecipient(context.Background(), recipient, usdc)
+	if err == nil {
+		t.Fatal("CheckRecipient() = nil, want an error")
+	}
+	// an outage must not be reported as the account's fault
+	if mirror.IsRecipientError(err) {
+		t.Errorf("IsRecipientError(%v) = true, want false", err)
+	}
+}
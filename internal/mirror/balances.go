@@ -0,0 +1,56 @@
+package mirror
+
+import (
+	"context"
+	"net/url"
+)
+
+type TokenBalance struct {
+	TokenID string `json:"token_id"`
+	// Balance is in the token's smallest unit.
+	Balance int64 `json:"balance"`
+}
+
+// AccountBalance is an account's balances as of the mirror node's latest
+// balance snapshot, which can be up to 15 minutes old.
+type AccountBalance struct {
+	Account string `json:"account"`
+	// Balance is in tinybars.
+	Balance int64 `json:"balance"`
+	Tokens []TokenBalance `json:"tokens"`
+	// Timestamp is the consensus timestamp of the snapshot.
+	Timestamp string `json:"-"`
+}
+
+// Token returns the balance of tokenID, which is 0 if the account holds none.
+func (ab *AccountBalance) Token(tokenID string) int64 {
+	for _, token := range ab.Tokens {
+		if token.TokenID == tokenID {
+			return token.Balance
+		}
+	}
+	return 0
+}
+
+type balancesResponse struct {
+	Timestamp string `json:"timestamp"`
+	Balances []AccountBalance `json:"balances"`
+	Links links `json:"links"`
+}
+
+// GetBalance returns an account's hbar and token balances, or ErrNotFound if
+// the account has none recorded.
+func (c *Client) GetBalance(ctx context.Context, accountID string) (*AccountBalance, error) {
+	var resp balancesResponse
+	err := c.get(ctx, "/api/v1/balances?account.id="+url.QueryEscape(accountID), &resp)
+	if err != nil {
+		return nil, err
+	}
+	for _, balance := range resp.Balances {
+		if balance.Account == accountID {
+			balance.Timestamp = resp.Timestamp
+			return &balance, nil
+		}
+	}
+	return nil, ErrNotFound
+}
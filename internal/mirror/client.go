@@ -0,0 +1,115 @@
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNotFound is returned when the mirror node has no such entity.
+var ErrNotFound = errors.New("not found on mirror node")
+
+// Client reads Hedera state from a mirror node's REST API, e.g.
+// https://testnet.mirrornode.hedera.com. Mirror nodes lag consensus by a few
+// seconds, so anything just submitted may not be visible yet.
+type Client struct {
+	BaseURL string
+	httpClient *http.Client
+}
+
+func NewClient(baseURL string, timeout time.Duration) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+// get fetches path, which is relative to BaseURL and starts with /api/v1,
+// and decodes the JSON response into out.
+func (c *Client) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return newStatusError(res, path)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("failed to decode mirror node response for %s: %w", path, err)
+	}
+	return nil
+}
+
+// StatusError is a response from the mirror node other than 200 or 404.
+type StatusError struct {
+	StatusCode int
+	Path string
+	// Messages are the mirror node's explanations, if its body had any.
+	Messages []string
+}
+
+func (e *StatusError) Error() string {
+	msg := fmt.Sprintf("mirror node returned status %d for %s", e.StatusCode, e.Path)
+	if len(e.Messages) > 0 {
+		msg += ": " + strings.Join(e.Messages, "; ")
+	}
+	return msg
+}
+
+// errorResponse is the body the mirror node sends with an error status.
+type errorResponse struct {
+	Status struct {
+		Messages []struct {
+			Message string `json:"message"`
+			Detail string `json:"detail"`
+		} `json:"messages"`
+	} `json:"_status"`
+}
+
+// maxErrorBodySize bounds how much of an error response is read.
+const maxErrorBodySize = 64 << 10
+
+func newStatusError(res *http.Response, path string) *StatusError {
+	statusErr := &StatusError{StatusCode: res.StatusCode, Path: path}
+
+	var body errorResponse
+	// a body that is not the mirror node's error format (e.g. from a proxy)
+	// leaves just the status
+	if json.NewDecoder(io.LimitReader(res.Body, maxErrorBodySize)).Decode(&body) != nil {
+		return statusErr
+	}
+	for _, message := range body.Status.Messages {
+		text := message.Message
+		if message.Detail != "" {
+			text += " (" + message.Detail + ")"
+		}
+		if text != "" {
+			statusErr.Messages = append(statusErr.Messages, text)
+		}
+	}
+	return statusErr
+}
+
+// links is the pagination block of list responses. Next is a path relative
+// to the mirror node, or empty on the last page.
+type links struct {
+	Next string `json:"next"`
+}
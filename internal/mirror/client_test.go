@@ -0,0 +1,72 @@
+package mirror_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/mirror/mirrortest"
+)
+
+func TestClientErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		status int
+		body string
+		wantNotFound bool
+		wantMessages []string
+	}{
+		{"not found", http.StatusNotFound, `{"_status": {"messages": [{"message": "Not found"}]}}`, true, nil},
+		{"mirror node error", http.StatusBadRequest, `{"_status": {"messages": [{"message": "Invalid parameter: account.id"}, {"message": "Invalid parameter: limit"}]}}`, false, []string{"Invalid parameter: account.id", "Invalid parameter: limit"}},
+		{"detail", http.StatusBadRequest, `{"_status": {"messages": [{"message": "Invalid parameter: timestamp", "detail": "Invalid value"}]}}`, false, []string{"Invalid parameter: timestamp (Invalid value)"}},
+		{"rate limited", http.StatusTooManyRequests, `{"_status": {"messages": [{"message": "Too many requests"}]}}`, false, []string{"Too many requests"}},
+		// e.g. a load balancer in front of the mirror node
+		{"not JSON", http.StatusBadGateway, `<html>502 Bad Gateway</html>`, false, nil},
+		{"empty", http.StatusServiceUnavailable, ``, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			_, err := mirror.NewClient(server.URL, 5*time.Second).GetAccount(context.Background(), "0.0.1234")
+			if errors.Is(err, mirror.ErrNotFound) != tt.wantNotFound {
+				t.Fatalf("GetAccount() = %v, want not found %t", err, tt.wantNotFound)
+			}
+			if tt.wantNotFound {
+				return
+			}
+
+			var statusErr *mirror.StatusError
+			if !errors.As(err, &statusErr) {
+				t.Fatalf("GetAccount() = %v, want a *StatusError", err)
+			}
+			if statusErr.StatusCode != tt.status {
+				t.Errorf("StatusCode = %d, want %d", statusErr.StatusCode, tt.status)
+			}
+			if !slices.Equal(statusErr.Messages, tt.wantMessages) {
+				t.Errorf("Messages = %q, want %q", statusErr.Messages, tt.wantMessages)
+			}
+		})
+	}
+}
+
+func TestClientErrorFromMirrortest(t *testing.T) {
+	server := mirrortest.NewServer()
+	defer server.Close()
+	server.SetUnavailable(true)
+
+	_, err := server.Client().GetBalance(context.Background(), "0.0.1234")
+	var statusErr *mirror.StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusServiceUnavailable || !slices.Equal(statusErr.Messages, []string{"Service Unavailable"}) {
+		t.Errorf("GetBalance() = %v, want a 503 saying Service Unavailable", err)
+	}
+}
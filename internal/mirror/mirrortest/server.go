@@ -0,0 +1,319 @@
+// Package mirrortest is a stand-in mirror node for tests. It serves the parts
+// of the mirror node REST API that package mirror uses, from state set up by
+// the test.
+package mirrortest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/mirror"
+)
+
+type Server struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	accounts map[string]mirror.Account
+	tokens map[string][]mirror.TokenRelationship
+	hbars map[string]int64
+	// transactions are kept in consensus order.
+	transactions []mirror.Transaction
+	// unavailable makes every request fail with 503.
+	unavailable bool
+}
+
+// NewServer starts a mirror node with no accounts. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		accounts: make(map[string]mirror.Account),
+		tokens: make(map[string][]mirror.TokenRelationship),
+		hbars: make(map[string]int64),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/accounts/{id}", s.handleAccount)
+	mux.HandleFunc("GET /api/v1/accounts/{id}/tokens", s.handleTokens)
+	mux.HandleFunc("GET /api/v1/balances", s.handleBalances)
+	mux.HandleFunc("GET /api/v1/transactions", s.handleTransactions)
+	mux.HandleFunc("GET /api/v1/transactions/{id}", s.handleTransaction)
+	s.Server = httptest.NewServer(s.check(mux))
+	return s
+}
+
+// Client returns a mirror client pointed at the server.
+func (s *Server) Client() *mirror.Client {
+	return mirror.NewClient(s.URL, 5*time.Second)
+}
+
+func (s *Server) AddAccount(account mirror.Account) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.accounts[account.Account] = account
+}
+
+// Associate adds or replaces the account's relationship with a token.
+func (s *Server) Associate(accountID string, relationship mirror.TokenRelationship) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	relationships := s.tokens[accountID]
+	for i, existing := range relationships {
+		if existing.TokenID == relationship.TokenID {
+			relationships[i] = relationship
+			return
+		}
+	}
+	s.tokens[accountID] = append(relationships, relationship)
+}
+
+// SetHbarBalance sets an account's balance in tinybars. Token balances are
+// those of its token relationships.
+func (s *Server) SetHbarBalance(accountID string, tinybars int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hbars[accountID] = tinybars
+}
+
+// AddTransaction records a transaction as having reached consensus. A
+// missing consensus timestamp is set to just after the latest one.
+func (s *Server) AddTransaction(txn mirror.Transaction) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if txn.ConsensusTimestamp == "" {
+		consensus := time.Now()
+		if len(s.transactions) > 0 {
+			latest := s.transactions[len(s.transactions)-1].ConsensusTime()
+			if !consensus.After(latest) {
+				consensus = latest.Add(time.Nanosecond)
+			}
+		}
+		txn.ConsensusTimestamp = mirror.FormatTimestamp(consensus)
+	}
+	if txn.Result == "" {
+		txn.Result = mirror.ResultSuccess
+	}
+	if txn.Name == "" {
+		txn.Name = mirror.TypeCryptoTransfer
+	}
+	s.transactions = append(s.transactions, txn)
+	sort.SliceStable(s.transactions, func(i, j int) bool {
+		return s.transactions[i].ConsensusTime().Before(s.transactions[j].ConsensusTime())
+	})
+}
+
+// SetUnavailable makes the server answer every request with 503 until it is
+// called again with false.
+func (s *Server) SetUnavailable(unavailable bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unavailable = unavailable
+}
+
+func (s *Server) check(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		unavailable := s.unavailable
+		s.mu.Unlock()
+		if unavailable {
+			writeError(w, http.StatusServiceUnavailable, "Service Unavailable")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleAccount(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	account, ok := s.accounts[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	writeJSON(w, account)
+}
+
+func (s *Server) handleTokens(w http.ResponseWriter, r *http.Request) {
+	accountID := r.PathValue("id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accounts[accountID]; !ok {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	tokenID := strings.TrimPrefix(r.URL.Query().Get("token.id"), "eq:")
+	tokens := []mirror.TokenRelationship{}
+	for _, relationship := range s.tokens[accountID] {
+		if tokenID == "" || relationship.TokenID == tokenID {
+			tokens = append(tokens, relationship)
+		}
+	}
+	writeJSON(w, map[string]any{"tokens": tokens, "links": map[string]any{"next": nil}})
+}
+
+func (s *Server) handleBalances(w http.ResponseWriter, r *http.Request) {
+	accountID := strings.TrimPrefix(r.URL.Query().Get("account.id"), "eq:")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	balances := []mirror.AccountBalance{}
+	if _, ok := s.accounts[accountID]; ok {
+		balance := mirror.AccountBalance{Account: accountID, Balance: s.hbars[accountID], Tokens: []mirror.TokenBalance{}}
+		for _, relationship := range s.tokens[accountID] {
+			balance.Tokens = append(balance.Tokens, mirror.TokenBalance{TokenID: relationship.TokenID, Balance: relationship.Balance})
+		}
+		balances = append(balances, balance)
+	}
+	writeJSON(w, map[string]any{"timestamp": mirror.FormatTimestamp(time.Now()), "balances": balances, "links": map[string]any{"next": nil}})
+}
+
+func (s *Server) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transactions := []mirror.Transaction{}
+	for _, txn := range s.transactions {
+		if txn.TransactionID == id {
+			transactions = append(transactions, txn)
+		}
+	}
+	if len(transactions) == 0 {
+		writeError(w, http.StatusNotFound, "Not found")
+		return
+	}
+	writeJSON(w, map[string]any{"transactions": transactions})
+}
+
+// handleTransactions supports the account.id, transactiontype, result,
+// timestamp (gt, gte, lt, lte), order and limit parameters, and pages with
+// links.next like the real mirror node.
+func (s *Server) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	accountID := strings.TrimPrefix(query.Get("account.id"), "eq:")
+	descending := query.Get("order") == "desc"
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 25
+	}
+
+	var bounds []func(time.Time) bool
+	for _, param := range query["timestamp"] {
+		op, value, ok := strings.Cut(param, ":")
+		if !ok {
+			op, value = "eq", param
+		}
+		bound, err := mirror.ParseTimestamp(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid parameter: timestamp")
+			return
+		}
+		switch op {
+		case "gt":
+			bounds = append(bounds, bound.Before)
+		case "gte":
+			bounds = append(bounds, func(t time.Time) bool { return !t.Before(bound) })
+		case "lt":
+			bounds = append(bounds, bound.After)
+		case "lte":
+			bounds = append(bounds, func(t time.Time) bool { return !t.After(bound) })
+		case "eq":
+			bounds = append(bounds, bound.Equal)
+		default:
+			writeError(w, http.StatusBadRequest, "Invalid parameter: timestamp")
+			return
+		}
+	}
+
+	s.mu.Lock()
+	var matches []mirror.Transaction
+	for _, txn := range s.transactions {
+		if accountID != "" && !involves(txn, accountID) {
+			continue
+		}
+		if query.Get("transactiontype") != "" && !strings.EqualFold(txn.Name, query.Get("transactiontype")) {
+			continue
+		}
+		if query.Get("result") == "success" && txn.Result != mirror.ResultSuccess {
+			continue
+		}
+		if query.Get("result") == "fail" && txn.Result == mirror.ResultSuccess {
+			continue
+		}
+		consensus := txn.ConsensusTime()
+		inBounds := true
+		for _, bound := range bounds {
+			inBounds = inBounds && bound(consensus)
+		}
+		if inBounds {
+			matches = append(matches, txn)
+		}
+	}
+	s.mu.Unlock()
+
+	if descending {
+		slices.Reverse(matches)
+	}
+	var next any
+	if len(matches) > limit {
+		matches = matches[:limit]
+		last := matches[len(matches)-1].ConsensusTimestamp
+		nextQuery := url.Values{}
+		for key, values := range query {
+			nextQuery[key] = values
+		}
+		var timestamps []string
+		for _, param := range query["timestamp"] {
+			op, _, _ := strings.Cut(param, ":")
+			if (descending && (op == "lt" || op == "lte")) || (!descending && (op == "gt" || op == "gte")) {
+				continue
+			}
+			timestamps = append(timestamps, param)
+		}
+		if descending {
+			timestamps = append(timestamps, "lt:"+last)
+		} else {
+			timestamps = append(timestamps, "gt:"+last)
+		}
+		nextQuery["timestamp"] = timestamps
+		next = "/api/v1/transactions?" + nextQuery.Encode()
+	}
+	if matches == nil {
+		matches = []mirror.Transaction{}
+	}
+	writeJSON(w, map[string]any{"transactions": matches, "links": map[string]any{"next": next}})
+}
+
+func involves(txn mirror.Transaction, accountID string) bool {
+	for _, transfer := range txn.Transfers {
+		if transfer.Account == accountID {
+			return true
+		}
+	}
+	for _, transfer := range txn.TokenTransfers {
+		if transfer.Account == accountID {
+			return true
+		}
+	}
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError answers in the mirror node's error format.
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"_status": map[string]any{"messages": []map[string]string{{"message": message}}}})
+}
@@ -0,0 +1,258 @@
+package mirror
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Transaction results and types as the mirror node names them.
+const (
+	ResultSuccess = "SUCCESS"
+	ResultDuplicate = "DUPLICATE_TRANSACTION"
+	TypeCryptoTransfer = "CRYPTOTRANSFER"
+)
+
+type Transfer struct {
+	Account string `json:"account"`
+	// Amount is in tinybars; negative amounts are debits.
+	Amount int64 `json:"amount"`
+}
+
+type TokenTransfer struct {
+	TokenID string `json:"token_id"`
+	Account string `json:"account"`
+	// Amount is in the token's smallest unit; negative amounts are debits.
+	Amount int64 `json:"amount"`
+}
+
+// Transaction is a transaction that reached consensus, successful or not.
+type Transaction struct {
+	// TransactionID is in the mirror node's 0.0.123-1700000000-000000001
+	// form; see TransactionIDFromMirror.
+	TransactionID string `json:"transaction_id"`
+	ConsensusTimestamp string `json:"consensus_timestamp"`
+	Name string `json:"name"`
+	Result string `json:"result"`
+	MemoBase64 string `json:"memo_base64"`
+	Nonce int `json:"nonce"`
+	Scheduled bool `json:"scheduled"`
+	Transfers []Transfer `json:"transfers"`
+	TokenTransfers []TokenTransfer `json:"token_transfers"`
+}
+
+func (t *Transaction) Memo() string {
+	memo, err := base64.StdEncoding.DecodeString(t.MemoBase64)
+	if err != nil {
+		return ""
+	}
+	return string(memo)
+}
+
+func (t *Transaction) Succeeded() bool {
+	return t.Result == ResultSuccess
+}
+
+// TokenAmount is the net amount of tokenID that moved into accountID.
+func (t *Transaction) TokenAmount(tokenID string, accountID string) int64 {
+	var amount int64
+	for _, transfer := range t.TokenTransfers {
+		if transfer.TokenID == tokenID && transfer.Account == accountID {
+			amount += transfer.Amount
+		}
+	}
+	return amount
+}
+
+func (t *Transaction) ConsensusTime() time.Time {
+	consensus, _ := ParseTimestamp(t.ConsensusTimestamp)
+	return consensus
+}
+
+type transactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+	Links links `json:"links"`
+}
+
+// GetTransaction returns the transaction with an ID in either the SDK's
+// 0.0.123@1700000000.000000001 form or the mirror node's form, or ErrNotFound
+// if it has not reached consensus (yet). When the same ID was submitted more
+// than once, the submission that was not rejected as a duplicate is returned.
+func (c *Client) GetTransaction(ctx context.Context, transactionID string) (*Transaction, error) {
+	var resp transactionsResponse
+	err := c.get(ctx, "/api/v1/transactions/"+url.PathEscape(TransactionIDToMirror(transactionID)), &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *Transaction
+	for i, txn := range resp.Transactions {
+		// child and scheduled transactions share the parent's ID
+		if txn.Nonce != 0 || txn.Scheduled {
+			continue
+		}
+		if found == nil || found.Result == ResultDuplicate {
+			found = &resp.Transactions[i]
+		}
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// TransferFilter selects transactions for ListTransfers. Zero fields don't
+// filter.
+type TransferFilter struct {
+	// AccountID is required: transactions that moved hbar or tokens into
+	// or out of it.
+	AccountID string
+	// TokenID keeps only transactions that moved this token for AccountID.
+	// The mirror node cannot filter by token, so this is done here and a
+	// page may come back shorter than Limit, or empty with a next cursor.
+	TokenID string
+	// Type is a mirror node transaction type such as TypeCryptoTransfer.
+	Type string
+	// SuccessfulOnly drops transactions that failed at consensus.
+	SuccessfulOnly bool
+	// After and Before bound the consensus timestamp, exclusively.
+	After time.Time
+	Before time.Time
+	// Descending lists newest first instead of oldest first.
+	Descending bool
+	// Limit is the page size, at most 100.
+	Limit int
+}
+
+func (f TransferFilter) path() string {
+	query := url.Values{}
+	query.Set("account.id", f.AccountID)
+	if f.Type != "" {
+		query.Set("transactiontype", f.Type)
+	}
+	if f.SuccessfulOnly {
+		query.Set("result", "success")
+	}
+	if !f.After.IsZero() {
+		query.Add("timestamp", "gt:"+FormatTimestamp(f.After))
+	}
+	if !f.Before.IsZero() {
+		query.Add("timestamp", "lt:"+FormatTimestamp(f.Before))
+	}
+	query.Set("order", "asc")
+	if f.Descending {
+		query.Set("order", "desc")
+	}
+	limit := f.Limit
+	if limit <= 0 || limit > 100 {
+		limit = 100
+	}
+	query.Set("limit", strconv.Itoa(limit))
+	return "/api/v1/transactions?" + query.Encode()
+}
+
+// ListTransfers returns a page of transactions matching filter, and the
+// cursor for the next page, which is empty on the last page. Pass an empty
+// cursor for the first page; later pages ignore all of filter but TokenID
+// and AccountID.
+func (c *Client) ListTransfers(ctx context.Context, filter TransferFilter, cursor string) ([]Transaction, string, error) {
+	if filter.AccountID == "" {
+		return nil, "", fmt.Errorf("mirror: ListTransfers needs an account")
+	}
+	path := cursor
+	if path == "" {
+		path = filter.path()
+	} else if !strings.HasPrefix(path, "/api/v1/transactions?") {
+		return nil, "", fmt.Errorf("mirror: invalid transfers cursor %q", cursor)
+	}
+
+	var resp transactionsResponse
+	err := c.get(ctx, path, &resp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	txns := resp.Transactions
+	if filter.TokenID != "" {
+		txns = txns[:0]
+		for _, txn := range resp.Transactions {
+			if txn.TokenAmount(filter.TokenID, filter.AccountID) != 0 {
+				txns = append(txns, txn)
+			}
+		}
+	}
+	return txns, resp.Links.Next, nil
+}
+
+// CursorTime is the consensus timestamp an ascending ListTransfers cursor
+// resumes after, or the zero time if cursor has none. Everything up to it has
+// been listed, including transactions dropped by the TokenID filter.
+func CursorTime(cursor string) time.Time {
+	_, query, _ := strings.Cut(cursor, "?")
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return time.Time{}
+	}
+	for _, param := range values["timestamp"] {
+		value, ok := strings.CutPrefix(param, "gt:")
+		if !ok {
+			continue
+		}
+		t, err := ParseTimestamp(value)
+		if err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// TransactionIDToMirror converts 0.0.123@1700000000.000000001 into the
+// mirror node's 0.0.123-1700000000-000000001. Other input is returned as is.
+func TransactionIDToMirror(id string) string {
+	account, validStart, ok := strings.Cut(id, "@")
+	if !ok {
+		return id
+	}
+	seconds, nanos, ok := strings.Cut(validStart, ".")
+	if !ok {
+		return id
+	}
+	return account + "-" + seconds + "-" + nanos
+}
+
+// TransactionIDFromMirror converts the mirror node's
+// 0.0.123-1700000000-000000001 into the 0.0.123@1700000000.000000001 form
+// used everywhere else. Other input is returned as is.
+func TransactionIDFromMirror(id string) string {
+	parts := strings.SplitN(id, "-", 3)
+	if len(parts) != 3 {
+		return id
+	}
+	return parts[0] + "@" + parts[1] + "." + parts[2]
+}
+
+// ParseTimestamp parses a consensus timestamp such as 1700000000.000000001.
+func ParseTimestamp(ts string) (time.Time, error) {
+	seconds, nanos, _ := strings.Cut(ts, ".")
+	s, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid consensus timestamp %q", ts)
+	}
+	var n int64
+	if nanos != "" {
+		n, err = strconv.ParseInt((nanos + "000000000")[:9], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid consensus timestamp %q", ts)
+		}
+	}
+	return time.Unix(s, n).UTC(), nil
+}
+
+// FormatTimestamp formats t as a consensus timestamp.
+func FormatTimestamp(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
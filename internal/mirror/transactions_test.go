@@ -0,0 +1,165 @@
+package mirror_test
+
+import (
+	"context"
+	"encoding/base64"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/mirror/mirrortest"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		ts string
+		want time.Time
+		wantErr bool
+	}{
+		{"1700000000.000000001", time.Unix(1700000000, 1), false},
+		{"1700000000.123456789", time.Unix(1700000000, 123456789), false},
+		{"1700000000", time.Unix(1700000000, 0), false},
+		// fewer than nine digits are a fraction of a second, not nanoseconds
+		{"1700000000.5", time.Unix(1700000000, 500000000), false},
+		{"1700000000.000100", time.Unix(1700000000, 100000), false},
+		{"", time.Time{}, true},
+		{"abc", time.Time{}, true},
+		{"1700000000.x", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ts, func(t *testing.T) {
+			got, err := mirror.ParseTimestamp(tt.ts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseTimestamp(%q) error = %v, want error %t", tt.ts, err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("ParseTimestamp(%q) = %v, want %v", tt.ts, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	tests := []struct {
+		t time.Time
+		want string
+	}{
+		{time.Unix(1700000000, 1), "1700000000.000000001"},
+		{time.Unix(1700000000, 0), "1700000000.000000000"},
+		{time.Unix(1700000000, 500000000).In(time.FixedZone("EAT", 3*60*60)), "1700000000.500000000"},
+	}
+	for _, tt := range tests {
+		got := mirror.FormatTimestamp(tt.t)
+		if got != tt.want {
+			t.Errorf("FormatTimestamp(%v) = %q, want %q", tt.t, got, tt.want)
+		}
+		parsed, err := mirror.ParseTimestamp(got)
+		if err != nil || !parsed.Equal(tt.t) {
+			t.Errorf("ParseTimestamp(%q) = %v, %v, want %v", got, parsed, err, tt.t)
+		}
+	}
+}
+
+func TestTransactionIDConversion(t *testing.T) {
+	const sdk, mirrorForm = "0.0.123@1700000000.000000001", "0.0.123-1700000000-000000001"
+	if got := mirror.TransactionIDToMirror(sdk); got != mirrorForm {
+		t.Errorf("TransactionIDToMirror(%q) = %q, want %q", sdk, got, mirrorForm)
+	}
+	if got := mirror.TransactionIDFromMirror(mirrorForm); got != sdk {
+		t.Errorf("TransactionIDFromMirror(%q) = %q, want %q", mirrorForm, got, sdk)
+	}
+	if got := mirror.TransactionIDToMirror(mirrorForm); got != mirrorForm {
+		t.Errorf("TransactionIDToMirror(%q) = %q, want it unchanged", mirrorForm, got)
+	}
+}
+
+// addDeposit records a transfer of units of token into the treasury at
+// consensus second sec.
+func addDeposit(server *mirrortest.Server, sec int64, token string, units int64) {
+	server.AddTransaction(mirror.Transaction{
+		TransactionID: "0.0.1234-" + strconv.FormatInt(sec, 10) + "-000000000",
+		ConsensusTimestamp: mirror.FormatTimestamp(time.Unix(sec, 0)),
+		MemoBase64: base64.StdEncoding.EncodeToString([]byte("deposit " + strconv.FormatInt(sec, 10))),
+		TokenTransfers: []mirror.TokenTransfer{
+			{TokenID: token, Account: "0.0.1234", Amount: -units},
+			{TokenID: token, Account: "0.0.98", Amount: units},
+		},
+	})
+}
+
+func TestListTransfersPaginates(t *testing.T) {
+	server := mirrortest.NewServer()
+	defer server.Close()
+	for sec := int64(1700000001); sec <= 1700000005; sec++ {
+		addDeposit(server, sec, usdc, 100)
+	}
+	// another token's transfer is on the pages but filtered out
+	addDeposit(server, 1700000006, "0.0.5555", 100)
+
+	client := server.Client()
+	filter := mirror.TransferFilter{AccountID: "0.0.98", TokenID: usdc, After: time.Unix(1700000000, 0), Limit: 2}
+	var memos []string
+	var pages int
+	cursor := ""
+	for {
+		txns, next, err := client.ListTransfers(context.Background(), filter, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, txn := range txns {
+			memos = append(memos, txn.Memo())
+		}
+		if next == "" {
+			break
+		}
+		// the cursor resumes after the last transaction on the page
+		if len(txns) > 0 && !mirror.CursorTime(next).Equal(txns[len(txns)-1].ConsensusTime()) {
+			t.Errorf("CursorTime(%q) = %v, want %v", next, mirror.CursorTime(next), txns[len(txns)-1].ConsensusTime())
+		}
+		cursor = next
+		if pages > 10 {
+			t.Fatal("pagination did not end")
+		}
+	}
+
+	want := []string{"deposit 1700000001", "deposit 1700000002", "deposit 1700000003", "deposit 1700000004", "deposit 1700000005"}
+	if len(memos) != len(want) {
+		t.Fatalf("listed %q, want %q", memos, want)
+	}
+	for i := range want {
+		if memos[i] != want[i] {
+			t.Errorf("transfer %d is %q, want %q", i, memos[i], want[i])
+		}
+	}
+	if pages != 3 {
+		t.Errorf("read %d pages, want 3", pages)
+	}
+}
+
+func TestListTransfersAfter(t *testing.T) {
+	server := mirrortest.NewServer()
+	defer server.Close()
+	addDeposit(server, 1700000001, usdc, 100)
+	addDeposit(server, 1700000002, usdc, 100)
+
+	// After is exclusive
+	txns, next, err := server.Client().ListTransfers(context.Background(), mirror.TransferFilter{AccountID: "0.0.98", After: time.Unix(1700000001, 0)}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(txns) != 1 || txns[0].Memo() != "deposit 1700000002" || next != "" {
+		t.Errorf("ListTransfers() = %d transfers, next %q, want only the second deposit and no next page", len(txns), next)
+	}
+}
+
+func TestListTransfersRejectsForeignCursor(t *testing.T) {
+	server := mirrortest.NewServer()
+	defer server.Close()
+
+	_, _, err := server.Client().ListTransfers(context.Background(), mirror.TransferFilter{AccountID: "0.0.98"}, "https://example.com/api/v1/transactions?limit=1")
+	if err == nil {
+		t.Error("ListTransfers() with a cursor for another host succeeded, want an error")
+	}
+}
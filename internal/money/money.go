@@ -0,0 +1,61 @@
+package money
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// Rounding rules for every amount we store or send anywhere. Conversions
+// always round down so that we never charge or deliver more than was quoted.
+const (
+	// M-Pesa only moves whole shillings.
+	KESPlaces = 0
+	// The USDC token on Hedera has six decimals.
+	USDCPlaces = 6
+	// exchange_rate is stored as DECIMAL(10,4).
+	RatePlaces = 4
+)
+
+func KES(amount decimal.Decimal) decimal.Decimal {
+	return amount.RoundFloor(KESPlaces)
+}
+
+func USDC(amount decimal.Decimal) decimal.Decimal {
+	return amount.RoundFloor(USDCPlaces)
+}
+
+func Rate(rate decimal.Decimal) decimal.Decimal {
+	return rate.Round(RatePlaces)
+}
+
+// KESToUSDC converts at a KES-per-USDC rate.
+func KESToUSDC(amountKSH decimal.Decimal, rate decimal.Decimal) decimal.Decimal {
+	return USDC(amountKSH.Div(rate))
+}
+
+// USDCToKES converts at a KES-per-USDC rate.
+func USDCToKES(amountUSDC decimal.Decimal, rate decimal.Decimal) decimal.Decimal {
+	return KES(amountUSDC.Mul(rate))
+}
+
+// ToUnits expresses amount in the smallest unit of a token with the given
+// number of decimals. It refuses amounts that would need rounding.
+func ToUnits(amount decimal.Decimal, decimals uint32) (int64, error) {
+	units := amount.Shift(int32(decimals))
+	if !units.Equal(units.Truncate(0)) {
+		return 0, fmt.Errorf("amount %s has more than %d decimal places", amount, decimals)
+	}
+	return units.IntPart(), nil
+}
+
+// FromUnits is the inverse of ToUnits.
+func FromUnits(units int64, decimals uint32) decimal.Decimal {
+	return decimal.New(units, -int32(decimals))
+}
+
+// WholeKES returns amount as an integer number of shillings for Daraja,
+// refusing fractional amounts rather than silently truncating them.
+func WholeKES(amount decimal.Decimal) (int64, error) {
+	return ToUnits(amount, KESPlaces)
+}
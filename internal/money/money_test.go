@@ -0,0 +1,83 @@
+package money
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func TestRounding(t *testing.T) {
+	tests := []struct {
+		name string
+		got decimal.Decimal
+		want string
+	}{
+		{"KES drops cents", KES(d("1000.99")), "1000"},
+		{"KES whole", KES(d("1000")), "1000"},
+		{"USDC to six places", USDC(d("7.1644049")), "7.164404"},
+		{"USDC never rounds up", USDC(d("0.0000019")), "0.000001"},
+		{"rate to four places", Rate(d("132.61234")), "132.6123"},
+		{"rate rounds half up", Rate(d("132.61235")), "132.6124"},
+		// 950 / 132.6 = 7.16440422...
+		{"KES to USDC", KESToUSDC(d("950"), d("132.6")), "7.164404"},
+		{"KES to USDC exact", KESToUSDC(d("1300"), d("130")), "10"},
+		// 7.164404 * 132.6 = 949.9999704
+		{"USDC to KES", USDCToKES(d("7.164404"), d("132.6")), "949"},
+		{"USDC to KES exact", USDCToKES(d("10"), d("130")), "1300"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.got.Equal(d(tt.want)) {
+				t.Errorf("got %s, want %s", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToUnits(t *testing.T) {
+	tests := []struct {
+		amount string
+		decimals uint32
+		want int64
+		wantErr bool
+	}{
+		{"7.164404", 6, 7164404, false},
+		{"10", 6, 10000000, false},
+		{"0.000001", 6, 1, false},
+		{"0", 6, 0, false},
+		{"35.82", 2, 3582, false},
+		{"1000", 0, 1000, false},
+		{"0.0000001", 6, 0, true},
+		{"35.825", 2, 0, true},
+		{"1000.5", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.amount, func(t *testing.T) {
+			got, err := ToUnits(d(tt.amount), tt.decimals)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ToUnits(%s, %d) error = %v, want error %t", tt.amount, tt.decimals, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ToUnits(%s, %d) = %d, want %d", tt.amount, tt.decimals, got, tt.want)
+			}
+			if !tt.wantErr && !FromUnits(got, tt.decimals).Equal(d(tt.amount)) {
+				t.Errorf("FromUnits(%d, %d) = %s, want %s", got, tt.decimals, FromUnits(got, tt.decimals), tt.amount)
+			}
+		})
+	}
+}
+
+func TestWholeKES(t *testing.T) {
+	got, err := WholeKES(d("1000"))
+	if err != nil || got != 1000 {
+		t.Errorf("WholeKES(1000) = %d, %v, want 1000", got, err)
+	}
+	_, err = WholeKES(d("999.50"))
+	if err == nil {
+		t.Error("WholeKES(999.50) succeeded, want an error rather than truncating")
+	}
+}
@@ -0,0 +1,141 @@
+package payments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ErrMalformedCallback means an STK callback could not be parsed or is
+// missing an item that a successful payment must carry.
+var ErrMalformedCallback = errors.New("malformed STK callback")
+
+// STKCallback is the result of an STK push as delivered to CALLBACK_URL. The
+// payment fields are only set when ResultCode is 0.
+type STKCallback struct {
+	MerchantRequestID string
+	CheckoutRequestID string
+	ResultCode int
+	ResultDesc string
+	Amount decimal.Decimal
+	MpesaReceiptNumber string
+	TransactionDate time.Time
+	PhoneNumber string
+}
+
+func (c *STKCallback) Succeeded() bool {
+	return c.ResultCode == 0
+}
+
+type stkCallbackEnvelope struct {
+	Body struct {
+		StkCallback struct {
+			MerchantRequestID string `json:"MerchantRequestID"`
+			CheckoutRequestID string `json:"CheckoutRequestID"`
+			ResultCode *int `json:"ResultCode"`
+			ResultDesc string `json:"ResultDesc"`
+			CallbackMetadata struct {
+				Item []struct {
+					Name string `json:"Name"`
+					Value json.RawMessage `json:"Value"`
+				} `json:"Item"`
+			} `json:"CallbackMetadata"`
+		} `json:"stkCallback"`
+	} `json:"Body"`
+}
+
+// ParseSTKCallback decodes an STK callback, reading metadata items by name
+// rather than position since Safaricom does not guarantee their order.
+func ParseSTKCallback(body []byte) (*STKCallback, error) {
+	var envelope stkCallbackEnvelope
+	err := json.Unmarshal(body, &envelope)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedCallback, err)
+	}
+
+	raw := envelope.Body.StkCallback
+	if raw.CheckoutRequestID == "" {
+		return nil, fmt.Errorf("%w: missing CheckoutRequestID", ErrMalformedCallback)
+	}
+	if raw.ResultCode == nil {
+		return nil, fmt.Errorf("%w: missing ResultCode", ErrMalformedCallback)
+	}
+
+	callback := &STKCallback{
+		MerchantRequestID: raw.MerchantRequestID,
+		CheckoutRequestID: raw.CheckoutRequestID,
+		ResultCode: *raw.ResultCode,
+		ResultDesc: raw.ResultDesc,
+	}
+	if !callback.Succeeded() {
+		return callback, nil
+	}
+
+	items := make(map[string]string, len(raw.CallbackMetadata.Item))
+	for _, item := range raw.CallbackMetadata.Item {
+		items[item.Name] = itemValue(item.Value)
+	}
+
+	amount, ok := items["Amount"]
+	if !ok {
+		return nil, fmt.Errorf("%w: missing Amount", ErrMalformedCallback)
+	}
+	callback.Amount, err = decimal.NewFromString(amount)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid Amount %q", ErrMalformedCallback, amount)
+	}
+
+	callback.MpesaReceiptNumber = items["MpesaReceiptNumber"]
+	if callback.MpesaReceiptNumber == "" {
+		return nil, fmt.Errorf("%w: missing MpesaReceiptNumber", ErrMalformedCallback)
+	}
+
+	callback.PhoneNumber = items["PhoneNumber"]
+	if callback.PhoneNumber == "" {
+		return nil, fmt.Errorf("%w: missing PhoneNumber", ErrMalformedCallback)
+	}
+
+	if date := items["TransactionDate"]; date != "" {
+		callback.TransactionDate, err = time.ParseInLocation("20060102150405", date, eat)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid TransactionDate %q", ErrMalformedCallback, date)
+		}
+	}
+
+	return callback, nil
+}
+
+// itemValue returns an item's value as text. Daraja sends numbers such as
+// PhoneNumber and TransactionDate as JSON numbers, which must not go through
+// float64 or they lose digits.
+func itemValue(value json.RawMessage) string {
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		return s
+	}
+	text := strings.TrimSpace(string(value))
+	if text == "null" {
+		return ""
+	}
+	if _, err := strconv.ParseFloat(text, 64); err != nil {
+		return ""
+	}
+	return text
+}
+
+// B2CResult is what Daraja posts to a payout's result and queue timeout URLs.
+type B2CResult struct {
+	Result struct {
+		ResultType int `json:"ResultType"`
+		ResultCode int `json:"ResultCode"`
+		ResultDesc string `json:"ResultDesc"`
+		OriginatorConversationID string `json:"OriginatorConversationID"`
+		ConversationID string `json:"ConversationID"`
+		TransactionID string `json:"TransactionID"`
+	} `json:"Result"`
+}
@@ -0,0 +1,106 @@
+package payments
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func stkCallbackBody(resultCode, items string) []byte {
+	return []byte(`{"Body": {"stkCallback": {
+		"MerchantRequestID": "29115-34620561-1",
+		"CheckoutRequestID": "ws_CO_191220191020363925",
+		"ResultCode": ` + resultCode + `,
+		"ResultDesc": "The service request is processed successfully.",
+		"CallbackMetadata": {"Item": [` + items + `]}
+	}}}`)
+}
+
+const (
+	itemAmount = `{"Name": "Amount", "Value": 1.00}`
+	itemReceipt = `{"Name": "MpesaReceiptNumber", "Value": "NLJ7RT61SV"}`
+	itemBalance = `{"Name": "Balance"}`
+	itemDate = `{"Name": "TransactionDate", "Value": 20191219102115}`
+	itemPhone = `{"Name": "PhoneNumber", "Value": 254708374149}`
+)
+
+func TestParseSTKCallback(t *testing.T) {
+	want := time.Date(2019, 12, 19, 7, 21, 15, 0, time.UTC)
+
+	orders := map[string]string{
+		"documented order": itemAmount + "," + itemReceipt + "," + itemBalance + "," + itemDate + "," + itemPhone,
+		"reordered": itemPhone + "," + itemDate + "," + itemReceipt + "," + itemAmount,
+		"strings": `{"Name": "PhoneNumber", "Value": "254708374149"}, {"Name": "Amount", "Value": "1.00"}, {"Name": "TransactionDate", "Value": "20191219102115"}, ` + itemReceipt,
+	}
+	for name, items := range orders {
+		t.Run(name, func(t *testing.T) {
+			callback, err := ParseSTKCallback(stkCallbackBody("0", items))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !callback.Succeeded() {
+				t.Error("callback did not succeed")
+			}
+			if callback.CheckoutRequestID != "ws_CO_191220191020363925" || callback.MerchantRequestID != "29115-34620561-1" {
+				t.Errorf("request IDs %q, %q", callback.CheckoutRequestID, callback.MerchantRequestID)
+			}
+			if !callback.Amount.Equal(decimal.NewFromInt(1)) {
+				t.Errorf("amount %s, want 1", callback.Amount)
+			}
+			if callback.MpesaReceiptNumber != "NLJ7RT61SV" {
+				t.Errorf("receipt %q", callback.MpesaReceiptNumber)
+			}
+			// a float64 would have printed 2.54708374149e+11
+			if callback.PhoneNumber != "254708374149" {
+				t.Errorf("phone %q", callback.PhoneNumber)
+			}
+			if !callback.TransactionDate.Equal(want) {
+				t.Errorf("transaction date %s, want %s", callback.TransactionDate, want)
+			}
+		})
+	}
+}
+
+func TestParseSTKCallbackFailure(t *testing.T) {
+	body := []byte(`{"Body": {"stkCallback": {
+		"MerchantRequestID": "8555-67195-1",
+		"CheckoutRequestID": "ws_CO_27072017151044001",
+		"ResultCode": 1032,
+		"ResultDesc": "Request cancelled by user"
+	}}}`)
+
+	callback, err := ParseSTKCallback(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if callback.Succeeded() || callback.ResultCode != 1032 || callback.ResultDesc != "Request cancelled by user" {
+		t.Errorf("got %+v, want a cancelled callback", callback)
+	}
+	if callback.MpesaReceiptNumber != "" || !callback.Amount.IsZero() {
+		t.Errorf("failed callback carries payment fields: %+v", callback)
+	}
+}
+
+func TestParseSTKCallbackMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"not json": []byte(`{"Body": `),
+		"no checkout ID": []byte(`{"Body": {"stkCallback": {"ResultCode": 0}}}`),
+		"no result code": []byte(`{"Body": {"stkCallback": {"CheckoutRequestID": "ws_CO_1"}}}`),
+		"no amount": stkCallbackBody("0", itemReceipt+","+itemDate+","+itemPhone),
+		"invalid amount": stkCallbackBody("0", `{"Name": "Amount", "Value": "one"}, `+itemReceipt+","+itemPhone),
+		"no receipt": stkCallbackBody("0", itemAmount+","+itemDate+","+itemPhone),
+		"no phone": stkCallbackBody("0", itemAmount+","+itemReceipt+","+itemDate),
+		"null phone": stkCallbackBody("0", itemAmount+","+itemReceipt+`, {"Name": "PhoneNumber", "Value": null}`),
+		"invalid date": stkCallbackBody("0", itemAmount+","+itemReceipt+","+itemPhone+`, {"Name": "TransactionDate", "Value": 20191319102115}`),
+	}
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseSTKCallback(body)
+			if !errors.Is(err, ErrMalformedCallback) {
+				t.Errorf("got %v, want ErrMalformedCallback", err)
+			}
+		})
+	}
+}
@@ -2,15 +2,24 @@ package payments
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
 	"log"
 	"net/http"
+	neturl "net/url"
 	"os"
 	"strconv"
+	"sync"
 	"time"
+
+	"github.com/nhx-finance/wallet/internal/money"
+	"github.com/shopspring/decimal"
+	"golang.org/x/sync/singleflight"
 )
 
 type STKPushResponse struct {
@@ -26,15 +35,70 @@ type AuthorizationResponse struct {
 	ExpiresIn string `json:"expires_in"`
 }
 
+// STKQueryResponse is returned by the STK Push Query API. While the payment is
+// still in progress Daraja answers with an error code instead of a result.
+type STKQueryResponse struct {
+	ResponseCode string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+	MerchantRequestID string `json:"MerchantRequestID"`
+	CheckoutRequestID string `json:"CheckoutRequestID"`
+	ResultCode string `json:"ResultCode"`
+	ResultDesc string `json:"ResultDesc"`
+	RequestID string `json:"requestId"`
+	ErrorCode string `json:"errorCode"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+const stkQueryInProgressCode = "500.001.1001"
 
-func InitiateSTKPush(phone string, amountKSH float64, hederaAccountID string) (*STKPushResponse, error) {
-	url := os.Getenv("STK_PUSH_URL")
-	if url == "" {
-		return nil, errors.New("STK_PUSH_URL is not set")
+// InProgress reports whether the customer has not yet completed or abandoned
+// the STK prompt.
+func (qr *STKQueryResponse) InProgress() bool {
+	return qr.ErrorCode == stkQueryInProgressCode
+}
+
+type B2CResponse struct {
+	ConversationID string `json:"ConversationID"`
+	OriginatorConversationID string `json:"OriginatorConversationID"`
+	ResponseCode string `json:"ResponseCode"`
+	ResponseDescription string `json:"ResponseDescription"`
+}
+
+// tokenRefreshMargin is how long before expiry a cached token is considered
+// stale, so that a request never goes out with a token about to lapse.
+const tokenRefreshMargin = time.Minute
+
+// Daraja expects timestamps in East Africa Time.
+var eat = time.FixedZone("EAT", 3*60*60)
+
+// DarajaClient talks to Safaricom's Daraja API. It caches the OAuth bearer
+// token until shortly before it expires and makes sure concurrent callers
+// share a single refresh.
+type DarajaClient struct {
+	httpClient *http.Client
+	authURL string
+	consumerKey string
+	consumerSecret string
+
+	mu sync.RWMutex
+	token string
+	expiresAt time.Time
+	refresh singleflight.Group
+}
+
+func NewDarajaClient(authURL string, consumerKey string, consumerSecret string, timeout time.Duration) *DarajaClient {
+	return &DarajaClient{
+		httpClient: &http.Client{Timeout: timeout},
+		authURL: authURL,
+		consumerKey: consumerKey,
+		consumerSecret: consumerSecret,
 	}
-	businessShortCode := os.Getenv("BUSINESS_SHORT_CODE")
-	if businessShortCode == "" {
-		return nil, errors.New("BUSINESS_SHORT_CODE is not set")
+}
+
+func NewDarajaClientFromEnv(timeout time.Duration) (*DarajaClient, error) {
+	authURL := os.Getenv("AUTHORIZATION_URL")
+	if authURL == "" {
+		return nil, errors.New("AUTHORIZATION_URL is not set")
 	}
 	consumerKey := os.Getenv("CONSUMER_KEY")
 	if consumerKey == "" {
@@ -44,6 +108,21 @@ func InitiateSTKPush(phone string, amountKSH float64, hederaAccountID string) (*
 	if consumerSecret == "" {
 		return nil, errors.New("CONSUMER_SECRET is not set")
 	}
+
+	return NewDarajaClient(authURL, consumerKey, consumerSecret, timeout), nil
+}
+
+// InitiateSTKPush sends the payment prompt. callbackToken is added to
+// CALLBACK_URL so that the callback can prove it came from this request.
+func (dc *DarajaClient) InitiateSTKPush(ctx context.Context, phone string, amountKSH decimal.Decimal, hederaAccountID string, callbackToken string) (*STKPushResponse, error) {
+	url := os.Getenv("STK_PUSH_URL")
+	if url == "" {
+		return nil, errors.New("STK_PUSH_URL is not set")
+	}
+	businessShortCode := os.Getenv("BUSINESS_SHORT_CODE")
+	if businessShortCode == "" {
+		return nil, errors.New("BUSINESS_SHORT_CODE is not set")
+	}
 	passKey := os.Getenv("PASS_KEY")
 	if passKey == "" {
 		return nil, errors.New("PASS_KEY is not set")
@@ -52,6 +131,10 @@ func InitiateSTKPush(phone string, amountKSH float64, hederaAccountID string) (*
 	if callbackURL == "" {
 		return nil, errors.New("CALLBACK_URL is not set")
 	}
+	callbackURL, err := withCallbackToken(callbackURL, callbackToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CALLBACK_URL: %w", err)
+	}
 
 	businessShortCodeInt, err := strconv.ParseInt(businessShortCode, 10, 64)
 	if err != nil {
@@ -61,16 +144,18 @@ func InitiateSTKPush(phone string, amountKSH float64, hederaAccountID string) (*
 	if err != nil {
 		return nil, errors.New("phone number must be a valid integer")
 	}
+	amount, err := money.WholeKES(amountKSH)
+	if err != nil {
+		return nil, err
+	}
 
-	method := "POST"
-	timestamp := time.Now().Format("YYYYMMDDHHmmss")
-	password := base64.StdEncoding.EncodeToString([]byte(businessShortCode + passKey + timestamp))
+	password, timestamp := stkPassword(businessShortCode, passKey)
 	payloadData := map[string]any{
 		"BusinessShortCode": businessShortCodeInt,
 		"Password": password,
 		"Timestamp": timestamp,
 		"TransactionType": "CustomerPayBillOnline",
-		"Amount": int(amountKSH),
+		"Amount": amount,
 		"PartyA": phoneInt,
 		"PartyB": businessShortCodeInt,
 		"PhoneNumber": phoneInt,
@@ -78,87 +163,280 @@ func InitiateSTKPush(phone string, amountKSH float64, hederaAccountID string) (*
 		"AccountReference": "NHXWALLET",
 		"TransactionDesc": "USDC Purchase",
 	}
-	
-	payloadBytes, err := json.Marshal(payloadData)
+
+	var stkResp STKPushResponse
+	statusCode, err := dc.postJSON(ctx, url, payloadData, &stkResp)
 	if err != nil {
-		log.Println("failed to marshal payload", err)
+		log.Println("failed to do STK push request", err)
 		return nil, err
 	}
-	payload := bytes.NewReader(payloadBytes)
-	client := &http.Client{}
-	httpReq, err := http.NewRequest(method, url, payload)
+
+	log.Println("STK push response status code: ", statusCode)
+
+	return &stkResp, nil
+}
+
+// NewCallbackToken returns a random token to put in a callback URL, so that
+// the callback can be told apart from a forged one.
+func NewCallbackToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
 	if err != nil {
-		log.Println("failed to create HTTP request", err)
-		return nil, err
+		return "", err
 	}
+	return hex.EncodeToString(b), nil
+}
 
-	accessToken, err := getAccessToken()
+func withCallbackToken(callbackURL string, token string) (string, error) {
+	if token == "" {
+		return callbackURL, nil
+	}
+	u, err := neturl.Parse(callbackURL)
 	if err != nil {
-		log.Println("failed to get access token", err)
-		return nil, err
+		return "", err
 	}
-	httpReq.Header.Add("Content-Type", "application/json")
-	httpReq.Header.Add("Authorization", "Bearer " + accessToken.AccessToken)
-	
-	res, err := client.Do(httpReq)
+	query := u.Query()
+	query.Set("token", token)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+func (dc *DarajaClient) QuerySTKPush(ctx context.Context, checkoutRequestID string) (*STKQueryResponse, error) {
+	url := os.Getenv("STK_QUERY_URL")
+	if url == "" {
+		return nil, errors.New("STK_QUERY_URL is not set")
+	}
+	businessShortCode := os.Getenv("BUSINESS_SHORT_CODE")
+	if businessShortCode == "" {
+		return nil, errors.New("BUSINESS_SHORT_CODE is not set")
+	}
+	passKey := os.Getenv("PASS_KEY")
+	if passKey == "" {
+		return nil, errors.New("PASS_KEY is not set")
+	}
+
+	businessShortCodeInt, err := strconv.ParseInt(businessShortCode, 10, 64)
 	if err != nil {
-		log.Println("failed to do HTTP request", err)
-		return nil, err
+		return nil, errors.New("BUSINESS_SHORT_CODE must be a valid integer")
 	}
-	defer res.Body.Close()
-	
-	bodyBytes, err := io.ReadAll(res.Body)
+
+	password, timestamp := stkPassword(businessShortCode, passKey)
+	payloadData := map[string]any{
+		"BusinessShortCode": businessShortCodeInt,
+		"Password": password,
+		"Timestamp": timestamp,
+		"CheckoutRequestID": checkoutRequestID,
+	}
+
+	var queryResp STKQueryResponse
+	statusCode, err := dc.postJSON(ctx, url, payloadData, &queryResp)
 	if err != nil {
-		log.Println("failed to read response body", err)
+		log.Println("failed to do STK query request", err)
 		return nil, err
 	}
-	
-	log.Println("STK push response status code: ", res.StatusCode)
-	
-	var stkResp STKPushResponse
-	if err := json.Unmarshal(bodyBytes, &stkResp); err != nil {
-		log.Println("failed to decode STK push response", err)
-		return nil, err
+	if queryResp.ResultCode == "" && !queryResp.InProgress() {
+		return nil, fmt.Errorf("STK query for %s failed with status %d: %s %s", checkoutRequestID, statusCode, queryResp.ErrorCode, queryResp.ErrorMessage)
 	}
-	
-	return &stkResp, nil
+
+	return &queryResp, nil
 }
 
-func getAccessToken() (*AuthorizationResponse, error) {
-	url := os.Getenv("AUTHORIZATION_URL")
+func (dc *DarajaClient) InitiateB2CPayment(ctx context.Context, phone string, amountKSH decimal.Decimal, originatorConversationID string, callbackToken string) (*B2CResponse, error) {
+	url := os.Getenv("B2C_URL")
 	if url == "" {
-		return nil, errors.New("AUTHORIZATION_URL is not set")
+		return nil, errors.New("B2C_URL is not set")
 	}
-	consumerKey := os.Getenv("CONSUMER_KEY")
-	if consumerKey == "" {
-		return nil, errors.New("CONSUMER_KEY is not set")
+	initiatorName := os.Getenv("B2C_INITIATOR_NAME")
+	if initiatorName == "" {
+		return nil, errors.New("B2C_INITIATOR_NAME is not set")
 	}
-	consumerSecret := os.Getenv("CONSUMER_SECRET")
-	if consumerSecret == "" {
-		return nil, errors.New("CONSUMER_SECRET is not set")
+	securityCredential := os.Getenv("B2C_SECURITY_CREDENTIAL")
+	if securityCredential == "" {
+		return nil, errors.New("B2C_SECURITY_CREDENTIAL is not set")
+	}
+	shortCode := os.Getenv("B2C_SHORT_CODE")
+	if shortCode == "" {
+		return nil, errors.New("B2C_SHORT_CODE is not set")
+	}
+	resultURL := os.Getenv("B2C_RESULT_URL")
+	if resultURL == "" {
+		return nil, errors.New("B2C_RESULT_URL is not set")
+	}
+	timeoutURL := os.Getenv("B2C_TIMEOUT_URL")
+	if timeoutURL == "" {
+		return nil, errors.New("B2C_TIMEOUT_URL is not set")
+	}
+	resultURL, err := withCallbackToken(resultURL, callbackToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid B2C_RESULT_URL: %w", err)
+	}
+	timeoutURL, err = withCallbackToken(timeoutURL, callbackToken)
+	if err != nil {
+		return nil, fmt.Errorf("invalid B2C_TIMEOUT_URL: %w", err)
 	}
 
-	encodedCredentials := base64.StdEncoding.EncodeToString([]byte(consumerKey + ":" + consumerSecret))
+	shortCodeInt, err := strconv.ParseInt(shortCode, 10, 64)
+	if err != nil {
+		return nil, errors.New("B2C_SHORT_CODE must be a valid integer")
+	}
+	phoneInt, err := strconv.ParseInt(phone, 10, 64)
+	if err != nil {
+		return nil, errors.New("phone number must be a valid integer")
+	}
+	amount, err := money.WholeKES(amountKSH)
+	if err != nil {
+		return nil, err
+	}
 
-	httpReq, err := http.NewRequest("GET", url, nil)
+	payloadData := map[string]any{
+		"OriginatorConversationID": originatorConversationID,
+		"InitiatorName": initiatorName,
+		"SecurityCredential": securityCredential,
+		"CommandID": "BusinessPayment",
+		"Amount": amount,
+		"PartyA": shortCodeInt,
+		"PartyB": phoneInt,
+		"Remarks": "USDC Withdrawal",
+		"QueueTimeOutURL": timeoutURL,
+		"ResultURL": resultURL,
+		"Occasion": "NHXWALLET",
+	}
+
+	var b2cResp B2CResponse
+	statusCode, err := dc.postJSON(ctx, url, payloadData, &b2cResp)
 	if err != nil {
+		log.Println("failed to do B2C request", err)
 		return nil, err
 	}
+
+	log.Println("B2C response status code: ", statusCode)
+
+	return &b2cResp, nil
+}
+
+func stkPassword(businessShortCode string, passKey string) (string, string) {
+	timestamp := time.Now().In(eat).Format("20060102150405")
+	password := base64.StdEncoding.EncodeToString([]byte(businessShortCode + passKey + timestamp))
+	return password, timestamp
+}
+
+// postJSON sends an authenticated JSON request and decodes the response into
+// out. A 401 is retried once with a freshly fetched token in case the cached
+// one was revoked early.
+func (dc *DarajaClient) postJSON(ctx context.Context, url string, payload any, out any) (int, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		accessToken, err := dc.accessToken(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get access token: %w", err)
+		}
+
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payloadBytes))
+		if err != nil {
+			return 0, err
+		}
+		httpReq.Header.Add("Content-Type", "application/json")
+		httpReq.Header.Add("Authorization", "Bearer " + accessToken)
+
+		res, err := dc.httpClient.Do(httpReq)
+		if err != nil {
+			return 0, err
+		}
+
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			res.Body.Close()
+			dc.invalidateToken(accessToken)
+			continue
+		}
+
+		err = json.NewDecoder(res.Body).Decode(out)
+		res.Body.Close()
+		if err != nil {
+			return res.StatusCode, fmt.Errorf("failed to decode response (status %d): %w", res.StatusCode, err)
+		}
+
+		return res.StatusCode, nil
+	}
+}
+
+func (dc *DarajaClient) accessToken(ctx context.Context) (string, error) {
+	dc.mu.RLock()
+	token, expiresAt := dc.token, dc.expiresAt
+	dc.mu.RUnlock()
+
+	if token != "" && time.Now().Before(expiresAt) {
+		return token, nil
+	}
+
+	// Requests that arrive while a refresh is in flight wait for it rather
+	// than each hitting the auth endpoint.
+	result, err, _ := dc.refresh.Do("token", func() (any, error) {
+		return dc.fetchToken(context.WithoutCancel(ctx))
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return result.(string), nil
+}
+
+func (dc *DarajaClient) invalidateToken(token string) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.token == token {
+		dc.token = ""
+		dc.expiresAt = time.Time{}
+	}
+}
+
+func (dc *DarajaClient) fetchToken(ctx context.Context) (string, error) {
+	encodedCredentials := base64.StdEncoding.EncodeToString([]byte(dc.consumerKey + ":" + dc.consumerSecret))
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, dc.authURL, nil)
+	if err != nil {
+		return "", err
+	}
 	httpReq.Header.Add("Authorization", "Basic " + encodedCredentials)
 	httpReq.Header.Add("Content-Type", "application/json")
 
-	client := &http.Client{}
-
-	res, err := client.Do(httpReq)
+	res, err := dc.httpClient.Do(httpReq)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("authorization endpoint returned status %d", res.StatusCode)
+	}
+
 	var authResp AuthorizationResponse
 	if err := json.NewDecoder(res.Body).Decode(&authResp); err != nil {
-		return nil, err
+		return "", err
+	}
+	if authResp.AccessToken == "" {
+		return "", errors.New("authorization response has no access token")
+	}
+
+	expiresIn, err := strconv.Atoi(authResp.ExpiresIn)
+	if err != nil {
+		return "", fmt.Errorf("invalid expires_in %q: %w", authResp.ExpiresIn, err)
 	}
-	
-	return &authResp, nil
-}
\ No newline at end of file
+	lifetime := time.Duration(expiresIn) * time.Second
+	if lifetime > 2*tokenRefreshMargin {
+		lifetime -= tokenRefreshMargin
+	} else {
+		lifetime /= 2
+	}
+
+	dc.mu.Lock()
+	dc.token = authResp.AccessToken
+	dc.expiresAt = time.Now().Add(lifetime)
+	dc.mu.Unlock()
+
+	return authResp.AccessToken, nil
+}
@@ -0,0 +1,210 @@
+package payments
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeAuth issues numbered tokens, each valid for expiresIn seconds.
+type fakeAuth struct {
+	*httptest.Server
+	calls atomic.Int32
+	expiresIn string
+	// release, if set, holds every token request until it is closed.
+	release chan struct{}
+}
+
+func newFakeAuth(t *testing.T, expiresIn string) *fakeAuth {
+	fa := &fakeAuth{expiresIn: expiresIn}
+	fa.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("key:secret")) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if fa.release != nil {
+			<-fa.release
+		}
+		n := fa.calls.Add(1)
+		json.NewEncoder(w).Encode(AuthorizationResponse{AccessToken: "token-" + strconv.Itoa(int(n)), ExpiresIn: fa.expiresIn})
+	}))
+	t.Cleanup(fa.Close)
+	return fa
+}
+
+func TestAccessTokenIsCached(t *testing.T) {
+	auth := newFakeAuth(t, "3599")
+	dc := NewDarajaClient(auth.URL, "key", "secret", 5*time.Second)
+
+	for i := 0; i < 3; i++ {
+		token, err := dc.accessToken(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "token-1" {
+			t.Errorf("token = %q, want token-1", token)
+		}
+	}
+	if got := auth.calls.Load(); got != 1 {
+		t.Errorf("fetched %d tokens, want 1", got)
+	}
+}
+
+func TestAccessTokenRefreshesBeforeExpiry(t *testing.T) {
+	tests := []struct {
+		expiresIn string
+		want time.Duration
+	}{
+		// a minute early
+		{"3599", 3539 * time.Second},
+		// too short for the margin, so halfway
+		{"60", 30 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expiresIn, func(t *testing.T) {
+			auth := newFakeAuth(t, tt.expiresIn)
+			dc := NewDarajaClient(auth.URL, "key", "secret", 5*time.Second)
+
+			before := time.Now()
+			_, err := dc.accessToken(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			lifetime := dc.expiresAt.Sub(before)
+			if lifetime < tt.want-time.Second || lifetime > tt.want+time.Second {
+				t.Errorf("token is used for %v, want %v", lifetime, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessTokenExpired(t *testing.T) {
+	auth := newFakeAuth(t, "3599")
+	dc := NewDarajaClient(auth.URL, "key", "secret", 5*time.Second)
+	_, err := dc.accessToken(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dc.mu.Lock()
+	dc.expiresAt = time.Now().Add(-time.Second)
+	dc.mu.Unlock()
+	token, err := dc.accessToken(context.Background())
+	if err != nil || token != "token-2" {
+		t.Errorf("token = %q, %v, want token-2", token, err)
+	}
+}
+
+func TestAccessTokenSharesRefresh(t *testing.T) {
+	auth := newFakeAuth(t, "3599")
+	auth.release = make(chan struct{})
+	dc := NewDarajaClient(auth.URL, "key", "secret", 5*time.Second)
+
+	const callers = 20
+	var wg sync.WaitGroup
+	tokens := make([]string, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tokens[i], errs[i] = dc.accessToken(context.Background())
+		}()
+	}
+	// let every caller reach the refresh before the token is issued
+	time.Sleep(100 * time.Millisecond)
+	close(auth.release)
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil || tokens[i] != "token-1" {
+			t.Errorf("caller %d got %q, %v, want token-1", i, tokens[i], errs[i])
+		}
+	}
+	if got := auth.calls.Load(); got != 1 {
+		t.Errorf("fetched %d tokens, want 1", got)
+	}
+}
+
+func TestAccessTokenRefreshOutlivesCaller(t *testing.T) {
+	auth := newFakeAuth(t, "3599")
+	auth.release = make(chan struct{})
+	dc := NewDarajaClient(auth.URL, "key", "secret", 5*time.Second)
+
+	// the first caller gives up, but others are still waiting on its refresh
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan string)
+	go func() {
+		token, _ := dc.accessToken(ctx)
+		done <- token
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	close(auth.release)
+	<-done
+
+	token, err := dc.accessToken(context.Background())
+	if err != nil || token != "token-1" {
+		t.Errorf("token = %q, %v, want token-1", token, err)
+	}
+}
+
+func TestAccessTokenBadCredentials(t *testing.T) {
+	auth := newFakeAuth(t, "3599")
+	dc := NewDarajaClient(auth.URL, "key", "wrong", 5*time.Second)
+
+	_, err := dc.accessToken(context.Background())
+	if err == nil {
+		t.Error("accessToken() with bad credentials succeeded")
+	}
+	if dc.token != "" {
+		t.Errorf("cached token %q after a failed fetch", dc.token)
+	}
+}
+
+func TestPostJSONRetriesRevokedToken(t *testing.T) {
+	auth := newFakeAuth(t, "3599")
+	var used []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		used = append(used, r.Header.Get("Authorization"))
+		// Daraja revoked the first token early
+		if r.Header.Get("Authorization") == "Bearer token-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(STKPushResponse{ResponseCode: "0"})
+	}))
+	defer api.Close()
+	dc := NewDarajaClient(auth.URL, "key", "secret", 5*time.Second)
+
+	var resp STKPushResponse
+	status, err := dc.postJSON(context.Background(), api.URL, map[string]any{}, &resp)
+	if err != nil || status != http.StatusOK || resp.ResponseCode != "0" {
+		t.Fatalf("postJSON() = %d, %v, %+v", status, err, resp)
+	}
+	if len(used) != 2 || used[1] != "Bearer token-2" {
+		t.Errorf("sent with %q, want token-1 then token-2", used)
+	}
+}
+
+func TestSTKPassword(t *testing.T) {
+	password, timestamp := stkPassword("174379", "passkey")
+	if len(timestamp) != len("20060102150405") {
+		t.Fatalf("timestamp = %q, want YYYYMMDDhhmmss", timestamp)
+	}
+	parsed, err := time.ParseInLocation("20060102150405", timestamp, eat)
+	if err != nil || time.Since(parsed).Abs() > time.Minute {
+		t.Errorf("timestamp %q is not now in EAT", timestamp)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(password)
+	if err != nil || string(decoded) != "174379passkey"+timestamp {
+		t.Errorf("password decodes to %q, want shortcode, passkey and timestamp", decoded)
+	}
+}
@@ -3,23 +3,39 @@ package payments
 import (
 	"context"
 	"log"
-	"math"
 	"net/http"
 	"os"
 
+	"github.com/nhx-finance/wallet/internal/money"
+	"github.com/nhx-finance/wallet/internal/prices"
+	"github.com/nhx-finance/wallet/internal/rates"
 	"github.com/nhx-finance/wallet/internal/utils"
+	"github.com/shopspring/decimal"
 	"github.com/stripe/stripe-go/v83"
 )
 
 
+// Metadata keys set on every checkout session, so that the webhook can build
+// the transaction without trusting anything the client sends later.
+const (
+	CheckoutMetadataAccountID = "account_id"
+	CheckoutMetadataAsset = "asset"
+	CheckoutMetadataQuantity = "quantity"
+	CheckoutMetadataExchangeRate = "exchange_rate"
+	CheckoutMetadataAPIKeyID = "api_key_id"
+)
 
 type StripeHandler struct {
 	StripeClient *stripe.Client
+	Rates rates.RateProvider
+	Prices prices.AssetPriceSource
 }
 
-func NewStripeHandler(stripeClient *stripe.Client) *StripeHandler {
+func NewStripeHandler(stripeClient *stripe.Client, rateProvider rates.RateProvider, priceSource prices.AssetPriceSource) *StripeHandler {
 	return &StripeHandler{
 		StripeClient: stripeClient,
+		Rates: rateProvider,
+		Prices: priceSource,
 	}
 }
 
@@ -34,35 +50,56 @@ func (sh *StripeHandler) AccountBalance(w http.ResponseWriter, r *http.Request){
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"balance": balance})
 }
 
-func (sh *StripeHandler) CreateCheckoutSession(email string, asset string, quantity float64, imageURL string, accountID string) (*stripe.CheckoutSession, error) {
-	price, err := utils.GetAssetPrice(asset)
+func (sh *StripeHandler) CreateCheckoutSession(ctx context.Context, email string, asset string, quantity int64, imageURL string, accountID string, apiKeyID string) (*stripe.CheckoutSession, error) {
+	rate, err := sh.Rates.KESPerUSDC(ctx)
 	if err != nil {
 		return nil, err
 	}
+	exchangeRate := money.Rate(rate.Value)
+	price := decimal.NewFromInt(1)
+	if asset != "USDC" {
+		assetPrice, err := sh.Prices.AssetPrice(ctx, asset)
+		if err != nil {
+			return nil, err
+		}
+		price = assetPrice.InUSDC(exchangeRate)
+	}
+
+	productData := &stripe.CheckoutSessionCreateLineItemPriceDataProductDataParams{
+		Name: stripe.String("nh" + string(asset)),
+		Description: stripe.String("nh" + string(asset) +" purchase Payment"),
+	}
+	if imageURL != "" {
+		productData.Images = []*string{stripe.String(imageURL)}
+	}
+
 	params := &stripe.CheckoutSessionCreateParams{
 		SuccessURL: stripe.String(os.Getenv("SUCCESS_URL")),
 		LineItems: []*stripe.CheckoutSessionCreateLineItemParams{
 			{
 				PriceData: &stripe.CheckoutSessionCreateLineItemPriceDataParams{
 					Currency: stripe.String("usd"),
-					ProductData: &stripe.CheckoutSessionCreateLineItemPriceDataProductDataParams{
-                        Name: stripe.String("nh" + string(asset)),
-						Images: []*string{stripe.String(imageURL)},
-						Description: stripe.String("nh" + string(asset) +" purchase Payment"),
-                    },
-					UnitAmount: stripe.Int64(int64(math.Ceil(100 * price))),
+					ProductData: productData,
+					UnitAmount: stripe.Int64(price.Shift(2).Ceil().IntPart()),
 				},
-				Quantity: stripe.Int64(int64(quantity)),
+				Quantity: stripe.Int64(quantity),
 			},
 		},
 		Mode: stripe.String("payment"),
 		Metadata: map[string]string{
-			"account_id": accountID,
+			CheckoutMetadataAccountID: accountID,
+			CheckoutMetadataAsset: asset,
+			CheckoutMetadataQuantity: decimal.NewFromInt(quantity).String(),
+			CheckoutMetadataExchangeRate: exchangeRate.String(),
+			CheckoutMetadataAPIKeyID: apiKeyID,
 		},
 		CancelURL: stripe.String(os.Getenv("CANCEL_URL")),
 	}
+	if email != "" {
+		params.CustomerEmail = stripe.String(email)
+	}
 
-	session, err := sh.StripeClient.V1CheckoutSessions.Create(context.Background(), params)
+	session, err := sh.StripeClient.V1CheckoutSessions.Create(ctx, params)
 	if err != nil {
 		log.Printf("failed to create checkout session: %v", err)
 		return nil, err
@@ -71,14 +108,14 @@ func (sh *StripeHandler) CreateCheckoutSession(email string, asset string, quant
 	return session, nil
 }
 
-func (sh *StripeHandler) RetrieveCheckoutSession(sessionID string) (*stripe.CheckoutSession, error) {
+func (sh *StripeHandler) RetrieveCheckoutSession(ctx context.Context, sessionID string) (*stripe.CheckoutSession, error) {
 	params := &stripe.CheckoutSessionRetrieveParams{}
 
-	session, err := sh.StripeClient.V1CheckoutSessions.Retrieve(context.TODO(), sessionID, params)
+	session, err := sh.StripeClient.V1CheckoutSessions.Retrieve(ctx, sessionID, params)
 	if err != nil {
 		log.Printf("failed to retrieve checkout session: %v", err)
 		return nil, err
 	}
 
 	return session, nil
-}
\ No newline at end of file
+}
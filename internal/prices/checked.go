@@ -0,0 +1,89 @@
+package prices
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+// CheckedPriceSource wraps another source and refuses prices that are stale
+// for the market. Every new price it sees is written to the asset_prices
+// history, which is also where it falls back to when the source fails.
+type CheckedPriceSource struct {
+	Source AssetPriceSource
+	Market *Market
+	MaxAge time.Duration
+	History stores.AssetPriceStore
+	Logger *log.Logger
+
+	mu sync.Mutex
+	recorded map[string]time.Time
+	now func() time.Time
+}
+
+func NewCheckedPriceSource(source AssetPriceSource, market *Market, maxAge time.Duration, history stores.AssetPriceStore, logger *log.Logger) *CheckedPriceSource {
+	return &CheckedPriceSource{
+		Source: source,
+		Market: market,
+		MaxAge: maxAge,
+		History: history,
+		Logger: logger,
+		recorded: map[string]time.Time{},
+		now: time.Now,
+	}
+}
+
+func (cs *CheckedPriceSource) AssetPrice(ctx context.Context, symbol string) (AssetPrice, error) {
+	now := cs.now()
+
+	price, err := cs.Source.AssetPrice(ctx, symbol)
+	if errors.Is(err, assets.ErrUnknownAsset) {
+		return AssetPrice{}, err
+	}
+	if err == nil {
+		cs.record(price)
+		if cs.Market.Fresh(price.AsOf, now, cs.MaxAge) {
+			return price, nil
+		}
+		err = fmt.Errorf("latest price is from %s", price.AsOf.Format(time.RFC3339))
+	}
+
+	last, historyErr := cs.History.GetLatestAssetPrice(symbol)
+	if historyErr == nil && cs.Market.Fresh(last.AsOf, now, cs.MaxAge) {
+		cs.Logger.Printf("failed to get a fresh %s price, serving price from %s: %v", symbol, last.AsOf.Format(time.RFC3339), err)
+		return AssetPrice{Symbol: last.Symbol, PriceKSH: last.PriceKSH, Source: last.Source, AsOf: last.AsOf}, nil
+	}
+	if historyErr != nil && !errors.Is(historyErr, sql.ErrNoRows) {
+		cs.Logger.Printf("failed to get last %s price: %v", symbol, historyErr)
+	}
+
+	return AssetPrice{}, fmt.Errorf("%w: %s: %v", ErrPriceStale, symbol, err)
+}
+
+// record writes a price to the history the first time it is seen.
+func (cs *CheckedPriceSource) record(price AssetPrice) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if cs.recorded[price.Symbol].Equal(price.AsOf) {
+		return
+	}
+	err := cs.History.RecordAssetPrice(stores.AssetPrice{
+		Symbol: price.Symbol,
+		PriceKSH: price.PriceKSH,
+		Source: price.Source,
+		AsOf: price.AsOf,
+	})
+	if err != nil {
+		cs.Logger.Printf("failed to record %s price: %v", price.Symbol, err)
+		return
+	}
+	cs.recorded[price.Symbol] = price.AsOf
+}
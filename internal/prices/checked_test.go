@@ -0,0 +1,124 @@
+package prices
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/shopspring/decimal"
+)
+
+// stubSource returns price, or err.
+type stubSource struct {
+	price AssetPrice
+	err error
+}
+
+func (ss *stubSource) AssetPrice(ctx context.Context, symbol string) (AssetPrice, error) {
+	return ss.price, ss.err
+}
+
+// memPriceHistory keeps recorded prices in memory.
+type memPriceHistory struct {
+	prices []stores.AssetPrice
+}
+
+func (m *memPriceHistory) RecordAssetPrice(price stores.AssetPrice) error {
+	m.prices = append(m.prices, price)
+	return nil
+}
+
+func (m *memPriceHistory) GetLatestAssetPrice(symbol string) (*stores.AssetPrice, error) {
+	var latest *stores.AssetPrice
+	for i, price := range m.prices {
+		if price.Symbol == symbol && (latest == nil || price.AsOf.After(latest.AsOf)) {
+			latest = &m.prices[i]
+		}
+	}
+	if latest == nil {
+		return nil, sql.ErrNoRows
+	}
+	return latest, nil
+}
+
+func newCheckedSource(source AssetPriceSource, history *memPriceHistory, now time.Time) *CheckedPriceSource {
+	cs := NewCheckedPriceSource(source, NSE(), 15*time.Minute, history, log.New(io.Discard, "", 0))
+	cs.now = func() time.Time { return now }
+	return cs
+}
+
+func scom(price string, asOf time.Time) AssetPrice {
+	return AssetPrice{Symbol: "SCOM", PriceKSH: decimal.RequireFromString(price), Source: "feed", AsOf: asOf}
+}
+
+func TestCheckedPriceSource(t *testing.T) {
+	thursdayNoon := at(30, 12, 0)
+
+	tests := []struct {
+		name string
+		source *stubSource
+		history []stores.AssetPrice
+		now time.Time
+		want string
+	}{
+		{"fresh price", &stubSource{price: scom("27.95", at(30, 11, 55))}, nil, thursdayNoon, "27.95"},
+		{"Friday's close on Saturday", &stubSource{price: scom("27.95", at(24, 15, 0))}, nil, at(25, 12, 0), "27.95"},
+		{"stale price, fresh history", &stubSource{price: scom("27.95", at(30, 10, 0))}, []stores.AssetPrice{{Symbol: "SCOM", PriceKSH: decimal.RequireFromString("28.10"), AsOf: at(30, 11, 50)}}, thursdayNoon, "28.10"},
+		{"source down, fresh history", &stubSource{err: errors.New("connection refused")}, []stores.AssetPrice{{Symbol: "SCOM", PriceKSH: decimal.RequireFromString("28.10"), AsOf: at(30, 11, 50)}}, thursdayNoon, "28.10"},
+		{"source down, stale history", &stubSource{err: errors.New("connection refused")}, []stores.AssetPrice{{Symbol: "SCOM", PriceKSH: decimal.RequireFromString("28.10"), AsOf: at(29, 15, 0)}}, thursdayNoon, ""},
+		{"source down, no history", &stubSource{err: errors.New("connection refused")}, nil, thursdayNoon, ""},
+		{"stale price, no history", &stubSource{price: scom("27.95", at(30, 10, 0))}, nil, thursdayNoon, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			history := &memPriceHistory{prices: tt.history}
+			price, err := newCheckedSource(tt.source, history, tt.now).AssetPrice(context.Background(), "SCOM")
+			if tt.want == "" {
+				if !errors.Is(err, ErrPriceStale) {
+					t.Errorf("AssetPrice() = %v, %v, want ErrPriceStale", price.PriceKSH, err)
+				}
+				return
+			}
+			if err != nil || !price.PriceKSH.Equal(decimal.RequireFromString(tt.want)) {
+				t.Errorf("AssetPrice() = %v, %v, want %s", price.PriceKSH, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckedPriceSourceRecordsEachPriceOnce(t *testing.T) {
+	source := &stubSource{price: scom("27.95", at(30, 11, 55))}
+	history := &memPriceHistory{}
+	cs := newCheckedSource(source, history, at(30, 12, 0))
+
+	for i := 0; i < 3; i++ {
+		_, err := cs.AssetPrice(context.Background(), "SCOM")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	source.price = scom("28.00", at(30, 11, 58))
+	_, err := cs.AssetPrice(context.Background(), "SCOM")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(history.prices) != 2 {
+		t.Errorf("recorded %d prices, want 2", len(history.prices))
+	}
+}
+
+func TestCheckedPriceSourceUnknownAsset(t *testing.T) {
+	source := &stubSource{err: fmt.Errorf("%w: no price for XYZ", assets.ErrUnknownAsset)}
+	_, err := newCheckedSource(source, &memPriceHistory{}, at(30, 12, 0)).AssetPrice(context.Background(), "XYZ")
+	if !errors.Is(err, assets.ErrUnknownAsset) || errors.Is(err, ErrPriceStale) {
+		t.Errorf("AssetPrice() = %v, want ErrUnknownAsset", err)
+	}
+}
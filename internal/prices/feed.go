@@ -0,0 +1,126 @@
+package prices
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/shopspring/decimal"
+)
+
+// A price feed is a JSON document of the form
+// {"prices": [{"symbol": "SCOM", "price_ksh": "27.95", "as_of": "2025-10-30T12:00:00Z"}]}.
+// Entries without as_of are taken to be as old as the feed itself.
+type feedEntry struct {
+	Symbol string `json:"symbol"`
+	PriceKSH decimal.Decimal `json:"price_ksh"`
+	AsOf time.Time `json:"as_of"`
+}
+
+type feed struct {
+	Prices []feedEntry `json:"prices"`
+}
+
+func (f *feed) price(symbol string, source string, feedTime time.Time) (AssetPrice, error) {
+	for _, entry := range f.Prices {
+		if !strings.EqualFold(entry.Symbol, symbol) {
+			continue
+		}
+		if !entry.PriceKSH.IsPositive() {
+			return AssetPrice{}, fmt.Errorf("price feed has non-positive price %s for %s", entry.PriceKSH, symbol)
+		}
+		asOf := entry.AsOf
+		if asOf.IsZero() {
+			asOf = feedTime
+		}
+		return AssetPrice{
+			Symbol: strings.ToUpper(entry.Symbol),
+			PriceKSH: entry.PriceKSH,
+			Source: source,
+			AsOf: asOf,
+		}, nil
+	}
+	return AssetPrice{}, fmt.Errorf("%w: no price for %s", assets.ErrUnknownAsset, symbol)
+}
+
+// FilePriceSource reads prices from a feed file kept up to date by something
+// else, e.g. a job that exports closing prices. Entries without as_of take the
+// file's modification time.
+type FilePriceSource struct {
+	Path string
+}
+
+func NewFilePriceSource(path string) *FilePriceSource {
+	return &FilePriceSource{Path: path}
+}
+
+func (fs *FilePriceSource) AssetPrice(ctx context.Context, symbol string) (AssetPrice, error) {
+	info, err := os.Stat(fs.Path)
+	if err != nil {
+		return AssetPrice{}, err
+	}
+	data, err := os.ReadFile(fs.Path)
+	if err != nil {
+		return AssetPrice{}, err
+	}
+
+	var prices feed
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return AssetPrice{}, fmt.Errorf("failed to parse price feed: %w", err)
+	}
+
+	return prices.price(symbol, fs.Path, info.ModTime())
+}
+
+// HTTPPriceSource fetches the feed from a URL. Entries without as_of take the
+// response's Last-Modified time, and are treated as stale if it has none.
+type HTTPPriceSource struct {
+	URL string
+	httpClient *http.Client
+}
+
+func NewHTTPPriceSource(url string, timeout time.Duration) *HTTPPriceSource {
+	return &HTTPPriceSource{
+		URL: url,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+func (hs *HTTPPriceSource) AssetPrice(ctx context.Context, symbol string) (AssetPrice, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hs.URL, nil)
+	if err != nil {
+		return AssetPrice{}, err
+	}
+
+	res, err := hs.httpClient.Do(req)
+	if err != nil {
+		return AssetPrice{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return AssetPrice{}, fmt.Errorf("price source returned status %d", res.StatusCode)
+	}
+
+	var prices feed
+	if err := json.NewDecoder(res.Body).Decode(&prices); err != nil {
+		return AssetPrice{}, fmt.Errorf("failed to decode price feed: %w", err)
+	}
+
+	lastModified, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+	return prices.price(symbol, hs.URL, lastModified)
+}
+
+// NewPriceSource returns an HTTPPriceSource for http(s) URLs and a
+// FilePriceSource for anything else.
+func NewPriceSource(location string, timeout time.Duration) AssetPriceSource {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return NewHTTPPriceSource(location, timeout)
+	}
+	return NewFilePriceSource(location)
+}
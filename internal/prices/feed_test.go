@@ -0,0 +1,83 @@
+package prices
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/shopspring/decimal"
+)
+
+const testFeed = `{"prices": [
+	{"symbol": "SCOM", "price_ksh": "27.95", "as_of": "2025-10-30T12:00:00Z"},
+	{"symbol": "eqty", "price_ksh": "48.50"},
+	{"symbol": "KCB", "price_ksh": "0"}
+]}`
+
+func TestFilePriceSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prices.json")
+	err := os.WriteFile(path, []byte(testFeed), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Date(2025, 10, 30, 12, 30, 0, 0, time.UTC)
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := NewFilePriceSource(path)
+
+	price, err := source.AssetPrice(context.Background(), "SCOM")
+	if err != nil || !price.PriceKSH.Equal(decimal.RequireFromString("27.95")) || !price.AsOf.Equal(time.Date(2025, 10, 30, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("SCOM = %v, %v, want 27.95 as of 12:00", price, err)
+	}
+
+	// symbols match in any case, and an entry without as_of is as old as the file
+	price, err = source.AssetPrice(context.Background(), "EQTY")
+	if err != nil || price.Symbol != "EQTY" || !price.AsOf.Equal(modTime) {
+		t.Errorf("EQTY = %v, %v, want 48.50 as of %v", price, err, modTime)
+	}
+
+	_, err = source.AssetPrice(context.Background(), "KCB")
+	if err == nil {
+		t.Error("KCB with a zero price succeeded, want an error")
+	}
+
+	_, err = source.AssetPrice(context.Background(), "ABSA")
+	if !errors.Is(err, assets.ErrUnknownAsset) {
+		t.Errorf("ABSA = %v, want ErrUnknownAsset", err)
+	}
+}
+
+func TestHTTPPriceSource(t *testing.T) {
+	lastModified := time.Date(2025, 10, 30, 12, 30, 0, 0, time.UTC)
+	var withHeader atomic.Bool
+	withHeader.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if withHeader.Load() {
+			w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		}
+		w.Write([]byte(testFeed))
+	}))
+	defer server.Close()
+	source := NewHTTPPriceSource(server.URL, 5*time.Second)
+
+	price, err := source.AssetPrice(context.Background(), "EQTY")
+	if err != nil || !price.AsOf.Equal(lastModified) || price.Source != server.URL {
+		t.Errorf("EQTY = %v, %v, want as of %v from %s", price, err, lastModified, server.URL)
+	}
+
+	// with no Last-Modified the entry has no age and can never be fresh
+	withHeader.Store(false)
+	price, err = source.AssetPrice(context.Background(), "EQTY")
+	if err != nil || !price.AsOf.IsZero() {
+		t.Errorf("EQTY = %v, %v, want a zero as_of", price, err)
+	}
+}
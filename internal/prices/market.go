@@ -0,0 +1,71 @@
+package prices
+
+import (
+	"time"
+)
+
+// Market describes when an exchange trades, so that a price can be judged
+// against the last session rather than the wall clock: on a Saturday the
+// Friday close is as fresh as an NSE price gets.
+type Market struct {
+	Location *time.Location
+	// Open and Close are offsets from local midnight.
+	Open time.Duration
+	Close time.Duration
+	// Holidays are local dates, as "2006-01-02", on which there is no session.
+	Holidays map[string]bool
+}
+
+// NSE trades from 09:30 to 15:00 East Africa Time on weekdays.
+func NSE() *Market {
+	return &Market{
+		Location: time.FixedZone("EAT", 3*60*60),
+		Open: 9*time.Hour + 30*time.Minute,
+		Close: 15 * time.Hour,
+		Holidays: map[string]bool{},
+	}
+}
+
+func (m *Market) isTradingDay(day time.Time) bool {
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return false
+	}
+	return !m.Holidays[day.Format(time.DateOnly)]
+}
+
+func (m *Market) midnight(t time.Time) time.Time {
+	local := t.In(m.Location)
+	return time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, m.Location)
+}
+
+func (m *Market) IsOpen(t time.Time) bool {
+	day := m.midnight(t)
+	if !m.isTradingDay(day) {
+		return false
+	}
+	return !t.Before(day.Add(m.Open)) && t.Before(day.Add(m.Close))
+}
+
+// LastClose returns the end of the most recent session that closed at or
+// before t.
+func (m *Market) LastClose(t time.Time) time.Time {
+	day := m.midnight(t)
+	// long enough to get past any run of holidays
+	for i := 0; i < 30; i++ {
+		if m.isTradingDay(day) && !day.Add(m.Close).After(t) {
+			return day.Add(m.Close)
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	return day.Add(m.Close)
+}
+
+// Fresh reports whether a price as of asOf can still be sold at, at now.
+// While the market is open the price must be younger than maxAge; while it is
+// closed it must be from no more than maxAge before the last close.
+func (m *Market) Fresh(asOf time.Time, now time.Time, maxAge time.Duration) bool {
+	if m.IsOpen(now) {
+		return now.Sub(asOf) <= maxAge
+	}
+	return !asOf.Before(m.LastClose(now).Add(-maxAge))
+}
@@ -0,0 +1,94 @@
+package prices
+
+import (
+	"testing"
+	"time"
+)
+
+var eat = time.FixedZone("EAT", 3*60*60)
+
+// at is a time in Nairobi in the week of Monday 27 October 2025.
+func at(day int, hour int, minute int) time.Time {
+	return time.Date(2025, 10, day, hour, minute, 0, 0, eat)
+}
+
+func TestMarketIsOpen(t *testing.T) {
+	nse := NSE()
+	tests := []struct {
+		name string
+		t time.Time
+		open bool
+	}{
+		{"before the open", at(30, 9, 29), false},
+		{"at the open", at(30, 9, 30), true},
+		{"midday", at(30, 12, 0), true},
+		{"at the close", at(30, 15, 0), false},
+		{"Saturday", at(25, 12, 0), false},
+		{"Sunday", at(26, 12, 0), false},
+		// the same instant as Thursday 12:00 in Nairobi
+		{"in UTC", at(30, 12, 0).UTC(), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nse.IsOpen(tt.t); got != tt.open {
+				t.Errorf("IsOpen(%v) = %t, want %t", tt.t, got, tt.open)
+			}
+		})
+	}
+}
+
+func TestMarketLastClose(t *testing.T) {
+	nse := NSE()
+	nse.Holidays["2025-10-20"] = true
+
+	tests := []struct {
+		name string
+		t time.Time
+		want time.Time
+	}{
+		{"during a session", at(30, 12, 0), at(29, 15, 0)},
+		{"at the close", at(30, 15, 0), at(30, 15, 0)},
+		{"evening", at(30, 20, 0), at(30, 15, 0)},
+		{"Saturday", at(25, 10, 0), at(24, 15, 0)},
+		{"Monday before the open", at(27, 8, 0), at(24, 15, 0)},
+		// Monday the 20th was a holiday
+		{"after a holiday", at(21, 8, 0), at(17, 15, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nse.LastClose(tt.t); !got.Equal(tt.want) {
+				t.Errorf("LastClose(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarketFresh(t *testing.T) {
+	nse := NSE()
+	const maxAge = 15 * time.Minute
+
+	tests := []struct {
+		name string
+		asOf time.Time
+		now time.Time
+		fresh bool
+	}{
+		{"open, young", at(30, 11, 50), at(30, 12, 0), true},
+		{"open, exactly max age", at(30, 11, 45), at(30, 12, 0), true},
+		{"open, just past max age", at(30, 11, 45).Add(-time.Second), at(30, 12, 0), false},
+		// the previous close is no good once the market has opened again
+		{"open, yesterday's close", at(29, 15, 0), at(30, 9, 45), false},
+		{"closed, the close", at(30, 15, 0), at(30, 20, 0), true},
+		{"closed, exactly max age before the close", at(30, 14, 45), at(30, 20, 0), true},
+		{"closed, just past max age before the close", at(30, 14, 45).Add(-time.Second), at(30, 20, 0), false},
+		{"weekend, Friday's close", at(24, 14, 55), at(26, 12, 0), true},
+		{"weekend, Thursday's close", at(23, 15, 0), at(26, 12, 0), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nse.Fresh(tt.asOf, tt.now, maxAge); got != tt.fresh {
+				t.Errorf("Fresh(%v, %v) = %t, want %t", tt.asOf, tt.now, got, tt.fresh)
+			}
+		})
+	}
+}
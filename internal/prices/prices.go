@@ -0,0 +1,34 @@
+package prices
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/money"
+	"github.com/shopspring/decimal"
+)
+
+// ErrPriceStale is returned when no price recent enough to sell at is
+// available. Callers should refuse to price new transactions.
+var ErrPriceStale = errors.New("asset price is stale")
+
+// AssetPrice is the KES price of one unit of an asset, where it came from and
+// the time it was valid at.
+type AssetPrice struct {
+	Symbol string `json:"symbol"`
+	PriceKSH decimal.Decimal `json:"price_ksh"`
+	Source string `json:"source"`
+	AsOf time.Time `json:"as_of"`
+}
+
+// InUSDC converts the price at a KES-per-USDC rate.
+func (p AssetPrice) InUSDC(rate decimal.Decimal) decimal.Decimal {
+	return p.PriceKSH.Div(rate).Round(money.USDCPlaces)
+}
+
+// AssetPriceSource returns the latest price of an asset, or an error wrapping
+// assets.ErrUnknownAsset if it has none for the symbol.
+type AssetPriceSource interface {
+	AssetPrice(ctx context.Context, symbol string) (AssetPrice, error)
+}
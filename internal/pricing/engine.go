@@ -0,0 +1,181 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/money"
+	"github.com/shopspring/decimal"
+)
+
+// ErrAmountTooSmall means fees would consume the whole amount.
+var ErrAmountTooSmall = errors.New("amount is too small to cover fees")
+
+var hundred = decimal.NewFromInt(100)
+
+// Price is the breakdown of a conversion. FeeKSH, SpreadKSH and AmountUSDC
+// valued at MidRate account for AmountKSH to the cent, so revenue can be
+// reported from the stored columns. ExchangeRate is the rate the customer
+// actually gets.
+type Price struct {
+	AmountKSH decimal.Decimal `json:"amount_ksh"`
+	AmountUSDC decimal.Decimal `json:"amount_usdc"`
+	MidRate decimal.Decimal `json:"mid_rate"`
+	ExchangeRate decimal.Decimal `json:"exchange_rate"`
+	FeeKSH decimal.Decimal `json:"fee_ksh"`
+	SpreadKSH decimal.Decimal `json:"spread_ksh"`
+}
+
+// Engine prices conversions from a fee schedule. When Path is set the
+// schedule is loaded from that file and Run reloads it whenever it changes;
+// readers never block on a reload.
+type Engine struct {
+	Path string
+	Interval time.Duration
+	Logger *log.Logger
+	schedule atomic.Pointer[Schedule]
+	// loadedMod is the modification time of the file the schedule was
+	// loaded from, so that a change made before Run starts is not missed.
+	loadedMod time.Time
+}
+
+// NewEngine loads the schedule at path, or charges no fees if path is empty.
+func NewEngine(path string, logger *log.Logger) (*Engine, error) {
+	engine := &Engine{
+		Path: path,
+		Interval: 30 * time.Second,
+		Logger: logger,
+	}
+
+	if path == "" {
+		engine.schedule.Store(FreeSchedule())
+		return engine, nil
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		engine.loadedMod = info.ModTime()
+	}
+	schedule, err := LoadSchedule(path)
+	if err != nil {
+		return nil, err
+	}
+	engine.schedule.Store(schedule)
+
+	return engine, nil
+}
+
+func (e *Engine) Schedule() *Schedule {
+	return e.schedule.Load()
+}
+
+// Run reloads the schedule whenever its file changes. A file that fails to
+// load is logged and the previous schedule stays in effect.
+func (e *Engine) Run(ctx context.Context) {
+	if e.Path == "" {
+		return
+	}
+
+	lastMod := e.loadedMod
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(e.Path)
+		if err != nil {
+			e.Logger.Printf("failed to stat fee schedule %s: %v", e.Path, err)
+			continue
+		}
+		if info.ModTime().Equal(lastMod) {
+			continue
+		}
+		lastMod = info.ModTime()
+
+		schedule, err := LoadSchedule(e.Path)
+		if err != nil {
+			e.Logger.Printf("failed to reload fee schedule %s, keeping the current one: %v", e.Path, err)
+			continue
+		}
+		e.schedule.Store(schedule)
+		e.Logger.Printf("reloaded fee schedule from %s", e.Path)
+	}
+}
+
+// PriceOnRamp prices a KES payment of amountKSH into asset. The fee comes off
+// the top and the rest converts at the mid rate marked up by the spread.
+func (e *Engine) PriceOnRamp(asset string, amountKSH decimal.Decimal, midRate decimal.Decimal) (Price, error) {
+	rule, err := e.Schedule().Rule("onramp", asset)
+	if err != nil {
+		return Price{}, err
+	}
+
+	fee := rule.fee(amountKSH)
+	net := amountKSH.Sub(fee)
+	if !net.IsPositive() {
+		return Price{}, ErrAmountTooSmall
+	}
+
+	rate := money.Rate(midRate.Mul(hundred.Add(rule.SpreadPercent)).Div(hundred))
+	amountUSDC := money.KESToUSDC(net, rate)
+	if !amountUSDC.IsPositive() {
+		return Price{}, ErrAmountTooSmall
+	}
+
+	return Price{
+		AmountKSH: amountKSH,
+		AmountUSDC: amountUSDC,
+		MidRate: midRate,
+		ExchangeRate: rate,
+		FeeKSH: fee,
+		SpreadKSH: net.Sub(amountUSDC.Mul(midRate)).Round(2),
+	}, nil
+}
+
+// PriceOffRamp prices selling amountUSDC of asset for KES. The asset converts
+// at the mid rate marked down by the spread, then the fee comes off and the
+// payout is rounded down to whole shillings.
+func (e *Engine) PriceOffRamp(asset string, amountUSDC decimal.Decimal, midRate decimal.Decimal) (Price, error) {
+	rule, err := e.Schedule().Rule("offramp", asset)
+	if err != nil {
+		return Price{}, err
+	}
+
+	rate := money.Rate(midRate.Mul(hundred.Sub(rule.SpreadPercent)).Div(hundred))
+	converted := amountUSDC.Mul(rate)
+	fee := rule.fee(converted)
+	payout := money.KES(converted.Sub(fee))
+	if !payout.IsPositive() {
+		return Price{}, ErrAmountTooSmall
+	}
+
+	return Price{
+		AmountKSH: payout,
+		AmountUSDC: amountUSDC,
+		MidRate: midRate,
+		ExchangeRate: rate,
+		FeeKSH: fee,
+		SpreadKSH: amountUSDC.Mul(midRate).Sub(payout).Sub(fee).Round(2),
+	}, nil
+}
+
+// fee is fixed + percent of amount, clamped to [min, max] and rounded up to
+// the cent.
+func (rule FeeRule) fee(amount decimal.Decimal) decimal.Decimal {
+	fee := rule.FixedKSH.Add(amount.Mul(rule.Percent).Div(hundred))
+	if fee.LessThan(rule.MinKSH) {
+		fee = rule.MinKSH
+	}
+	if rule.MaxKSH.IsPositive() && fee.GreaterThan(rule.MaxKSH) {
+		fee = rule.MaxKSH
+	}
+	return fee.RoundCeil(2)
+}
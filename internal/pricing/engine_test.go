@@ -0,0 +1,245 @@
+package pricing
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func d(s string) decimal.Decimal {
+	return decimal.RequireFromString(s)
+}
+
+func engineWith(rules ...FeeRule) *Engine {
+	engine := &Engine{Logger: log.New(io.Discard, "", 0)}
+	engine.schedule.Store(&Schedule{Rules: rules})
+	return engine
+}
+
+func TestPriceOnRamp(t *testing.T) {
+	standard := FeeRule{Direction: "onramp", Asset: "*", FixedKSH: d("10"), Percent: d("1.5"), MinKSH: d("20"), MaxKSH: d("500"), SpreadPercent: d("2")}
+
+	tests := []struct {
+		name string
+		rule FeeRule
+		amountKSH string
+		wantFee string
+		wantUSDC string
+		wantRate string
+		wantSpread string
+	}{
+		// 975 / 132.6 = 7.3529411..., and 975 - 7.352941 * 130 = 19.11767
+		{"percentage fee", standard, "1000", "25", "7.352941", "132.6", "19.12"},
+		{"minimum fee", standard, "100", "20", "0.603318", "132.6", "1.57"},
+		{"maximum fee", standard, "100000", "500", "750.377073", "132.6", "1950.98"},
+		// 1.5% of 1001 is 15.015, rounded up to the cent; 985.98 / 130 is
+		// 7.5844615..., rounded down
+		{"fee rounds up", FeeRule{Direction: "onramp", Asset: "*", Percent: d("1.5")}, "1001", "15.02", "7.584461", "130", "0"},
+		{"free", FeeRule{Direction: "onramp", Asset: "*"}, "1000", "0", "7.692307", "130", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, err := engineWith(tt.rule).PriceOnRamp("USDC", d(tt.amountKSH), d("130"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !price.FeeKSH.Equal(d(tt.wantFee)) {
+				t.Errorf("fee = %s, want %s", price.FeeKSH, tt.wantFee)
+			}
+			if !price.AmountUSDC.Equal(d(tt.wantUSDC)) {
+				t.Errorf("amount_usdc = %s, want %s", price.AmountUSDC, tt.wantUSDC)
+			}
+			if !price.ExchangeRate.Equal(d(tt.wantRate)) {
+				t.Errorf("exchange_rate = %s, want %s", price.ExchangeRate, tt.wantRate)
+			}
+			if !price.SpreadKSH.Equal(d(tt.wantSpread)) {
+				t.Errorf("spread = %s, want %s", price.SpreadKSH, tt.wantSpread)
+			}
+			// fee, spread and the USDC at the mid rate account for the payment
+			accounted := price.FeeKSH.Add(price.SpreadKSH).Add(price.AmountUSDC.Mul(price.MidRate))
+			if accounted.Sub(price.AmountKSH).Abs().GreaterThan(d("0.01")) {
+				t.Errorf("fee + spread + USDC at mid = %s, want %s to the cent", accounted, price.AmountKSH)
+			}
+		})
+	}
+}
+
+func TestPriceOnRampTooSmall(t *testing.T) {
+	engine := engineWith(FeeRule{Direction: "onramp", Asset: "*", MinKSH: d("20")})
+
+	_, err := engine.PriceOnRamp("USDC", d("20"), d("130"))
+	if !errors.Is(err, ErrAmountTooSmall) {
+		t.Errorf("PriceOnRamp() = %v, want ErrAmountTooSmall", err)
+	}
+}
+
+func TestPriceOffRamp(t *testing.T) {
+	standard := FeeRule{Direction: "offramp", Asset: "*", Percent: d("1"), SpreadPercent: d("1")}
+
+	tests := []struct {
+		name string
+		rule FeeRule
+		amountUSDC string
+		wantPayout string
+		wantFee string
+		wantSpread string
+	}{
+		// 10 * 128.7 = 1287, less a 12.87 fee, is paid as 1274
+		{"percentage fee", standard, "10", "1274", "12.87", "13.13"},
+		{"uncapped", standard, "10000", "1274130", "12870", "13000"},
+		{"capped", FeeRule{Direction: "offramp", Asset: "*", Percent: d("1"), MaxKSH: d("100"), SpreadPercent: d("1")}, "10000", "1286900", "100", "13000"},
+		// the shilling fraction is kept, not paid out
+		{"payout rounds down", FeeRule{Direction: "offramp", Asset: "*"}, "1.123456", "146", "0", "0.05"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, err := engineWith(tt.rule).PriceOffRamp("USDC", d(tt.amountUSDC), d("130"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !price.AmountKSH.Equal(d(tt.wantPayout)) {
+				t.Errorf("payout = %s, want %s", price.AmountKSH, tt.wantPayout)
+			}
+			if !price.FeeKSH.Equal(d(tt.wantFee)) {
+				t.Errorf("fee = %s, want %s", price.FeeKSH, tt.wantFee)
+			}
+			if !price.SpreadKSH.Equal(d(tt.wantSpread)) {
+				t.Errorf("spread = %s, want %s", price.SpreadKSH, tt.wantSpread)
+			}
+		})
+	}
+}
+
+func TestPriceOffRampTooSmall(t *testing.T) {
+	engine := engineWith(FeeRule{Direction: "offramp", Asset: "*", FixedKSH: d("50")})
+
+	_, err := engine.PriceOffRamp("USDC", d("0.3"), d("130"))
+	if !errors.Is(err, ErrAmountTooSmall) {
+		t.Errorf("PriceOffRamp() = %v, want ErrAmountTooSmall", err)
+	}
+}
+
+func TestScheduleRule(t *testing.T) {
+	schedule := &Schedule{Rules: []FeeRule{
+		{Direction: "onramp", Asset: "*", FixedKSH: d("10")},
+		{Direction: "onramp", Asset: "SCOM", FixedKSH: d("30")},
+		{Direction: "offramp", Asset: "USDC", FixedKSH: d("5")},
+	}}
+
+	tests := []struct {
+		direction string
+		asset string
+		wantFixed string
+	}{
+		{"onramp", "SCOM", "30"},
+		{"onramp", "USDC", "10"},
+		{"offramp", "USDC", "5"},
+		{"offramp", "SCOM", ""},
+	}
+	for _, tt := range tests {
+		rule, err := schedule.Rule(tt.direction, tt.asset)
+		if tt.wantFixed == "" {
+			if err == nil {
+				t.Errorf("Rule(%s, %s) = %+v, want an error", tt.direction, tt.asset, rule)
+			}
+			continue
+		}
+		if err != nil || !rule.FixedKSH.Equal(d(tt.wantFixed)) {
+			t.Errorf("Rule(%s, %s) = %s, %v, want fixed fee %s", tt.direction, tt.asset, rule.FixedKSH, err, tt.wantFixed)
+		}
+	}
+}
+
+func writeSchedule(t *testing.T, path string, body string) {
+	t.Helper()
+	err := os.WriteFile(path, []byte(body), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadSchedule(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		wantErr bool
+	}{
+		{"valid", `{"rules": [{"direction": "onramp", "asset": "*", "fixed_ksh": "10", "percent": "1.5", "min_ksh": "20", "max_ksh": "500", "spread_percent": "2"}]}`, false},
+		{"not JSON", `rules:`, true},
+		{"bad direction", `{"rules": [{"direction": "sideways", "asset": "*"}]}`, true},
+		{"no asset", `{"rules": [{"direction": "onramp"}]}`, true},
+		{"negative fee", `{"rules": [{"direction": "onramp", "asset": "*", "fixed_ksh": "-1"}]}`, true},
+		{"whole spread", `{"rules": [{"direction": "offramp", "asset": "*", "spread_percent": "100"}]}`, true},
+		{"max below min", `{"rules": [{"direction": "onramp", "asset": "*", "min_ksh": "20", "max_ksh": "10"}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fees.json")
+			writeSchedule(t, path, tt.body)
+
+			_, err := LoadSchedule(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadSchedule() error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEngineReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fees.json")
+	writeSchedule(t, path, `{"rules": [{"direction": "onramp", "asset": "*", "fixed_ksh": "10"}]}`)
+	engine, err := NewEngine(path, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.Interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go engine.Run(ctx)
+
+	fixedFee := func() decimal.Decimal {
+		rule, _ := engine.Schedule().Rule("onramp", "USDC")
+		return rule.FixedKSH
+	}
+	// bump the modification time so that a reload is seen even on
+	// filesystems with coarse timestamps
+	touch := func(body string, age time.Duration) {
+		writeSchedule(t, path, body)
+		modTime := time.Now().Add(age)
+		err := os.Chtimes(path, modTime, modTime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor := func(want string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for !fixedFee().Equal(d(want)) {
+			if time.Now().After(deadline) {
+				t.Fatalf("fixed fee is %s, want %s", fixedFee(), want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	touch(`{"rules": [{"direction": "onramp", "asset": "*", "fixed_ksh": "25"}]}`, time.Minute)
+	waitFor("25")
+
+	// a broken file leaves the last good schedule in effect
+	touch(`{"rules": [{"direction": "sideways", "asset": "*"}]}`, 2*time.Minute)
+	time.Sleep(50 * time.Millisecond)
+	if !fixedFee().Equal(d("25")) {
+		t.Errorf("fixed fee is %s after a bad reload, want 25", fixedFee())
+	}
+
+	touch(`{"rules": [{"direction": "onramp", "asset": "*", "fixed_ksh": "30"}]}`, 3*time.Minute)
+	waitFor("30")
+}
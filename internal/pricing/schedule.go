@@ -0,0 +1,96 @@
+package pricing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/shopspring/decimal"
+)
+
+// FeeRule prices one direction of one asset. Fees are in KES; Percent and
+// SpreadPercent are percentages, so "1.5" means 1.5%.
+type FeeRule struct {
+	Direction string `json:"direction"`
+	Asset string `json:"asset"`
+	FixedKSH decimal.Decimal `json:"fixed_ksh"`
+	Percent decimal.Decimal `json:"percent"`
+	MinKSH decimal.Decimal `json:"min_ksh"`
+	// MaxKSH of zero means the fee is uncapped.
+	MaxKSH decimal.Decimal `json:"max_ksh"`
+	SpreadPercent decimal.Decimal `json:"spread_percent"`
+}
+
+type Schedule struct {
+	Rules []FeeRule `json:"rules"`
+}
+
+// Rule finds the rule for a direction and asset, falling back to a rule for
+// asset "*" if there is no exact match.
+func (s *Schedule) Rule(direction string, asset string) (FeeRule, error) {
+	var wildcard *FeeRule
+	for i, rule := range s.Rules {
+		if rule.Direction != direction {
+			continue
+		}
+		if rule.Asset == asset {
+			return rule, nil
+		}
+		if rule.Asset == "*" {
+			wildcard = &s.Rules[i]
+		}
+	}
+	if wildcard != nil {
+		return *wildcard, nil
+	}
+	return FeeRule{}, fmt.Errorf("no fee rule for %s %s", direction, asset)
+}
+
+func (s *Schedule) validate() error {
+	for _, rule := range s.Rules {
+		if rule.Direction != "onramp" && rule.Direction != "offramp" {
+			return fmt.Errorf("invalid direction %q", rule.Direction)
+		}
+		if rule.Asset == "" {
+			return errors.New("fee rule is missing an asset")
+		}
+		if rule.FixedKSH.IsNegative() || rule.Percent.IsNegative() || rule.MinKSH.IsNegative() || rule.MaxKSH.IsNegative() {
+			return fmt.Errorf("fee rule for %s %s has a negative amount", rule.Direction, rule.Asset)
+		}
+		if rule.SpreadPercent.IsNegative() || rule.SpreadPercent.GreaterThanOrEqual(decimal.NewFromInt(100)) {
+			return fmt.Errorf("fee rule for %s %s has an invalid spread", rule.Direction, rule.Asset)
+		}
+		if rule.MaxKSH.IsPositive() && rule.MaxKSH.LessThan(rule.MinKSH) {
+			return fmt.Errorf("fee rule for %s %s has max below min", rule.Direction, rule.Asset)
+		}
+	}
+	return nil
+}
+
+func LoadSchedule(path string) (*Schedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var schedule Schedule
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		return nil, fmt.Errorf("failed to parse fee schedule: %w", err)
+	}
+	if err := schedule.validate(); err != nil {
+		return nil, err
+	}
+
+	return &schedule, nil
+}
+
+// FreeSchedule charges nothing on either direction.
+func FreeSchedule() *Schedule {
+	return &Schedule{
+		Rules: []FeeRule{
+			{Direction: "onramp", Asset: "*"},
+			{Direction: "offramp", Asset: "*"},
+		},
+	}
+}
@@ -0,0 +1,171 @@
+package pubsub
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+// TransactionSubscriber follows changes to a transaction; see
+// TransactionBroker.Subscribe.
+type TransactionSubscriber interface {
+	Subscribe(transactionID string) (<-chan struct{}, func())
+}
+
+// TransactionBroker tells subscribers when a transaction's status changes on
+// any instance. Changes are announced by Postgres NOTIFY when they commit, so
+// a subscriber only learns that something happened and reads the events
+// themselves from the database.
+type TransactionBroker struct {
+	DB *sql.DB
+	RetryInterval time.Duration
+	Logger *log.Logger
+
+	mu sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+	closed bool
+}
+
+func NewTransactionBroker(db *sql.DB, logger *log.Logger) *TransactionBroker {
+	return &TransactionBroker{
+		DB: db,
+		RetryInterval: 5 * time.Second,
+		Logger: logger,
+		subscribers: map[string]map[chan struct{}]struct{}{},
+	}
+}
+
+// Subscribe returns a channel that receives a value whenever the transaction
+// may have new events, and a function that ends the subscription. The channel
+// is closed when the broker shuts down.
+func (b *TransactionBroker) Subscribe(transactionID string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subscribers[transactionID] == nil {
+		b.subscribers[transactionID] = map[chan struct{}]struct{}{}
+	}
+	b.subscribers[transactionID][ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		if _, ok := b.subscribers[transactionID][ch]; !ok {
+			return
+		}
+		delete(b.subscribers[transactionID], ch)
+		if len(b.subscribers[transactionID]) == 0 {
+			delete(b.subscribers, transactionID)
+		}
+		close(ch)
+	}
+}
+
+// Run listens for notifications until ctx is done, reconnecting after
+// failures. Notifications sent while it was reconnecting are lost, so every
+// subscriber is woken once it is listening again.
+func (b *TransactionBroker) Run(ctx context.Context) {
+	defer b.closeAll()
+
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		b.Logger.Printf("lost %s notifications, reconnecting in %s: %v", stores.TransactionEventsChannel, b.RetryInterval, err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(b.RetryInterval):
+		}
+	}
+}
+
+func (b *TransactionBroker) listen(ctx context.Context) error {
+	conn, err := b.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.Raw(func(driverConn any) error {
+		stdlibConn, ok := driverConn.(*stdlib.Conn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		pgConn := stdlibConn.Conn()
+
+		_, err := pgConn.Exec(ctx, "LISTEN "+stores.TransactionEventsChannel)
+		if err != nil {
+			return err
+		}
+		b.wakeAll()
+
+		for {
+			notification, err := pgConn.WaitForNotification(ctx)
+			if err != nil {
+				// The connection may still be listening; don't hand it back
+				// to the pool like that.
+				pgConn.Close(context.Background())
+				return err
+			}
+			b.wake(notification.Payload)
+		}
+	})
+}
+
+func (b *TransactionBroker) wake(transactionID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[transactionID] {
+		notify(ch)
+	}
+}
+
+func (b *TransactionBroker) wakeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, subscribers := range b.subscribers {
+		for ch := range subscribers {
+			notify(ch)
+		}
+	}
+}
+
+func (b *TransactionBroker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for transactionID, subscribers := range b.subscribers {
+		for ch := range subscribers {
+			close(ch)
+		}
+		delete(b.subscribers, transactionID)
+	}
+}
+
+// notify never blocks: a subscriber that has not yet handled the last wakeup
+// will read everything new when it does.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,80 @@
+package pubsub
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+func received(ch <-chan struct{}) bool {
+	select {
+	case _, ok := <-ch:
+		return ok
+	default:
+		return false
+	}
+}
+
+func closed(ch <-chan struct{}) bool {
+	select {
+	case _, ok := <-ch:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func TestTransactionBrokerWakesSubscribers(t *testing.T) {
+	b := NewTransactionBroker(nil, log.New(io.Discard, "", 0))
+	first, unsubscribeFirst := b.Subscribe("txn-1")
+	second, unsubscribeSecond := b.Subscribe("txn-1")
+	other, unsubscribeOther := b.Subscribe("txn-2")
+	defer unsubscribeSecond()
+	defer unsubscribeOther()
+
+	// a subscriber that is behind gets one wakeup, not a blocked broker
+	b.wake("txn-1")
+	b.wake("txn-1")
+	if !received(first) || !received(second) {
+		t.Error("subscribers of txn-1 were not woken")
+	}
+	if received(first) {
+		t.Error("wakeups were not coalesced")
+	}
+	if received(other) {
+		t.Error("subscriber of txn-2 was woken for txn-1")
+	}
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	if !closed(first) {
+		t.Error("unsubscribing did not close the channel")
+	}
+	b.wake("txn-1")
+	if !received(second) {
+		t.Error("remaining subscriber was not woken")
+	}
+
+	b.wakeAll()
+	if !received(second) || !received(other) {
+		t.Error("wakeAll missed a subscriber")
+	}
+}
+
+func TestTransactionBrokerCloses(t *testing.T) {
+	b := NewTransactionBroker(nil, log.New(io.Discard, "", 0))
+	ch, unsubscribe := b.Subscribe("txn-1")
+
+	b.closeAll()
+	if !closed(ch) {
+		t.Error("shutting down did not close the subscriber")
+	}
+	// must not close it twice
+	unsubscribe()
+
+	late, unsubscribeLate := b.Subscribe("txn-1")
+	defer unsubscribeLate()
+	if !closed(late) {
+		t.Error("subscribing after shutdown returned an open channel")
+	}
+}
@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	updatedAt time.Time
+}
+
+// MemoryLimiter keeps buckets in this process only. Limits are per replica,
+// so it is meant as a fallback for PostgresLimiter and for local use.
+type MemoryLimiter struct {
+	mu sync.Mutex
+	buckets map[string]*bucket
+	now func() time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{
+		buckets: make(map[string]*bucket),
+		now: time.Now,
+	}
+}
+
+func (ml *MemoryLimiter) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	now := ml.now()
+	capacity := float64(limit.Requests)
+	b, ok := ml.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updatedAt: now}
+		ml.buckets[key] = b
+	}
+	elapsed := math.Max(now.Sub(b.updatedAt).Seconds(), 0)
+	b.tokens = math.Min(capacity, b.tokens+elapsed*limit.refillPerSecond())
+	b.updatedAt = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return result(limit, allowed, b.tokens), nil
+}
+
+// Prune forgets buckets untouched since before.
+func (ml *MemoryLimiter) Prune(before time.Time) int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	pruned := 0
+	for key, b := range ml.buckets {
+		if b.updatedAt.Before(before) {
+			delete(ml.buckets, key)
+			pruned++
+		}
+	}
+	return pruned
+}
@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+// PostgresLimiter keeps buckets in Postgres so that limits hold across
+// replicas. If Postgres cannot be reached it falls back to Fallback, which
+// only limits per replica but keeps a database outage from either letting
+// everything through or taking the routes down.
+type PostgresLimiter struct {
+	Store stores.RateLimitStore
+	Fallback *MemoryLimiter
+	// Retention is how long idle buckets are kept. It must be at least the
+	// longest Limit.Per in use, or clients get their burst back early.
+	Retention time.Duration
+	Logger *log.Logger
+}
+
+func NewPostgresLimiter(store stores.RateLimitStore, logger *log.Logger) *PostgresLimiter {
+	return &PostgresLimiter{
+		Store: store,
+		Fallback: NewMemoryLimiter(),
+		Retention: 24 * time.Hour,
+		Logger: logger,
+	}
+}
+
+func (pl *PostgresLimiter) Take(ctx context.Context, key string, limit Limit) (Result, error) {
+	allowed, tokens, err := pl.Store.TakeRateLimitToken(key, float64(limit.Requests), limit.refillPerSecond())
+	if err != nil {
+		pl.Logger.Printf("failed to check rate limit %s in postgres, limiting in memory: %v", key, err)
+		return pl.Fallback.Take(ctx, key, limit)
+	}
+	return result(limit, allowed, tokens), nil
+}
+
+// Run deletes idle buckets once an hour.
+func (pl *PostgresLimiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		before := time.Now().Add(-pl.Retention)
+		deleted, err := pl.Store.DeleteRateLimitBucketsBefore(before)
+		if err != nil {
+			pl.Logger.Printf("failed to delete idle rate limit buckets: %v", err)
+		} else if deleted > 0 {
+			pl.Logger.Printf("deleted %d idle rate limit buckets", deleted)
+		}
+		pl.Fallback.Prune(before)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
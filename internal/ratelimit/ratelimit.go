@@ -0,0 +1,86 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit is a token bucket that holds Requests tokens and refills completely
+// over Per, so a client can burst Requests requests and then make one every
+// Per/Requests.
+type Limit struct {
+	Requests int
+	Per time.Duration
+}
+
+// ParseLimit parses "<requests>/<duration>", e.g. "3/5m". "off" or "" is the
+// zero Limit, which allows everything.
+func ParseLimit(s string) (Limit, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "off" {
+		return Limit{}, nil
+	}
+	requests, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("rate limit %q is not <requests>/<duration>", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("rate limit %q must allow at least one request", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("rate limit %q has an invalid duration", s)
+	}
+	return Limit{Requests: n, Per: d}, nil
+}
+
+func (l Limit) Enabled() bool {
+	return l.Requests > 0 && l.Per > 0
+}
+
+// refillPerSecond is how many tokens the bucket gains per second.
+func (l Limit) refillPerSecond() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// retryAfter is how long until a bucket holding tokens has a whole token.
+func (l Limit) retryAfter(tokens float64) time.Duration {
+	if tokens >= 1 {
+		return 0
+	}
+	seconds := math.Ceil((1 - tokens) / l.refillPerSecond())
+	return time.Duration(seconds) * time.Second
+}
+
+func (l Limit) String() string {
+	if !l.Enabled() {
+		return "off"
+	}
+	return fmt.Sprintf("%d/%s", l.Requests, l.Per)
+}
+
+type Result struct {
+	Allowed bool
+	// Remaining is how many whole requests may be made right now.
+	Remaining int
+	// RetryAfter is how long a denied client should wait.
+	RetryAfter time.Duration
+}
+
+func result(limit Limit, allowed bool, tokens float64) Result {
+	res := Result{Allowed: allowed, Remaining: int(math.Floor(tokens))}
+	if !allowed {
+		res.RetryAfter = limit.retryAfter(tokens)
+	}
+	return res
+}
+
+// Limiter takes a token from the bucket for key.
+type Limiter interface {
+	Take(ctx context.Context, key string, limit Limit) (Result, error)
+}
@@ -0,0 +1,56 @@
+package rates
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// CachedRateProvider wraps another provider. Rates younger than TTL are
+// served from memory; when a refresh fails the last good rate keeps being
+// served until it is older than MaxAge, after which ErrRateStale is returned.
+type CachedRateProvider struct {
+	Source RateProvider
+	TTL time.Duration
+	MaxAge time.Duration
+	Logger *log.Logger
+
+	mu sync.Mutex
+	last Rate
+	now func() time.Time
+}
+
+func NewCachedRateProvider(source RateProvider, ttl time.Duration, maxAge time.Duration, logger *log.Logger) *CachedRateProvider {
+	return &CachedRateProvider{
+		Source: source,
+		TTL: ttl,
+		MaxAge: maxAge,
+		Logger: logger,
+		now: time.Now,
+	}
+}
+
+func (cp *CachedRateProvider) KESPerUSDC(ctx context.Context) (Rate, error) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	now := cp.now()
+	if !cp.last.FetchedAt.IsZero() && now.Sub(cp.last.FetchedAt) < cp.TTL {
+		return cp.last, nil
+	}
+
+	rate, err := cp.Source.KESPerUSDC(ctx)
+	if err == nil {
+		cp.last = rate
+		return rate, nil
+	}
+
+	if !cp.last.FetchedAt.IsZero() && now.Sub(cp.last.FetchedAt) < cp.MaxAge {
+		cp.Logger.Printf("failed to refresh exchange rate, serving rate from %s: %v", cp.last.FetchedAt.Format(time.RFC3339), err)
+		return cp.last, nil
+	}
+
+	return Rate{}, fmt.Errorf("%w: %v", ErrRateStale, err)
+}
@@ -0,0 +1,137 @@
+package rates
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// scriptedSource returns its rate, stamped with the test clock, or err.
+type scriptedSource struct {
+	clock *time.Time
+	value decimal.Decimal
+	err error
+	calls int
+}
+
+func (ss *scriptedSource) KESPerUSDC(ctx context.Context) (Rate, error) {
+	ss.calls++
+	if ss.err != nil {
+		return Rate{}, ss.err
+	}
+	return Rate{Value: ss.value, Source: "test", FetchedAt: *ss.clock}, nil
+}
+
+func newTestCache(t *testing.T) (*CachedRateProvider, *scriptedSource, *time.Time) {
+	t.Helper()
+	clock := time.Date(2025, 10, 30, 12, 0, 0, 0, time.UTC)
+	source := &scriptedSource{clock: &clock, value: decimal.NewFromInt(130)}
+	cache := NewCachedRateProvider(source, time.Minute, 10*time.Minute, log.New(io.Discard, "", 0))
+	cache.now = func() time.Time { return clock }
+	return cache, source, &clock
+}
+
+func TestCachedRateProviderTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		age time.Duration
+		wantCalls int
+	}{
+		{"fresh", 0, 1},
+		{"just inside TTL", time.Minute - time.Nanosecond, 1},
+		{"at TTL", time.Minute, 2},
+		{"past TTL", 5 * time.Minute, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, source, clock := newTestCache(t)
+			_, err := cache.KESPerUSDC(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			*clock = clock.Add(tt.age)
+			source.value = decimal.NewFromInt(131)
+			rate, err := cache.KESPerUSDC(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source.calls != tt.wantCalls {
+				t.Errorf("source called %d times, want %d", source.calls, tt.wantCalls)
+			}
+			want := decimal.NewFromInt(130)
+			if tt.wantCalls == 2 {
+				want = decimal.NewFromInt(131)
+			}
+			if !rate.Value.Equal(want) {
+				t.Errorf("rate = %s, want %s", rate.Value, want)
+			}
+		})
+	}
+}
+
+func TestCachedRateProviderMaxAge(t *testing.T) {
+	tests := []struct {
+		name string
+		age time.Duration
+		wantStale bool
+	}{
+		{"past TTL", 2 * time.Minute, false},
+		{"just inside max age", 10*time.Minute - time.Nanosecond, false},
+		{"at max age", 10 * time.Minute, true},
+		{"past max age", time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, source, clock := newTestCache(t)
+			_, err := cache.KESPerUSDC(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			*clock = clock.Add(tt.age)
+			source.err = errors.New("connection refused")
+			rate, err := cache.KESPerUSDC(context.Background())
+			if tt.wantStale {
+				if !errors.Is(err, ErrRateStale) {
+					t.Errorf("KESPerUSDC() = %v, %v, want ErrRateStale", rate, err)
+				}
+				return
+			}
+			if err != nil || !rate.Value.Equal(decimal.NewFromInt(130)) {
+				t.Errorf("KESPerUSDC() = %v, %v, want the last rate 130", rate.Value, err)
+			}
+		})
+	}
+}
+
+func TestCachedRateProviderNeverFetched(t *testing.T) {
+	cache, source, _ := newTestCache(t)
+	source.err = errors.New("connection refused")
+
+	_, err := cache.KESPerUSDC(context.Background())
+	if !errors.Is(err, ErrRateStale) {
+		t.Errorf("KESPerUSDC() = %v, want ErrRateStale", err)
+	}
+}
+
+func TestCachedRateProviderRecovers(t *testing.T) {
+	cache, source, clock := newTestCache(t)
+	source.err = errors.New("connection refused")
+	_, err := cache.KESPerUSDC(context.Background())
+	if !errors.Is(err, ErrRateStale) {
+		t.Fatalf("KESPerUSDC() = %v, want ErrRateStale", err)
+	}
+
+	*clock = clock.Add(time.Second)
+	source.err = nil
+	rate, err := cache.KESPerUSDC(context.Background())
+	if err != nil || !rate.Value.Equal(decimal.NewFromInt(130)) {
+		t.Errorf("KESPerUSDC() = %v, %v, want 130 once the source is back", rate.Value, err)
+	}
+}
@@ -0,0 +1,83 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// HTTPRateProvider reads the rate from a coin-price endpoint such as the one
+// configured in EXCHANGE_RATE_URL.
+type HTTPRateProvider struct {
+	URL string
+	httpClient *http.Client
+}
+
+func NewHTTPRateProvider(url string, timeout time.Duration) *HTTPRateProvider {
+	return &HTTPRateProvider{
+		URL: url,
+		httpClient: &http.Client{Timeout: timeout},
+	}
+}
+
+type coinPrice struct {
+	Price decimal.Decimal `json:"price"`
+}
+
+type coinPriceResponse struct {
+	Code string `json:"code"`
+	Msg string `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+func (hp *HTTPRateProvider) KESPerUSDC(ctx context.Context) (Rate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, hp.URL, nil)
+	if err != nil {
+		return Rate{}, err
+	}
+
+	res, err := hp.httpClient.Do(req)
+	if err != nil {
+		return Rate{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Rate{}, fmt.Errorf("rate source returned status %d", res.StatusCode)
+	}
+
+	var body coinPriceResponse
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return Rate{}, fmt.Errorf("failed to decode rate response: %w", err)
+	}
+
+	price, err := parseCoinPrice(body.Data)
+	if err != nil {
+		return Rate{}, fmt.Errorf("rate source returned %q: %w", body.Msg, err)
+	}
+	if !price.IsPositive() {
+		return Rate{}, fmt.Errorf("rate source returned non-positive price %s", price)
+	}
+
+	return Rate{Value: price, Source: hp.URL, FetchedAt: time.Now()}, nil
+}
+
+// parseCoinPrice accepts data as either a single object or a list of them.
+func parseCoinPrice(data json.RawMessage) (decimal.Decimal, error) {
+	var single coinPrice
+	if err := json.Unmarshal(data, &single); err == nil && !single.Price.IsZero() {
+		return single.Price, nil
+	}
+
+	var list []coinPrice
+	if err := json.Unmarshal(data, &list); err == nil && len(list) > 0 {
+		return list[0].Price, nil
+	}
+
+	return decimal.Zero, errors.New("no price in response")
+}
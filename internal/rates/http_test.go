@@ -0,0 +1,56 @@
+package rates
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestHTTPRateProvider(t *testing.T) {
+	tests := []struct {
+		name string
+		status int
+		body string
+		want string
+	}{
+		{"object", http.StatusOK, `{"code": "0", "msg": "success", "data": {"price": "129.45"}}`, "129.45"},
+		{"number", http.StatusOK, `{"code": "0", "msg": "success", "data": {"price": 129.45}}`, "129.45"},
+		{"list", http.StatusOK, `{"code": "0", "msg": "success", "data": [{"price": "129.45"}, {"price": "130"}]}`, "129.45"},
+		{"empty list", http.StatusOK, `{"code": "1", "msg": "no data", "data": []}`, ""},
+		{"no data", http.StatusOK, `{"code": "1", "msg": "unknown pair"}`, ""},
+		{"zero", http.StatusOK, `{"code": "0", "msg": "success", "data": [{"price": "0"}]}`, ""},
+		{"negative", http.StatusOK, `{"code": "0", "msg": "success", "data": {"price": "-1"}}`, ""},
+		{"server error", http.StatusInternalServerError, `{"code": "0", "data": {"price": "129.45"}}`, ""},
+		{"not JSON", http.StatusOK, `<html></html>`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			rate, err := NewHTTPRateProvider(server.URL, 5*time.Second).KESPerUSDC(context.Background())
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("KESPerUSDC() = %s, want an error", rate.Value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !rate.Value.Equal(decimal.RequireFromString(tt.want)) {
+				t.Errorf("KESPerUSDC() = %s, want %s", rate.Value, tt.want)
+			}
+			if rate.Source != server.URL || rate.FetchedAt.IsZero() {
+				t.Errorf("rate came from %q at %v, want %q now", rate.Source, rate.FetchedAt, server.URL)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package rates
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// ErrRateStale is returned when no rate recent enough to quote from is
+// available. Callers should refuse to price new transactions.
+var ErrRateStale = errors.New("exchange rate is stale")
+
+// Rate is a KES per USDC exchange rate and where it came from.
+type Rate struct {
+	Value decimal.Decimal `json:"value"`
+	Source string `json:"source"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+type RateProvider interface {
+	KESPerUSDC(ctx context.Context) (Rate, error)
+}
+
+// FixedRateProvider always returns the same rate. It is meant for tests and
+// local development.
+type FixedRateProvider struct {
+	Value decimal.Decimal
+}
+
+func NewFixedRateProvider(value decimal.Decimal) *FixedRateProvider {
+	return &FixedRateProvider{Value: value}
+}
+
+func (fp *FixedRateProvider) KESPerUSDC(ctx context.Context) (Rate, error) {
+	return Rate{Value: fp.Value, Source: "fixed", FetchedAt: time.Now()}, nil
+}
@@ -3,14 +3,62 @@ package routes
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/nhx-finance/wallet/internal/app"
+	"github.com/nhx-finance/wallet/internal/stores"
 )
 
 func SetUpRoutes(app *app.Application) *chi.Mux {
 	r := chi.NewRouter()
 
 	r.Get("/health", app.HealthCheck)
-	r.Post("/onramp/initiate", app.TransactionHandler.HandleInitiatePayment)
-	r.Post("/webhooks/mpesa", app.WebhookHandler.HandleWebhook)
+
+	// Inbound payment webhooks authenticate themselves, see MpesaVerifier and
+	// HandleStripeWebhook.
+	r.With(app.MpesaVerifier.VerifySTKCallback).Post("/webhooks/mpesa", app.WebhookHandler.HandleWebhook)
+	r.With(app.MpesaVerifier.VerifyB2CCallback(stores.WebhookB2CResult)).Post("/webhooks/mpesa/b2c/result", app.WebhookHandler.HandleB2CResult)
+	r.With(app.MpesaVerifier.VerifyB2CCallback(stores.WebhookB2CTimeout)).Post("/webhooks/mpesa/b2c/timeout", app.WebhookHandler.HandleB2CTimeout)
+
+	requireScope := app.APIKeys.Require
+
+	// The API key runs before idempotency, which scopes keys per API key.
+	// Rate limits run before idempotency too, so that a 429 is not stored
+	// as the response to replay; a replay only takes from the IP bucket.
+	r.With(requireScope(stores.ScopeQuotesWrite)).Post("/quotes", app.QuoteHandler.HandleCreateQuote)
+	r.With(requireScope(stores.ScopeOnRampWrite), app.RateLimit.Handler, app.Idempotency.Handler).Post("/onramp/initiate", app.TransactionHandler.HandleInitiatePayment)
+	r.With(requireScope(stores.ScopeOffRampWrite), app.RateLimit.Handler, app.Idempotency.Handler).Post("/offramp/initiate", app.TransactionHandler.HandleInitiateOffRamp)
+
+	r.With(requireScope(stores.ScopeTransactionsRead)).Get("/transactions", app.TransactionHandler.HandleListTransactions)
+	r.With(requireScope(stores.ScopeTransactionsRead)).Get("/transactions/{id}", app.TransactionHandler.HandleGetTransaction)
+	r.With(app.APIKeys.RequireForStream(stores.ScopeTransactionsRead)).Get("/transactions/{id}/events", app.TransactionHandler.HandleTransactionEvents)
+
+	r.Group(func(r chi.Router) {
+		r.Use(requireScope(stores.ScopeWebhooksManage))
+		r.Post("/webhook-subscriptions", app.MerchantWebhookHandler.HandleCreateSubscription)
+		r.Get("/webhook-subscriptions", app.MerchantWebhookHandler.HandleListSubscriptions)
+		r.Delete("/webhook-subscriptions/{id}", app.MerchantWebhookHandler.HandleDeleteSubscription)
+		r.Get("/webhook-subscriptions/{id}/deliveries", app.MerchantWebhookHandler.HandleListDeliveries)
+		r.Get("/webhook-deliveries/{id}", app.MerchantWebhookHandler.HandleGetDelivery)
+		r.Post("/webhook-deliveries/{id}/replay", app.MerchantWebhookHandler.HandleReplayDelivery)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(requireScope(stores.ScopeKeysManage))
+		r.Post("/api-keys", app.APIKeyHandler.HandleCreateAPIKey)
+		r.Get("/api-keys", app.APIKeyHandler.HandleListAPIKeys)
+		r.Post("/api-keys/{id}/rotate", app.APIKeyHandler.HandleRotateAPIKey)
+		r.Delete("/api-keys/{id}", app.APIKeyHandler.HandleRevokeAPIKey)
+	})
+
+	r.Group(func(r chi.Router) {
+		r.Use(requireScope(stores.ScopeReviewsResolve))
+		r.Get("/reviews", app.ReviewHandler.HandleListReviews)
+		r.Post("/reviews/{id}/resolve", app.ReviewHandler.HandleResolveReview)
+	})
+
+	if app.CheckoutHandler != nil {
+		r.With(requireScope(stores.ScopeCheckoutWrite), app.Idempotency.Handler).Post("/checkout/sessions", app.CheckoutHandler.HandleCreateCheckoutSession)
+		r.With(requireScope(stores.ScopeCheckoutWrite)).Get("/checkout/sessions/{id}", app.CheckoutHandler.HandleGetCheckoutSession)
+		r.Post("/webhooks/stripe", app.CheckoutHandler.HandleStripeWebhook)
+	}
 
 	return r
 }
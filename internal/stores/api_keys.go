@@ -0,0 +1,259 @@
+package stores
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/utils"
+)
+
+// API key scopes.
+const (
+	ScopeQuotesWrite = "quotes:write"
+	ScopeOnRampWrite = "onramp:write"
+	ScopeOffRampWrite = "offramp:write"
+	ScopeCheckoutWrite = "checkout:write"
+	ScopeTransactionsRead = "transactions:read"
+	ScopeWebhooksManage = "webhooks:manage"
+	ScopeKeysManage = "keys:manage"
+	// ScopeReviewsResolve is for operators' keys: it acts on every
+	// client's transactions.
+	ScopeReviewsResolve = "reviews:resolve"
+)
+
+// Scopes lists every scope a key can be granted.
+var Scopes = []string{ScopeQuotesWrite, ScopeOnRampWrite, ScopeOffRampWrite, ScopeCheckoutWrite, ScopeTransactionsRead, ScopeWebhooksManage, ScopeKeysManage, ScopeReviewsResolve}
+
+// APIKey is a client credential. Only the SHA-256 of the key is stored; the
+// prefix, which is part of the key, identifies it without the secret.
+type APIKey struct {
+	ID string `json:"id"`
+	Name string `json:"name"`
+	Prefix string `json:"prefix"`
+	KeyHash string `json:"-"`
+	Scopes []string `json:"scopes"`
+	RotatedFrom string `json:"rotated_from,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func ValidScope(scope string) bool {
+	for _, known := range Scopes {
+		if known == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (k *APIKey) HasScope(scope string) bool {
+	for _, granted := range k.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the key may be used at t.
+func (k *APIKey) Active(t time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || t.Before(*k.ExpiresAt)
+}
+
+type PostgresAPIKeyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAPIKeyStore(db *sql.DB) *PostgresAPIKeyStore {
+	return &PostgresAPIKeyStore{db: db}
+}
+
+type APIKeyStore interface {
+	CreateAPIKey(key APIKey) (*APIKey, error)
+	GetAPIKeyByID(id string) (*APIKey, error)
+	GetAPIKeyByPrefix(prefix string) (*APIKey, error)
+	ListAPIKeys() ([]APIKey, error)
+	RotateAPIKey(oldID string, newKey APIKey, oldExpiresAt time.Time) (*APIKey, error)
+	RevokeAPIKey(id string) (*APIKey, error)
+	TouchAPIKey(id string) error
+	InAPIKeyFamily(keyID string, otherID string) (bool, error)
+}
+
+const apiKeyColumns = `id, name, prefix, key_hash, array_to_string(scopes, ',') as scopes,
+	COALESCE(rotated_from::text, '') as rotated_from, expires_at, revoked_at, last_used_at, created_at`
+
+func scanAPIKey(row rowScanner) (*APIKey, error) {
+	key := &APIKey{}
+	var scopes string
+	err := row.Scan(&key.ID, &key.Name, &key.Prefix, &key.KeyHash, &scopes, &key.RotatedFrom, &key.ExpiresAt, &key.RevokedAt, &key.LastUsedAt, &key.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	key.Scopes = []string{}
+	if scopes != "" {
+		key.Scopes = strings.Split(scopes, ",")
+	}
+	return key, nil
+}
+
+// apiKeyFamily selects the IDs of the keys related to keyID, a SQL expression,
+// by rotation: the keys it replaced and the keys that replaced it. A client's
+// transactions and subscriptions belong to the whole family, so rotating a
+// key does not lose access to them.
+func apiKeyFamily(keyID string) string {
+	return `(
+		WITH RECURSIVE family AS (
+			SELECT id, rotated_from FROM api_keys WHERE id = ` + keyID + `
+			UNION
+			SELECT k.id, k.rotated_from FROM api_keys k
+			JOIN family f ON k.rotated_from = f.id OR k.id = f.rotated_from
+		)
+		SELECT id FROM family
+	)`
+}
+
+// InAPIKeyFamily reports whether otherID is keyID or one of the keys related
+// to it by rotation.
+func (pk *PostgresAPIKeyStore) InAPIKeyFamily(keyID string, otherID string) (bool, error) {
+	if !utils.IsUUID(keyID) || !utils.IsUUID(otherID) {
+		return false, nil
+	}
+
+	query := `
+
+	SELECT $2::uuid IN ` + apiKeyFamily("$1::uuid")
+
+	var member bool
+	err := pk.db.QueryRow(query, keyID, otherID).Scan(&member)
+	if err != nil {
+		return false, err
+	}
+	return member, nil
+}
+
+const insertAPIKeyQuery = `
+
+	INSERT INTO api_keys (name, prefix, key_hash, scopes, rotated_from, expires_at)
+	VALUES ($1, $2, $3, string_to_array($4, ','), NULLIF($5, '')::uuid, $6)
+	RETURNING ` + apiKeyColumns
+
+func (pk *PostgresAPIKeyStore) CreateAPIKey(key APIKey) (*APIKey, error) {
+	return scanAPIKey(pk.db.QueryRow(insertAPIKeyQuery, key.Name, key.Prefix, key.KeyHash, strings.Join(key.Scopes, ","), key.RotatedFrom, key.ExpiresAt))
+}
+
+func (pk *PostgresAPIKeyStore) GetAPIKeyByID(id string) (*APIKey, error) {
+	query := `
+
+	SELECT ` + apiKeyColumns + `
+	FROM api_keys
+	WHERE id = $1
+	`
+
+	return scanAPIKey(pk.db.QueryRow(query, id))
+}
+
+func (pk *PostgresAPIKeyStore) GetAPIKeyByPrefix(prefix string) (*APIKey, error) {
+	query := `
+
+	SELECT ` + apiKeyColumns + `
+	FROM api_keys
+	WHERE prefix = $1
+	`
+
+	return scanAPIKey(pk.db.QueryRow(query, prefix))
+}
+
+func (pk *PostgresAPIKeyStore) ListAPIKeys() ([]APIKey, error) {
+	query := `
+
+	SELECT ` + apiKeyColumns + `
+	FROM api_keys
+	ORDER BY created_at ASC
+	`
+
+	rows, err := pk.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, *key)
+	}
+	return keys, rows.Err()
+}
+
+// RotateAPIKey creates newKey as the replacement of an active key and makes
+// the old one expire at oldExpiresAt, so that clients can switch over. It
+// returns sql.ErrNoRows if the old key is revoked or has expired.
+func (pk *PostgresAPIKeyStore) RotateAPIKey(oldID string, newKey APIKey, oldExpiresAt time.Time) (*APIKey, error) {
+	tx, err := pk.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+	UPDATE api_keys
+	SET expires_at = LEAST(COALESCE(expires_at, $2), $2)
+	WHERE id = $1 AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)
+	`, oldID, oldExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+	if updated == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	created, err := scanAPIKey(tx.QueryRow(insertAPIKeyQuery, newKey.Name, newKey.Prefix, newKey.KeyHash, strings.Join(newKey.Scopes, ","), oldID, newKey.ExpiresAt))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+func (pk *PostgresAPIKeyStore) RevokeAPIKey(id string) (*APIKey, error) {
+	query := `
+
+	UPDATE api_keys
+	SET revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP)
+	WHERE id = $1
+	RETURNING ` + apiKeyColumns
+
+	return scanAPIKey(pk.db.QueryRow(query, id))
+}
+
+// TouchAPIKey records that a key was used, at most once a minute.
+func (pk *PostgresAPIKeyStore) TouchAPIKey(id string) error {
+	query := `
+
+	UPDATE api_keys
+	SET last_used_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < CURRENT_TIMESTAMP - INTERVAL '1 minute')
+	`
+
+	_, err := pk.db.Exec(query, id)
+	return err
+}
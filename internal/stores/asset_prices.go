@@ -0,0 +1,66 @@
+package stores
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// AssetPrice is one observed KES price of an asset, kept so that every price
+// we sold at can be traced back to its source.
+type AssetPrice struct {
+	ID int64 `json:"id"`
+	Symbol string `json:"symbol"`
+	PriceKSH decimal.Decimal `json:"price_ksh"`
+	Source string `json:"source"`
+	AsOf time.Time `json:"as_of"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+type PostgresAssetPriceStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAssetPriceStore(db *sql.DB) *PostgresAssetPriceStore {
+	return &PostgresAssetPriceStore{db: db}
+}
+
+type AssetPriceStore interface {
+	RecordAssetPrice(price AssetPrice) error
+	GetLatestAssetPrice(symbol string) (*AssetPrice, error)
+}
+
+const assetPriceColumns = `id, symbol, price_ksh, source, as_of, recorded_at`
+
+// RecordAssetPrice stores a price unless one for the same symbol and time is
+// already stored.
+func (pa *PostgresAssetPriceStore) RecordAssetPrice(price AssetPrice) error {
+	query := `
+
+	INSERT INTO asset_prices (symbol, price_ksh, source, as_of)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (symbol, as_of) DO NOTHING
+	`
+
+	_, err := pa.db.Exec(query, price.Symbol, price.PriceKSH, price.Source, price.AsOf)
+	return err
+}
+
+func (pa *PostgresAssetPriceStore) GetLatestAssetPrice(symbol string) (*AssetPrice, error) {
+	query := `
+
+	SELECT ` + assetPriceColumns + `
+	FROM asset_prices
+	WHERE symbol = $1
+	ORDER BY as_of DESC
+	LIMIT 1
+	`
+
+	price := &AssetPrice{}
+	err := pa.db.QueryRow(query, symbol).Scan(&price.ID, &price.Symbol, &price.PriceKSH, &price.Source, &price.AsOf, &price.RecordedAt)
+	if err != nil {
+		return nil, err
+	}
+	return price, nil
+}
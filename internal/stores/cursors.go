@@ -0,0 +1,54 @@
+package stores
+
+import (
+	"database/sql"
+	"errors"
+)
+
+type PostgresCursorStore struct {
+	db *sql.DB
+}
+
+func NewPostgresCursorStore(db *sql.DB) *PostgresCursorStore {
+	return &PostgresCursorStore{db: db}
+}
+
+// CursorStore remembers how far a background worker has read through an
+// external feed, so that a restart carries on from there.
+type CursorStore interface {
+	GetCursor(name string) (string, error)
+	SetCursor(name string, value string) error
+}
+
+// GetCursor returns the cursor saved under name, or "" if there is none.
+func (pc *PostgresCursorStore) GetCursor(name string) (string, error) {
+	query := `
+
+	SELECT value
+	FROM worker_cursors
+	WHERE name = $1
+	`
+
+	var value string
+	err := pc.db.QueryRow(query, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+func (pc *PostgresCursorStore) SetCursor(name string, value string) error {
+	query := `
+
+	INSERT INTO worker_cursors (name, value, updated_at)
+	VALUES ($1, $2, CURRENT_TIMESTAMP)
+	ON CONFLICT (name) DO UPDATE
+	SET value = EXCLUDED.value, updated_at = EXCLUDED.updated_at
+	`
+
+	_, err := pc.db.Exec(query, name, value)
+	return err
+}
@@ -0,0 +1,125 @@
+package stores
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type IdempotencyKey struct {
+	Scope string `json:"scope"`
+	Key string `json:"key"`
+	RequestHash string `json:"request_hash"`
+	Status string `json:"status"`
+	ResponseStatus int `json:"response_status"`
+	ResponseBody []byte `json:"response_body"`
+	ContentType string `json:"content_type"`
+	CreatedAt time.Time `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+type PostgresIdempotencyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresIdempotencyStore(db *sql.DB) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{db: db}
+}
+
+type IdempotencyStore interface {
+	ClaimIdempotencyKey(scope string, key string, requestHash string) (*IdempotencyKey, bool, error)
+	GetIdempotencyKey(scope string, key string) (*IdempotencyKey, error)
+	CompleteIdempotencyKey(scope string, key string, responseStatus int, responseBody []byte, contentType string) error
+	DeleteIdempotencyKey(scope string, key string) error
+	DeleteIdempotencyKeysBefore(before time.Time) (int64, error)
+}
+
+const idempotencyKeyColumns = `scope, key, request_hash, status,
+	COALESCE(response_status, 0) as response_status,
+	COALESCE(response_body, ''::bytea) as response_body,
+	COALESCE(content_type, '') as content_type,
+	created_at, completed_at`
+
+func scanIdempotencyKey(row rowScanner) (*IdempotencyKey, error) {
+	ik := &IdempotencyKey{}
+	err := row.Scan(&ik.Scope, &ik.Key, &ik.RequestHash, &ik.Status, &ik.ResponseStatus, &ik.ResponseBody, &ik.ContentType, &ik.CreatedAt, &ik.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return ik, nil
+}
+
+// ClaimIdempotencyKey records key as in progress. If the key already exists
+// it returns the existing row and false, so the caller can replay or reject.
+func (pi *PostgresIdempotencyStore) ClaimIdempotencyKey(scope string, key string, requestHash string) (*IdempotencyKey, bool, error) {
+	query := `
+
+	INSERT INTO idempotency_keys (scope, key, request_hash)
+	VALUES ($1, $2, $3)
+	ON CONFLICT (scope, key) DO NOTHING
+	RETURNING ` + idempotencyKeyColumns
+
+	ik, err := scanIdempotencyKey(pi.db.QueryRow(query, scope, key, requestHash))
+	if err == nil {
+		return ik, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	ik, err = pi.GetIdempotencyKey(scope, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return ik, false, nil
+}
+
+func (pi *PostgresIdempotencyStore) GetIdempotencyKey(scope string, key string) (*IdempotencyKey, error) {
+	query := `
+
+	SELECT ` + idempotencyKeyColumns + `
+	FROM idempotency_keys
+	WHERE scope = $1 AND key = $2
+	`
+
+	return scanIdempotencyKey(pi.db.QueryRow(query, scope, key))
+}
+
+func (pi *PostgresIdempotencyStore) CompleteIdempotencyKey(scope string, key string, responseStatus int, responseBody []byte, contentType string) error {
+	query := `
+
+	UPDATE idempotency_keys
+	SET status = 'completed', response_status = $3, response_body = $4, content_type = $5, completed_at = CURRENT_TIMESTAMP
+	WHERE scope = $1 AND key = $2 AND status = 'in_progress'
+	`
+
+	_, err := pi.db.Exec(query, scope, key, responseStatus, responseBody, contentType)
+	return err
+}
+
+// DeleteIdempotencyKey forgets an in-progress key so the request can be
+// retried, for when the handler died before producing a response.
+func (pi *PostgresIdempotencyStore) DeleteIdempotencyKey(scope string, key string) error {
+	query := `
+
+	DELETE FROM idempotency_keys
+	WHERE scope = $1 AND key = $2 AND status = 'in_progress'
+	`
+
+	_, err := pi.db.Exec(query, scope, key)
+	return err
+}
+
+func (pi *PostgresIdempotencyStore) DeleteIdempotencyKeysBefore(before time.Time) (int64, error) {
+	query := `
+
+	DELETE FROM idempotency_keys
+	WHERE created_at < $1
+	`
+
+	result, err := pi.db.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
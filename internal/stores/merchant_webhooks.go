@@ -0,0 +1,356 @@
+package stores
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Outbound webhook delivery statuses.
+const (
+	DeliveryPending = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed = "failed"
+)
+
+// WebhookSubscription is a partner endpoint that is sent transaction events.
+// EventTypes are e.g. "transaction.settled", or "*" for all of them. Only
+// events of transactions created by the subscription's API key family are
+// sent.
+type WebhookSubscription struct {
+	ID string `json:"id"`
+	URL string `json:"url"`
+	// APIKeyID is the API key that created the subscription.
+	APIKeyID string `json:"api_key_id,omitempty"`
+	// Secret signs every delivery. It is only shown when the subscription
+	// is created.
+	Secret string `json:"-"`
+	EventTypes []string `json:"event_types"`
+	Active bool `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookDelivery is one event queued for one subscription. Its payload is
+// fixed when the event is recorded, so retries and replays send the same
+// bytes.
+type WebhookDelivery struct {
+	ID string `json:"id"`
+	SubscriptionID string `json:"subscription_id"`
+	TransactionEventID string `json:"transaction_event_id"`
+	EventType string `json:"event_type"`
+	Payload json.RawMessage `json:"payload"`
+	Status string `json:"status"`
+	Attempts int `json:"attempts"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebhookDeliveryAttempt struct {
+	ID string `json:"id"`
+	DeliveryID string `json:"delivery_id"`
+	StatusCode int `json:"status_code,omitempty"`
+	Error string `json:"error,omitempty"`
+	DurationMS int64 `json:"duration_ms"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+type PostgresMerchantWebhookStore struct {
+	db *sql.DB
+}
+
+func NewPostgresMerchantWebhookStore(db *sql.DB) *PostgresMerchantWebhookStore {
+	return &PostgresMerchantWebhookStore{db: db}
+}
+
+type MerchantWebhookStore interface {
+	CreateWebhookSubscription(subscription WebhookSubscription) (*WebhookSubscription, error)
+	GetWebhookSubscription(id string) (*WebhookSubscription, error)
+	GetWebhookSubscriptionForAPIKey(id string, apiKeyID string) (*WebhookSubscription, error)
+	ListWebhookSubscriptions(apiKeyID string) ([]WebhookSubscription, error)
+	DeactivateWebhookSubscription(id string, apiKeyID string) (*WebhookSubscription, error)
+	ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error)
+	GetWebhookDelivery(id string, apiKeyID string) (*WebhookDelivery, error)
+	ListWebhookDeliveries(subscriptionID string, limit int) ([]WebhookDelivery, error)
+	RecordWebhookDeliveryAttempt(delivery WebhookDelivery, attempt WebhookDeliveryAttempt) (*WebhookDelivery, error)
+	GetWebhookDeliveryAttempts(deliveryID string) ([]WebhookDeliveryAttempt, error)
+	ReplayWebhookDelivery(id string, apiKeyID string) (*WebhookDelivery, error)
+}
+
+const webhookSubscriptionColumns = `id, url, COALESCE(api_key_id::text, '') as api_key_id, secret,
+	array_to_string(event_types, ',') as event_types, active, created_at, updated_at`
+
+func scanWebhookSubscription(row rowScanner) (*WebhookSubscription, error) {
+	subscription := &WebhookSubscription{}
+	var eventTypes string
+	err := row.Scan(&subscription.ID, &subscription.URL, &subscription.APIKeyID, &subscription.Secret, &eventTypes, &subscription.Active, &subscription.CreatedAt, &subscription.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	subscription.EventTypes = strings.Split(eventTypes, ",")
+	return subscription, nil
+}
+
+const webhookDeliveryColumns = `id, subscription_id, transaction_event_id, event_type, payload, status, attempts,
+	next_attempt_at, COALESCE(last_error, '') as last_error, delivered_at, created_at`
+
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	var payload []byte
+	err := row.Scan(&delivery.ID, &delivery.SubscriptionID, &delivery.TransactionEventID, &delivery.EventType, &payload, &delivery.Status, &delivery.Attempts, &delivery.NextAttemptAt, &delivery.LastError, &delivery.DeliveredAt, &delivery.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	delivery.Payload = json.RawMessage(payload)
+	return delivery, nil
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, *delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (pm *PostgresMerchantWebhookStore) CreateWebhookSubscription(subscription WebhookSubscription) (*WebhookSubscription, error) {
+	query := `
+
+	INSERT INTO webhook_subscriptions (url, api_key_id, secret, event_types)
+	VALUES ($1, NULLIF($2, '')::uuid, $3, string_to_array($4, ','))
+	RETURNING ` + webhookSubscriptionColumns
+
+	return scanWebhookSubscription(pm.db.QueryRow(query, subscription.URL, subscription.APIKeyID, subscription.Secret, strings.Join(subscription.EventTypes, ",")))
+}
+
+func (pm *PostgresMerchantWebhookStore) GetWebhookSubscription(id string) (*WebhookSubscription, error) {
+	query := `
+
+	SELECT ` + webhookSubscriptionColumns + `
+	FROM webhook_subscriptions
+	WHERE id = $1
+	`
+
+	return scanWebhookSubscription(pm.db.QueryRow(query, id))
+}
+
+// GetWebhookSubscriptionForAPIKey is GetWebhookSubscription for a client: a
+// subscription created by a key outside apiKeyID's rotation family is
+// sql.ErrNoRows.
+func (pm *PostgresMerchantWebhookStore) GetWebhookSubscriptionForAPIKey(id string, apiKeyID string) (*WebhookSubscription, error) {
+	query := `
+
+	SELECT ` + webhookSubscriptionColumns + `
+	FROM webhook_subscriptions
+	WHERE id = $1 AND api_key_id IN ` + apiKeyFamily("$2::uuid")
+
+	return scanWebhookSubscription(pm.db.QueryRow(query, id, apiKeyID))
+}
+
+// ListWebhookSubscriptions returns the subscriptions of apiKeyID's rotation
+// family.
+func (pm *PostgresMerchantWebhookStore) ListWebhookSubscriptions(apiKeyID string) ([]WebhookSubscription, error) {
+	query := `
+
+	SELECT ` + webhookSubscriptionColumns + `
+	FROM webhook_subscriptions
+	WHERE api_key_id IN ` + apiKeyFamily("$1::uuid") + `
+	ORDER BY created_at ASC
+	`
+
+	rows, err := pm.db.Query(query, apiKeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []WebhookSubscription{}
+	for rows.Next() {
+		subscription, err := scanWebhookSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, *subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+// DeactivateWebhookSubscription stops new events being queued for a
+// subscription of apiKeyID's rotation family. Deliveries already queued are
+// still attempted.
+func (pm *PostgresMerchantWebhookStore) DeactivateWebhookSubscription(id string, apiKeyID string) (*WebhookSubscription, error) {
+	query := `
+
+	UPDATE webhook_subscriptions
+	SET active = FALSE, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND api_key_id IN ` + apiKeyFamily("$2::uuid") + `
+	RETURNING ` + webhookSubscriptionColumns
+
+	return scanWebhookSubscription(pm.db.QueryRow(query, id, apiKeyID))
+}
+
+// ClaimDueWebhookDeliveries returns pending deliveries whose next attempt is
+// due and pushes that attempt back by lease, so that other dispatchers leave
+// them alone while they are being sent.
+func (pm *PostgresMerchantWebhookStore) ClaimDueWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	query := `
+
+	UPDATE webhook_deliveries
+	SET next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+	WHERE id IN (
+		SELECT id FROM webhook_deliveries
+		WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+		ORDER BY next_attempt_at ASC
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	)
+	RETURNING ` + webhookDeliveryColumns
+
+	rows, err := pm.db.Query(query, limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+// GetWebhookDelivery returns a delivery to a subscription of apiKeyID's
+// rotation family.
+func (pm *PostgresMerchantWebhookStore) GetWebhookDelivery(id string, apiKeyID string) (*WebhookDelivery, error) {
+	query := `
+
+	SELECT ` + webhookDeliveryColumns + `
+	FROM webhook_deliveries
+	WHERE id = $1 AND subscription_id IN (
+		SELECT id FROM webhook_subscriptions WHERE api_key_id IN ` + apiKeyFamily("$2::uuid") + `
+	)
+	`
+
+	return scanWebhookDelivery(pm.db.QueryRow(query, id, apiKeyID))
+}
+
+func (pm *PostgresMerchantWebhookStore) ListWebhookDeliveries(subscriptionID string, limit int) ([]WebhookDelivery, error) {
+	query := `
+
+	SELECT ` + webhookDeliveryColumns + `
+	FROM webhook_deliveries
+	WHERE subscription_id = $1
+	ORDER BY created_at DESC
+	LIMIT $2
+	`
+
+	rows, err := pm.db.Query(query, subscriptionID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+// RecordWebhookDeliveryAttempt stores an attempt and the delivery's resulting
+// status, attempt count, next attempt time and last error.
+func (pm *PostgresMerchantWebhookStore) RecordWebhookDeliveryAttempt(delivery WebhookDelivery, attempt WebhookDeliveryAttempt) (*WebhookDelivery, error) {
+	tx, err := pm.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+	INSERT INTO webhook_delivery_attempts (delivery_id, status_code, error, duration_ms)
+	VALUES ($1, NULLIF($2, 0), NULLIF($3, ''), $4)
+	`, delivery.ID, attempt.StatusCode, attempt.Error, attempt.DurationMS)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+
+	UPDATE webhook_deliveries
+	SET status = $2, attempts = $3, next_attempt_at = $4, last_error = NULLIF($5, ''),
+		delivered_at = CASE WHEN $2 = 'delivered' THEN CURRENT_TIMESTAMP END
+	WHERE id = $1
+	RETURNING ` + webhookDeliveryColumns
+
+	updated, err := scanWebhookDelivery(tx.QueryRow(query, delivery.ID, delivery.Status, delivery.Attempts, delivery.NextAttemptAt, delivery.LastError))
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+func (pm *PostgresMerchantWebhookStore) GetWebhookDeliveryAttempts(deliveryID string) ([]WebhookDeliveryAttempt, error) {
+	query := `
+
+	SELECT id, delivery_id, COALESCE(status_code, 0) as status_code, COALESCE(error, '') as error, duration_ms, attempted_at
+	FROM webhook_delivery_attempts
+	WHERE delivery_id = $1
+	ORDER BY attempted_at ASC
+	`
+
+	rows, err := pm.db.Query(query, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []WebhookDeliveryAttempt{}
+	for rows.Next() {
+		var attempt WebhookDeliveryAttempt
+		err := rows.Scan(&attempt.ID, &attempt.DeliveryID, &attempt.StatusCode, &attempt.Error, &attempt.DurationMS, &attempt.AttemptedAt)
+		if err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// ReplayWebhookDelivery queues a delivery to be sent again straight away with
+// a fresh set of retries, whatever its current status. The delivery must be to
+// a subscription of apiKeyID's rotation family.
+func (pm *PostgresMerchantWebhookStore) ReplayWebhookDelivery(id string, apiKeyID string) (*WebhookDelivery, error) {
+	query := `
+
+	UPDATE webhook_deliveries
+	SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP, delivered_at = NULL
+	WHERE id = $1 AND subscription_id IN (
+		SELECT id FROM webhook_subscriptions WHERE api_key_id IN ` + apiKeyFamily("$2::uuid") + `
+	)
+	RETURNING ` + webhookDeliveryColumns
+
+	return scanWebhookDelivery(pm.db.QueryRow(query, id, apiKeyID))
+}
+
+// queueWebhookDeliveries queues an event for every active subscription that
+// wants its type and belongs to the rotation family of the API key that
+// created the transaction, as part of the database transaction that records
+// it.
+func queueWebhookDeliveries(tx *sql.Tx, eventID string, eventType string, apiKeyID string, payload []byte) error {
+	query := `
+
+	INSERT INTO webhook_deliveries (subscription_id, transaction_event_id, event_type, payload)
+	SELECT id, $1, $2, $3
+	FROM webhook_subscriptions
+	WHERE active AND ($2 = ANY(event_types) OR '*' = ANY(event_types))
+		AND api_key_id IN ` + apiKeyFamily("NULLIF($4, '')::uuid")
+
+	_, err := tx.Exec(query, eventID, eventType, payload, apiKeyID)
+	return err
+}
@@ -0,0 +1,100 @@
+package stores
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+type Quote struct {
+	ID string `json:"id"`
+	Direction string `json:"direction"`
+	// Asset is what the quoted USDC buys; its fee rule priced the quote.
+	Asset string `json:"asset"`
+	// AssetQuantity is how much of Asset the on-ramp delivers, fixed at the
+	// asset price when the quote was made.
+	AssetQuantity decimal.Decimal `json:"asset_quantity"`
+	AmountKSH decimal.Decimal `json:"amount_ksh"`
+	AmountUSDC decimal.Decimal `json:"amount_usdc"`
+	ExchangeRate decimal.Decimal `json:"exchange_rate"`
+	FeeKSH decimal.Decimal `json:"fee_ksh"`
+	SpreadKSH decimal.Decimal `json:"spread_ksh"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedAt *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type PostgresQuoteStore struct {
+	db *sql.DB
+}
+
+func NewPostgresQuoteStore(db *sql.DB) *PostgresQuoteStore {
+	return &PostgresQuoteStore{db: db}
+}
+
+type QuoteStore interface {
+	CreateQuote(quote Quote) (*Quote, error)
+	GetQuoteByID(id string) (*Quote, error)
+	ReserveQuote(id string) (*Quote, error)
+	ReleaseQuote(id string) error
+}
+
+const quoteColumns = `id, direction, asset, asset_quantity, amount_ksh, amount_usdc, exchange_rate, fee_ksh, spread_ksh, expires_at, used_at, created_at`
+
+func scanQuote(row rowScanner) (*Quote, error) {
+	quote := &Quote{}
+	err := row.Scan(&quote.ID, &quote.Direction, &quote.Asset, &quote.AssetQuantity, &quote.AmountKSH, &quote.AmountUSDC, &quote.ExchangeRate, &quote.FeeKSH, &quote.SpreadKSH, &quote.ExpiresAt, &quote.UsedAt, &quote.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return quote, nil
+}
+
+func (pq *PostgresQuoteStore) CreateQuote(quote Quote) (*Quote, error) {
+	query := `
+
+	INSERT INTO quotes (direction, asset, asset_quantity, amount_ksh, amount_usdc, exchange_rate, fee_ksh, spread_ksh, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	RETURNING ` + quoteColumns
+
+	return scanQuote(pq.db.QueryRow(query, quote.Direction, quote.Asset, quote.AssetQuantity, quote.AmountKSH, quote.AmountUSDC, quote.ExchangeRate, quote.FeeKSH, quote.SpreadKSH, quote.ExpiresAt))
+}
+
+func (pq *PostgresQuoteStore) GetQuoteByID(id string) (*Quote, error) {
+	query := `
+
+	SELECT ` + quoteColumns + `
+	FROM quotes
+	WHERE id = $1
+	`
+
+	return scanQuote(pq.db.QueryRow(query, id))
+}
+
+// ReserveQuote marks an unexpired, unused quote as used. It returns
+// sql.ErrNoRows if the quote does not exist, has expired or was already used.
+func (pq *PostgresQuoteStore) ReserveQuote(id string) (*Quote, error) {
+	query := `
+
+	UPDATE quotes
+	SET used_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP
+	RETURNING ` + quoteColumns
+
+	return scanQuote(pq.db.QueryRow(query, id))
+}
+
+// ReleaseQuote makes a reserved quote usable again, for when the transaction
+// it was reserved for could not be started.
+func (pq *PostgresQuoteStore) ReleaseQuote(id string) error {
+	query := `
+
+	UPDATE quotes
+	SET used_at = NULL
+	WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM transactions WHERE quote_id = $1)
+	`
+
+	_, err := pq.db.Exec(query, id)
+	return err
+}
@@ -0,0 +1,65 @@
+package stores
+
+import (
+	"database/sql"
+	"time"
+)
+
+type PostgresRateLimitStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRateLimitStore(db *sql.DB) *PostgresRateLimitStore {
+	return &PostgresRateLimitStore{db: db}
+}
+
+type RateLimitStore interface {
+	TakeRateLimitToken(key string, capacity float64, refillPerSecond float64) (bool, float64, error)
+	DeleteRateLimitBucketsBefore(before time.Time) (int64, error)
+}
+
+// TakeRateLimitToken refills the token bucket for key, then takes a token if
+// one is left. It returns whether a token was taken and how many are left.
+// A new bucket starts full. The whole check is one statement, so concurrent
+// requests on any replica cannot both take the last token.
+func (pr *PostgresRateLimitStore) TakeRateLimitToken(key string, capacity float64, refillPerSecond float64) (bool, float64, error) {
+	query := `
+
+	INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+	VALUES ($1, $2::float8 - 1, $2::float8 >= 1, now())
+	ON CONFLICT (key) DO UPDATE
+	SET tokens = CASE
+			WHEN LEAST($2::float8, b.tokens + GREATEST(EXTRACT(EPOCH FROM now() - b.updated_at)::float8, 0) * $3::float8) >= 1
+			THEN LEAST($2::float8, b.tokens + GREATEST(EXTRACT(EPOCH FROM now() - b.updated_at)::float8, 0) * $3::float8) - 1
+			ELSE LEAST($2::float8, b.tokens + GREATEST(EXTRACT(EPOCH FROM now() - b.updated_at)::float8, 0) * $3::float8)
+		END,
+		allowed = LEAST($2::float8, b.tokens + GREATEST(EXTRACT(EPOCH FROM now() - b.updated_at)::float8, 0) * $3::float8) >= 1,
+		updated_at = GREATEST(b.updated_at, now())
+	RETURNING allowed, tokens
+	`
+
+	var allowed bool
+	var tokens float64
+	err := pr.db.QueryRow(query, key, capacity, refillPerSecond).Scan(&allowed, &tokens)
+	if err != nil {
+		return false, 0, err
+	}
+	return allowed, tokens, nil
+}
+
+// DeleteRateLimitBucketsBefore deletes buckets untouched since before. Their
+// next request starts a full bucket, so only buckets that would have refilled
+// by now should be deleted.
+func (pr *PostgresRateLimitStore) DeleteRateLimitBucketsBefore(before time.Time) (int64, error) {
+	query := `
+
+	DELETE FROM rate_limit_buckets
+	WHERE updated_at < $1
+	`
+
+	result, err := pr.db.Exec(query, before)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
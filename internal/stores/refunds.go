@@ -0,0 +1,92 @@
+package stores
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+// RefundReason says why a deposit the treasury received has to be returned.
+type RefundReason string
+
+const (
+	// RefundShortDeposit is a deposit for less than its off-ramp's amount.
+	RefundShortDeposit RefundReason = "short_deposit"
+	// RefundUnexpectedDeposit is a deposit for an off-ramp that had already
+	// expired or been funded by another deposit.
+	RefundUnexpectedDeposit RefundReason = "unexpected_deposit"
+	// RefundPayoutFailed is a deposit whose off-ramp could not be paid out.
+	RefundPayoutFailed RefundReason = "payout_failed"
+)
+
+// Refund is a deposit that an operator has to send back to the off-ramp's
+// account. It stays pending until they mark it refunded.
+type Refund struct {
+	ID string `json:"id"`
+	TransactionID string `json:"transaction_id"`
+	// DepositTxID is the Hedera transaction that made the deposit.
+	DepositTxID string `json:"deposit_tx_id"`
+	AmountUSDC decimal.Decimal `json:"amount_usdc"`
+	Reason RefundReason `json:"reason"`
+	Status string `json:"status"`
+	CreatedAt time.Time `json:"created_at"`
+	RefundedAt *time.Time `json:"refunded_at,omitempty"`
+}
+
+type PostgresRefundStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRefundStore(db *sql.DB) *PostgresRefundStore {
+	return &PostgresRefundStore{db: db}
+}
+
+type RefundStore interface {
+	CreateRefund(refund Refund) (*Refund, bool, error)
+}
+
+const refundColumns = `id, transaction_id, deposit_tx_id, amount_usdc, reason, status, created_at, refunded_at`
+
+func scanRefund(row rowScanner) (*Refund, error) {
+	refund := &Refund{}
+	err := row.Scan(&refund.ID, &refund.TransactionID, &refund.DepositTxID, &refund.AmountUSDC, &refund.Reason, &refund.Status, &refund.CreatedAt, &refund.RefundedAt)
+	if err != nil {
+		return nil, err
+	}
+	return refund, nil
+}
+
+// CreateRefund records a pending refund of a deposit. A deposit is refunded
+// at most once, so if one is already recorded for it that one is returned
+// with false.
+func (pr *PostgresRefundStore) CreateRefund(refund Refund) (*Refund, bool, error) {
+	query := `
+
+	INSERT INTO deposit_refunds (transaction_id, deposit_tx_id, amount_usdc, reason)
+	VALUES ($1, $2, $3, $4)
+	ON CONFLICT (deposit_tx_id) DO NOTHING
+	RETURNING ` + refundColumns
+
+	created, err := scanRefund(pr.db.QueryRow(query, refund.TransactionID, refund.DepositTxID, refund.AmountUSDC, refund.Reason))
+	if err == nil {
+		return created, true, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	query = `
+
+	SELECT ` + refundColumns + `
+	FROM deposit_refunds
+	WHERE deposit_tx_id = $1
+	`
+
+	existing, err := scanRefund(pr.db.QueryRow(query, refund.DepositTxID))
+	if err != nil {
+		return nil, false, err
+	}
+	return existing, false, nil
+}
@@ -0,0 +1,84 @@
+package stores
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidTransition is returned when a status change is not allowed by
+// allowedTransitions, regardless of the transaction's current state.
+var ErrInvalidTransition = errors.New("invalid transaction status transition")
+
+type TransactionStatus string
+
+const (
+	StatusPending TransactionStatus = "pending"
+	StatusInitiated TransactionStatus = "initiated"
+	StatusConfirmed TransactionStatus = "confirmed"
+	StatusSettling TransactionStatus = "settling"
+	StatusSettled TransactionStatus = "settled"
+	StatusFailed TransactionStatus = "failed"
+	StatusExpired TransactionStatus = "expired"
+	// StatusReview holds a payment whose details did not match the
+	// transaction, e.g. a partial payment, until someone resolves it.
+	StatusReview TransactionStatus = "review"
+)
+
+// allowedTransitions lists every status a transaction may move to from each
+// status. Settled, failed and expired are final.
+var allowedTransitions = map[TransactionStatus][]TransactionStatus{
+	// off-ramp waiting for the user's USDC deposit
+	StatusPending: {StatusConfirmed, StatusFailed, StatusExpired},
+	// on-ramp waiting for the STK push to be paid
+	StatusInitiated: {StatusConfirmed, StatusFailed, StatusExpired, StatusReview},
+	StatusReview: {StatusConfirmed, StatusFailed},
+	StatusConfirmed: {StatusSettling, StatusFailed},
+	// settling returns to confirmed when an attempt is released for retry
+	StatusSettling: {StatusSettled, StatusFailed, StatusConfirmed},
+	StatusSettled: {},
+	StatusFailed: {},
+	StatusExpired: {},
+}
+
+func (s TransactionStatus) CanTransitionTo(next TransactionStatus) bool {
+	for _, allowed := range allowedTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+func (s TransactionStatus) IsValid() bool {
+	_, ok := allowedTransitions[s]
+	return ok
+}
+
+func (s TransactionStatus) IsFinal() bool {
+	return len(allowedTransitions[s]) == 0
+}
+
+func checkTransition(from TransactionStatus, to TransactionStatus) error {
+	if !from.CanTransitionTo(to) {
+		return fmt.Errorf("%w: %s to %s", ErrInvalidTransition, from, to)
+	}
+	return nil
+}
+
+// Actors recorded against status changes.
+const (
+	ActorAPI = "api"
+	ActorMpesaCallback = "mpesa_callback"
+	ActorSTKResolver = "stk_resolver"
+	ActorSettler = "settler"
+	ActorOffRampWorker = "offramp_worker"
+	ActorB2CCallback = "b2c_callback"
+	ActorStripeWebhook = "stripe_webhook"
+	ActorOperator = "operator"
+)
+
+// StatusChange says who moved a transaction and why, for its event history.
+type StatusChange struct {
+	Actor string
+	Reason string
+}
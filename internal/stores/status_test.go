@@ -0,0 +1,64 @@
+package stores
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAllowedTransitions(t *testing.T) {
+	all := []TransactionStatus{StatusPending, StatusInitiated, StatusConfirmed, StatusSettling, StatusSettled, StatusFailed, StatusExpired, StatusReview}
+	allowed := map[TransactionStatus][]TransactionStatus{
+		StatusPending: {StatusConfirmed, StatusFailed, StatusExpired},
+		StatusInitiated: {StatusConfirmed, StatusFailed, StatusExpired, StatusReview},
+		StatusReview: {StatusConfirmed, StatusFailed},
+		StatusConfirmed: {StatusSettling, StatusFailed},
+		StatusSettling: {StatusSettled, StatusFailed, StatusConfirmed},
+	}
+
+	for _, from := range all {
+		for _, to := range all {
+			want := false
+			for _, next := range allowed[from] {
+				want = want || next == to
+			}
+			if got := from.CanTransitionTo(to); got != want {
+				t.Errorf("%s -> %s allowed = %t, want %t", from, to, got, want)
+			}
+
+			err := checkTransition(from, to)
+			if want != (err == nil) {
+				t.Errorf("checkTransition(%s, %s) = %v", from, to, err)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidTransition) {
+				t.Errorf("checkTransition(%s, %s) = %v, want ErrInvalidTransition", from, to, err)
+			}
+		}
+	}
+}
+
+func TestFinalStatuses(t *testing.T) {
+	tests := []struct {
+		status TransactionStatus
+		final bool
+	}{
+		{StatusPending, false},
+		{StatusInitiated, false},
+		{StatusReview, false},
+		{StatusConfirmed, false},
+		{StatusSettling, false},
+		{StatusSettled, true},
+		{StatusFailed, true},
+		{StatusExpired, true},
+	}
+	for _, tt := range tests {
+		if !tt.status.IsValid() {
+			t.Errorf("%s is not valid", tt.status)
+		}
+		if got := tt.status.IsFinal(); got != tt.final {
+			t.Errorf("%s final = %t, want %t", tt.status, got, tt.final)
+		}
+	}
+	if TransactionStatus("refunded").IsValid() {
+		t.Error("an unknown status is valid")
+	}
+}
@@ -0,0 +1,110 @@
+package stores
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// TransactionEventsChannel is the Postgres NOTIFY channel that carries the
+// ID of every transaction whose status changes, once the change commits.
+const TransactionEventsChannel = "transaction_events"
+
+type TransactionEvent struct {
+	ID string `json:"id"`
+	TransactionID string `json:"transaction_id"`
+	FromStatus TransactionStatus `json:"from_status,omitempty"`
+	ToStatus TransactionStatus `json:"to_status"`
+	Actor string `json:"actor"`
+	Reason string `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TransactionEventType names a change to status in outbound webhooks, e.g.
+// "transaction.settled".
+func TransactionEventType(status TransactionStatus) string {
+	return "transaction." + string(status)
+}
+
+// TransactionEventPayload is the body of an outbound webhook: the event and
+// the transaction as it was right after it.
+type TransactionEventPayload struct {
+	ID string `json:"id"`
+	Type string `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data TransactionEventData `json:"data"`
+}
+
+type TransactionEventData struct {
+	Event TransactionEvent `json:"event"`
+	Transaction Transaction `json:"transaction"`
+}
+
+// recordTransactionEvent records a status change of transaction, which must
+// already show the new status, and queues it for webhook subscribers.
+func recordTransactionEvent(tx *sql.Tx, transaction *Transaction, from TransactionStatus, to TransactionStatus, change StatusChange) error {
+	query := `
+
+	INSERT INTO transaction_events (transaction_id, from_status, to_status, actor, reason)
+	VALUES ($1, NULLIF($2, ''), $3, $4, NULLIF($5, ''))
+	RETURNING id, created_at
+	`
+
+	event := TransactionEvent{
+		TransactionID: transaction.ID,
+		FromStatus: from,
+		ToStatus: to,
+		Actor: change.Actor,
+		Reason: change.Reason,
+	}
+	err := tx.QueryRow(query, transaction.ID, from, to, change.Actor, change.Reason).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(TransactionEventPayload{
+		ID: event.ID,
+		Type: TransactionEventType(to),
+		CreatedAt: event.CreatedAt,
+		Data: TransactionEventData{Event: event, Transaction: *transaction},
+	})
+	if err != nil {
+		return err
+	}
+	err = queueWebhookDeliveries(tx, event.ID, TransactionEventType(to), transaction.APIKeyID, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`SELECT pg_notify($1, $2)`, TransactionEventsChannel, transaction.ID)
+	return err
+}
+
+// GetTransactionEvents returns the full status history of a transaction,
+// oldest first.
+func (pt *PostgresTransactionStore) GetTransactionEvents(transactionID string) ([]TransactionEvent, error) {
+	query := `
+
+	SELECT id, transaction_id, COALESCE(from_status, '') as from_status, to_status, actor, COALESCE(reason, '') as reason, created_at
+	FROM transaction_events
+	WHERE transaction_id = $1
+	ORDER BY created_at ASC, id ASC
+	`
+
+	rows, err := pt.db.Query(query, transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []TransactionEvent{}
+	for rows.Next() {
+		var event TransactionEvent
+		err := rows.Scan(&event.ID, &event.TransactionID, &event.FromStatus, &event.ToStatus, &event.Actor, &event.Reason, &event.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
@@ -0,0 +1,117 @@
+package stores
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TransactionFilter selects transactions for ListTransactions. Zero fields
+// are not filtered on.
+type TransactionFilter struct {
+	// APIKeyID limits the listing to transactions created by that key or
+	// another key of its rotation family.
+	APIKeyID string
+	HederaAccountID string
+	Phone string
+	Status TransactionStatus
+	Type string
+	// From is inclusive and To exclusive, both on created_at.
+	From time.Time
+	To time.Time
+	// After continues a listing from the last transaction of a previous page.
+	After *TransactionCursor
+	Limit int
+}
+
+// TransactionCursor is the position of a transaction in the newest-first
+// ordering used by ListTransactions.
+type TransactionCursor struct {
+	CreatedAt time.Time
+	ID string
+}
+
+func (pt *PostgresTransactionStore) GetTransactionByID(id string) (*Transaction, error) {
+	query := `
+
+	SELECT ` + transactionColumns + `
+	FROM transactions
+	WHERE id = $1
+	`
+
+	return scanTransaction(pt.db.QueryRow(query, id))
+}
+
+// GetTransactionByIDForAPIKey is GetTransactionByID for a client: a
+// transaction created by a key outside apiKeyID's rotation family is
+// sql.ErrNoRows.
+func (pt *PostgresTransactionStore) GetTransactionByIDForAPIKey(id string, apiKeyID string) (*Transaction, error) {
+	query := `
+
+	SELECT ` + transactionColumns + `
+	FROM transactions
+	WHERE id = $1 AND api_key_id IN ` + apiKeyFamily("$2::uuid")
+
+	return scanTransaction(pt.db.QueryRow(query, id, apiKeyID))
+}
+
+// ListTransactions returns transactions matching filter, newest first. Ties
+// on created_at are broken by ID so that pages never overlap or skip rows.
+func (pt *PostgresTransactionStore) ListTransactions(filter TransactionFilter) ([]Transaction, error) {
+	var conditions []string
+	var args []any
+	where := func(condition string, arg ...any) {
+		for _, a := range arg {
+			args = append(args, a)
+			condition = strings.Replace(condition, "?", fmt.Sprintf("$%d", len(args)), 1)
+		}
+		conditions = append(conditions, condition)
+	}
+
+	if filter.APIKeyID != "" {
+		where("api_key_id IN "+apiKeyFamily("?::uuid"), filter.APIKeyID)
+	}
+	if filter.HederaAccountID != "" {
+		where("hedera_account_id = ?", filter.HederaAccountID)
+	}
+	if filter.Phone != "" {
+		where("phone = ?", filter.Phone)
+	}
+	if filter.Status != "" {
+		where("status = ?", filter.Status)
+	}
+	if filter.Type != "" {
+		where("type = ?", filter.Type)
+	}
+	if !filter.From.IsZero() {
+		where("created_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		where("created_at < ?", filter.To)
+	}
+	if filter.After != nil {
+		where("(created_at, id) < (?, ?::uuid)", filter.After.CreatedAt, filter.After.ID)
+	}
+
+	query := `
+
+	SELECT ` + transactionColumns + `
+	FROM transactions`
+	if len(conditions) > 0 {
+		query += `
+	WHERE ` + strings.Join(conditions, " AND ")
+	}
+	args = append(args, filter.Limit)
+	query += fmt.Sprintf(`
+	ORDER BY created_at DESC, id DESC
+	LIMIT $%d
+	`, len(args))
+
+	rows, err := pt.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTransactions(rows)
+}
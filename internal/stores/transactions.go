@@ -3,6 +3,8 @@ package stores
 import (
 	"database/sql"
 	"time"
+
+	"github.com/shopspring/decimal"
 )
 
 type Transaction struct {
@@ -10,13 +12,30 @@ type Transaction struct {
 	Phone string `json:"phone"`
 	HederaAccountID string `json:"hedera_account_id"`
 	Type string `json:"type"`
-	AmountKSH float64 `json:"amount_ksh"`
-	AmountUSDC float64 `json:"amount_usdc"`
-	ExchangeRate float64 `json:"exchange_rate"`
-	Status string `json:"status"`
+	AmountKSH decimal.Decimal `json:"amount_ksh"`
+	AmountUSDC decimal.Decimal `json:"amount_usdc"`
+	// Asset is what is delivered for an on-ramp or card purchase, or
+	// deposited for an off-ramp, and AssetQuantity how much of it. For USDC
+	// the quantity is AmountUSDC.
+	Asset string `json:"asset"`
+	AssetQuantity decimal.Decimal `json:"asset_quantity"`
+	ExchangeRate decimal.Decimal `json:"exchange_rate"`
+	FeeKSH decimal.Decimal `json:"fee_ksh"`
+	SpreadKSH decimal.Decimal `json:"spread_ksh"`
+	Status TransactionStatus `json:"status"`
 	MpesaCheckoutID string `json:"mpesa_checkout_id"`
 	MpesaReceiptNumber string `json:"mpesa_receipt_number"`
 	HederaTxID string `json:"hedera_tx_id"`
+	DepositMemo string `json:"deposit_memo,omitempty"`
+	MpesaConversationID string `json:"mpesa_conversation_id,omitempty"`
+	QuoteID string `json:"quote_id,omitempty"`
+	StripeSessionID string `json:"stripe_session_id,omitempty"`
+	// APIKeyID is the API key that created the transaction.
+	APIKeyID string `json:"api_key_id,omitempty"`
+	// CallbackTokenHash is the SHA-256 of the token in this transaction's
+	// STK callback URL, or for an off-ramp in its B2C result URL.
+	CallbackTokenHash string `json:"-"`
+	SettlementAttempts int `json:"settlement_attempts"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
@@ -31,34 +50,109 @@ func NewPostgresTransactionStore(db *sql.DB) *PostgresTransactionStore {
 
 type TransactionStore interface {
 	CreateTransaction(tx Transaction) (*Transaction, error)
+	GetTransactionByID(id string) (*Transaction, error)
+	GetTransactionByIDForAPIKey(id string, apiKeyID string) (*Transaction, error)
+	ListTransactions(filter TransactionFilter) ([]Transaction, error)
+	TransitionTransaction(id string, from TransactionStatus, to TransactionStatus, change StatusChange) (*Transaction, error)
 	GetTransactionByMpesaCheckoutID(mpesaCheckoutID string) (*Transaction, error)
-	UpdateTransactionByMpesaCheckoutID(mpesaCheckoutID string, status string, mpesaReceiptNumber string) (*Transaction, error)
+	UpdateTransactionByMpesaCheckoutID(mpesaCheckoutID string, status TransactionStatus, mpesaReceiptNumber string, change StatusChange) (*Transaction, error)
+	GetTransactionsByTypeAndStatus(txType string, status TransactionStatus, limit int) ([]Transaction, error)
+	GetTransactionsByStatusUpdatedBefore(txType string, status TransactionStatus, before time.Time, limit int) ([]Transaction, error)
+	ClaimTransactionForSettlement(id string, hederaTxID string, change StatusChange) (*Transaction, error)
+	MarkTransactionSettled(id string, change StatusChange) (*Transaction, error)
+	ReleaseTransactionSettlement(id string, change StatusChange) (*Transaction, error)
+	FailTransactionSettlement(id string, change StatusChange) (*Transaction, error)
+	GetTransactionByDepositMemo(depositMemo string) (*Transaction, error)
+	ConfirmOffRampDeposit(id string, hederaTxID string, change StatusChange) (*Transaction, error)
+	ClaimTransactionForPayout(id string, callbackTokenHash string, change StatusChange) (*Transaction, error)
+	ReleaseTransactionPayout(id string, change StatusChange) (*Transaction, error)
+	SetTransactionMpesaConversationID(id string, conversationID string) (*Transaction, error)
+	UpdateTransactionPayout(conversationID string, originatorConversationID string, status TransactionStatus, mpesaReceiptNumber string, change StatusChange) (*Transaction, error)
+	GetTransactionByStripeSessionID(sessionID string) (*Transaction, error)
+	GetTransactionEvents(transactionID string) ([]TransactionEvent, error)
+}
+
+const transactionColumns = `id, phone, hedera_account_id, type, amount_ksh, amount_usdc, asset, asset_quantity, exchange_rate, fee_ksh, spread_ksh, status,
+	COALESCE(mpesa_checkout_id, '') as mpesa_checkout_id,
+	COALESCE(mpesa_receipt_number, '') as mpesa_receipt_number,
+	COALESCE(hedera_tx_id, '') as hedera_tx_id,
+	COALESCE(deposit_memo, '') as deposit_memo,
+	COALESCE(mpesa_conversation_id, '') as mpesa_conversation_id,
+	COALESCE(quote_id::text, '') as quote_id,
+	COALESCE(callback_token_hash, '') as callback_token_hash,
+	COALESCE(stripe_session_id, '') as stripe_session_id,
+	COALESCE(api_key_id::text, '') as api_key_id,
+	settlement_attempts, created_at, updated_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTransaction(row rowScanner) (*Transaction, error) {
+	transaction := &Transaction{}
+	err := row.Scan(&transaction.ID, &transaction.Phone, &transaction.HederaAccountID, &transaction.Type, &transaction.AmountKSH, &transaction.AmountUSDC, &transaction.Asset, &transaction.AssetQuantity, &transaction.ExchangeRate, &transaction.FeeKSH, &transaction.SpreadKSH, &transaction.Status, &transaction.MpesaCheckoutID, &transaction.MpesaReceiptNumber, &transaction.HederaTxID, &transaction.DepositMemo, &transaction.MpesaConversationID, &transaction.QuoteID, &transaction.CallbackTokenHash, &transaction.StripeSessionID, &transaction.APIKeyID, &transaction.SettlementAttempts, &transaction.CreatedAt, &transaction.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return transaction, nil
+}
+
+func scanTransactions(rows *sql.Rows) ([]Transaction, error) {
+	transactions := []Transaction{}
+	for rows.Next() {
+		transaction, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		transactions = append(transactions, *transaction)
+	}
+	return transactions, rows.Err()
 }
 
 func (pt *PostgresTransactionStore) CreateTransaction(tx Transaction) (*Transaction, error) {
+	dbTx, err := pt.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	defer dbTx.Rollback()
+
 	query := `
 	INSERT INTO transactions (
-	phone, hedera_account_id, type, amount_ksh, amount_usdc, exchange_rate, status, mpesa_checkout_id
+	phone, hedera_account_id, type, amount_ksh, amount_usdc, asset, asset_quantity, exchange_rate, fee_ksh, spread_ksh, status, mpesa_checkout_id, deposit_memo, quote_id, callback_token_hash, stripe_session_id, api_key_id
 	)
-	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-	RETURNING id, phone, hedera_account_id, type, amount_ksh, amount_usdc, exchange_rate, status, 
-	COALESCE(mpesa_checkout_id, '') as mpesa_checkout_id, 
-	COALESCE(mpesa_receipt_number, '') as mpesa_receipt_number, 
-	COALESCE(hedera_tx_id, '') as hedera_tx_id, 
-	created_at, updated_at
-	`
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, ''), NULLIF($13, ''), NULLIF($14, '')::uuid, NULLIF($15, ''), NULLIF($16, ''), NULLIF($17, '')::uuid)
+	RETURNING ` + transactionColumns
 
-	err := pt.db.QueryRow(query, tx.Phone, tx.HederaAccountID, tx.Type, tx.AmountKSH, tx.AmountUSDC, tx.ExchangeRate, tx.Status, tx.MpesaCheckoutID).
-	Scan(&tx.ID, &tx.Phone, &tx.HederaAccountID, &tx.Type, &tx.AmountKSH, &tx.AmountUSDC, &tx.ExchangeRate, &tx.Status, &tx.MpesaCheckoutID, &tx.MpesaReceiptNumber, &tx.HederaTxID, &tx.CreatedAt, &tx.UpdatedAt)
+	transaction, err := scanTransaction(dbTx.QueryRow(query, tx.Phone, tx.HederaAccountID, tx.Type, tx.AmountKSH, tx.AmountUSDC, tx.Asset, tx.AssetQuantity, tx.ExchangeRate, tx.FeeKSH, tx.SpreadKSH, tx.Status, tx.MpesaCheckoutID, tx.DepositMemo, tx.QuoteID, tx.CallbackTokenHash, tx.StripeSessionID, tx.APIKeyID))
 	if err != nil {
 		return nil, err
 	}
 
-	return &tx, nil
+	err = recordTransactionEvent(dbTx, transaction, "", transaction.Status, StatusChange{Actor: ActorAPI, Reason: "created"})
+	if err != nil {
+		return nil, err
+	}
+
+	err = dbTx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
 }
 
-func (pt *PostgresTransactionStore) UpdateTransactionByMpesaCheckoutID(mpesaCheckoutID string, status string, mpesaReceiptNumber string) (*Transaction, error) {
-	transaction := &Transaction{}
+// transition moves a transaction from one status to another and records the
+// change in transaction_events, in a single database transaction. query must
+// be an UPDATE ... RETURNING transactionColumns whose last two parameters are
+// the new and the current status, and it must guard on the current status so
+// that a row that has already moved on yields sql.ErrNoRows.
+func (pt *PostgresTransactionStore) transition(from TransactionStatus, to TransactionStatus, change StatusChange, query string, args ...any) (*Transaction, error) {
+	err := checkTransition(from, to)
+	if err != nil {
+		return nil, err
+	}
+
 	tx, err := pt.db.Begin()
 	if err != nil {
 		return nil, err
@@ -66,20 +160,13 @@ func (pt *PostgresTransactionStore) UpdateTransactionByMpesaCheckoutID(mpesaChec
 
 	defer tx.Rollback()
 
-	query := `
-	
-	UPDATE transactions
-	SET status = $1, mpesa_receipt_number = $2
-	WHERE mpesa_checkout_id = $3
-	RETURNING id, phone, hedera_account_id, type, amount_ksh, amount_usdc, exchange_rate, status, 
-	COALESCE(mpesa_checkout_id, '') as mpesa_checkout_id, 
-	COALESCE(mpesa_receipt_number, '') as mpesa_receipt_number, 
-	COALESCE(hedera_tx_id, '') as hedera_tx_id, 
-	created_at, updated_at
-	`
+	args = append(args, to, from)
+	transaction, err := scanTransaction(tx.QueryRow(query, args...))
+	if err != nil {
+		return nil, err
+	}
 
-	err = tx.QueryRow(query, status, mpesaReceiptNumber, mpesaCheckoutID).
-	Scan(&transaction.ID, &transaction.Phone, &transaction.HederaAccountID, &transaction.Type, &transaction.AmountKSH, &transaction.AmountUSDC, &transaction.ExchangeRate, &transaction.Status, &transaction.MpesaCheckoutID, &transaction.MpesaReceiptNumber, &transaction.HederaTxID, &transaction.CreatedAt, &transaction.UpdatedAt)
+	err = recordTransactionEvent(tx, transaction, from, to, change)
 	if err != nil {
 		return nil, err
 	}
@@ -92,24 +179,204 @@ func (pt *PostgresTransactionStore) UpdateTransactionByMpesaCheckoutID(mpesaChec
 	return transaction, nil
 }
 
+// TransitionTransaction moves a transaction from one status to another with
+// no other changes. It returns sql.ErrNoRows if the transaction is no longer
+// in from.
+func (pt *PostgresTransactionStore) TransitionTransaction(id string, from TransactionStatus, to TransactionStatus, change StatusChange) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET status = $2, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND status = $3
+	RETURNING ` + transactionColumns
+
+	return pt.transition(from, to, change, query, id)
+}
+
+// UpdateTransactionByMpesaCheckoutID resolves an initiated STK push. Both the
+// M-Pesa callback and the STK query resolver go through here, so whichever
+// arrives second gets sql.ErrNoRows instead of overwriting the first.
+func (pt *PostgresTransactionStore) UpdateTransactionByMpesaCheckoutID(mpesaCheckoutID string, status TransactionStatus, mpesaReceiptNumber string, change StatusChange) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET status = $3, mpesa_receipt_number = NULLIF($2, ''), updated_at = CURRENT_TIMESTAMP
+	WHERE mpesa_checkout_id = $1 AND status = $4
+	RETURNING ` + transactionColumns
+
+	return pt.transition(StatusInitiated, status, change, query, mpesaCheckoutID, mpesaReceiptNumber)
+}
+
 func (pt *PostgresTransactionStore) GetTransactionByMpesaCheckoutID(mpesaCheckoutID string) (*Transaction, error) {
-	transaction := &Transaction{}
 	query := `
-	
-	SELECT id, phone, hedera_account_id, type, amount_ksh, amount_usdc, exchange_rate, status, 
-	COALESCE(mpesa_checkout_id, '') as mpesa_checkout_id, 
-	COALESCE(mpesa_receipt_number, '') as mpesa_receipt_number, 
-	COALESCE(hedera_tx_id, '') as hedera_tx_id, 
-	created_at, updated_at
+
+	SELECT ` + transactionColumns + `
 	FROM transactions
 	WHERE mpesa_checkout_id = $1
 	`
 
-	err := pt.db.QueryRow(query, mpesaCheckoutID).
-	Scan(&transaction.ID, &transaction.Phone, &transaction.HederaAccountID, &transaction.Type, &transaction.AmountKSH, &transaction.AmountUSDC, &transaction.ExchangeRate, &transaction.Status, &transaction.MpesaCheckoutID, &transaction.MpesaReceiptNumber, &transaction.HederaTxID, &transaction.CreatedAt, &transaction.UpdatedAt)
+	return scanTransaction(pt.db.QueryRow(query, mpesaCheckoutID))
+}
+
+func (pt *PostgresTransactionStore) GetTransactionsByTypeAndStatus(txType string, status TransactionStatus, limit int) ([]Transaction, error) {
+	query := `
+
+	SELECT ` + transactionColumns + `
+	FROM transactions
+	WHERE type = $1 AND status = $2
+	ORDER BY created_at ASC
+	LIMIT $3
+	`
+
+	rows, err := pt.db.Query(query, txType, status, limit)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return transaction, nil
-}
\ No newline at end of file
+	return scanTransactions(rows)
+}
+
+func (pt *PostgresTransactionStore) GetTransactionsByStatusUpdatedBefore(txType string, status TransactionStatus, before time.Time, limit int) ([]Transaction, error) {
+	query := `
+
+	SELECT ` + transactionColumns + `
+	FROM transactions
+	WHERE type = $1 AND status = $2 AND updated_at < $3
+	ORDER BY updated_at ASC
+	LIMIT $4
+	`
+
+	rows, err := pt.db.Query(query, txType, status, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTransactions(rows)
+}
+
+// ClaimTransactionForSettlement moves a confirmed on-ramp or card transaction
+// to settling and records the Hedera transaction ID that will be submitted for
+// it. Only one
+// caller can win the claim; everyone else gets sql.ErrNoRows.
+func (pt *PostgresTransactionStore) ClaimTransactionForSettlement(id string, hederaTxID string, change StatusChange) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET status = $3, hedera_tx_id = $2, settlement_attempts = settlement_attempts + 1, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND type IN ('onramp', 'card') AND status = $4
+	RETURNING ` + transactionColumns
+
+	return pt.transition(StatusConfirmed, StatusSettling, change, query, id, hederaTxID)
+}
+
+func (pt *PostgresTransactionStore) MarkTransactionSettled(id string, change StatusChange) (*Transaction, error) {
+	return pt.TransitionTransaction(id, StatusSettling, StatusSettled, change)
+}
+
+// ReleaseTransactionSettlement returns a settling transaction to confirmed so
+// that it is picked up again. Callers must be sure the recorded Hedera
+// transaction did not transfer anything.
+func (pt *PostgresTransactionStore) ReleaseTransactionSettlement(id string, change StatusChange) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET status = $2, hedera_tx_id = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND type IN ('onramp', 'card') AND status = $3
+	RETURNING ` + transactionColumns
+
+	return pt.transition(StatusSettling, StatusConfirmed, change, query, id)
+}
+
+func (pt *PostgresTransactionStore) FailTransactionSettlement(id string, change StatusChange) (*Transaction, error) {
+	return pt.TransitionTransaction(id, StatusSettling, StatusFailed, change)
+}
+
+func (pt *PostgresTransactionStore) GetTransactionByStripeSessionID(sessionID string) (*Transaction, error) {
+	query := `
+
+	SELECT ` + transactionColumns + `
+	FROM transactions
+	WHERE stripe_session_id = $1
+	`
+
+	return scanTransaction(pt.db.QueryRow(query, sessionID))
+}
+
+func (pt *PostgresTransactionStore) GetTransactionByDepositMemo(depositMemo string) (*Transaction, error) {
+	query := `
+
+	SELECT ` + transactionColumns + `
+	FROM transactions
+	WHERE deposit_memo = $1
+	`
+
+	return scanTransaction(pt.db.QueryRow(query, depositMemo))
+}
+
+// ConfirmOffRampDeposit records the inbound Hedera transfer that funded an
+// off-ramp and makes the transaction eligible for payout.
+func (pt *PostgresTransactionStore) ConfirmOffRampDeposit(id string, hederaTxID string, change StatusChange) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET status = $3, hedera_tx_id = $2, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND type = 'offramp' AND status = $4
+	RETURNING ` + transactionColumns
+
+	return pt.transition(StatusPending, StatusConfirmed, change, query, id, hederaTxID)
+}
+
+func (pt *PostgresTransactionStore) ClaimTransactionForPayout(id string, callbackTokenHash string, change StatusChange) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET status = $2, settlement_attempts = settlement_attempts + 1, callback_token_hash = $4, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND type = 'offramp' AND status = $3
+	RETURNING ` + transactionColumns
+
+	return pt.transition(StatusConfirmed, StatusSettling, change, query, id, callbackTokenHash)
+}
+
+// ReleaseTransactionPayout returns an off-ramp to confirmed after Daraja
+// rejected the payout request outright.
+func (pt *PostgresTransactionStore) ReleaseTransactionPayout(id string, change StatusChange) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET status = $2, mpesa_conversation_id = NULL, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1 AND type = 'offramp' AND status = $3
+	RETURNING ` + transactionColumns
+
+	return pt.transition(StatusSettling, StatusConfirmed, change, query, id)
+}
+
+func (pt *PostgresTransactionStore) SetTransactionMpesaConversationID(id string, conversationID string) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET mpesa_conversation_id = $2, updated_at = CURRENT_TIMESTAMP
+	WHERE id = $1
+	RETURNING ` + transactionColumns
+
+	return scanTransaction(pt.db.QueryRow(query, id, conversationID))
+}
+
+// UpdateTransactionPayout resolves a settling off-ramp from its B2C result.
+// The off-ramp is found by Daraja's conversation ID or, since a result can
+// arrive before that ID is recorded, by the originator conversation ID, which
+// is the transaction ID. originatorConversationID must be a UUID or "".
+func (pt *PostgresTransactionStore) UpdateTransactionPayout(conversationID string, originatorConversationID string, status TransactionStatus, mpesaReceiptNumber string, change StatusChange) (*Transaction, error) {
+	query := `
+
+	UPDATE transactions
+	SET status = $4, mpesa_receipt_number = NULLIF($3, ''),
+		mpesa_conversation_id = COALESCE(mpesa_conversation_id, NULLIF($1, '')),
+		updated_at = CURRENT_TIMESTAMP
+	WHERE type = 'offramp' AND status = $5
+		AND (mpesa_conversation_id = $1 OR id = NULLIF($2, '')::uuid)
+	RETURNING ` + transactionColumns
+
+	return pt.transition(StatusSettling, status, change, query, conversationID, originatorConversationID, mpesaReceiptNumber)
+}
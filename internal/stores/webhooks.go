@@ -6,15 +6,32 @@ import (
 	"time"
 )
 
+// Webhook event types.
+const (
+	WebhookSTKCallback = "stk_callback"
+	WebhookB2CResult = "b2c_result"
+	WebhookB2CTimeout = "b2c_timeout"
+)
 
 type Webhook struct {
 	ID string `json:"id"`
 	TransactionID string `json:"transaction_id"`
 	Source string `json:"source"`
+	EventType string `json:"event_type"`
+	// EventKey identifies the event across redeliveries, e.g. the
+	// CheckoutRequestID of an STK callback.
+	EventKey string `json:"event_key"`
+	// RawBody is the request body exactly as received. Payload is the same
+	// body as JSON, or nil if it did not parse.
+	RawBody []byte `json:"-"`
 	Payload json.RawMessage `json:"payload"`
 	StatusCode int `json:"status_code"`
 	ReceivedAt time.Time `json:"received_at"`
 	Processed bool `json:"processed"`
+	ProcessedAt *time.Time `json:"processed_at,omitempty"`
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// VerificationError is why the webhook was rejected as not genuine.
+	VerificationError string `json:"verification_error,omitempty"`
 }
 
 type PostgresWebhookStore struct {
@@ -27,20 +44,74 @@ func NewPostgresWebhookStore(db *sql.DB) *PostgresWebhookStore {
 
 type WebhookStore interface {
 	CreateWebhook(webhook Webhook) (*Webhook, error)
+	CompleteWebhook(webhook Webhook) (*Webhook, error)
+	GetProcessedWebhookByEventKey(eventType string, eventKey string) (*Webhook, error)
 }
 
-func (pw *PostgresWebhookStore) CreateWebhook(webhook Webhook) (*Webhook, error) {
-	query := `
-	
-	INSERT INTO webhooks (transaction_id, source, payload, status_code, received_at, processed)
-	VALUES ($1, $2, $3, $4, $5, $6)
-	RETURNING id, transaction_id, source, payload, status_code, received_at, processed
-	`
+const webhookColumns = `id, COALESCE(transaction_id::text, '') as transaction_id, source, event_type,
+	COALESCE(event_key, '') as event_key, raw_body, payload, status_code, received_at,
+	COALESCE(processed, FALSE) as processed, processed_at,
+	COALESCE(duplicate_of::text, '') as duplicate_of,
+	COALESCE(verification_error, '') as verification_error`
 
-	err := pw.db.QueryRow(query, webhook.TransactionID, webhook.Source, webhook.Payload, webhook.StatusCode, webhook.ReceivedAt, webhook.Processed).
-	Scan(&webhook.ID, &webhook.TransactionID, &webhook.Source, &webhook.Payload, &webhook.StatusCode, &webhook.ReceivedAt, &webhook.Processed)
+func scanWebhook(row rowScanner) (*Webhook, error) {
+	webhook := &Webhook{}
+	var payload []byte
+	err := row.Scan(&webhook.ID, &webhook.TransactionID, &webhook.Source, &webhook.EventType, &webhook.EventKey, &webhook.RawBody, &payload, &webhook.StatusCode, &webhook.ReceivedAt, &webhook.Processed, &webhook.ProcessedAt, &webhook.DuplicateOf, &webhook.VerificationError)
 	if err != nil {
 		return nil, err
 	}
-	return &webhook, nil
-}
\ No newline at end of file
+	if payload != nil {
+		webhook.Payload = json.RawMessage(payload)
+	}
+	return webhook, nil
+}
+
+func (pw *PostgresWebhookStore) CreateWebhook(webhook Webhook) (*Webhook, error) {
+	query := `
+
+	INSERT INTO webhooks (transaction_id, source, event_type, event_key, raw_body, payload, status_code, received_at, processed, verification_error)
+	VALUES (NULLIF($1, '')::uuid, $2, $3, NULLIF($4, ''), $5, $6, $7, $8, $9, NULLIF($10, ''))
+	RETURNING ` + webhookColumns
+
+	var payload any
+	if len(webhook.Payload) > 0 {
+		payload = []byte(webhook.Payload)
+	}
+
+	return scanWebhook(pw.db.QueryRow(query, webhook.TransactionID, webhook.Source, webhook.EventType, webhook.EventKey, webhook.RawBody, payload, webhook.StatusCode, webhook.ReceivedAt, webhook.Processed, webhook.VerificationError))
+}
+
+// CompleteWebhook records the outcome of handling a stored webhook: the
+// transaction it belongs to, the status code we answered with, and whether it
+// was processed or recognised as a duplicate.
+func (pw *PostgresWebhookStore) CompleteWebhook(webhook Webhook) (*Webhook, error) {
+	query := `
+
+	UPDATE webhooks
+	SET transaction_id = NULLIF($2, '')::uuid,
+		event_key = NULLIF($3, ''),
+		status_code = $4,
+		processed = $5,
+		processed_at = CASE WHEN $5 THEN CURRENT_TIMESTAMP END,
+		duplicate_of = NULLIF($6, '')::uuid
+	WHERE id = $1
+	RETURNING ` + webhookColumns
+
+	return scanWebhook(pw.db.QueryRow(query, webhook.ID, webhook.TransactionID, webhook.EventKey, webhook.StatusCode, webhook.Processed, webhook.DuplicateOf))
+}
+
+// GetProcessedWebhookByEventKey returns the first delivery of an event that
+// was processed, or sql.ErrNoRows if none has been.
+func (pw *PostgresWebhookStore) GetProcessedWebhookByEventKey(eventType string, eventKey string) (*Webhook, error) {
+	query := `
+
+	SELECT ` + webhookColumns + `
+	FROM webhooks
+	WHERE event_type = $1 AND event_key = $2 AND processed AND duplicate_of IS NULL
+	ORDER BY received_at ASC
+	LIMIT 1
+	`
+
+	return scanWebhook(pw.db.QueryRow(query, eventType, eventKey))
+}
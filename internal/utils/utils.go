@@ -1,20 +1,34 @@
 package utils
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/shopspring/decimal"
-)
-
-const (
-	DefaultExchangeRate = 134.3421
 )
 
 type Envelope map[string]any
 
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func IsUUID(s string) bool {
+	return uuidPattern.MatchString(s)
+}
+
+// HashToken returns the hex SHA-256 of a secret token, which is what gets
+// stored in place of the token itself.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func WriteJSON(w http.ResponseWriter, status int, data Envelope) error {
 	js, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
@@ -39,21 +53,18 @@ func ReadParamID(r *http.Request, key string) (string, error) {
 	return idParam, nil
 }
 
-func GetAssetPrice(asset string) (float64, error) {
-	exchangeRate, _ := GetUSDCKSHExchangeRate()
-	assets := map[string]float64{
-		"USDC": 1.0,
-		"KCB": decimal.NewFromFloat(57.00).Div(decimal.NewFromFloat(exchangeRate)).Round(6).InexactFloat64(),
-		"SCOM": decimal.NewFromFloat(27.95).Div(decimal.NewFromFloat(exchangeRate)).Round(6).InexactFloat64(),
-		"EQTY": decimal.NewFromFloat(59.50).Div(decimal.NewFromFloat(exchangeRate)).Round(6).InexactFloat64(),
-		"HAFR": decimal.NewFromFloat(1.13).Div(decimal.NewFromFloat(exchangeRate)).Round(6).InexactFloat64(),
-		"KEGN": decimal.NewFromFloat(9.12).Div(decimal.NewFromFloat(exchangeRate)).Round(6).InexactFloat64(),
-		"KQ": decimal.NewFromFloat(3.85).Div(decimal.NewFromFloat(exchangeRate)).Round(6).InexactFloat64(),
+func GetEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
 	}
-	return assets[asset], nil
+	return value
 }
 
-func GetUSDCKSHExchangeRate() (float64, error) {
-	// TODO: Implement actual exchange rate fetching
-	return DefaultExchangeRate, nil
+func GetEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
 }
\ No newline at end of file
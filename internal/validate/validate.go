@@ -0,0 +1,134 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/shopspring/decimal"
+)
+
+// Errors maps request fields to what is wrong with them. It is returned to
+// clients as is, so messages should say how to fix the input.
+type Errors map[string]string
+
+// Add records message for field unless the field already has an error.
+func (e Errors) Add(field string, message string) {
+	if _, ok := e[field]; !ok {
+		e[field] = message
+	}
+}
+
+func (e Errors) Empty() bool {
+	return len(e) == 0
+}
+
+var ErrInvalidMSISDN = errors.New("must be a Kenyan mobile number such as 0712345678 or +254712345678")
+
+// MSISDN normalises a Kenyan mobile number, written as 0712345678,
+// 712345678, 254712345678 or +254 712 345 678 (and the same for 01xx
+// numbers), to the 254XXXXXXXXX form Daraja expects.
+func MSISDN(phone string) (string, error) {
+	digits := strings.NewReplacer(" ", "", "-", "", "(", "", ")", "").Replace(strings.TrimSpace(phone))
+	digits = strings.TrimPrefix(digits, "+")
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return "", ErrInvalidMSISDN
+		}
+	}
+
+	var subscriber string
+	switch {
+	case len(digits) == 12 && strings.HasPrefix(digits, "254"):
+		subscriber = digits[3:]
+	case len(digits) == 10 && strings.HasPrefix(digits, "0"):
+		subscriber = digits[1:]
+	case len(digits) == 9:
+		subscriber = digits
+	default:
+		return "", ErrInvalidMSISDN
+	}
+	if subscriber[0] != '7' && subscriber[0] != '1' {
+		return "", ErrInvalidMSISDN
+	}
+	return "254" + subscriber, nil
+}
+
+var ErrInvalidAccountID = errors.New("must be a Hedera account ID such as 0.0.123456, optionally with its checksum")
+
+// AccountID parses a Hedera account ID. A checksum (0.0.123456-vfmkw) is
+// checked against client's network, so that an ID copied from another
+// network is refused. Aliases are refused: funds are only sent to and
+// matched against numbered accounts.
+func AccountID(s string, client *hiero.Client) (hiero.AccountID, error) {
+	id, err := hiero.AccountIDFromString(strings.TrimSpace(s))
+	if err != nil || id.AliasKey != nil || id.AliasEvmAddress != nil || id.Account == 0 {
+		return hiero.AccountID{}, ErrInvalidAccountID
+	}
+	if id.GetChecksum() != nil {
+		err = id.ValidateChecksum(client)
+		if err != nil {
+			return hiero.AccountID{}, errors.New("has a checksum for a different network or a typo")
+		}
+	}
+	return id, nil
+}
+
+// AmountRange is the smallest and largest amount, in whole shillings, that
+// M-Pesa will move in one transaction.
+type AmountRange struct {
+	Min decimal.Decimal
+	Max decimal.Decimal
+}
+
+func NewAmountRange(min int, max int) AmountRange {
+	return AmountRange{Min: decimal.NewFromInt(int64(min)), Max: decimal.NewFromInt(int64(max))}
+}
+
+func (ar AmountRange) Check(amountKSH decimal.Decimal) error {
+	if amountKSH.LessThan(ar.Min) {
+		return fmt.Errorf("must be at least KES %s", ar.Min)
+	}
+	if amountKSH.GreaterThan(ar.Max) {
+		return fmt.Errorf("must be at most KES %s", ar.Max)
+	}
+	return nil
+}
+
+// reservedPrefixes are ranges that are not reachable on the public internet,
+// or that could be mapped onto an internal address, beyond those the
+// netip.Addr predicates cover.
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2002::/16"),
+}
+
+// PublicAddr reports whether addr is a public unicast address, i.e. not
+// loopback, private, link-local (which includes cloud metadata endpoints such
+// as 169.254.169.254), multicast, unspecified or reserved. Servers only send
+// requests to addresses a client chose if they are public.
+func PublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
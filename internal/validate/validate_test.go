@@ -0,0 +1,164 @@
+package validate
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/shopspring/decimal"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"255.255.255.255", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := PublicAddr(netip.MustParseAddr(tt.addr)); got != tt.public {
+				t.Errorf("PublicAddr(%s) = %v, want %v", tt.addr, got, tt.public)
+			}
+		})
+	}
+}
+
+func TestMSISDN(t *testing.T) {
+	tests := []struct {
+		phone string
+		want string
+	}{
+		{"0712345678", "254712345678"},
+		{"0112345678", "254112345678"},
+		{"712345678", "254712345678"},
+		{"112345678", "254112345678"},
+		{"254712345678", "254712345678"},
+		{"254112345678", "254112345678"},
+		{"+254712345678", "254712345678"},
+		{"+254 712 345 678", "254712345678"},
+		{" 0712-345-678 ", "254712345678"},
+		{"(0712) 345678", "254712345678"},
+		{"071234567", ""},
+		{"07123456789", ""},
+		{"25471234567", ""},
+		{"2547123456789", ""},
+		{"+2547123456789", ""},
+		{"", ""},
+		{"0712a45678", ""},
+		{"0712.345.678", ""},
+		{"++254712345678", ""},
+		// landlines and other countries' numbers
+		{"0202345678", ""},
+		{"0812345678", ""},
+		{"255712345678", ""},
+		{"+447712345678", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.phone, func(t *testing.T) {
+			got, err := MSISDN(tt.phone)
+			if tt.want == "" {
+				if !errors.Is(err, ErrInvalidMSISDN) {
+					t.Errorf("MSISDN(%q) = %q, %v, want ErrInvalidMSISDN", tt.phone, got, err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("MSISDN(%q) = %q, %v, want %q", tt.phone, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccountID(t *testing.T) {
+	testnet := hiero.ClientForTestnet()
+	defer testnet.Close()
+	mainnet := hiero.ClientForMainnet()
+	defer mainnet.Close()
+
+	account := hiero.AccountID{Account: 123456}
+	withChecksum, err := account.ToStringWithChecksum(testnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mainnetChecksum, err := account.ToStringWithChecksum(mainnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// change the last letter of the checksum
+	last := withChecksum[len(withChecksum)-1]
+	typo := withChecksum[:len(withChecksum)-1] + string(rune('a'+(last-'a'+1)%26))
+
+	tests := []struct {
+		name string
+		id string
+		want string
+		wantErr bool
+	}{
+		{"without checksum", "0.0.123456", "0.0.123456", false},
+		{"surrounding space", " 0.0.123456 ", "0.0.123456", false},
+		{"non-zero shard and realm", "1.2.3", "1.2.3", false},
+		{"with checksum", withChecksum, "0.0.123456", false},
+		{"bad checksum", typo, "", true},
+		{"other network's checksum", mainnetChecksum, "", true},
+		{"empty", "", "", true},
+		{"account number only", "123456", "", true},
+		{"account zero", "0.0.0", "", true},
+		{"not a number", "0.0.abc", "", true},
+		{"negative", "0.0.-5", "", true},
+		{"EVM address alias", "0.0.b794f5ea0ba39494ce839613fffba74279579268", "", true},
+		{"public key alias", "0.0.302d300706052b8104000a032200036aa3e9eb5f05bc4bb8e42b4f8c8ed02b8c7e4b5a89b3bb0a2f8fc06ee3a5ab0c26", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AccountID(tt.id, testnet)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AccountID(%q) error = %v, want error %t", tt.id, err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("AccountID(%q) = %s, want %s", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmountRange(t *testing.T) {
+	stk := NewAmountRange(1, 250000)
+	tests := []struct {
+		amount string
+		ok bool
+	}{
+		{"1", true},
+		{"250000", true},
+		{"1000", true},
+		{"0", false},
+		{"0.5", false},
+		{"250001", false},
+		{"-10", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.amount, func(t *testing.T) {
+			err := stk.Check(decimal.RequireFromString(tt.amount))
+			if (err == nil) != tt.ok {
+				t.Errorf("Check(%s) = %v, want ok %t", tt.amount, err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,312 @@
+package workers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/money"
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/utils"
+)
+
+const (
+	depositCursorName = "offramp_deposits"
+	maxDepositPages = 10
+)
+
+// OffRampWorker watches the treasury account for USDC deposits that match a
+// pending off-ramp's memo and pays the user out over M-Pesa B2C once the
+// deposit is seen.
+type OffRampWorker struct {
+	TransactionStore stores.TransactionStore
+	// CursorStore keeps how far the treasury's transfers have been checked.
+	CursorStore stores.CursorStore
+	Daraja *payments.DarajaClient
+	Mirror *mirror.Client
+	// Refunder records deposits that cannot be paid out.
+	Refunder *Refunder
+	TreasuryAccountID hiero.AccountID
+	TokenID hiero.TokenID
+	TokenDecimals uint32
+	Interval time.Duration
+	// DepositWindow is how long a pending off-ramp waits for its deposit
+	// before it expires.
+	DepositWindow time.Duration
+	// MirrorLag is how far behind consensus the mirror node may be. Once a
+	// scan has read every listed transfer, the treasury is known to have had
+	// no others until this long ago.
+	MirrorLag time.Duration
+	BatchSize int
+	MaxAttempts int
+	Logger *log.Logger
+}
+
+func NewOffRampWorker(transactionStore stores.TransactionStore, cursorStore stores.CursorStore, daraja *payments.DarajaClient, mirrorClient *mirror.Client, refunder *Refunder, treasuryAccountID hiero.AccountID, tokenID hiero.TokenID, tokenDecimals uint32, logger *log.Logger) *OffRampWorker {
+	return &OffRampWorker{
+		TransactionStore: transactionStore,
+		CursorStore: cursorStore,
+		Daraja: daraja,
+		Mirror: mirrorClient,
+		Refunder: refunder,
+		TreasuryAccountID: treasuryAccountID,
+		TokenID: tokenID,
+		TokenDecimals: tokenDecimals,
+		Interval: 10 * time.Second,
+		DepositWindow: 30 * time.Minute,
+		MirrorLag: time.Minute,
+		BatchSize: 100,
+		MaxAttempts: 3,
+		Logger: logger,
+	}
+}
+
+func (o *OffRampWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+
+	for {
+		o.detectDeposits(ctx)
+		o.payoutConfirmed(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *OffRampWorker) detectDeposits(ctx context.Context) {
+	after, err := o.depositHighWater()
+	if err != nil {
+		o.Logger.Printf("failed to load deposit scan position: %v", err)
+		return
+	}
+
+	filter := mirror.TransferFilter{
+		AccountID: o.TreasuryAccountID.String(),
+		TokenID: o.TokenID.String(),
+		Type: mirror.TypeCryptoTransfer,
+		SuccessfulOnly: true,
+		After: after,
+	}
+
+	// A pass reads at most maxDepositPages; the high-water mark is saved
+	// after every page, so a backlog is worked off over several passes.
+	var cursor string
+	for page := 0; page < maxDepositPages; page++ {
+		deposits, next, err := o.Mirror.ListTransfers(ctx, filter, cursor)
+		if err != nil {
+			o.Logger.Printf("failed to query mirror node for deposits: %v", err)
+			return
+		}
+
+		for _, deposit := range deposits {
+			if !o.applyDeposit(ctx, deposit) {
+				// retried from here on the next pass
+				o.saveDepositHighWater(after)
+				return
+			}
+			after = deposit.ConsensusTime()
+		}
+		if skipped := mirror.CursorTime(next); skipped.After(after) {
+			after = skipped
+		}
+		// Nothing newer is listed, so the treasury had no other transfers up
+		// to what the mirror node must have by now. Without this a quiet
+		// treasury would never move the mark and no off-ramp would expire.
+		if settled := time.Now().Add(-o.MirrorLag); next == "" && settled.After(after) {
+			after = settled
+		}
+		o.saveDepositHighWater(after)
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	o.expireAbandoned(after)
+}
+
+// depositHighWater is the consensus time up to which the treasury's transfers
+// have been checked. The first scan starts just before the oldest pending
+// off-ramp, or now if there is none.
+func (o *OffRampWorker) depositHighWater() (time.Time, error) {
+	saved, err := o.CursorStore.GetCursor(depositCursorName)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if saved != "" {
+		return mirror.ParseTimestamp(saved)
+	}
+
+	oldest, err := o.TransactionStore.GetTransactionsByTypeAndStatus("offramp", stores.StatusPending, 1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(oldest) == 0 {
+		return time.Now().Add(-time.Minute), nil
+	}
+	return oldest[0].CreatedAt.Add(-time.Minute), nil
+}
+
+func (o *OffRampWorker) saveDepositHighWater(after time.Time) {
+	err := o.CursorStore.SetCursor(depositCursorName, mirror.FormatTimestamp(after))
+	if err != nil {
+		o.Logger.Printf("failed to save deposit scan position: %v", err)
+	}
+}
+
+// applyDeposit confirms the off-ramp a treasury transfer's memo names, if any,
+// or records a refund if the transfer cannot fund it. It returns false if the
+// transfer could not be checked and must be seen again.
+func (o *OffRampWorker) applyDeposit(ctx context.Context, deposit mirror.Transaction) bool {
+	memo := deposit.Memo()
+	if memo == "" {
+		return true
+	}
+	txn, err := o.TransactionStore.GetTransactionByDepositMemo(memo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		o.Logger.Printf("failed to look up off-ramp for deposit %s: %v", deposit.TransactionID, err)
+		return false
+	}
+
+	received := deposit.TokenAmount(o.TokenID.String(), o.TreasuryAccountID.String())
+	depositTxID := mirror.TransactionIDFromMirror(deposit.TransactionID)
+	if txn.Status != stores.StatusPending {
+		if txn.HederaTxID == depositTxID {
+			return true
+		}
+		return o.refundDeposit(ctx, txn, depositTxID, received, stores.RefundUnexpectedDeposit)
+	}
+
+	expected, err := money.ToUnits(txn.AmountUSDC, o.TokenDecimals)
+	if err != nil {
+		o.Logger.Printf("off-ramp %s has an amount the token cannot represent: %v", txn.ID, err)
+		return true
+	}
+	if received < expected {
+		o.Logger.Printf("deposit %s for off-ramp %s is short: got %d, expected %d units", deposit.TransactionID, txn.ID, received, expected)
+		return o.refundDeposit(ctx, txn, depositTxID, received, stores.RefundShortDeposit)
+	}
+
+	_, err = o.TransactionStore.ConfirmOffRampDeposit(txn.ID, depositTxID, stores.StatusChange{Actor: stores.ActorOffRampWorker, Reason: "deposit " + deposit.TransactionID + " received"})
+	if errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		o.Logger.Printf("failed to confirm deposit for off-ramp %s: %v", txn.ID, err)
+		return false
+	}
+	o.Logger.Printf("off-ramp %s funded by %s", txn.ID, deposit.TransactionID)
+	return true
+}
+
+// refundDeposit records a deposit of units that cannot fund txn. It returns
+// false if the refund could not be recorded, so the deposit is seen again.
+func (o *OffRampWorker) refundDeposit(ctx context.Context, txn *stores.Transaction, depositTxID string, units int64, reason stores.RefundReason) bool {
+	err := o.Refunder.Refund(ctx, stores.Refund{TransactionID: txn.ID, DepositTxID: depositTxID, AmountUSDC: money.FromUnits(units, o.TokenDecimals), Reason: reason})
+	if err != nil {
+		o.Logger.Printf("%v", err)
+		return false
+	}
+	return true
+}
+
+// expireAbandoned expires pending off-ramps whose deposit window closed before
+// scannedTo, the consensus time every treasury transfer has been checked up
+// to, so none of them can have an unseen deposit made in time.
+func (o *OffRampWorker) expireAbandoned(scannedTo time.Time) {
+	abandoned, err := o.TransactionStore.GetTransactionsByStatusUpdatedBefore("offramp", stores.StatusPending, scannedTo.Add(-o.DepositWindow), o.BatchSize)
+	if err != nil {
+		o.Logger.Printf("failed to load abandoned off-ramps: %v", err)
+		return
+	}
+
+	for _, txn := range abandoned {
+		_, err := o.TransactionStore.TransitionTransaction(txn.ID, stores.StatusPending, stores.StatusExpired, stores.StatusChange{Actor: stores.ActorOffRampWorker, Reason: "no deposit within " + o.DepositWindow.String()})
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			o.Logger.Printf("failed to expire off-ramp %s: %v", txn.ID, err)
+			continue
+		}
+		o.Logger.Printf("off-ramp %s expired without a deposit", txn.ID)
+	}
+}
+
+func (o *OffRampWorker) payoutConfirmed(ctx context.Context) {
+	txns, err := o.TransactionStore.GetTransactionsByTypeAndStatus("offramp", stores.StatusConfirmed, o.BatchSize)
+	if err != nil {
+		o.Logger.Printf("failed to load confirmed off-ramps: %v", err)
+		return
+	}
+
+	for _, txn := range txns {
+		callbackToken, err := payments.NewCallbackToken()
+		if err != nil {
+			o.Logger.Printf("failed to create callback token for off-ramp %s: %v", txn.ID, err)
+			continue
+		}
+		claimed, err := o.TransactionStore.ClaimTransactionForPayout(txn.ID, utils.HashToken(callbackToken), stores.StatusChange{Actor: stores.ActorOffRampWorker, Reason: "requesting B2C payout"})
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			o.Logger.Printf("failed to claim off-ramp %s for payout: %v", txn.ID, err)
+			continue
+		}
+
+		b2cResp, err := o.Daraja.InitiateB2CPayment(ctx, claimed.Phone, claimed.AmountKSH, claimed.ID, callbackToken)
+		if err != nil {
+			// We cannot tell whether Daraja accepted the request, so the
+			// row stays in settling until someone reconciles it.
+			o.Logger.Printf("failed to request payout for off-ramp %s, needs manual reconciliation: %v", claimed.ID, err)
+			continue
+		}
+
+		if b2cResp.ResponseCode != "0" {
+			o.Logger.Printf("payout for off-ramp %s rejected: %s", claimed.ID, b2cResp.ResponseDescription)
+			o.releasePayout(ctx, claimed, b2cResp.ResponseDescription)
+			continue
+		}
+
+		_, err = o.TransactionStore.SetTransactionMpesaConversationID(claimed.ID, b2cResp.ConversationID)
+		if err != nil {
+			o.Logger.Printf("failed to record conversation %s for off-ramp %s: %v", b2cResp.ConversationID, claimed.ID, err)
+		}
+	}
+}
+
+func (o *OffRampWorker) releasePayout(ctx context.Context, txn *stores.Transaction, reason string) {
+	change := stores.StatusChange{Actor: stores.ActorOffRampWorker, Reason: reason}
+	if txn.SettlementAttempts >= o.MaxAttempts {
+		_, err := o.TransactionStore.FailTransactionSettlement(txn.ID, change)
+		if err != nil {
+			o.Logger.Printf("failed to mark off-ramp %s failed: %v", txn.ID, err)
+			return
+		}
+		o.Logger.Printf("off-ramp %s failed after %d payout attempts", txn.ID, txn.SettlementAttempts)
+		err = o.Refunder.Refund(ctx, stores.Refund{TransactionID: txn.ID, DepositTxID: txn.HederaTxID, AmountUSDC: txn.AmountUSDC, Reason: stores.RefundPayoutFailed})
+		if err != nil {
+			o.Logger.Printf("%v", err)
+		}
+		return
+	}
+
+	_, err := o.TransactionStore.ReleaseTransactionPayout(txn.ID, change)
+	if err != nil {
+		o.Logger.Printf("failed to release off-ramp %s: %v", txn.ID, err)
+	}
+}
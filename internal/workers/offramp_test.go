@@ -0,0 +1,241 @@
+package workers
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"io"
+	"log"
+	"strconv"
+	"testing"
+	"time"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/mirror/mirrortest"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/shopspring/decimal"
+)
+
+// offRampStore keeps off-ramps in memory. Any method the deposit scan does
+// not use panics.
+type offRampStore struct {
+	stores.TransactionStore
+	txns []*stores.Transaction
+}
+
+func (m *offRampStore) GetTransactionByDepositMemo(depositMemo string) (*stores.Transaction, error) {
+	for _, txn := range m.txns {
+		if txn.DepositMemo == depositMemo {
+			found := *txn
+			return &found, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *offRampStore) GetTransactionsByTypeAndStatus(txType string, status stores.TransactionStatus, limit int) ([]stores.Transaction, error) {
+	return m.GetTransactionsByStatusUpdatedBefore(txType, status, time.Now().Add(time.Hour), limit)
+}
+
+func (m *offRampStore) GetTransactionsByStatusUpdatedBefore(txType string, status stores.TransactionStatus, before time.Time, limit int) ([]stores.Transaction, error) {
+	var found []stores.Transaction
+	for _, txn := range m.txns {
+		if txn.Type == txType && txn.Status == status && txn.UpdatedAt.Before(before) && len(found) < limit {
+			found = append(found, *txn)
+		}
+	}
+	return found, nil
+}
+
+func (m *offRampStore) transition(id string, from stores.TransactionStatus, to stores.TransactionStatus, update func(*stores.Transaction)) (*stores.Transaction, error) {
+	for _, txn := range m.txns {
+		if txn.ID == id && txn.Status == from {
+			txn.Status = to
+			update(txn)
+			updated := *txn
+			return &updated, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (m *offRampStore) TransitionTransaction(id string, from stores.TransactionStatus, to stores.TransactionStatus, change stores.StatusChange) (*stores.Transaction, error) {
+	return m.transition(id, from, to, func(*stores.Transaction) {})
+}
+
+func (m *offRampStore) ConfirmOffRampDeposit(id string, hederaTxID string, change stores.StatusChange) (*stores.Transaction, error) {
+	return m.transition(id, stores.StatusPending, stores.StatusConfirmed, func(txn *stores.Transaction) {
+		txn.HederaTxID = hederaTxID
+	})
+}
+
+type memCursorStore map[string]string
+
+func (m memCursorStore) GetCursor(name string) (string, error) {
+	return m[name], nil
+}
+
+func (m memCursorStore) SetCursor(name string, value string) error {
+	m[name] = value
+	return nil
+}
+
+// memRefundStore keeps one refund per deposit, like the Postgres store.
+type memRefundStore struct {
+	refunds []stores.Refund
+}
+
+func (m *memRefundStore) CreateRefund(refund stores.Refund) (*stores.Refund, bool, error) {
+	for _, existing := range m.refunds {
+		if existing.DepositTxID == refund.DepositTxID {
+			return &existing, false, nil
+		}
+	}
+	refund.ID = "refund-" + strconv.Itoa(len(m.refunds)+1)
+	refund.Status = "pending"
+	m.refunds = append(m.refunds, refund)
+	return &refund, true, nil
+}
+
+type alertRecorder struct {
+	alerts []string
+}
+
+func (ar *alertRecorder) Alert(ctx context.Context, message string) {
+	ar.alerts = append(ar.alerts, message)
+}
+
+func TestDetectDepositsPastAbandonedOffRamp(t *testing.T) {
+	treasury := hiero.AccountID{Account: 1000}
+	token := hiero.TokenID{Token: 2000}
+	now := time.Now()
+
+	store := &offRampStore{txns: []*stores.Transaction{
+		{ID: "abandoned", Type: "offramp", Status: stores.StatusPending, DepositMemo: "NHX-ABANDONED", AmountUSDC: decimal.NewFromInt(5), CreatedAt: now.Add(-2 * time.Hour), UpdatedAt: now.Add(-2 * time.Hour)},
+		{ID: "funded", Type: "offramp", Status: stores.StatusPending, DepositMemo: "NHX-FUNDED", AmountUSDC: decimal.NewFromInt(10), CreatedAt: now.Add(-time.Minute), UpdatedAt: now.Add(-time.Minute)},
+	}}
+
+	server := mirrortest.NewServer()
+	defer server.Close()
+	// more unrelated treasury transfers than one pass reads
+	for i := range 1100 {
+		server.AddTransaction(mirror.Transaction{
+			TransactionID: "0.0.5-" + strconv.Itoa(i) + "-0",
+			ConsensusTimestamp: mirror.FormatTimestamp(now.Add(-90 * time.Minute).Add(time.Duration(i) * time.Second)),
+			TokenTransfers: []mirror.TokenTransfer{{TokenID: token.String(), Account: treasury.String(), Amount: 1}},
+		})
+	}
+	server.AddTransaction(mirror.Transaction{
+		TransactionID: "0.0.7-1700000000-000000001",
+		ConsensusTimestamp: mirror.FormatTimestamp(now.Add(-30 * time.Second)),
+		MemoBase64: base64.StdEncoding.EncodeToString([]byte("NHX-FUNDED")),
+		TokenTransfers: []mirror.TokenTransfer{{TokenID: token.String(), Account: treasury.String(), Amount: 10_000_000}},
+	})
+
+	worker := NewOffRampWorker(store, memCursorStore{}, nil, server.Client(), nil, treasury, token, 6, log.New(io.Discard, "", 0))
+	for pass := 0; pass < 3; pass++ {
+		worker.detectDeposits(t.Context())
+	}
+
+	if got := store.txns[1]; got.Status != stores.StatusConfirmed || got.HederaTxID != "0.0.7@1700000000.000000001" {
+		t.Errorf("funded off-ramp is %s with deposit %q, want confirmed by 0.0.7@1700000000.000000001", got.Status, got.HederaTxID)
+	}
+	if got := store.txns[0].Status; got != stores.StatusExpired {
+		t.Errorf("abandoned off-ramp is %s, want expired", got)
+	}
+}
+
+func TestDetectDepositsExpiresOffRampsOnQuietTreasury(t *testing.T) {
+	treasury := hiero.AccountID{Account: 1000}
+	token := hiero.TokenID{Token: 2000}
+	now := time.Now()
+
+	store := &offRampStore{txns: []*stores.Transaction{
+		{ID: "abandoned", Type: "offramp", Status: stores.StatusPending, DepositMemo: "NHX-ABANDONED", AmountUSDC: decimal.NewFromInt(5), CreatedAt: now.Add(-2 * time.Hour), UpdatedAt: now.Add(-2 * time.Hour)},
+		{ID: "waiting", Type: "offramp", Status: stores.StatusPending, DepositMemo: "NHX-WAITING", AmountUSDC: decimal.NewFromInt(10), CreatedAt: now.Add(-5 * time.Minute), UpdatedAt: now.Add(-5 * time.Minute)},
+	}}
+	cursors := memCursorStore{}
+
+	// the treasury has no transfers at all
+	server := mirrortest.NewServer()
+	defer server.Close()
+
+	worker := NewOffRampWorker(store, cursors, nil, server.Client(), nil, treasury, token, 6, log.New(io.Discard, "", 0))
+	worker.detectDeposits(t.Context())
+
+	scannedTo, err := mirror.ParseTimestamp(cursors[depositCursorName])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scannedTo.Before(now.Add(-worker.MirrorLag)) {
+		t.Errorf("scan position %s did not move up to the mirror lag", scannedTo)
+	}
+	if got := store.txns[0].Status; got != stores.StatusExpired {
+		t.Errorf("abandoned off-ramp is %s, want expired", got)
+	}
+	if got := store.txns[1].Status; got != stores.StatusPending {
+		t.Errorf("off-ramp inside its window is %s, want pending", got)
+	}
+}
+
+func TestDetectDepositsRecordsRefunds(t *testing.T) {
+	treasury := hiero.AccountID{Account: 1000}
+	token := hiero.TokenID{Token: 2000}
+	now := time.Now()
+
+	store := &offRampStore{txns: []*stores.Transaction{
+		{ID: "short", Type: "offramp", Status: stores.StatusPending, DepositMemo: "NHX-SHORT", AmountUSDC: decimal.NewFromInt(10), CreatedAt: now.Add(-10 * time.Minute), UpdatedAt: now.Add(-10 * time.Minute)},
+		{ID: "expired", Type: "offramp", Status: stores.StatusExpired, DepositMemo: "NHX-EXPIRED", AmountUSDC: decimal.NewFromInt(5), CreatedAt: now.Add(-2 * time.Hour), UpdatedAt: now.Add(-time.Hour)},
+		{ID: "funded", Type: "offramp", Status: stores.StatusSettled, DepositMemo: "NHX-FUNDED", HederaTxID: "0.0.7@1700000000.000000003", AmountUSDC: decimal.NewFromInt(2), CreatedAt: now.Add(-time.Hour), UpdatedAt: now.Add(-time.Hour)},
+	}}
+	deposits := []struct {
+		id string
+		memo string
+		units int64
+	}{
+		{"0.0.7-1700000000-000000001", "NHX-SHORT", 9_500_000},
+		{"0.0.7-1700000000-000000002", "NHX-EXPIRED", 5_000_000},
+		// the deposit that funded the off-ramp needs no refund
+		{"0.0.7-1700000000-000000003", "NHX-FUNDED", 2_000_000},
+	}
+	server := mirrortest.NewServer()
+	defer server.Close()
+	for i, deposit := range deposits {
+		server.AddTransaction(mirror.Transaction{
+			TransactionID: deposit.id,
+			ConsensusTimestamp: mirror.FormatTimestamp(now.Add(-5 * time.Minute).Add(time.Duration(i) * time.Second)),
+			MemoBase64: base64.StdEncoding.EncodeToString([]byte(deposit.memo)),
+			TokenTransfers: []mirror.TokenTransfer{{TokenID: token.String(), Account: treasury.String(), Amount: deposit.units}},
+		})
+	}
+
+	refunds := &memRefundStore{}
+	alerter := &alertRecorder{}
+	logger := log.New(io.Discard, "", 0)
+	cursors := memCursorStore{}
+	worker := NewOffRampWorker(store, cursors, nil, server.Client(), NewRefunder(refunds, alerter, logger), treasury, token, 6, logger)
+	worker.detectDeposits(t.Context())
+	// the deposits are seen again, e.g. after the scan position was lost
+	delete(cursors, depositCursorName)
+	worker.detectDeposits(t.Context())
+
+	want := []stores.Refund{
+		{TransactionID: "short", DepositTxID: "0.0.7@1700000000.000000001", AmountUSDC: decimal.RequireFromString("9.5"), Reason: stores.RefundShortDeposit},
+		{TransactionID: "expired", DepositTxID: "0.0.7@1700000000.000000002", AmountUSDC: decimal.NewFromInt(5), Reason: stores.RefundUnexpectedDeposit},
+	}
+	if len(refunds.refunds) != len(want) {
+		t.Fatalf("recorded %d refunds, want %d: %+v", len(refunds.refunds), len(want), refunds.refunds)
+	}
+	for i, got := range refunds.refunds {
+		if got.TransactionID != want[i].TransactionID || got.DepositTxID != want[i].DepositTxID || !got.AmountUSDC.Equal(want[i].AmountUSDC) || got.Reason != want[i].Reason {
+			t.Errorf("refund %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if len(alerter.alerts) != len(want) {
+		t.Errorf("sent %d alerts, want one per refund: %q", len(alerter.alerts), alerter.alerts)
+	}
+	if got := store.txns[0].Status; got != stores.StatusPending {
+		t.Errorf("short off-ramp is %s, want pending", got)
+	}
+}
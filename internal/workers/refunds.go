@@ -0,0 +1,42 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/nhx-finance/wallet/internal/alerts"
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+// Refunder records deposits the treasury has to send back and tells an
+// operator about each one, since returning the USDC is done by hand.
+type Refunder struct {
+	RefundStore stores.RefundStore
+	Alerter alerts.Alerter
+	Logger *log.Logger
+}
+
+func NewRefunder(refundStore stores.RefundStore, alerter alerts.Alerter, logger *log.Logger) *Refunder {
+	return &Refunder{
+		RefundStore: refundStore,
+		Alerter: alerter,
+		Logger: logger,
+	}
+}
+
+// Refund records refund unless its deposit already has one, alerting only
+// the first time so that a deposit seen again is not reported twice.
+func (rf *Refunder) Refund(ctx context.Context, refund stores.Refund) error {
+	recorded, created, err := rf.RefundStore.CreateRefund(refund)
+	if err != nil {
+		return fmt.Errorf("failed to record refund of deposit %s for off-ramp %s: %w", refund.DepositTxID, refund.TransactionID, err)
+	}
+	if !created {
+		return nil
+	}
+
+	rf.Logger.Printf("deposit %s of %s USDC for off-ramp %s needs a refund: %s", recorded.DepositTxID, recorded.AmountUSDC, recorded.TransactionID, recorded.Reason)
+	rf.Alerter.Alert(ctx, fmt.Sprintf("Deposit %s of %s USDC for off-ramp %s needs a refund (%s), refund %s", recorded.DepositTxID, recorded.AmountUSDC, recorded.TransactionID, recorded.Reason, recorded.ID))
+	return nil
+}
@@ -0,0 +1,387 @@
+package workers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/mirror"
+	"github.com/nhx-finance/wallet/internal/money"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/shopspring/decimal"
+)
+
+// expiredTransferGrace is how long after its valid start an expired transfer
+// is given to show up on the mirror node before it is taken to have never
+// reached consensus. It covers the longest transaction valid duration (3m)
+// plus the mirror node's lag.
+const expiredTransferGrace = 5 * time.Minute
+
+// definitiveRejections are the precheck statuses that mean no submission of a
+// transfer can reach consensus, so it is safe to retry under a new transaction
+// ID. The SDK resubmits the same ID to other nodes when a node fails, so any
+// other status, DUPLICATE_TRANSACTION above all, may follow a submission that
+// went through.
+var definitiveRejections = map[hiero.Status]bool{
+	hiero.StatusInsufficientPayerBalance: true,
+	hiero.StatusInsufficientAccountBalance: true,
+	hiero.StatusInsufficientTokenBalance: true,
+	hiero.StatusInsufficientTxFee: true,
+	hiero.StatusPayerAccountNotFound: true,
+	hiero.StatusInvalidPayerAccountID: true,
+	hiero.StatusInvalidAccountID: true,
+	hiero.StatusAccountDeleted: true,
+	hiero.StatusAccountExpiredAndPendingRemoval: true,
+	hiero.StatusInvalidSignature: true,
+	hiero.StatusInvalidTokenID: true,
+	hiero.StatusInvalidTokenDecimals: true,
+	hiero.StatusUnexpectedTokenDecimals: true,
+	hiero.StatusTokenWasDeleted: true,
+	hiero.StatusTokenIsPaused: true,
+	hiero.StatusTokenNotAssociatedToAccount: true,
+	hiero.StatusAccountFrozenForToken: true,
+	hiero.StatusAccountKycNotGrantedForToken: true,
+	hiero.StatusMemoTooLong: true,
+}
+
+// settlementTypes are the transaction types whose asset the settler delivers
+// once payment is confirmed.
+var settlementTypes = []string{"onramp", "card"}
+
+// Settler delivers the purchased asset for confirmed on-ramp and card
+// transactions. All of its state lives in the transactions table so a
+// restarted process picks up exactly where the previous one stopped.
+type Settler struct {
+	TransactionStore stores.TransactionStore
+	HieroClient *hiero.Client
+	// Mirror settles transfers whose receipts the network no longer holds.
+	Mirror *mirror.Client
+	Assets *assets.Registry
+	Interval time.Duration
+	BatchSize int
+	MaxAttempts int
+	// MintBatch is how many whole tokens of a mintable asset are minted at
+	// a time when the operator runs out.
+	MintBatch int
+	Logger *log.Logger
+	wake chan struct{}
+}
+
+func NewSettler(transactionStore stores.TransactionStore, hieroClient *hiero.Client, mirrorClient *mirror.Client, assetRegistry *assets.Registry, logger *log.Logger) *Settler {
+	return &Settler{
+		TransactionStore: transactionStore,
+		HieroClient: hieroClient,
+		Mirror: mirrorClient,
+		Assets: assetRegistry,
+		Interval: 15 * time.Second,
+		BatchSize: 20,
+		MaxAttempts: 5,
+		MintBatch: 1000,
+		Logger: logger,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// Trigger asks the settler to run a pass now instead of waiting for the next
+// tick. It never blocks.
+func (s *Settler) Trigger() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Settler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.resumeInFlight(ctx)
+		s.settleConfirmed()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *Settler) settleConfirmed() {
+	for _, txType := range settlementTypes {
+		txns, err := s.TransactionStore.GetTransactionsByTypeAndStatus(txType, stores.StatusConfirmed, s.BatchSize)
+		if err != nil {
+			s.Logger.Printf("failed to load confirmed %s transactions: %v", txType, err)
+			continue
+		}
+
+		for _, txn := range txns {
+			s.settle(txn)
+		}
+	}
+}
+
+func (s *Settler) settle(txn stores.Transaction) {
+	recipient, err := hiero.AccountIDFromString(txn.HederaAccountID)
+	if err != nil {
+		s.Logger.Printf("transaction %s has invalid hedera account %q: %v", txn.ID, txn.HederaAccountID, err)
+		return
+	}
+	asset, err := s.Assets.Get(txn.Asset)
+	if err != nil {
+		s.Logger.Printf("cannot settle transaction %s: %v", txn.ID, err)
+		return
+	}
+
+	hederaTxID := hiero.TransactionIDGenerate(s.HieroClient.GetOperatorAccountID())
+	claimed, err := s.TransactionStore.ClaimTransactionForSettlement(txn.ID, hederaTxID.String(), stores.StatusChange{Actor: stores.ActorSettler, Reason: "submitting transfer " + hederaTxID.String()})
+	if errors.Is(err, sql.ErrNoRows) {
+		// another worker got there first
+		return
+	}
+	if err != nil {
+		s.Logger.Printf("failed to claim transaction %s: %v", txn.ID, err)
+		return
+	}
+
+	transfer, err := s.buildTransfer(hederaTxID, recipient, asset, claimed.AssetQuantity)
+	if err != nil {
+		s.Logger.Printf("failed to build transfer for transaction %s: %v", txn.ID, err)
+		s.release(claimed, err.Error())
+		return
+	}
+
+	resp, err := transfer.Execute(s.HieroClient)
+	if err != nil {
+		s.Logger.Printf("failed to submit transfer %s for transaction %s: %v", hederaTxID, txn.ID, err)
+		// Only a definitive rejection is released here. Anything else is
+		// ambiguous and is left for resumeInFlight.
+		var precheck hiero.ErrHederaPreCheckStatus
+		if errors.As(err, &precheck) {
+			s.handleRejection(claimed, asset, precheck.Status)
+		}
+		return
+	}
+
+	receipt, err := resp.GetReceipt(s.HieroClient)
+	s.applyReceipt(claimed, receipt, err)
+}
+
+// resumeInFlight finishes transactions that were claimed but never marked
+// settled, e.g. because the process died mid-transfer. It resubmits the exact
+// same Hedera transaction ID, which the network deduplicates, so a transfer
+// that already went through is never sent twice.
+func (s *Settler) resumeInFlight(ctx context.Context) {
+	var txns []stores.Transaction
+	for _, txType := range settlementTypes {
+		settling, err := s.TransactionStore.GetTransactionsByTypeAndStatus(txType, stores.StatusSettling, s.BatchSize)
+		if err != nil {
+			s.Logger.Printf("failed to load settling %s transactions: %v", txType, err)
+			continue
+		}
+		txns = append(txns, settling...)
+	}
+
+	for _, txn := range txns {
+		hederaTxID, err := hiero.TransactionIdFromString(txn.HederaTxID)
+		if err != nil {
+			s.Logger.Printf("transaction %s has invalid hedera tx id %q: %v", txn.ID, txn.HederaTxID, err)
+			continue
+		}
+		recipient, err := hiero.AccountIDFromString(txn.HederaAccountID)
+		if err != nil {
+			s.Logger.Printf("transaction %s has invalid hedera account %q: %v", txn.ID, txn.HederaAccountID, err)
+			continue
+		}
+		asset, err := s.Assets.Get(txn.Asset)
+		if err != nil {
+			s.Logger.Printf("cannot resume transaction %s: %v", txn.ID, err)
+			continue
+		}
+
+		transfer, err := s.buildTransfer(hederaTxID, recipient, asset, txn.AssetQuantity)
+		if err != nil {
+			s.Logger.Printf("failed to rebuild transfer for transaction %s: %v", txn.ID, err)
+			continue
+		}
+
+		resp, err := transfer.Execute(s.HieroClient)
+		if err == nil {
+			receipt, err := resp.GetReceipt(s.HieroClient)
+			s.applyReceipt(&txn, receipt, err)
+			continue
+		}
+
+		var precheck hiero.ErrHederaPreCheckStatus
+		if !errors.As(err, &precheck) {
+			s.Logger.Printf("failed to resubmit transfer %s for transaction %s: %v", hederaTxID, txn.ID, err)
+			continue
+		}
+
+		switch precheck.Status {
+		case hiero.StatusDuplicateTransaction, hiero.StatusTransactionExpired:
+			// The original may or may not have reached consensus; only its
+			// receipt can tell us.
+			receipt, err := hiero.NewTransactionReceiptQuery().
+				SetTransactionID(hederaTxID).
+				Execute(s.HieroClient)
+			if err != nil && receipt.Status == hiero.StatusReceiptNotFound && precheck.Status == hiero.StatusTransactionExpired {
+				s.confirmFromMirror(ctx, &txn, hederaTxID)
+				continue
+			}
+			s.applyReceipt(&txn, receipt, err)
+		default:
+			s.handleRejection(&txn, asset, precheck.Status)
+		}
+	}
+}
+
+// handleRejection releases a transaction whose transfer failed precheck with
+// status, if that status is a definitive rejection. Any other status, e.g.
+// BUSY after the SDK ran out of retries, leaves the transaction settling so
+// resumeInFlight can find out what happened to its transaction ID.
+func (s *Settler) handleRejection(txn *stores.Transaction, asset assets.Asset, status hiero.Status) {
+	if !definitiveRejections[status] {
+		s.Logger.Printf("transfer %s for transaction %s got %s, leaving it settling until its outcome is known", txn.HederaTxID, txn.ID, status)
+		return
+	}
+	s.Logger.Printf("transfer %s for transaction %s rejected with %s", txn.HederaTxID, txn.ID, status)
+	s.replenish(asset, txn.AssetQuantity, status)
+	s.release(txn, "transfer rejected with "+status.String())
+}
+
+// confirmFromMirror settles or releases a transaction whose transfer expired
+// and whose receipt is gone, going by the mirror node's record of the
+// transfer. An expired transfer the mirror node has never seen did not reach
+// consensus and never will, so the transaction can be retried with a new ID.
+func (s *Settler) confirmFromMirror(ctx context.Context, txn *stores.Transaction, hederaTxID hiero.TransactionID) {
+	record, err := s.Mirror.GetTransaction(ctx, hederaTxID.String())
+	if errors.Is(err, mirror.ErrNotFound) {
+		if hederaTxID.ValidStart != nil && time.Since(*hederaTxID.ValidStart) < expiredTransferGrace {
+			return
+		}
+		s.Logger.Printf("transfer %s for transaction %s expired without reaching consensus", hederaTxID, txn.ID)
+		s.release(txn, "transfer "+hederaTxID.String()+" expired without reaching consensus")
+		return
+	}
+	if err != nil {
+		s.Logger.Printf("failed to look up expired transfer %s for transaction %s on the mirror node: %v", hederaTxID, txn.ID, err)
+		return
+	}
+
+	if !record.Succeeded() {
+		s.Logger.Printf("transfer %s for transaction %s failed with %s", hederaTxID, txn.ID, record.Result)
+		s.release(txn, "transfer failed with "+record.Result)
+		return
+	}
+
+	_, err = s.TransactionStore.MarkTransactionSettled(txn.ID, stores.StatusChange{Actor: stores.ActorSettler, Reason: "transfer " + txn.HederaTxID + " confirmed by mirror node"})
+	if err != nil {
+		s.Logger.Printf("failed to mark transaction %s settled: %v", txn.ID, err)
+		return
+	}
+	s.Logger.Printf("transaction %s settled with hedera tx %s", txn.ID, txn.HederaTxID)
+}
+
+func (s *Settler) buildTransfer(hederaTxID hiero.TransactionID, recipient hiero.AccountID, asset assets.Asset, quantity decimal.Decimal) (*hiero.TransferTransaction, error) {
+	units, err := money.ToUnits(quantity, asset.Decimals)
+	if err != nil {
+		return nil, err
+	}
+	if units <= 0 {
+		return nil, errors.New("transfer amount must be positive")
+	}
+
+	return hiero.NewTransferTransaction().
+		SetTransactionID(hederaTxID).
+		SetRegenerateTransactionID(false).
+		SetTransactionMemo("NHX settlement: "+asset.Symbol).
+		AddTokenTransferWithDecimals(asset.TokenID, s.HieroClient.GetOperatorAccountID(), -units, asset.Decimals).
+		AddTokenTransferWithDecimals(asset.TokenID, recipient, units, asset.Decimals).
+		FreezeWith(s.HieroClient)
+}
+
+func (s *Settler) applyReceipt(txn *stores.Transaction, receipt hiero.TransactionReceipt, err error) {
+	if err == nil && receipt.Status == hiero.StatusSuccess {
+		_, err := s.TransactionStore.MarkTransactionSettled(txn.ID, stores.StatusChange{Actor: stores.ActorSettler, Reason: "transfer " + txn.HederaTxID + " succeeded"})
+		if err != nil {
+			s.Logger.Printf("failed to mark transaction %s settled: %v", txn.ID, err)
+			return
+		}
+		s.Logger.Printf("transaction %s settled with hedera tx %s", txn.ID, txn.HederaTxID)
+		return
+	}
+
+	var receiptErr hiero.ErrHederaReceiptStatus
+	if errors.As(err, &receiptErr) || (err == nil && receipt.Status != hiero.StatusSuccess) {
+		// The transfer reached consensus and failed, so nothing moved.
+		s.Logger.Printf("transfer %s for transaction %s failed with %s", txn.HederaTxID, txn.ID, receipt.Status)
+		asset, err := s.Assets.Get(txn.Asset)
+		if err == nil {
+			s.replenish(asset, txn.AssetQuantity, receipt.Status)
+		}
+		s.release(txn, "transfer failed with "+receipt.Status.String())
+		return
+	}
+
+	s.Logger.Printf("failed to get receipt for transfer %s of transaction %s: %v", txn.HederaTxID, txn.ID, err)
+}
+
+// replenish mints more of a mintable asset after a delivery of quantity failed
+// because the operator ran out of it. It mints MintBatch tokens, or the whole
+// delivery if that is larger. The delivery itself is retried by the next pass,
+// so a mint that fails here only costs one settlement attempt.
+func (s *Settler) replenish(asset assets.Asset, quantity decimal.Decimal, status hiero.Status) {
+	if !asset.Mint || status != hiero.StatusInsufficientTokenBalance {
+		return
+	}
+
+	amount := decimal.NewFromInt(int64(s.MintBatch))
+	if quantity.GreaterThan(amount) {
+		amount = quantity
+	}
+	units, err := money.ToUnits(amount, asset.Decimals)
+	if err != nil {
+		s.Logger.Printf("failed to mint %s: %v", asset.Symbol, err)
+		return
+	}
+
+	resp, err := hiero.NewTokenMintTransaction().
+		SetTokenID(asset.TokenID).
+		SetAmount(uint64(units)).
+		SetTransactionMemo("NHX treasury top-up: "+asset.Symbol).
+		Execute(s.HieroClient)
+	if err != nil {
+		s.Logger.Printf("failed to mint %s: %v", asset.Symbol, err)
+		return
+	}
+	_, err = resp.GetReceipt(s.HieroClient)
+	if err != nil {
+		s.Logger.Printf("failed to mint %s: %v", asset.Symbol, err)
+		return
+	}
+	s.Logger.Printf("minted %s %s into the treasury", amount, asset.Symbol)
+}
+
+func (s *Settler) release(txn *stores.Transaction, reason string) {
+	change := stores.StatusChange{Actor: stores.ActorSettler, Reason: reason}
+	if txn.SettlementAttempts >= s.MaxAttempts {
+		_, err := s.TransactionStore.FailTransactionSettlement(txn.ID, change)
+		if err != nil {
+			s.Logger.Printf("failed to mark transaction %s failed: %v", txn.ID, err)
+			return
+		}
+		s.Logger.Printf("transaction %s failed after %d settlement attempts", txn.ID, txn.SettlementAttempts)
+		return
+	}
+
+	_, err := s.TransactionStore.ReleaseTransactionSettlement(txn.ID, change)
+	if err != nil {
+		s.Logger.Printf("failed to release transaction %s: %v", txn.ID, err)
+	}
+}
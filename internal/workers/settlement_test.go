@@ -0,0 +1,66 @@
+package workers
+
+import (
+	"io"
+	"log"
+	"testing"
+
+	hiero "github.com/hiero-ledger/hiero-sdk-go/v2/sdk"
+	"github.com/nhx-finance/wallet/internal/assets"
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/shopspring/decimal"
+)
+
+// releaseRecorder is a TransactionStore that records settlement releases.
+// Any other method panics.
+type releaseRecorder struct {
+	stores.TransactionStore
+	released []string
+	failed []string
+}
+
+func (r *releaseRecorder) ReleaseTransactionSettlement(id string, change stores.StatusChange) (*stores.Transaction, error) {
+	r.released = append(r.released, id)
+	return &stores.Transaction{ID: id, Status: stores.StatusConfirmed}, nil
+}
+
+func (r *releaseRecorder) FailTransactionSettlement(id string, change stores.StatusChange) (*stores.Transaction, error) {
+	r.failed = append(r.failed, id)
+	return &stores.Transaction{ID: id, Status: stores.StatusFailed}, nil
+}
+
+func TestHandleRejection(t *testing.T) {
+	asset := assets.Asset{Symbol: "USDC", Decimals: 6}
+
+	tests := []struct {
+		status hiero.Status
+		released bool
+	}{
+		{hiero.StatusDuplicateTransaction, false},
+		{hiero.StatusBusy, false},
+		{hiero.StatusPlatformNotActive, false},
+		{hiero.StatusPlatformTransactionNotCreated, false},
+		{hiero.StatusTransactionExpired, false},
+		{hiero.StatusUnknown, false},
+		{hiero.StatusInsufficientPayerBalance, true},
+		{hiero.StatusInvalidAccountID, true},
+		{hiero.StatusTokenNotAssociatedToAccount, true},
+		{hiero.StatusAccountFrozenForToken, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status.String(), func(t *testing.T) {
+			store := &releaseRecorder{}
+			s := NewSettler(store, nil, nil, assets.NewRegistry(), log.New(io.Discard, "", 0))
+			txn := &stores.Transaction{ID: "txn-1", Status: stores.StatusSettling, Asset: "USDC", AssetQuantity: decimal.NewFromInt(10), HederaTxID: "0.0.2@1700000000.000000000", SettlementAttempts: 1}
+
+			s.handleRejection(txn, asset, tt.status)
+
+			if got := len(store.released) == 1; got != tt.released {
+				t.Errorf("released = %v, want %v", got, tt.released)
+			}
+			if len(store.failed) != 0 {
+				t.Errorf("failed = %v, want none", store.failed)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package workers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/alerts"
+	"github.com/nhx-finance/wallet/internal/payments"
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+// STKResolver settles on-ramps whose M-Pesa callback never arrived by asking
+// Daraja's STK Push Query API what happened to them.
+type STKResolver struct {
+	TransactionStore stores.TransactionStore
+	Daraja *payments.DarajaClient
+	Settler *Settler
+	// Alerter is told about transactions moved to review.
+	Alerter alerts.Alerter
+	Interval time.Duration
+	// MinAge is how long a transaction is left alone to give the callback a
+	// chance to arrive.
+	MinAge time.Duration
+	// Deadline is the age after which a transaction Daraja still has no
+	// result for is moved to review. It is never expired or failed without
+	// one, since the customer may have paid.
+	Deadline time.Duration
+	BatchSize int
+	Logger *log.Logger
+}
+
+func NewSTKResolver(transactionStore stores.TransactionStore, daraja *payments.DarajaClient, settler *Settler, alerter alerts.Alerter, logger *log.Logger) *STKResolver {
+	return &STKResolver{
+		TransactionStore: transactionStore,
+		Daraja: daraja,
+		Settler: settler,
+		Alerter: alerter,
+		Interval: 30 * time.Second,
+		MinAge: 2 * time.Minute,
+		Deadline: 10 * time.Minute,
+		BatchSize: 50,
+		Logger: logger,
+	}
+}
+
+func (sr *STKResolver) Run(ctx context.Context) {
+	ticker := time.NewTicker(sr.Interval)
+	defer ticker.Stop()
+
+	for {
+		sr.resolveStuck(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (sr *STKResolver) resolveStuck(ctx context.Context) {
+	txns, err := sr.TransactionStore.GetTransactionsByStatusUpdatedBefore("onramp", stores.StatusInitiated, time.Now().Add(-sr.MinAge), sr.BatchSize)
+	if err != nil {
+		sr.Logger.Printf("failed to load initiated transactions: %v", err)
+		return
+	}
+
+	for _, txn := range txns {
+		pastDeadline := time.Since(txn.CreatedAt) > sr.Deadline
+
+		queryResp, err := sr.Daraja.QuerySTKPush(ctx, txn.MpesaCheckoutID)
+		if err != nil {
+			sr.Logger.Printf("failed to query STK push %s: %v", txn.MpesaCheckoutID, err)
+			if pastDeadline {
+				sr.review(ctx, txn, "STK query failed past the deadline: "+err.Error())
+			}
+			continue
+		}
+
+		switch {
+		case queryResp.InProgress():
+			if pastDeadline {
+				sr.review(ctx, txn, "STK push still in progress past the deadline: "+queryResp.ErrorMessage)
+			}
+		case queryResp.ResultCode == "0":
+			if sr.apply(txn, stores.StatusConfirmed, queryResp.ResultDesc) {
+				sr.Settler.Trigger()
+			}
+		default:
+			sr.apply(txn, stores.StatusFailed, queryResp.ResultDesc)
+		}
+	}
+}
+
+// review parks a transaction Daraja has given no result for, so that someone
+// can reconcile it against the M-Pesa statement.
+func (sr *STKResolver) review(ctx context.Context, txn stores.Transaction, reason string) {
+	if sr.apply(txn, stores.StatusReview, reason) {
+		sr.Alerter.Alert(ctx, fmt.Sprintf("On-ramp %s (STK push %s) needs manual reconciliation: %s", txn.ID, txn.MpesaCheckoutID, reason))
+	}
+}
+
+func (sr *STKResolver) apply(txn stores.Transaction, status stores.TransactionStatus, reason string) bool {
+	// The query API does not return the M-Pesa receipt number.
+	_, err := sr.TransactionStore.UpdateTransactionByMpesaCheckoutID(txn.MpesaCheckoutID, status, "", stores.StatusChange{Actor: stores.ActorSTKResolver, Reason: reason})
+	if errors.Is(err, sql.ErrNoRows) {
+		// the callback arrived while we were querying
+		return false
+	}
+	if err != nil {
+		sr.Logger.Printf("failed to mark transaction %s %s: %v", txn.ID, status, err)
+		return false
+	}
+
+	sr.Logger.Printf("transaction %s resolved as %s by STK query", txn.ID, status)
+	return true
+}
@@ -0,0 +1,199 @@
+package workers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/stores"
+	"github.com/nhx-finance/wallet/internal/validate"
+)
+
+// WebhookDispatcher sends queued transaction events to partner webhook
+// subscriptions, retrying failures with exponential backoff.
+type WebhookDispatcher struct {
+	Store stores.MerchantWebhookStore
+	Interval time.Duration
+	BatchSize int
+	// Lease is how long claimed deliveries are hidden from other
+	// dispatchers; it must cover sending a whole batch.
+	Lease time.Duration
+	// BaseDelay is the wait before the first retry. Each later retry waits
+	// twice as long as the one before, up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay time.Duration
+	MaxAttempts int
+	Logger *log.Logger
+	httpClient *http.Client
+}
+
+func NewWebhookDispatcher(store stores.MerchantWebhookStore, timeout time.Duration, logger *log.Logger) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		Store: store,
+		Interval: 5 * time.Second,
+		BatchSize: 20,
+		Lease: 5 * time.Minute,
+		BaseDelay: 30 * time.Second,
+		MaxDelay: 6 * time.Hour,
+		MaxAttempts: 12,
+		Logger: logger,
+		httpClient: newPublicHTTPClient(timeout),
+	}
+}
+
+var errNonPublicAddress = errors.New("refusing to connect to a non-public address")
+
+// newPublicHTTPClient returns a client that only connects to public
+// addresses. Subscription URLs are checked when they are created, but the
+// check is repeated on every connection, redirects included, since a host can
+// be made to resolve elsewhere later. No proxy is used, as it would be the
+// proxy's address that got checked.
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !validate.PublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%w %s", errNonPublicAddress, address)
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+func (wd *WebhookDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(wd.Interval)
+	defer ticker.Stop()
+
+	for {
+		wd.dispatchDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (wd *WebhookDispatcher) dispatchDue(ctx context.Context) {
+	deliveries, err := wd.Store.ClaimDueWebhookDeliveries(wd.BatchSize, wd.Lease)
+	if err != nil {
+		wd.Logger.Printf("failed to claim webhook deliveries: %v", err)
+		return
+	}
+
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			// the lease runs out and another dispatcher picks them up
+			return
+		}
+		wd.dispatch(ctx, delivery)
+	}
+}
+
+func (wd *WebhookDispatcher) dispatch(ctx context.Context, delivery stores.WebhookDelivery) {
+	subscription, err := wd.Store.GetWebhookSubscription(delivery.SubscriptionID)
+	if err != nil {
+		wd.Logger.Printf("failed to get subscription %s for delivery %s: %v", delivery.SubscriptionID, delivery.ID, err)
+		return
+	}
+
+	started := time.Now()
+	statusCode, err := wd.send(ctx, subscription, delivery)
+	attempt := stores.WebhookDeliveryAttempt{
+		DeliveryID: delivery.ID,
+		StatusCode: statusCode,
+		DurationMS: time.Since(started).Milliseconds(),
+	}
+
+	delivery.Attempts++
+	if err == nil {
+		delivery.Status = stores.DeliveryDelivered
+		delivery.NextAttemptAt = nil
+		delivery.LastError = ""
+	} else {
+		attempt.Error = err.Error()
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= wd.MaxAttempts {
+			delivery.Status = stores.DeliveryFailed
+			delivery.NextAttemptAt = nil
+			wd.Logger.Printf("giving up on webhook delivery %s to %s after %d attempts: %v", delivery.ID, subscription.URL, delivery.Attempts, err)
+		} else {
+			next := time.Now().Add(wd.backoff(delivery.Attempts))
+			delivery.NextAttemptAt = &next
+		}
+	}
+
+	_, err = wd.Store.RecordWebhookDeliveryAttempt(delivery, attempt)
+	if err != nil {
+		wd.Logger.Printf("failed to record attempt of webhook delivery %s: %v", delivery.ID, err)
+	}
+}
+
+func (wd *WebhookDispatcher) send(ctx context.Context, subscription *stores.WebhookSubscription, delivery stores.WebhookDelivery) (int, error) {
+	timestamp := time.Now().Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "NHX-Webhooks/1.0")
+	req.Header.Set("X-NHX-Event", delivery.EventType)
+	req.Header.Set("X-NHX-Delivery", delivery.ID)
+	req.Header.Set("X-NHX-Signature", SignWebhookPayload(subscription.Secret, timestamp, delivery.Payload))
+
+	res, err := wd.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("endpoint returned status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// backoff is the wait after the given number of failed attempts.
+func (wd *WebhookDispatcher) backoff(attempts int) time.Duration {
+	delay := wd.BaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= wd.MaxDelay {
+			return wd.MaxDelay
+		}
+	}
+	return delay
+}
+
+// SignWebhookPayload returns the X-NHX-Signature header for a payload:
+// "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<payload>" keyed by the
+// subscription secret>". Receivers should recompute it and reject old
+// timestamps.
+func SignWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "t=" + strconv.FormatInt(timestamp, 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,180 @@
+package workers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhx-finance/wallet/internal/stores"
+)
+
+func TestPublicHTTPClientRefusesLoopback(t *testing.T) {
+	reached := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+
+	wd := NewWebhookDispatcher(nil, time.Second, log.New(io.Discard, "", 0))
+	res, err := wd.httpClient.Get(server.URL)
+	if err == nil {
+		res.Body.Close()
+	}
+	if !errors.Is(err, errNonPublicAddress) {
+		t.Errorf("err = %v, want %v", err, errNonPublicAddress)
+	}
+	if reached {
+		t.Error("request reached the loopback server")
+	}
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	// computed independently with Python's hmac module
+	want := "t=1767225600,v1=45b40331de0325606dc5400202ade162460fbe48daf9401adfdcd0d7b4f35470"
+	if got := SignWebhookPayload("whsec_test", 1767225600, []byte(`{"id":"evt_1"}`)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if SignWebhookPayload("whsec_other", 1767225600, []byte(`{"id":"evt_1"}`)) == want {
+		t.Error("signature does not depend on the secret")
+	}
+	if SignWebhookPayload("whsec_test", 1767225601, []byte(`{"id":"evt_1"}`))[len("t=1767225601,"):] == want[len("t=1767225600,"):] {
+		t.Error("signature does not cover the timestamp")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	wd := NewWebhookDispatcher(nil, time.Second, log.New(io.Discard, "", 0))
+
+	tests := []struct {
+		attempts int
+		want time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{10, 256 * time.Minute},
+		{11, 6 * time.Hour},
+		{12, 6 * time.Hour},
+		// must not overflow
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := wd.backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff after %d attempts = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// memMerchantWebhookStore serves one subscription and records attempts.
+// Methods the tests do not use panic.
+type memMerchantWebhookStore struct {
+	stores.MerchantWebhookStore
+	subscription stores.WebhookSubscription
+	recorded []stores.WebhookDelivery
+	attempts []stores.WebhookDeliveryAttempt
+}
+
+func (m *memMerchantWebhookStore) GetWebhookSubscription(id string) (*stores.WebhookSubscription, error) {
+	subscription := m.subscription
+	return &subscription, nil
+}
+
+func (m *memMerchantWebhookStore) RecordWebhookDeliveryAttempt(delivery stores.WebhookDelivery, attempt stores.WebhookDeliveryAttempt) (*stores.WebhookDelivery, error) {
+	m.recorded = append(m.recorded, delivery)
+	m.attempts = append(m.attempts, attempt)
+	return &delivery, nil
+}
+
+func TestWebhookDispatch(t *testing.T) {
+	payload := []byte(`{"id":"event-1","type":"transaction.settled"}`)
+
+	tests := []struct {
+		name string
+		// status is what the endpoint answers; 0 closes the connection
+		status int
+		// attempts before this one
+		attempts int
+		wantStatus string
+		wantRetry bool
+	}{
+		{"delivered", http.StatusNoContent, 0, stores.DeliveryDelivered, false},
+		{"delivered on a retry", http.StatusOK, 5, stores.DeliveryDelivered, false},
+		{"endpoint error is retried", http.StatusInternalServerError, 0, stores.DeliveryPending, true},
+		{"connection failure is retried", 0, 2, stores.DeliveryPending, true},
+		{"last attempt fails the delivery", http.StatusServiceUnavailable, 11, stores.DeliveryFailed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type request struct {
+				header http.Header
+				body []byte
+			}
+			requests := make(chan request, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				requests <- request{r.Header, body}
+				if tt.status == 0 {
+					conn, _, _ := w.(http.Hijacker).Hijack()
+					conn.Close()
+					return
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			store := &memMerchantWebhookStore{subscription: stores.WebhookSubscription{ID: "sub-1", URL: server.URL, Secret: "whsec_test", Active: true}}
+			wd := NewWebhookDispatcher(store, time.Second, log.New(io.Discard, "", 0))
+			// the test server is on loopback
+			wd.httpClient = &http.Client{Timeout: time.Second}
+
+			before := time.Now()
+			wd.dispatch(t.Context(), stores.WebhookDelivery{ID: "delivery-1", SubscriptionID: "sub-1", EventType: "transaction.settled", Payload: payload, Status: stores.DeliveryPending, Attempts: tt.attempts})
+
+			var got request
+			select {
+			case got = <-requests:
+			default:
+				t.Fatal("endpoint was not called")
+			}
+			if string(got.body) != string(payload) || got.header.Get("X-NHX-Event") != "transaction.settled" || got.header.Get("X-NHX-Delivery") != "delivery-1" {
+				t.Errorf("sent %s with event %q, delivery %q", got.body, got.header.Get("X-NHX-Event"), got.header.Get("X-NHX-Delivery"))
+			}
+			signature := got.header.Get("X-NHX-Signature")
+			timestamp, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+			if err != nil || signature != SignWebhookPayload("whsec_test", timestamp, payload) {
+				t.Errorf("signature %q does not verify", signature)
+			}
+			if age := time.Since(time.Unix(timestamp, 0)); age < -time.Second || age > time.Minute {
+				t.Errorf("signature timestamp is %s old", age)
+			}
+
+			if len(store.recorded) != 1 {
+				t.Fatalf("recorded %d attempts, want 1", len(store.recorded))
+			}
+			delivery, attempt := store.recorded[0], store.attempts[0]
+			if delivery.Status != tt.wantStatus || delivery.Attempts != tt.attempts+1 {
+				t.Errorf("delivery %s after %d attempts, want %s after %d", delivery.Status, delivery.Attempts, tt.wantStatus, tt.attempts+1)
+			}
+			if attempt.DeliveryID != "delivery-1" || attempt.StatusCode != tt.status {
+				t.Errorf("attempt recorded as %+v, want status %d", attempt, tt.status)
+			}
+			if (delivery.LastError == "") != (tt.wantStatus == stores.DeliveryDelivered) || attempt.Error != delivery.LastError {
+				t.Errorf("last error %q, attempt error %q", delivery.LastError, attempt.Error)
+			}
+			if tt.wantRetry {
+				wantNext := before.Add(wd.backoff(tt.attempts + 1))
+				if delivery.NextAttemptAt == nil || delivery.NextAttemptAt.Before(wantNext) || delivery.NextAttemptAt.After(wantNext.Add(time.Second)) {
+					t.Errorf("next attempt at %v, want about %v", delivery.NextAttemptAt, wantNext)
+				}
+			} else if delivery.NextAttemptAt != nil {
+				t.Errorf("next attempt at %v, want none", delivery.NextAttemptAt)
+			}
+		})
+	}
+}
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/nhx-finance/wallet/internal/app"
@@ -12,10 +18,19 @@ import (
 )
 
 func main() {
+	var port int
+	var apiKeyName string
+	var apiKeyScopes string
+	flag.IntVar(&port, "port", 8080, "backend sever port")
+	flag.StringVar(&apiKeyName, "create-api-key", "", "create an API key with this name, print it and exit")
+	flag.StringVar(&apiKeyScopes, "scopes", "keys:manage", "comma-separated scopes for -create-api-key")
+	flag.Parse()
+
 	orcus, err := app.NewApplication()
 
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "failed to start: %v\n", err)
+		os.Exit(1)
 	}
 
 	defer func(DB *sql.DB) {
@@ -25,9 +40,26 @@ func main() {
 		}
 	}(orcus.DB)
 
-	var port int
-	flag.IntVar(&port, "port", 8080, "backend sever port")
-	flag.Parse()
+	if apiKeyName != "" {
+		apiKey, key, err := orcus.CreateAPIKey(apiKeyName, strings.Split(apiKeyScopes, ","))
+		if err != nil {
+			orcus.Logger.Fatalf("failed to create API key: %v", err)
+		}
+		fmt.Printf("Created API key %s (%s) with scopes %s\n%s\n", apiKey.ID, apiKey.Name, strings.Join(apiKey.Scopes, ","), key)
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go orcus.Settler.Run(ctx)
+	go orcus.OffRampWorker.Run(ctx)
+	go orcus.STKResolver.Run(ctx)
+	go orcus.Pricing.Run(ctx)
+	go orcus.Idempotency.Run(ctx)
+	go orcus.RateLimiter.Run(ctx)
+	go orcus.Broker.Run(ctx)
+	go orcus.WebhookDispatcher.Run(ctx)
 
 	orcus.Logger.Println("Application running")
 
@@ -41,11 +73,21 @@ func main() {
 		WriteTimeout:      time.Second * 30,
 	}
 
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			orcus.Logger.Printf("failed to shut down server: %v", err)
+		}
+	}()
+
 	orcus.Logger.Printf("Listening on port: %d", port)
 
 	err = server.ListenAndServe()
 
-	if err != nil {
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		orcus.Logger.Fatal(err)
 	}
 }
\ No newline at end of file
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions DROP CONSTRAINT valid_status;
+ALTER TABLE transactions ADD CONSTRAINT valid_status CHECK (status IN ('pending', 'initiated', 'confirmed', 'settling', 'settled', 'failed'));
+ALTER TABLE transactions ADD COLUMN settlement_attempts INT NOT NULL DEFAULT 0;
+CREATE INDEX idx_transactions_type_status ON transactions(type, status);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_transactions_type_status;
+ALTER TABLE transactions DROP COLUMN settlement_attempts;
+ALTER TABLE transactions DROP CONSTRAINT valid_status;
+ALTER TABLE transactions ADD CONSTRAINT valid_status CHECK (status IN ('pending', 'initiated', 'confirmed', 'settled', 'failed'));
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions ADD COLUMN deposit_memo VARCHAR(64) UNIQUE;
+ALTER TABLE transactions ADD COLUMN mpesa_conversation_id VARCHAR(100);
+CREATE INDEX idx_transactions_mpesa_conversation_id ON transactions(mpesa_conversation_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_transactions_mpesa_conversation_id;
+ALTER TABLE transactions DROP COLUMN mpesa_conversation_id;
+ALTER TABLE transactions DROP COLUMN deposit_memo;
+-- +goose StatementEnd
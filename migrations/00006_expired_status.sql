@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions DROP CONSTRAINT valid_status;
+ALTER TABLE transactions ADD CONSTRAINT valid_status CHECK (status IN ('pending', 'initiated', 'confirmed', 'settling', 'settled', 'failed', 'expired'));
+CREATE INDEX idx_transactions_mpesa_checkout_id ON transactions(mpesa_checkout_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS idx_transactions_mpesa_checkout_id;
+ALTER TABLE transactions DROP CONSTRAINT valid_status;
+ALTER TABLE transactions ADD CONSTRAINT valid_status CHECK (status IN ('pending', 'initiated', 'confirmed', 'settling', 'settled', 'failed'));
+-- +goose StatementEnd
@@ -0,0 +1,23 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE quotes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    direction VARCHAR(20) NOT NULL,
+    amount_ksh DECIMAL(15,2) NOT NULL,
+    amount_usdc DECIMAL(15,6) NOT NULL,
+    exchange_rate DECIMAL(10,4) NOT NULL,
+    fee_ksh DECIMAL(15,2) NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT valid_direction CHECK (direction IN ('onramp'))
+);
+
+ALTER TABLE transactions ADD COLUMN quote_id UUID UNIQUE REFERENCES quotes(id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE transactions DROP COLUMN quote_id;
+DROP TABLE quotes;
+-- +goose StatementEnd
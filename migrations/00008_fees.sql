@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions ADD COLUMN fee_ksh DECIMAL(15,2) NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN spread_ksh DECIMAL(15,2) NOT NULL DEFAULT 0;
+ALTER TABLE quotes ADD COLUMN spread_ksh DECIMAL(15,2) NOT NULL DEFAULT 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE quotes DROP COLUMN spread_ksh;
+ALTER TABLE transactions DROP COLUMN spread_ksh;
+ALTER TABLE transactions DROP COLUMN fee_ksh;
+-- +goose StatementEnd
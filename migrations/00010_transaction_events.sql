@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE transaction_events (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    transaction_id UUID NOT NULL REFERENCES transactions(id),
+    from_status VARCHAR(20),
+    to_status VARCHAR(20) NOT NULL,
+    actor VARCHAR(50) NOT NULL,
+    reason TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT clock_timestamp()
+);
+
+CREATE INDEX idx_transaction_events_transaction ON transaction_events(transaction_id, created_at);
+
+-- existing transactions start their history at their current status
+INSERT INTO transaction_events (transaction_id, to_status, actor, reason, created_at)
+SELECT id, status, 'migration', 'history not recorded before this point', updated_at
+FROM transactions;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE transaction_events;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE webhooks ALTER COLUMN payload DROP NOT NULL;
+ALTER TABLE webhooks ADD COLUMN raw_body BYTEA NOT NULL DEFAULT ''::bytea;
+ALTER TABLE webhooks ADD COLUMN event_type VARCHAR(50) NOT NULL DEFAULT 'stk_callback';
+ALTER TABLE webhooks ADD COLUMN event_key VARCHAR(100);
+ALTER TABLE webhooks ADD COLUMN processed_at TIMESTAMP WITH TIME ZONE;
+ALTER TABLE webhooks ADD COLUMN duplicate_of UUID REFERENCES webhooks(id);
+
+CREATE INDEX idx_webhooks_event ON webhooks(event_type, event_key) WHERE processed;
+CREATE INDEX idx_webhooks_transaction ON webhooks(transaction_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX idx_webhooks_transaction;
+DROP INDEX idx_webhooks_event;
+ALTER TABLE webhooks DROP COLUMN duplicate_of;
+ALTER TABLE webhooks DROP COLUMN processed_at;
+ALTER TABLE webhooks DROP COLUMN event_key;
+ALTER TABLE webhooks DROP COLUMN event_type;
+ALTER TABLE webhooks DROP COLUMN raw_body;
+DELETE FROM webhooks WHERE payload IS NULL;
+ALTER TABLE webhooks ALTER COLUMN payload SET NOT NULL;
+-- +goose StatementEnd
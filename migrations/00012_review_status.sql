@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions DROP CONSTRAINT valid_status;
+ALTER TABLE transactions ADD CONSTRAINT valid_status CHECK (status IN ('pending', 'initiated', 'confirmed', 'settling', 'settled', 'failed', 'expired', 'review'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE transactions DROP CONSTRAINT valid_status;
+ALTER TABLE transactions ADD CONSTRAINT valid_status CHECK (status IN ('pending', 'initiated', 'confirmed', 'settling', 'settled', 'failed', 'expired'));
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions ADD COLUMN callback_token_hash CHAR(64);
+ALTER TABLE webhooks ADD COLUMN verification_error TEXT;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE webhooks DROP COLUMN verification_error;
+ALTER TABLE transactions DROP COLUMN callback_token_hash;
+-- +goose StatementEnd
@@ -0,0 +1,19 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions DROP CONSTRAINT valid_type;
+ALTER TABLE transactions ADD CONSTRAINT valid_type CHECK (type IN ('onramp', 'offramp', 'card'));
+ALTER TABLE transactions ADD COLUMN stripe_session_id VARCHAR(255) UNIQUE;
+
+ALTER TABLE webhooks DROP CONSTRAINT valid_source;
+ALTER TABLE webhooks ADD CONSTRAINT valid_source CHECK (source IN ('mpesa', 'stripe'));
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE webhooks DROP CONSTRAINT valid_source;
+ALTER TABLE webhooks ADD CONSTRAINT valid_source CHECK (source = 'mpesa');
+
+ALTER TABLE transactions DROP COLUMN stripe_session_id;
+ALTER TABLE transactions DROP CONSTRAINT valid_type;
+ALTER TABLE transactions ADD CONSTRAINT valid_type CHECK (type IN ('onramp', 'offramp'));
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE transactions ADD COLUMN asset VARCHAR(20) NOT NULL DEFAULT 'USDC';
+ALTER TABLE transactions ADD COLUMN asset_quantity DECIMAL(38,18);
+UPDATE transactions SET asset_quantity = amount_usdc;
+ALTER TABLE transactions ALTER COLUMN asset_quantity SET NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE transactions DROP COLUMN asset_quantity;
+ALTER TABLE transactions DROP COLUMN asset;
+-- +goose StatementEnd
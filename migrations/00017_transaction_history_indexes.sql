@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE INDEX idx_transactions_hedera_account_created ON transactions(hedera_account_id, created_at DESC, id DESC);
+CREATE INDEX idx_transactions_phone_created ON transactions(phone, created_at DESC, id DESC);
+CREATE INDEX idx_transactions_created ON transactions(created_at DESC, id DESC);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX idx_transactions_created;
+DROP INDEX idx_transactions_phone_created;
+DROP INDEX idx_transactions_hedera_account_created;
+-- +goose StatementEnd
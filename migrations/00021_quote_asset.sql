@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE quotes ADD COLUMN asset VARCHAR(20) NOT NULL DEFAULT 'USDC';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE quotes DROP COLUMN asset;
+-- +goose StatementEnd
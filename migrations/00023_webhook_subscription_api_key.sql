@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE webhook_subscriptions ADD COLUMN api_key_id UUID REFERENCES api_keys(id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE webhook_subscriptions DROP COLUMN api_key_id;
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE quotes ADD COLUMN asset_quantity DECIMAL(38,18);
+UPDATE quotes SET asset_quantity = amount_usdc WHERE asset = 'USDC';
+-- quotes for other assets never fixed a quantity; they cannot be honoured
+UPDATE quotes SET asset_quantity = 0, expires_at = LEAST(expires_at, CURRENT_TIMESTAMP) WHERE asset_quantity IS NULL;
+ALTER TABLE quotes ALTER COLUMN asset_quantity SET NOT NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE quotes DROP COLUMN asset_quantity;
+-- +goose StatementEnd
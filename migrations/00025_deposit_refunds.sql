@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE deposit_refunds (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    transaction_id UUID NOT NULL REFERENCES transactions(id),
+    deposit_tx_id VARCHAR(100) NOT NULL UNIQUE,
+    amount_usdc DECIMAL(15,6) NOT NULL,
+    reason VARCHAR(30) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    refunded_at TIMESTAMP WITH TIME ZONE,
+    CONSTRAINT valid_refund_reason CHECK (reason IN ('short_deposit', 'unexpected_deposit', 'payout_failed')),
+    CONSTRAINT valid_refund_status CHECK (status IN ('pending', 'refunded'))
+);
+
+CREATE INDEX idx_deposit_refunds_pending ON deposit_refunds (created_at) WHERE status = 'pending';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE deposit_refunds;
+-- +goose StatementEnd